@@ -219,11 +219,12 @@ type MediaRecorderConstraints struct {
 	FileName    string
 	Unique      bool
 	Append      bool
-	Chunks      int
-	Segments    int
-	MaxDuration uint32
-	MaxSize     int64
-	MaxFrames   int64
+	Chunks      int    // per segment, or files in total if not segmented
+	Segments    int    // files to keep on disk, 0 for all
+	MaxDuration uint32 // per file, in seconds
+	MaxSize     int64  // per file, in bytes
+	MaxFrames   int64  // per file
+	Seekable    bool   // whether to index keyframes on finishing a file
 }
 
 // IMediaRecorder records a specified IMediaStream.
@@ -218,7 +218,7 @@ func (me *AVC) parseNalUnits(pkt *av.Packet) error {
 	nalus := make([][]byte, 0)
 
 	pkt.Set("DTS", me.info.Timestamp)
-	pkt.Set("PTS", pkt.Get("CTS").(uint32)+pkt.Get("DTS").(uint32))
+	pkt.Set("PTS", uint32(int32(pkt.Get("CTS").(uint32)<<8)>>8)+pkt.Get("DTS").(uint32)) // SI24
 	pkt.Set("Data", data)
 
 	for i := 0; i < size; /* void */ {
@@ -0,0 +1,36 @@
+package cmaf
+
+import (
+	"time"
+
+	"github.com/studease/common/av"
+	"github.com/studease/common/av/format/fmp4"
+	"github.com/studease/common/av/utils/box"
+)
+
+func (me *CMAF) ftyp() []byte {
+	return box.FTYP("cmfc", 0, "iso6", "cmfc", "avc1", "mp41")
+}
+
+func (me *CMAF) moov(tracks ...av.IMediaStreamTrack) []byte {
+	info := &me.Info
+	if me.source != nil {
+		info = me.source.Information()
+	}
+	return box.MOOV(me.Info.Timescale, 0, true, fmp4.Tracks(info, me.Info.Timescale, me.logger, tracks...)...)
+}
+
+func (me *CMAF) moof(track av.IMediaStreamTrack, pkt *av.Packet) []byte {
+	trk := track.(*MediaStreamTrack)
+	return box.MOOF(trk.SN, uint32(trk.ID()), uint64(trk.Timestamp), fmp4.Sample(track, pkt, trk.Duration))
+}
+
+// prft maps the decode time of the next sample to the wall clock, for low latency playback.
+func (me *CMAF) prft(track av.IMediaStreamTrack) []byte {
+	trk := track.(*MediaStreamTrack)
+	return box.PRFT(uint32(trk.ID()), box.NTP(time.Now()), uint64(trk.Timestamp))
+}
+
+func (me *CMAF) mdat(data []byte) []byte {
+	return box.MDAT(data)
+}
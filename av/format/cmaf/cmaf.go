@@ -1,7 +1,6 @@
 package cmaf
 
 import (
-	"fmt"
 	"sync"
 	"sync/atomic"
 
@@ -9,6 +8,8 @@ import (
 	"github.com/studease/common/av/codec/aac"
 	"github.com/studease/common/av/codec/avc"
 	"github.com/studease/common/av/format"
+	"github.com/studease/common/av/format/fmp4"
+	"github.com/studease/common/av/utils/box"
 	"github.com/studease/common/events"
 	ErrorEvent "github.com/studease/common/events/errorevent"
 	Event "github.com/studease/common/events/event"
@@ -31,6 +32,7 @@ type CMAF struct {
 	source      av.IMediaStream
 	InitSegment *MediaChunk // init segment with all tracks
 	readyState  uint32
+	demuxer     *fmp4.Demuxer
 
 	addtrackListener    *events.EventListener
 	removetrackListener *events.EventListener
@@ -45,6 +47,7 @@ func (me *CMAF) Init(mode uint32, logger log.ILogger) av.IRemuxer {
 	me.Mode = mode
 	me.logger = logger
 	me.readyState = format.RemuxInactive
+	me.demuxer = new(fmp4.Demuxer).Init(&me.MediaStream, me.newTrack, logger)
 	me.addtrackListener = events.NewListener(me.onAddTrack, 0)
 	me.removetrackListener = events.NewListener(me.onRemoveTrack, 0)
 	me.packetListener = events.NewListener(me.onPacket, 0)
@@ -55,13 +58,21 @@ func (me *CMAF) Init(mode uint32, logger log.ILogger) av.IRemuxer {
 
 // Append parses buffer.
 func (me *CMAF) Append(data []byte) {
-	// TODO(spencerlau): Parse cmaf boxes
-	me.DispatchEvent(ErrorEvent.New(ErrorEvent.ERROR, me, "NotSupportedError", fmt.Errorf("The operation is not supported")))
+	err := me.demuxer.Append(data)
+	if err != nil {
+		me.DispatchEvent(ErrorEvent.New(ErrorEvent.ERROR, me, "DataError", err))
+	}
+}
+
+// newTrack creates a track of the demuxed source.
+func (me *CMAF) newTrack(kind string, source av.IMediaStreamTrackSource) av.IMediaStreamTrack {
+	return new(MediaStreamTrack).Init(kind, source, me.logger)
 }
 
 // Reset clears IDemuxer cache, and closes IMediaStream.
 func (me *CMAF) Reset() {
 	me.MediaStream.Close()
+	me.Info = av.Information{}
 	me.Init(me.Mode, me.logger)
 }
 
@@ -87,7 +98,7 @@ func (me *CMAF) Source(ms av.IMediaStream) {
 		if item.Kind() == format.KindVideo && (me.Mode&av.ModeVideo&av.ModeKeyframe) == 0 || item.Kind() == format.KindAudio && (me.Mode&av.ModeAudio) == 0 {
 			continue
 		}
-		track := item.Clone()
+		track := new(MediaStreamTrack).Init(item.Kind(), item.Source(), me.logger)
 		me.AddTrack(track)
 		source := track.Source()
 		if infoframe := source.GetInfoFrame(); infoframe != nil {
@@ -224,7 +235,7 @@ func (me *CMAF) generateInitSegment(kind string, codec string, tracks ...av.IMed
 
 	ftyp := me.ftyp()
 	moov := me.moov(tracks...)
-	data := merge(ftyp, moov)
+	data := box.Merge(ftyp, moov)
 
 	seg := me.format(kind, codec, 0, data)
 	switch kind {
@@ -251,18 +262,24 @@ func (me *CMAF) generateSegment(track av.IMediaStreamTrack, pkt *av.Packet) {
 		}
 	}
 
+	// Stamps tfdt with the DTS, and the sample duration with the last delta, as the next DTS is not known yet.
+	dts := pkt.Get("DTS").(uint32) - me.Info.TimeBase
+	if trk.SN > 0 && dts > trk.Timestamp {
+		trk.Duration = dts - trk.Timestamp
+	}
+	if trk.SN == 0 || dts > trk.Timestamp {
+		trk.Timestamp = dts
+	}
+
 	trk.SN++
 	prft := me.prft(track)
 	moof := me.moof(track, pkt)
 	mdat := me.mdat(pkt.Get("Data").([]byte))
-	data := merge(prft, moof, mdat)
+	data := box.Merge(prft, moof, mdat)
 
 	seg := me.format(pkt.Kind, pkt.Codec, pkt.Timestamp, data)
 	seg.Extends(pkt)
 	me.DispatchEvent(MediaEvent.New(MediaEvent.PACKET, me, seg))
-
-	var delta = pkt.Get("DTS").(uint32) - me.Info.TimeBase - trk.Timestamp
-	trk.Timestamp += ctx.RefSampleDuration + delta
 }
 
 func (me *CMAF) format(kind string, codec string, timestamp uint32, data []byte) *av.Packet {
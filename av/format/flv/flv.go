@@ -6,7 +6,11 @@ import (
 	"sync/atomic"
 
 	"github.com/studease/common/av"
+	"github.com/studease/common/av/codec"
+	_ "github.com/studease/common/av/codec/aac" // Register AAC source.
+	_ "github.com/studease/common/av/codec/avc" // Register AVC source.
 	"github.com/studease/common/av/format"
+	"github.com/studease/common/av/utils/amf"
 	"github.com/studease/common/events"
 	ErrorEvent "github.com/studease/common/events/errorevent"
 	Event "github.com/studease/common/events/event"
@@ -242,7 +246,7 @@ func (me *FLV) Append(data []byte) {
 			case KindScript:
 				me.packet.Kind = av.KindScript
 			default:
-				me.DispatchEvent(ErrorEvent.New(ErrorEvent.ERROR, me, "TypeError", fmt.Errorf("Unrecognized flv tag 0x02X", data[i])))
+				me.DispatchEvent(ErrorEvent.New(ErrorEvent.ERROR, me, "TypeError", fmt.Errorf("Unrecognized flv tag 0x%02X", data[i])))
 				return
 			}
 			me.state = sw_length0
@@ -296,28 +300,8 @@ func (me *FLV) Append(data []byte) {
 			i += int(n) - 1
 
 			if me.packet.Position == me.packet.Length {
-				switch me.packet.Kind {
-				case av.KindAudio:
-					me.packet.Set("Format", (me.packet.Payload[0]>>4)&0x0F)
-					me.packet.Set("SampleRate", (me.packet.Payload[0]>>2)&0x03)
-					me.packet.Set("SampleSize", (me.packet.Payload[0]>>1)&0x01)
-					me.packet.Set("SampleType", me.packet.Payload[0]&0x01)
-					me.packet.Set("DataType", me.packet.Payload[1]) // Extra parsing
-					me.packet.Position = 1
-
-				case av.KindVideo:
-					frametype := (me.packet.Payload[0] >> 4) & 0x0F
-					me.packet.Set("FrameType", frametype)
-					me.packet.Set("Codec", me.packet.Payload[0]&0x0F)
-					me.packet.Set("DataType", me.packet.Payload[1]) // Extra parsing
-					me.packet.Set("Keyframe", frametype == KEYFRAME || frametype == GENERATED_KEYFRAME)
-					me.packet.Position = 1
-
-				case av.KindScript:
-					me.packet.Position = 0
-				}
-				me.DispatchEvent(MediaEvent.New(MediaEvent.PACKET, me, me.packet))
 				me.state = sw_backpointer0
+				me.demux(me.packet)
 			}
 
 		default:
@@ -327,12 +311,194 @@ func (me *FLV) Append(data []byte) {
 	}
 }
 
+// demux routes a complete tag to the codec source of its track, or dispatches it as a data frame.
+func (me *FLV) demux(pkt *av.Packet) {
+	switch pkt.Kind {
+	case av.KindAudio:
+		if pkt.Length < 2 {
+			me.logger.Debugf(2, "Ignored empty audio tag: timestamp=%d.", pkt.Timestamp)
+			return
+		}
+
+		pkt.Set("Format", (pkt.Payload[0]>>4)&0x0F)
+		pkt.Set("SampleRate", (pkt.Payload[0]>>2)&0x03)
+		pkt.Set("SampleSize", (pkt.Payload[0]>>1)&0x01)
+		pkt.Set("SampleType", pkt.Payload[0]&0x01)
+
+		switch pkt.Payload[0] & 0xF0 {
+		case AAC:
+			pkt.Codec = "AAC"
+		default:
+			me.logger.Debugf(2, "Ignored unsupported audio codec: 0x%02X.", pkt.Payload[0]&0xF0)
+			return
+		}
+
+	case av.KindVideo:
+		if pkt.Length < 5 {
+			me.logger.Debugf(2, "Ignored empty video tag: timestamp=%d.", pkt.Timestamp)
+			return
+		}
+
+		frametype := (pkt.Payload[0] >> 4) & 0x0F
+		pkt.Set("FrameType", frametype)
+		pkt.Set("Keyframe", frametype == KEYFRAME || frametype == GENERATED_KEYFRAME)
+
+		switch pkt.Payload[0] & 0x0F {
+		case AVC:
+			pkt.Codec = "AVC"
+		default:
+			me.logger.Debugf(2, "Ignored unsupported video codec: 0x%02X.", pkt.Payload[0]&0x0F)
+			return
+		}
+
+	case av.KindScript:
+		me.demuxData(pkt)
+		return
+	}
+
+	source := me.getSource(pkt.Kind, pkt.Codec)
+	if source == nil {
+		return
+	}
+
+	pkt.Position = 1
+	err := source.Parse(pkt)
+	if err != nil {
+		return
+	}
+	source.Sink(pkt)
+}
+
+// getSource returns the codec source of the track, which is created on the first packet.
+func (me *FLV) getSource(kind string, name string) av.IMediaStreamTrackSource {
+	var (
+		tracks []av.IMediaStreamTrack
+	)
+
+	switch kind {
+	case av.KindAudio:
+		tracks = me.GetAudioTracks()
+	case av.KindVideo:
+		tracks = me.GetVideoTracks()
+	}
+
+	if len(tracks) > 0 {
+		source := tracks[0].Source()
+		if source.Kind() != name {
+			me.logger.Debugf(2, "Ignored codec switching: kind=%s, codec=%s.", kind, name)
+			return nil
+		}
+		return source
+	}
+
+	source := codec.New(name, &me.Info, &format.LoggerFactory{Logger: me.logger})
+	if source == nil {
+		me.logger.Errorf("Unrecognized codec: %s", name)
+		return nil
+	}
+
+	me.AddTrack(new(format.MediaStreamTrack).Init(kind, source, me.logger))
+	return source
+}
+
+// demuxData decodes the data frame, strips "@setDataFrame" if present, and fills Info with onMetaData.
+func (me *FLV) demuxData(pkt *av.Packet) {
+	var (
+		key   amf.Value
+		value amf.Value
+	)
+
+	i, err := amf.Decode(&key, pkt.Payload)
+	if err == nil && key.Type == amf.STRING && key.String() == "@setDataFrame" {
+		pkt.Payload = pkt.Payload[i:]
+		pkt.Length = uint32(len(pkt.Payload))
+		i, err = amf.Decode(&key, pkt.Payload)
+	}
+	if err != nil || key.Type != amf.STRING {
+		me.logger.Debugf(2, "Ignored invalid data frame: timestamp=%d.", pkt.Timestamp)
+		return
+	}
+
+	pkt.Position = 0
+	pkt.Set("Key", key.String())
+
+	_, err = amf.Decode(&value, pkt.Payload[i:])
+	if err == nil {
+		pkt.Set("Value", &value)
+		if key.String() == "onMetaData" {
+			me.parseMetaData(&value)
+		}
+	}
+
+	me.MediaStream.SetDataFrame(key.String(), pkt)
+	me.DispatchEvent(MediaEvent.New(MediaEvent.PACKET, me, pkt))
+}
+
+func (me *FLV) parseMetaData(v *amf.Value) {
+	if v.Type != amf.OBJECT && v.Type != amf.ECMA_ARRAY {
+		return
+	}
+
+	if n, ok := number(v, "duration"); ok {
+		me.Info.Duration = uint32(n * 1000)
+	}
+	if n, ok := number(v, "filesize"); ok {
+		me.Info.Size = int64(n)
+	}
+	if n, ok := number(v, "width"); ok {
+		me.Info.Width = uint32(n)
+	}
+	if n, ok := number(v, "height"); ok {
+		me.Info.Height = uint32(n)
+	}
+	if n, ok := number(v, "framerate"); ok && n > 0 {
+		me.Info.FrameRate.Init(n, 1)
+	}
+	if n, ok := number(v, "videodatarate"); ok {
+		me.Info.VideoDataRate = uint32(n)
+	}
+	if n, ok := number(v, "audiodatarate"); ok {
+		me.Info.AudioDataRate = uint32(n)
+	}
+	if n, ok := number(v, "audiosamplerate"); ok {
+		me.Info.SampleRate = uint32(n)
+	}
+	if n, ok := number(v, "audiosamplesize"); ok {
+		me.Info.SampleSize = uint32(n)
+	}
+	if b := v.Get("stereo"); b != nil {
+		if stereo, ok := b.Raw().(bool); ok {
+			me.Info.Channels = 1
+			if stereo {
+				me.Info.Channels = 2
+			}
+		}
+	}
+	me.Info.BitRate = me.Info.VideoDataRate + me.Info.AudioDataRate
+}
+
+// number returns the non-negative number of the key in an AMF object.
+func number(v *amf.Value, key string) (float64, bool) {
+	if item := v.Get(key); item != nil {
+		if n, ok := item.Raw().(float64); ok && n >= 0 {
+			return n, true
+		}
+	}
+	return 0, false
+}
+
 // Reset clears IDemuxer cache, and closes IMediaStream.
 func (me *FLV) Reset() {
 	me.MediaStream.Close()
+	me.Info = av.Information{}
 	me.Init(me.Mode, me.logger)
 }
 
+// Header returns the FLV header of this mode.
+func (me *FLV) Header() []byte {
+	return Header(me.Mode)
+}
+
 // Source attaches the IMediaStream as input.
 func (me *FLV) Source(ms av.IMediaStream) {
 	if ms == nil {
@@ -445,6 +611,10 @@ func (me *FLV) onAudioPacket(pkt *av.Packet) {
 
 	switch pkt.Codec {
 	case "AAC":
+		// Without video, pumping starts with audio.
+		if (me.Mode&av.ModeVideo) == 0 && atomic.CompareAndSwapUint32(&me.readyState, format.RemuxWaiting, format.RemuxPumping) {
+			me.Info.TimeBase = pkt.Timestamp
+		}
 		if source.GetInfoFrame() == nil || atomic.LoadUint32(&me.readyState) != format.RemuxPumping {
 			return
 		}
@@ -540,7 +710,9 @@ func (me *FLV) format(pkt *av.Packet) *av.Packet {
 
 // SetDataFrame stores a data frame with the given key.
 func (me *FLV) SetDataFrame(key string, pkt *av.Packet) {
-	me.Info = *me.source.Information()
+	if me.source != nil {
+		me.Info = *me.source.Information()
+	}
 	me.MediaStream.SetDataFrame(key, pkt)
 }
 
@@ -0,0 +1,83 @@
+package fmp4
+
+import (
+	"github.com/studease/common/av"
+	"github.com/studease/common/av/codec/aac"
+	"github.com/studease/common/av/codec/avc"
+	"github.com/studease/common/av/format"
+	"github.com/studease/common/av/utils/box"
+	"github.com/studease/common/log"
+)
+
+func (me *FMP4) ftyp() []byte {
+	return box.FTYP("isom", 0x200, "isom", "iso6", "avc1", "mp41")
+}
+
+func (me *FMP4) moov(tracks ...av.IMediaStreamTrack) []byte {
+	info := &me.Info
+	if me.source != nil {
+		info = me.source.Information()
+	}
+	return box.MOOV(me.Info.Timescale, 0, true, Tracks(info, me.Info.Timescale, me.logger, tracks...)...)
+}
+
+func (me *FMP4) moof(track av.IMediaStreamTrack, pkt *av.Packet) []byte {
+	trk := track.(*format.MediaStreamTrack)
+	return box.MOOF(trk.SN, uint32(trk.ID()), uint64(trk.Timestamp), Sample(track, pkt, trk.Duration))
+}
+
+func (me *FMP4) mdat(data []byte) []byte {
+	return box.MDAT(data)
+}
+
+// Tracks describes the tracks for moov, the sources of which must have got their info frames.
+// Unsupported sources are ignored with a warning.
+func Tracks(info *av.Information, timescale uint32, logger log.ILogger, tracks ...av.IMediaStreamTrack) []*box.Track {
+	trks := make([]*box.Track, 0, len(tracks))
+	for _, track := range tracks {
+		t := &box.Track{
+			ID:        uint32(track.ID()),
+			Timescale: timescale,
+		}
+
+		switch source := track.Source().(type) {
+		case *avc.AVC:
+			t.Handler = box.HANDLER_VIDEO
+			t.Config = source.AVCC
+			t.Width = info.Width
+			t.Height = info.Height
+		case *aac.AAC:
+			t.Handler = box.HANDLER_SOUND
+			t.Config = source.Config
+			t.SampleRate = source.SamplingFrequency
+			t.Channels = source.Channels
+			t.Bitrate = info.AudioDataRate * 1000
+		default:
+			logger.Warnf("Unsupported source by fmp4, ignored: %s", track.Source().Kind())
+			continue
+		}
+		trks = append(trks, t)
+	}
+	return trks
+}
+
+// Sample describes the packet for trun, with flags of the source context.
+// The duration falls back to the reference one of the source if 0.
+func Sample(track av.IMediaStreamTrack, pkt *av.Packet, duration uint32) *box.Sample {
+	ctx := track.Source().Context()
+	if duration == 0 {
+		duration = ctx.RefSampleDuration
+	}
+	flags := ctx.Flags
+	if keyframe, _ := pkt.Get("Keyframe").(bool); track.Kind() == format.KindVideo && !keyframe {
+		flags.IsNonSync = 1
+	}
+	cts, _ := pkt.Get("CTS").(uint32)
+
+	return &box.Sample{
+		Duration:              duration,
+		Size:                  uint32(len(pkt.Get("Data").([]byte))),
+		Flags:                 box.SampleFlags(flags.IsLeading, flags.SampleDependsOn, flags.SampleIsDependedOn, flags.SampleHasRedundancy, flags.IsNonSync),
+		CompositionTimeOffset: int32(cts<<8) >> 8, // SI24
+	}
+}
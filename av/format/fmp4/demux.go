@@ -0,0 +1,138 @@
+package fmp4
+
+import (
+	"github.com/studease/common/av"
+	"github.com/studease/common/av/codec"
+	"github.com/studease/common/av/codec/aac"
+	"github.com/studease/common/av/codec/avc"
+	"github.com/studease/common/av/format"
+	"github.com/studease/common/av/utils/box"
+	"github.com/studease/common/log"
+)
+
+// Demuxer parses fragmented MP4 into the tracks of a MediaStream, and sinks the frames in the same layout as FLV tags.
+// It's shared by FMP4 and CMAF, each of which creates tracks of its own type.
+type Demuxer struct {
+	stream   *format.MediaStream
+	newTrack func(kind string, source av.IMediaStreamTrackSource) av.IMediaStreamTrack
+	logger   log.ILogger
+	parser   *box.Parser
+	sources  map[uint32]av.IMediaStreamTrackSource // by track ID
+}
+
+// Init this class.
+func (me *Demuxer) Init(ms *format.MediaStream, newTrack func(kind string, source av.IMediaStreamTrackSource) av.IMediaStreamTrack, logger log.ILogger) *Demuxer {
+	me.stream = ms
+	me.newTrack = newTrack
+	me.logger = logger
+	me.parser = new(box.Parser).Init()
+	me.sources = make(map[uint32]av.IMediaStreamTrackSource)
+	return me
+}
+
+// Append parses buffer, and sinks the tracks and frames completed so far.
+func (me *Demuxer) Append(data []byte) error {
+	tracks, frames, err := me.parser.Append(data)
+	for _, t := range tracks {
+		me.addSource(t)
+	}
+	for _, f := range frames {
+		me.demux(f)
+	}
+	return err
+}
+
+// addSource creates the track of the parsed one if not exists, and sinks its config as the info frame.
+func (me *Demuxer) addSource(t *box.Track) {
+	var (
+		kind    string
+		name    string
+		payload []byte
+	)
+
+	switch t.Format {
+	case "avc1", "avc3":
+		kind = format.KindVideo
+		name = "AVC"
+		payload = append([]byte{0x17, avc.SEQUENCE_HEADER, 0x00, 0x00, 0x00}, t.Config...)
+	case "mp4a":
+		kind = format.KindAudio
+		name = "AAC"
+		payload = append([]byte{0xAF, aac.SPECIFIC_CONFIG}, t.Config...)
+	default:
+		me.logger.Debugf(2, "Ignored unsupported sample entry: track=%d, format=%s.", t.ID, t.Format)
+		return
+	}
+
+	source := me.sources[t.ID]
+	if source == nil {
+		source = codec.New(name, &me.stream.Info, &format.LoggerFactory{Logger: me.logger})
+		if source == nil {
+			me.logger.Errorf("Unrecognized codec: %s", name)
+			return
+		}
+		me.sources[t.ID] = source
+		me.stream.AddTrack(me.newTrack(kind, source))
+	}
+
+	me.sink(source, kind, 0, payload)
+}
+
+// demux sinks the frame into the source of its track, in the same layout as FLV tags.
+func (me *Demuxer) demux(f *box.Frame) {
+	var (
+		payload []byte
+		kind    string
+	)
+
+	source := me.sources[f.TrackID]
+	t := me.parser.Track(f.TrackID)
+	if source == nil || t == nil || t.Timescale == 0 {
+		return
+	}
+
+	timescale := uint64(me.stream.Info.Timescale)
+	dts := f.DTS * timescale / uint64(t.Timescale)
+	// Signed as CompositionTime of FLV, e.g. negative of CMAF, where PTS equals DTS on I and P frames.
+	cts := int64(f.CompositionTimeOffset) * int64(timescale) / int64(t.Timescale)
+
+	switch source.Kind() {
+	case "AVC":
+		kind = format.KindVideo
+		frametype := byte(0x20)
+		if f.Keyframe {
+			frametype = 0x10
+		}
+		payload = make([]byte, 5+len(f.Data))
+		payload[0] = frametype | 0x07
+		payload[1] = avc.NALU
+		payload[2] = byte(cts >> 16)
+		payload[3] = byte(cts >> 8)
+		payload[4] = byte(cts)
+		copy(payload[5:], f.Data)
+	case "AAC":
+		kind = format.KindAudio
+		payload = append([]byte{0xAF, aac.RAW_FRAME_DATA}, f.Data...)
+	default:
+		return
+	}
+
+	me.sink(source, kind, uint32(dts), payload)
+}
+
+func (me *Demuxer) sink(source av.IMediaStreamTrackSource, kind string, timestamp uint32, payload []byte) {
+	pkt := new(av.Packet).Init()
+	pkt.Kind = kind
+	pkt.Codec = source.Kind()
+	pkt.Length = uint32(len(payload))
+	pkt.Timestamp = timestamp
+	pkt.Payload = payload
+	pkt.Position = 1
+	pkt.Set("Keyframe", kind == format.KindAudio || payload[0]>>4 == 0x01)
+
+	err := source.Parse(pkt)
+	if err != nil {
+		return
+	}
+	source.Sink(pkt)
+}
@@ -1,7 +1,6 @@
 package fmp4
 
 import (
-	"fmt"
 	"sync"
 	"sync/atomic"
 
@@ -9,6 +8,7 @@ import (
 	"github.com/studease/common/av/codec/aac"
 	"github.com/studease/common/av/codec/avc"
 	"github.com/studease/common/av/format"
+	"github.com/studease/common/av/utils/box"
 	"github.com/studease/common/events"
 	ErrorEvent "github.com/studease/common/events/errorevent"
 	Event "github.com/studease/common/events/event"
@@ -31,6 +31,7 @@ type FMP4 struct {
 	source      av.IMediaStream
 	InitSegment *av.Packet // init segment with all tracks
 	readyState  uint32
+	demuxer     *Demuxer
 
 	addtrackListener    *events.EventListener
 	removetrackListener *events.EventListener
@@ -45,6 +46,7 @@ func (me *FMP4) Init(mode uint32, logger log.ILogger) av.IRemuxer {
 	me.Mode = mode
 	me.logger = logger
 	me.readyState = format.RemuxInactive
+	me.demuxer = new(Demuxer).Init(&me.MediaStream, me.newTrack, logger)
 	me.addtrackListener = events.NewListener(me.onAddTrack, 0)
 	me.removetrackListener = events.NewListener(me.onRemoveTrack, 0)
 	me.packetListener = events.NewListener(me.onPacket, 0)
@@ -55,13 +57,21 @@ func (me *FMP4) Init(mode uint32, logger log.ILogger) av.IRemuxer {
 
 // Append parses buffer.
 func (me *FMP4) Append(data []byte) {
-	// TODO(spencerlau): Parse fmp4 boxes
-	me.DispatchEvent(ErrorEvent.New(ErrorEvent.ERROR, me, "NotSupportedError", fmt.Errorf("The operation is not supported")))
+	err := me.demuxer.Append(data)
+	if err != nil {
+		me.DispatchEvent(ErrorEvent.New(ErrorEvent.ERROR, me, "DataError", err))
+	}
+}
+
+// newTrack creates a track of the demuxed source.
+func (me *FMP4) newTrack(kind string, source av.IMediaStreamTrackSource) av.IMediaStreamTrack {
+	return new(format.MediaStreamTrack).Init(kind, source, me.logger)
 }
 
 // Reset clears IDemuxer cache, and closes IMediaStream.
 func (me *FMP4) Reset() {
 	me.MediaStream.Close()
+	me.Info = av.Information{}
 	me.Init(me.Mode, me.logger)
 }
 
@@ -91,7 +101,7 @@ func (me *FMP4) Source(ms av.IMediaStream) {
 		me.AddTrack(track)
 		source := track.Source()
 		if infoframe := source.GetInfoFrame(); infoframe != nil && (me.Mode&av.ModeInterleaved) == 0 {
-			// me.generateInitSegment(track.Kind(), source.Kind(), track)
+			me.generateInitSegment(track.Kind(), source.Kind(), track)
 		}
 		source.AddEventListener(MediaEvent.PACKET, me.packetListener)
 	}
@@ -161,9 +171,17 @@ func (me *FMP4) onAudioPacket(pkt *av.Packet) {
 		switch pkt.Get("DataType").(byte) {
 		case aac.SPECIFIC_CONFIG:
 			if (me.Mode & av.ModeInterleaved) == 0 {
-				// me.generateInitSegment(track.Kind(), source.Kind(), track)
+				me.generateInitSegment(track.Kind(), source.Kind(), track)
 			}
 		case aac.RAW_FRAME_DATA:
+			// Without video, pumping starts with audio.
+			if (me.Mode&av.ModeVideo) == 0 && source.GetInfoFrame() != nil && atomic.CompareAndSwapUint32(&me.readyState, format.RemuxWaiting, format.RemuxPumping) {
+				me.Info.TimeBase = pkt.Timestamp
+				if (me.Mode & av.ModeInterleaved) != 0 {
+					tracks := me.GetTracks()
+					me.generateInitSegment(av.KindScript, "", tracks...)
+				}
+			}
 			if source.GetInfoFrame() == nil || atomic.LoadUint32(&me.readyState) != format.RemuxPumping {
 				return
 			}
@@ -227,7 +245,7 @@ func (me *FMP4) generateInitSegment(kind string, codec string, tracks ...av.IMed
 
 	ftyp := me.ftyp()
 	moov := me.moov(tracks...)
-	data := merge(ftyp, moov)
+	data := box.Merge(ftyp, moov)
 
 	seg := me.format(kind, codec, 0, data)
 	switch kind {
@@ -254,17 +272,23 @@ func (me *FMP4) generateSegment(track av.IMediaStreamTrack, pkt *av.Packet) {
 		}
 	}
 
+	// Stamps tfdt with the DTS, and the sample duration with the last delta, as the next DTS is not known yet.
+	dts := pkt.Get("DTS").(uint32) - me.Info.TimeBase
+	if trk.SN > 0 && dts > trk.Timestamp {
+		trk.Duration = dts - trk.Timestamp
+	}
+	if trk.SN == 0 || dts > trk.Timestamp {
+		trk.Timestamp = dts
+	}
+
 	trk.SN++
 	moof := me.moof(track, pkt)
 	mdat := me.mdat(pkt.Get("Data").([]byte))
-	data := merge(moof, mdat)
+	data := box.Merge(moof, mdat)
 
 	seg := me.format(pkt.Kind, pkt.Codec, pkt.Timestamp, data)
 	seg.Extends(pkt)
 	me.DispatchEvent(MediaEvent.New(MediaEvent.PACKET, me, seg))
-
-	var delta = pkt.Get("DTS").(uint32) - me.Info.TimeBase - trk.Timestamp
-	trk.Timestamp += ctx.RefSampleDuration + delta
 }
 
 func (me *FMP4) format(kind string, codec string, timestamp uint32, data []byte) *av.Packet {
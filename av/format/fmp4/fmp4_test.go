@@ -0,0 +1,201 @@
+package fmp4
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io/ioutil"
+	"testing"
+
+	"github.com/studease/common/av/format"
+	_ "github.com/studease/common/av/format/flv"
+	"github.com/studease/common/av/utils/box"
+	"github.com/studease/common/log"
+)
+
+var (
+	testAVCC = []byte{
+		0x01, 0x42, 0xC0, 0x1E, 0xFF, 0xE1, 0x00, 0x08, 0x67, 0x42, 0xC0, 0x1E, 0xDA, 0x05, 0x07, 0xE4,
+		0x01, 0x00, 0x04, 0x68, 0xCE, 0x38, 0x80,
+	}
+	testASC = []byte{0x12, 0x10}
+)
+
+func testFactory() log.ILoggerFactory {
+	return new(log.DefaultLoggerFactory).Init(0x0800, ioutil.Discard)
+}
+
+func flvTag(typ byte, timestamp uint32, body []byte) []byte {
+	tag := make([]byte, 11, 11+len(body)+4)
+	tag[0] = typ
+	tag[1] = byte(len(body) >> 16)
+	tag[2] = byte(len(body) >> 8)
+	tag[3] = byte(len(body))
+	tag[4] = byte(timestamp >> 16)
+	tag[5] = byte(timestamp >> 8)
+	tag[6] = byte(timestamp)
+	tag[7] = byte(timestamp >> 24)
+	tag = append(tag, body...)
+	size := make([]byte, 4)
+	binary.BigEndian.PutUint32(size, uint32(11+len(body)))
+	return append(tag, size...)
+}
+
+type testTag struct {
+	typ       byte
+	timestamp uint32
+}
+
+// testTags returns the audio and video tags of media frames in an FLV, skipping the configs.
+func testTags(t *testing.T, data []byte) []testTag {
+	if len(data) < 13 || string(data[:3]) != "FLV" {
+		t.Fatalf("Invalid FLV header")
+	}
+
+	tags := make([]testTag, 0)
+	for i := 13; i+11 <= len(data); {
+		size := int(data[i+1])<<16 | int(data[i+2])<<8 | int(data[i+3])
+		timestamp := uint32(data[i+7])<<24 | uint32(data[i+4])<<16 | uint32(data[i+5])<<8 | uint32(data[i+6])
+		if i+11+size+4 > len(data) {
+			t.Fatalf("Truncated tag at %d", i)
+		}
+		if body := data[i+11 : i+11+size]; (data[i] == 8 || data[i] == 9) && len(body) > 1 && body[1] != 0 {
+			tags = append(tags, testTag{data[i], timestamp})
+		}
+		i += 11 + size + 4
+	}
+	return tags
+}
+
+// TestRoundTrip converts an FLV into fMP4 and back, which must keep the timestamps of all frames,
+// including the ones not spaced by the reference sample duration.
+func TestRoundTrip(t *testing.T) {
+	src := []byte{'F', 'L', 'V', 0x01, 0x05, 0, 0, 0, 0x09, 0, 0, 0, 0}
+	src = append(src, flvTag(9, 0, append([]byte{0x17, 0, 0, 0, 0}, testAVCC...))...)
+	src = append(src, flvTag(8, 0, append([]byte{0xAF, 0}, testASC...))...)
+
+	var expected []testTag
+	video, audio := uint32(0), uint32(0)
+	for i := 0; i < 100; i++ {
+		nalu := make([]byte, 4+50)
+		binary.BigEndian.PutUint32(nalu, 50)
+		nalu[4] = 0x41
+		flag := byte(0x27)
+		if i%25 == 0 {
+			nalu[4] = 0x65
+			flag = 0x17
+		}
+		src = append(src, flvTag(9, video, append([]byte{flag, 1, 0, 0, 0}, nalu...))...)
+		expected = append(expected, testTag{9, video})
+
+		for audio <= video {
+			src = append(src, flvTag(8, audio, append([]byte{0xAF, 1}, make([]byte, 20)...))...)
+			expected = append(expected, testTag{8, audio})
+			audio += 23 + uint32(i%3)/2 // about 1024 samples at 44.1kHz
+		}
+
+		// Jitters between 33 and 40ms.
+		video += 33 + uint32(i%2)*7
+	}
+
+	var mp4 bytes.Buffer
+	err := format.Convert(context.Background(), &mp4, "FMP4", bytes.NewReader(src), "FLV", testFactory())
+	if err != nil {
+		t.Fatalf("Failed to remux: %v", err)
+	}
+	var dst bytes.Buffer
+	err = format.Convert(context.Background(), &dst, "FLV", bytes.NewReader(mp4.Bytes()), "FMP4", testFactory())
+	if err != nil {
+		t.Fatalf("Failed to demux: %v", err)
+	}
+
+	for _, typ := range []byte{8, 9} {
+		var want, got []uint32
+		for _, tag := range expected {
+			if tag.typ == typ {
+				want = append(want, tag.timestamp)
+			}
+		}
+		for _, tag := range testTags(t, dst.Bytes()) {
+			if tag.typ == typ {
+				got = append(got, tag.timestamp)
+			}
+		}
+
+		if len(got) != len(want) {
+			t.Fatalf("Expected %d tags of type %d, got %d", len(want), typ, len(got))
+		}
+		for i, timestamp := range got {
+			if timestamp != want[i] {
+				t.Fatalf("Expected tag %d of type %d at %d, got %d", i, typ, want[i], timestamp)
+			}
+		}
+	}
+}
+
+// TestNegativeCompositionTime converts an FLV with signed CompositionTime into fMP4 and back,
+// which must keep negative offsets of trun version 1, as used by CMAF, instead of clamping them.
+func TestNegativeCompositionTime(t *testing.T) {
+	src := []byte{'F', 'L', 'V', 0x01, 0x01, 0, 0, 0, 0x09, 0, 0, 0, 0}
+	src = append(src, flvTag(9, 0, append([]byte{0x17, 0, 0, 0, 0}, testAVCC...))...)
+
+	var expected []int32
+	for i := 0; i < 30; i++ {
+		nalu := make([]byte, 4+50)
+		binary.BigEndian.PutUint32(nalu, 50)
+		nalu[4] = 0x41
+		flag := byte(0x27)
+		if i%10 == 0 {
+			nalu[4] = 0x65
+			flag = 0x17
+		}
+
+		cts := []int32{0, 80, -40}[i%3]
+		expected = append(expected, cts)
+		body := append([]byte{flag, 1, byte(cts >> 16), byte(cts >> 8), byte(cts)}, nalu...)
+		src = append(src, flvTag(9, uint32(i*40+40), body)...)
+	}
+
+	var mp4 bytes.Buffer
+	err := format.Convert(context.Background(), &mp4, "FMP4", bytes.NewReader(src), "FLV", testFactory())
+	if err != nil {
+		t.Fatalf("Failed to remux: %v", err)
+	}
+	_, frames, err := new(box.Parser).Init().Append(mp4.Bytes())
+	if err != nil {
+		t.Fatalf("Failed to parse: %v", err)
+	}
+	if len(frames) != len(expected) {
+		t.Fatalf("Expected %d frames, got %d", len(expected), len(frames))
+	}
+	for i, f := range frames {
+		if f.CompositionTimeOffset != expected[i] {
+			t.Fatalf("Expected composition time offset %d of frame %d, got %d", expected[i], i, f.CompositionTimeOffset)
+		}
+	}
+
+	var dst bytes.Buffer
+	err = format.Convert(context.Background(), &dst, "FLV", bytes.NewReader(mp4.Bytes()), "FMP4", testFactory())
+	if err != nil {
+		t.Fatalf("Failed to demux: %v", err)
+	}
+
+	var got []int32
+	data := dst.Bytes()
+	for i := 13; i+11 <= len(data); {
+		size := int(data[i+1])<<16 | int(data[i+2])<<8 | int(data[i+3])
+		if body := data[i+11 : i+11+size]; data[i] == 9 && len(body) > 5 && body[1] == 1 {
+			got = append(got, int32(uint32(body[2])<<24|uint32(body[3])<<16|uint32(body[4])<<8)>>8)
+		}
+		i += 11 + size + 4
+	}
+
+	if len(got) != len(expected) {
+		t.Fatalf("Expected %d video tags, got %d", len(expected), len(got))
+	}
+	for i, cts := range got {
+		if cts != expected[i] {
+			t.Fatalf("Expected CompositionTime %d of tag %d, got %d", expected[i], i, cts)
+		}
+	}
+}
@@ -38,7 +38,8 @@ type MediaStreamTrack struct {
 	kind      string
 	source    av.IMediaStreamTrackSource
 	SN        uint32
-	Timestamp uint32
+	Timestamp uint32 // DTS of the last sample
+	Duration  uint32 // between the last two samples, 0 if unknown
 }
 
 // Init this class.
@@ -50,6 +51,7 @@ func (me *MediaStreamTrack) Init(kind string, source av.IMediaStreamTrackSource,
 	me.source = source
 	me.SN = 0
 	me.Timestamp = 0
+	me.Duration = 0
 	return me
 }
 
@@ -264,3 +266,13 @@ func New(name string, mode uint32, factory log.ILoggerFactory) av.IRemuxer {
 	}
 	return nil
 }
+
+// LoggerFactory shares a logger whatever the scope, e.g. of a demuxer with its codec sources.
+type LoggerFactory struct {
+	Logger log.ILogger
+}
+
+// NewLogger returns the shared logger.
+func (me *LoggerFactory) NewLogger(scope string) log.ILogger {
+	return me.Logger
+}
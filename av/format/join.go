@@ -0,0 +1,252 @@
+package format
+
+import (
+	"bytes"
+	"context"
+	"sort"
+	"time"
+
+	"github.com/studease/common/av"
+	"github.com/studease/common/av/codec"
+	"github.com/studease/common/events"
+	MediaEvent "github.com/studease/common/events/mediaevent"
+	MediaStreamTrackEvent "github.com/studease/common/events/mediastreamtrackevent"
+	"github.com/studease/common/log"
+)
+
+// Joiner sinks the packets of successive demuxers into the tracks of this IMediaStream, on a continuous timeline.
+// Packets are queued until Flush, which sorts them by timestamp, so that demuxers of separate tracks are interleaved.
+// After Break, the timeline goes on from the end of the last packets, whatever the next timestamps are.
+// Sources are created by kind, and replaced if the codec changes. Repeated configs are dropped.
+type Joiner struct {
+	MediaStream
+
+	Realtime bool // whether Flush delivers packets no faster than their timestamps
+	logger   log.ILogger
+	factory  log.ILoggerFactory
+	queue    []*av.Packet
+	sources  map[string]av.IMediaStreamTrackSource // by kind
+	tracks   map[string]av.IMediaStreamTrack       // by kind
+	last     map[string]uint32                     // timestamp of the last packet by kind
+	delta    map[string]uint32                     // duration of the last packet by kind
+	base     int64                                 // timestamp of the demuxers, where the timeline goes on, -1 if not known yet
+	offset   uint32                                // on the timeline of the base
+	start    time.Time                             // wall clock of the first packet flushed
+	first    uint32                                // timestamp of the first packet flushed
+	began    bool
+
+	addtrackListener *events.EventListener
+	packetListener   *events.EventListener
+}
+
+// Init this class.
+func (me *Joiner) Init(logger log.ILogger, factory log.ILoggerFactory) *Joiner {
+	me.MediaStream.Init(logger)
+	me.Realtime = false
+	me.logger = logger
+	me.factory = factory
+	me.queue = nil
+	me.sources = make(map[string]av.IMediaStreamTrackSource)
+	me.tracks = make(map[string]av.IMediaStreamTrack)
+	me.last = make(map[string]uint32)
+	me.delta = make(map[string]uint32)
+	me.base = -1
+	me.offset = 0
+	me.began = false
+	me.addtrackListener = events.NewListener(me.onAddTrack, 0)
+	me.packetListener = events.NewListener(me.onPacket, 0)
+	return me
+}
+
+// Attach starts queuing the packets of the demuxer.
+func (me *Joiner) Attach(ms av.IMediaStream) {
+	for _, track := range ms.GetTracks() {
+		track.Source().AddEventListener(MediaEvent.PACKET, me.packetListener)
+	}
+	ms.AddEventListener(MediaStreamTrackEvent.ADDTRACK, me.addtrackListener)
+}
+
+// Detach stops queuing the packets of the demuxer.
+func (me *Joiner) Detach(ms av.IMediaStream) {
+	for _, track := range ms.GetTracks() {
+		track.Source().RemoveEventListener(MediaEvent.PACKET, me.packetListener)
+	}
+	ms.RemoveEventListener(MediaStreamTrackEvent.ADDTRACK, me.addtrackListener)
+}
+
+// Break makes the timeline go on from the end of the last packets, e.g. after a discontinuity.
+func (me *Joiner) Break() {
+	me.base = -1
+}
+
+func (me *Joiner) onAddTrack(e *MediaStreamTrackEvent.MediaStreamTrackEvent) {
+	e.Track.Source().AddEventListener(MediaEvent.PACKET, me.packetListener)
+}
+
+func (me *Joiner) onPacket(e *MediaEvent.MediaEvent) {
+	me.queue = append(me.queue, e.Packet)
+}
+
+// Flush sinks the queued packets in the order of timestamps, or returns on ctx done if Realtime.
+// A config is sorted along with the next packet of its kind, or the first packet if it leads its kind.
+func (me *Joiner) Flush(ctx context.Context) error {
+	var (
+		queue = me.queue
+		keys  = make([]uint32, len(queue))
+		next  = make(map[string]uint32)
+		first = uint32(0) // the smallest timestamp of frames
+	)
+
+	me.queue = nil
+
+	for i := len(queue) - 1; i >= 0; i-- {
+		pkt := queue[i]
+		keys[i] = pkt.Timestamp
+		if config(pkt) {
+			if n, ok := next[pkt.Kind]; ok {
+				keys[i] = n
+			}
+			continue
+		}
+		if len(next) == 0 || pkt.Timestamp < first {
+			first = pkt.Timestamp
+		}
+		next[pkt.Kind] = pkt.Timestamp
+	}
+
+	// Leading configs go first, so that every track is configured before any frame.
+	seen := make(map[string]bool)
+	for i, pkt := range queue {
+		if !config(pkt) {
+			seen[pkt.Kind] = true
+		} else if !seen[pkt.Kind] && len(next) > 0 {
+			keys[i] = first
+		}
+	}
+
+	index := make([]int, len(queue))
+	for i := range index {
+		index[i] = i
+	}
+	sort.SliceStable(index, func(i int, j int) bool {
+		a, b := index[i], index[j]
+		if keys[a] != keys[b] {
+			return keys[a] < keys[b]
+		}
+		return config(queue[a]) && !config(queue[b])
+	})
+
+	for _, i := range index {
+		err := me.sink(ctx, queue[i], keys[i])
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (me *Joiner) sink(ctx context.Context, pkt *av.Packet, timestamp uint32) error {
+	source := me.sources[pkt.Kind]
+	if source == nil || source.Kind() != pkt.Codec {
+		source = codec.New(pkt.Codec, &me.Info, me.factory)
+		if source == nil {
+			me.logger.Errorf("Unrecognized codec: %s", pkt.Codec)
+			return nil
+		}
+		if track := me.tracks[pkt.Kind]; track != nil {
+			me.RemoveTrack(track)
+		}
+		track := new(MediaStreamTrack).Init(pkt.Kind, source, me.logger)
+		me.sources[pkt.Kind] = source
+		me.tracks[pkt.Kind] = track
+		me.AddTrack(track)
+	}
+	if infoframe := source.GetInfoFrame(); infoframe != nil && bytes.Equal(infoframe.Payload, pkt.Payload) {
+		return nil
+	}
+
+	p := new(av.Packet).Init()
+	p.Kind = pkt.Kind
+	p.Codec = pkt.Codec
+	p.Length = pkt.Length
+	p.Timestamp = me.timestamp(pkt.Kind, timestamp)
+	p.Payload = pkt.Payload
+	p.Position = 1
+	p.Set("Keyframe", pkt.Get("Keyframe"))
+
+	if me.Realtime {
+		err := me.wait(ctx, p.Timestamp)
+		if err != nil {
+			return err
+		}
+	}
+
+	err := source.Parse(p)
+	if err != nil {
+		return nil
+	}
+	source.Sink(p)
+	return nil
+}
+
+// timestamp maps the timestamp of the demuxers onto the continuous timeline.
+func (me *Joiner) timestamp(kind string, timestamp uint32) uint32 {
+	if me.base < 0 {
+		me.base = int64(timestamp)
+		me.offset = 0
+		for k, last := range me.last {
+			if n := last + me.delta[k]; n > me.offset {
+				me.offset = n
+			}
+		}
+	}
+
+	n := int64(me.offset) + int64(timestamp) - me.base
+	if n < 0 {
+		n = 0
+	}
+	if last, ok := me.last[kind]; ok {
+		if n < int64(last) {
+			n = int64(last)
+		}
+		if d := uint32(n) - last; d > 0 {
+			me.delta[kind] = d
+		}
+	}
+	me.last[kind] = uint32(n)
+	return uint32(n)
+}
+
+// wait delays the packet to its timestamp in real time.
+func (me *Joiner) wait(ctx context.Context, timestamp uint32) error {
+	if !me.began {
+		me.start = time.Now()
+		me.first = timestamp
+		me.began = true
+		return nil
+	}
+	if timestamp <= me.first {
+		return nil
+	}
+
+	d := time.Until(me.start.Add(time.Duration(timestamp-me.first) * time.Millisecond))
+	if d <= 0 {
+		return nil
+	}
+
+	t := time.NewTimer(d)
+	defer t.Stop()
+
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// config returns whether the packet is an AVC sequence header or an AAC specific config.
+func config(pkt *av.Packet) bool {
+	typ, _ := pkt.Get("DataType").(byte)
+	return typ == 0x00
+}
@@ -0,0 +1,189 @@
+package format_test
+
+import (
+	"context"
+	"encoding/binary"
+	"io/ioutil"
+	"testing"
+
+	"github.com/studease/common/av"
+	"github.com/studease/common/av/format"
+	_ "github.com/studease/common/av/format/flv"
+	"github.com/studease/common/events"
+	MediaEvent "github.com/studease/common/events/mediaevent"
+	MediaStreamTrackEvent "github.com/studease/common/events/mediastreamtrackevent"
+	"github.com/studease/common/log"
+)
+
+const testInterval = 40 // ms between frames
+
+var (
+	testAVCC = []byte{
+		0x01, 0x42, 0xC0, 0x1E, 0xFF, 0xE1, 0x00, 0x08, 0x67, 0x42, 0xC0, 0x1E, 0xDA, 0x05, 0x07, 0xE4,
+		0x01, 0x00, 0x04, 0x68, 0xCE, 0x38, 0x80,
+	}
+	testASC = []byte{0x12, 0x10}
+)
+
+func testFactory() log.ILoggerFactory {
+	return new(log.DefaultLoggerFactory).Init(0x0800, ioutil.Discard)
+}
+
+func flvTag(typ byte, timestamp uint32, body []byte) []byte {
+	tag := make([]byte, 11, 11+len(body)+4)
+	tag[0] = typ
+	tag[1] = byte(len(body) >> 16)
+	tag[2] = byte(len(body) >> 8)
+	tag[3] = byte(len(body))
+	tag[4] = byte(timestamp >> 16)
+	tag[5] = byte(timestamp >> 8)
+	tag[6] = byte(timestamp)
+	tag[7] = byte(timestamp >> 24)
+	tag = append(tag, body...)
+	size := make([]byte, 4)
+	binary.BigEndian.PutUint32(size, uint32(11+len(body)))
+	return append(tag, size...)
+}
+
+// testFLV returns an FLV of n frames of the kinds from the timestamp, led by the configs.
+func testFLV(video bool, audio bool, from uint32, n int) []byte {
+	b := []byte{'F', 'L', 'V', 0x01, 0x00, 0, 0, 0, 0x09, 0, 0, 0, 0}
+	if video {
+		b[4] |= 0x01
+		b = append(b, flvTag(9, from, append([]byte{0x17, 0, 0, 0, 0}, testAVCC...))...)
+	}
+	if audio {
+		b[4] |= 0x04
+		b = append(b, flvTag(8, from, append([]byte{0xAF, 0}, testASC...))...)
+	}
+	for i := 0; i < n; i++ {
+		timestamp := from + uint32(i*testInterval)
+		if video {
+			nalu := make([]byte, 4+50)
+			binary.BigEndian.PutUint32(nalu, 50)
+			nalu[4] = 0x41
+			flag := byte(0x27)
+			if i == 0 {
+				nalu[4] = 0x65
+				flag = 0x17
+			}
+			b = append(b, flvTag(9, timestamp, append([]byte{flag, 1, 0, 0, 0}, nalu...))...)
+		}
+		if audio {
+			b = append(b, flvTag(8, timestamp, append([]byte{0xAF, 1}, make([]byte, 20)...))...)
+		}
+	}
+	return b
+}
+
+type testPacket struct {
+	kind      string
+	config    bool
+	timestamp uint32
+}
+
+// testJoiner returns a Joiner, and the packets sunk into its tracks so far.
+func testJoiner() (*format.Joiner, *[]testPacket) {
+	var (
+		joiner  = new(format.Joiner).Init(testFactory().NewLogger("Joiner"), testFactory())
+		packets = make([]testPacket, 0)
+	)
+
+	packetListener := events.NewListener(func(e *MediaEvent.MediaEvent) {
+		datatype, _ := e.Packet.Get("DataType").(byte)
+		packets = append(packets, testPacket{e.Packet.Kind, datatype == 0, e.Packet.Timestamp})
+	}, 0)
+	joiner.AddEventListener(MediaStreamTrackEvent.ADDTRACK, events.NewListener(func(e *MediaStreamTrackEvent.MediaStreamTrackEvent) {
+		e.Track.Source().AddEventListener(MediaEvent.PACKET, packetListener)
+	}, 0))
+	return joiner, &packets
+}
+
+func testDemuxer(t *testing.T) av.IDemuxer {
+	demuxer, ok := format.New("FLV", av.ModeAll, testFactory()).(av.IDemuxer)
+	if !ok {
+		t.Fatalf("Demuxer FLV not registered")
+	}
+	return demuxer
+}
+
+// testFrames checks that the frames of the kind are n, spaced by testInterval from 0.
+func testFrames(t *testing.T, packets []testPacket, kind string, n int) {
+	var frames []uint32
+	for _, pkt := range packets {
+		if pkt.kind == kind && !pkt.config {
+			frames = append(frames, pkt.timestamp)
+		}
+	}
+	if len(frames) != n {
+		t.Fatalf("Expected %d %s frames, got %d", n, kind, len(frames))
+	}
+	for i, timestamp := range frames {
+		if timestamp != uint32(i*testInterval) {
+			t.Fatalf("Expected %s frame %d at %d, got %d", kind, i, i*testInterval, timestamp)
+		}
+	}
+}
+
+// TestJoinerBreak joins demuxers of unrelated timestamps, and drops the repeated configs.
+func TestJoinerBreak(t *testing.T) {
+	joiner, packets := testJoiner()
+
+	for _, from := range []uint32{1000, 0, 90000} {
+		demuxer := testDemuxer(t)
+		joiner.Attach(demuxer)
+		joiner.Break()
+		demuxer.Append(testFLV(true, true, from, 10))
+		joiner.Detach(demuxer)
+
+		err := joiner.Flush(context.Background())
+		if err != nil {
+			t.Fatalf("Failed to flush: %v", err)
+		}
+	}
+
+	testFrames(t, *packets, "video", 30)
+	testFrames(t, *packets, "audio", 30)
+	for i, pkt := range *packets {
+		if pkt.config && i > 1 {
+			t.Fatalf("Repeated %s config at %d", pkt.kind, i)
+		}
+	}
+}
+
+// TestJoinerInterleave sorts the packets of a video demuxer and an audio one by timestamps, configs first.
+func TestJoinerInterleave(t *testing.T) {
+	joiner, packets := testJoiner()
+
+	video, audio := testDemuxer(t), testDemuxer(t)
+	joiner.Attach(video)
+	joiner.Attach(audio)
+	video.Append(testFLV(true, false, 500, 5))
+	audio.Append(testFLV(false, true, 500, 5))
+
+	err := joiner.Flush(context.Background())
+	if err != nil {
+		t.Fatalf("Failed to flush: %v", err)
+	}
+
+	testFrames(t, *packets, "video", 5)
+	testFrames(t, *packets, "audio", 5)
+	for i, pkt := range *packets {
+		if i < 2 != pkt.config {
+			t.Fatalf("Unexpected packet %d: %+v", i, pkt)
+		}
+		if i > 0 && pkt.timestamp < (*packets)[i-1].timestamp {
+			t.Fatalf("Packet %d at %d, before %d", i, pkt.timestamp, (*packets)[i-1].timestamp)
+		}
+	}
+
+	// Without Break, the timeline follows the timestamps of the demuxers.
+	video.Append(testFLV(true, false, 700, 5)[13:])
+	err = joiner.Flush(context.Background())
+	if err != nil {
+		t.Fatalf("Failed to flush: %v", err)
+	}
+	if last := (*packets)[len(*packets)-1]; last.kind != "video" || last.timestamp != 200+4*testInterval {
+		t.Fatalf("Unexpected last packet: %+v", last)
+	}
+}
@@ -0,0 +1,307 @@
+package format
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/studease/common/av"
+	"github.com/studease/common/events"
+	ErrorEvent "github.com/studease/common/events/errorevent"
+	Event "github.com/studease/common/events/event"
+	MediaEvent "github.com/studease/common/events/mediaevent"
+	MediaStreamTrackEvent "github.com/studease/common/events/mediastreamtrackevent"
+	"github.com/studease/common/log"
+)
+
+// Static constants.
+const (
+	ReadBufferSize  = 32 * 1024
+	WriteQueueSize  = 64
+	DefaultPipeMode = av.ModeAll | av.ModeInterleaved
+)
+
+// IHeader is implemented by IRemuxer which requires a header before the buffer, e.g. FLV.
+type IHeader interface {
+	Header() []byte
+}
+
+// pacer delays the demuxed packets to their timestamps in real time.
+type pacer struct {
+	ctx   context.Context
+	start time.Time
+	base  uint32
+	began bool
+
+	addtrackListener *events.EventListener
+	packetListener   *events.EventListener
+}
+
+func (me *pacer) init(ctx context.Context) *pacer {
+	me.ctx = ctx
+	me.began = false
+	me.addtrackListener = events.NewListener(me.onAddTrack, 0)
+	me.packetListener = events.NewListener(me.onPacket, 0)
+	return me
+}
+
+func (me *pacer) attach(ms av.IMediaStream) {
+	for _, track := range ms.GetTracks() {
+		track.Source().AddEventListener(MediaEvent.PACKET, me.packetListener)
+	}
+	ms.AddEventListener(MediaStreamTrackEvent.ADDTRACK, me.addtrackListener)
+	ms.AddEventListener(MediaEvent.PACKET, me.packetListener)
+}
+
+func (me *pacer) detach(ms av.IMediaStream) {
+	for _, track := range ms.GetTracks() {
+		track.Source().RemoveEventListener(MediaEvent.PACKET, me.packetListener)
+	}
+	ms.RemoveEventListener(MediaStreamTrackEvent.ADDTRACK, me.addtrackListener)
+	ms.RemoveEventListener(MediaEvent.PACKET, me.packetListener)
+}
+
+func (me *pacer) onAddTrack(e *MediaStreamTrackEvent.MediaStreamTrackEvent) {
+	e.Track.Source().AddEventListener(MediaEvent.PACKET, me.packetListener)
+}
+
+func (me *pacer) onPacket(e *MediaEvent.MediaEvent) {
+	ts := e.Packet.Timestamp
+	if !me.began {
+		me.start = time.Now()
+		me.base = ts
+		me.began = true
+		return
+	}
+	if ts <= me.base {
+		return
+	}
+
+	d := time.Until(me.start.Add(time.Duration(ts-me.base) * time.Millisecond))
+	if d <= 0 {
+		return
+	}
+
+	t := time.NewTimer(d)
+	defer t.Stop()
+
+	select {
+	case <-t.C:
+	case <-me.ctx.Done():
+	}
+}
+
+// ReadFrom appends data read from r to the IDemuxer, until EOF, an error, or ctx done.
+// If realtime, packets are delivered no faster than their timestamps.
+// A blocking read is interrupted by closing r, if it is an io.Closer.
+func ReadFrom(ctx context.Context, demuxer av.IDemuxer, r io.Reader, realtime bool) error {
+	var (
+		failed error
+		mtx    sync.Mutex
+	)
+
+	errorListener := events.NewListener(func(e *ErrorEvent.ErrorEvent) {
+		mtx.Lock()
+		if failed == nil {
+			failed = fmt.Errorf("%s: %v", e.Name, e.Message)
+		}
+		mtx.Unlock()
+	}, 0)
+	demuxer.AddEventListener(ErrorEvent.ERROR, errorListener)
+	defer demuxer.RemoveEventListener(ErrorEvent.ERROR, errorListener)
+
+	if realtime {
+		p := new(pacer).init(ctx)
+		p.attach(demuxer)
+		defer p.detach(demuxer)
+	}
+
+	done := make(chan struct{})
+	defer close(done)
+
+	if c, ok := r.(io.Closer); ok {
+		go func() {
+			select {
+			case <-ctx.Done():
+				c.Close()
+			case <-done:
+			}
+		}()
+	}
+
+	buf := make([]byte, ReadBufferSize)
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		n, err := r.Read(buf)
+		if n > 0 {
+			demuxer.Append(buf[:n])
+
+			mtx.Lock()
+			e := failed
+			mtx.Unlock()
+			if e != nil {
+				return e
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			if e := ctx.Err(); e != nil {
+				return e
+			}
+			return err
+		}
+	}
+}
+
+// Writer writes buffer of an IRemuxer to an io.Writer.
+// The IRemuxer is blocked while the queue is full, until written or the Writer closed.
+type Writer struct {
+	remuxer av.IRemuxer
+	w       io.Writer
+	logger  log.ILogger
+	queue   chan []byte
+	closed  chan struct{}
+	done    chan struct{}
+	once    sync.Once
+	stop    sync.Once
+	written int64
+
+	packetListener *events.EventListener
+	closeListener  *events.EventListener
+}
+
+// Init this class, and starts listening to the IRemuxer, before it is fed with any data.
+func (me *Writer) Init(remuxer av.IRemuxer, w io.Writer, logger log.ILogger) *Writer {
+	me.remuxer = remuxer
+	me.w = w
+	me.logger = logger
+	me.queue = make(chan []byte, WriteQueueSize)
+	me.closed = make(chan struct{})
+	me.done = make(chan struct{})
+	me.written = 0
+	me.packetListener = events.NewListener(me.onPacket, 0)
+	me.closeListener = events.NewListener(me.onClose, 0)
+
+	me.remuxer.AddEventListener(MediaEvent.PACKET, me.packetListener)
+	me.remuxer.AddEventListener(Event.CLOSE, me.closeListener)
+	return me
+}
+
+func (me *Writer) onPacket(e *MediaEvent.MediaEvent) {
+	select {
+	case me.queue <- e.Packet.Payload:
+	case <-me.done:
+	}
+}
+
+func (me *Writer) onClose(e *Event.Event) {
+	me.once.Do(func() {
+		close(me.closed)
+	})
+}
+
+// Run writes the header if any, and then the queued buffer, until the IRemuxer closes, an error, or ctx done.
+func (me *Writer) Run(ctx context.Context) error {
+	defer me.Close()
+
+	if h, ok := me.remuxer.(IHeader); ok {
+		err := me.write(h.Header())
+		if err != nil {
+			return err
+		}
+	}
+
+	for {
+		select {
+		case data := <-me.queue:
+			err := me.write(data)
+			if err != nil {
+				return err
+			}
+
+		case <-me.closed:
+			// Drain what was queued before closing.
+			for {
+				select {
+				case data := <-me.queue:
+					err := me.write(data)
+					if err != nil {
+						return err
+					}
+				default:
+					return nil
+				}
+			}
+
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+func (me *Writer) write(data []byte) error {
+	n, err := me.w.Write(data)
+	me.written += int64(n)
+	if err != nil {
+		me.logger.Debugf(3, "Writer failed to write: %v", err)
+	}
+	return err
+}
+
+// Written returns the number of bytes written.
+func (me *Writer) Written() int64 {
+	return me.written
+}
+
+// Close stops listening to the IRemuxer, and releases it if blocked.
+func (me *Writer) Close() {
+	me.stop.Do(func() {
+		me.remuxer.RemoveEventListener(MediaEvent.PACKET, me.packetListener)
+		me.remuxer.RemoveEventListener(Event.CLOSE, me.closeListener)
+		close(me.done)
+	})
+}
+
+// Convert demuxes r in format src, and writes it to w in format dst, e.g. Convert(ctx, w, "FMP4", r, "FLV", factory).
+func Convert(ctx context.Context, w io.Writer, dst string, r io.Reader, src string, factory log.ILoggerFactory) error {
+	demuxer, ok := New(src, DefaultPipeMode, factory).(av.IDemuxer)
+	if !ok {
+		return fmt.Errorf("demuxer %s not registered", src)
+	}
+	remuxer := New(dst, DefaultPipeMode, factory)
+	if remuxer == nil {
+		return fmt.Errorf("remuxer %s not registered", dst)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	writer := new(Writer).Init(remuxer, w, factory.NewLogger("pipe"))
+	remuxer.Source(demuxer)
+
+	errc := make(chan error, 1)
+	go func() {
+		err := writer.Run(ctx)
+
+		// Stop reading as well, since nothing could be written any more.
+		cancel()
+		errc <- err
+	}()
+
+	err := ReadFrom(ctx, demuxer, r, false)
+
+	// Flushes the writer, which returns after draining.
+	remuxer.Close()
+
+	if e := <-errc; e != nil && (err == nil || err == context.Canceled) {
+		err = e
+	}
+	return err
+}
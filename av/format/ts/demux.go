@@ -0,0 +1,498 @@
+package ts
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+
+	"github.com/studease/common/av"
+	"github.com/studease/common/av/codec"
+	"github.com/studease/common/av/codec/aac"
+	"github.com/studease/common/av/codec/avc"
+	"github.com/studease/common/av/format"
+)
+
+// Static constants.
+const (
+	maxTimestampJump int64 = 10 * Timescale // treated as a discontinuity beyond this
+	wrap             int64 = 1 << 33
+)
+
+// elementaryStream reassembles the PES packets of a PID.
+type elementaryStream struct {
+	typ     byte
+	pid     uint16
+	cc      byte
+	started bool // whether any packet has been received
+	pes     []byte
+	source  av.IMediaStreamTrackSource
+	config  []byte // AVC decoder configuration record, or AudioSpecificConfig
+	sps     []byte
+	pps     []byte
+}
+
+// demuxer keeps the parsing state of the TS demuxer.
+type demuxer struct {
+	buffer        []byte // of an incomplete packet
+	pmt           uint16 // PID of PMT, 0 if not found yet
+	streams       map[uint16]*elementaryStream
+	started       bool
+	raw           uint64 // last DTS as is
+	clock         int64  // last DTS on the continuous timeline
+	pcr           int64  // last PCR base, -1 if none
+	discontinuity bool
+}
+
+func (me *demuxer) init() *demuxer {
+	me.buffer = nil
+	me.pmt = 0
+	me.streams = make(map[uint16]*elementaryStream)
+	me.started = false
+	me.raw = 0
+	me.clock = 0
+	me.pcr = -1
+	me.discontinuity = false
+	return me
+}
+
+// Append parses buffer.
+func (me *TS) Append(data []byte) {
+	d := &me.demuxer
+	if len(d.buffer) > 0 {
+		data = append(d.buffer, data...)
+		d.buffer = nil
+	}
+
+	for i := 0; i < len(data); /* void */ {
+		if data[i] != SyncByte {
+			n := bytes.IndexByte(data[i:], SyncByte)
+			if n < 0 {
+				me.logger.Debugf(2, "Dropped %d bytes while looking for sync byte.", len(data)-i)
+				return
+			}
+			me.logger.Debugf(2, "Dropped %d bytes while looking for sync byte.", n)
+			i += n
+			continue
+		}
+		if i+PacketSize > len(data) {
+			d.buffer = append([]byte(nil), data[i:]...)
+			return
+		}
+
+		me.parsePacket(data[i : i+PacketSize])
+		i += PacketSize
+	}
+}
+
+// Reset clears IDemuxer cache, and closes IMediaStream.
+func (me *TS) Reset() {
+	me.MediaStream.Close()
+	me.Info = av.Information{}
+	me.Init(me.Mode, me.logger)
+}
+
+// parsePacket parses a TS packet, of which errors are logged and dropped, as contribution feeds are lossy.
+func (me *TS) parsePacket(p []byte) {
+	d := &me.demuxer
+	pusi := p[1]&0x40 != 0
+	pid := uint16(p[1]&0x1F)<<8 | uint16(p[2])
+	control := (p[3] >> 4) & 0x03
+	cc := p[3] & 0x0F
+
+	if p[1]&0x80 != 0 {
+		me.logger.Debugf(2, "Dropped packet with transport error: pid=%d.", pid)
+		return
+	}
+
+	i := 4
+	if control&0x02 != 0 {
+		n := int(p[4])
+		if 5+n > PacketSize {
+			me.logger.Debugf(2, "Dropped packet with invalid adaptation field length: pid=%d, length=%d.", pid, n)
+			return
+		}
+		if n > 0 {
+			me.parseAdaptationField(p[5 : 5+n])
+		}
+		i = 5 + n
+	}
+	if control&0x01 == 0 {
+		return
+	}
+	payload := p[i:]
+
+	switch {
+	case pid == PID_PAT:
+		if err := me.parsePAT(payload, pusi); err != nil {
+			me.logger.Debugf(2, "Dropped PAT: %v", err)
+		}
+		return
+	case pid == d.pmt && d.pmt != 0:
+		if err := me.parsePMT(payload, pusi); err != nil {
+			me.logger.Debugf(2, "Dropped PMT: %v", err)
+		}
+		return
+	}
+
+	es := d.streams[pid]
+	if es == nil {
+		return
+	}
+
+	// Duplicate packets are dropped, and lost ones break the current PES.
+	if es.started {
+		if cc == es.cc {
+			return
+		}
+		if cc != (es.cc+1)&0x0F {
+			me.logger.Debugf(2, "Continuity lost: pid=%d, expected=%d, got=%d.", pid, (es.cc+1)&0x0F, cc)
+			es.pes = nil
+		}
+	}
+	es.cc = cc
+	es.started = true
+
+	if pusi {
+		if len(es.pes) > 0 {
+			me.parsePES(es, es.pes)
+		}
+		es.pes = append(make([]byte, 0, len(payload)*8), payload...)
+	} else if es.pes != nil {
+		es.pes = append(es.pes, payload...)
+	}
+
+	// PES with a known length is flushed as soon as it's complete.
+	if len(es.pes) >= 6 {
+		if n := int(binary.BigEndian.Uint16(es.pes[4:6])); n > 0 && len(es.pes) >= 6+n {
+			me.parsePES(es, es.pes[:6+n])
+			es.pes = nil
+		}
+	}
+}
+
+func (me *TS) parseAdaptationField(af []byte) {
+	d := &me.demuxer
+	if af[0]&0x80 != 0 {
+		d.discontinuity = true
+	}
+	if af[0]&0x10 != 0 && len(af) >= 7 {
+		base := int64(af[1])<<25 | int64(af[2])<<17 | int64(af[3])<<9 | int64(af[4])<<1 | int64(af[5])>>7
+		if d.pcr >= 0 {
+			if delta := diff(base, d.pcr); delta < -maxTimestampJump || delta > maxTimestampJump {
+				me.logger.Debugf(2, "PCR jumped from %d to %d.", d.pcr, base)
+				d.discontinuity = true
+			}
+		}
+		d.pcr = base
+	}
+}
+
+// section returns the PSI section in the payload, which is assumed to fit in a packet.
+func section(payload []byte, pusi bool) ([]byte, error) {
+	if !pusi || len(payload) < 1 {
+		return nil, nil
+	}
+
+	i := 1 + int(payload[0])
+	if i+3 > len(payload) {
+		return nil, fmt.Errorf("invalid pointer field")
+	}
+
+	s := payload[i:]
+	n := 3 + int(binary.BigEndian.Uint16(s[1:3])&0x0FFF)
+	if n > len(s) || n < 3+4 {
+		return nil, fmt.Errorf("PSI section across packets not supported")
+	}
+	if CRC32(s[:n]) != 0 {
+		return nil, fmt.Errorf("PSI section CRC mismatch")
+	}
+	return s[:n], nil
+}
+
+func (me *TS) parsePAT(payload []byte, pusi bool) error {
+	s, err := section(payload, pusi)
+	if s == nil || err != nil {
+		return err
+	}
+	if s[0] != 0x00 {
+		return nil
+	}
+
+	for i := 8; i+4 <= len(s)-4; i += 4 {
+		program := binary.BigEndian.Uint16(s[i : i+2])
+		if program == 0 { // network PID
+			continue
+		}
+		me.demuxer.pmt = binary.BigEndian.Uint16(s[i+2:i+4]) & 0x1FFF
+		break
+	}
+	return nil
+}
+
+func (me *TS) parsePMT(payload []byte, pusi bool) error {
+	s, err := section(payload, pusi)
+	if s == nil || err != nil {
+		return err
+	}
+	if s[0] != 0x02 || len(s) < 12 {
+		return nil
+	}
+
+	info := int(binary.BigEndian.Uint16(s[10:12]) & 0x0FFF)
+	for i := 12 + info; i+5 <= len(s)-4; /* void */ {
+		typ := s[i]
+		pid := binary.BigEndian.Uint16(s[i+1:i+3]) & 0x1FFF
+		n := int(binary.BigEndian.Uint16(s[i+3:i+5]) & 0x0FFF)
+		i += 5 + n
+
+		switch typ {
+		case STREAM_TYPE_AVC, STREAM_TYPE_AAC:
+		default:
+			me.logger.Debugf(2, "Ignored unsupported stream: pid=%d, type=0x%02X.", pid, typ)
+			continue
+		}
+		if es, ok := me.demuxer.streams[pid]; ok && es.typ == typ {
+			continue
+		}
+		me.demuxer.streams[pid] = &elementaryStream{typ: typ, pid: pid}
+	}
+	return nil
+}
+
+func (me *TS) parsePES(es *elementaryStream, pes []byte) {
+	if len(pes) < 9 || pes[0] != 0x00 || pes[1] != 0x00 || pes[2] != 0x01 {
+		me.logger.Debugf(2, "Dropped invalid PES: pid=%d.", es.pid)
+		return
+	}
+
+	flags := pes[7]
+	i := 9 + int(pes[8])
+	if i > len(pes) || flags&0x80 == 0 || len(pes) < 14 {
+		me.logger.Debugf(2, "Dropped PES without PTS: pid=%d.", es.pid)
+		return
+	}
+
+	pts := int64(readTimestamp(pes[9:14]))
+	dts := pts
+	if flags&0x40 != 0 && len(pes) >= 19 {
+		dts = int64(readTimestamp(pes[14:19]))
+	}
+
+	clock := me.unwrap(uint64(dts))
+	cts := diff(pts, dts)
+	if cts < 0 {
+		cts = 0
+	}
+
+	switch es.typ {
+	case STREAM_TYPE_AVC:
+		me.demuxVideo(es, clock, cts, pes[i:])
+	case STREAM_TYPE_AAC:
+		me.demuxAudio(es, clock, pes[i:])
+	}
+}
+
+// unwrap maps the 33-bit DTS onto a continuous timeline, which goes on seamlessly over discontinuities.
+func (me *TS) unwrap(raw uint64) int64 {
+	d := &me.demuxer
+	if !d.started {
+		d.started = true
+		d.raw = raw
+		d.clock = 0
+		d.discontinuity = false
+		return 0
+	}
+
+	delta := diff(int64(raw), int64(d.raw))
+	if d.discontinuity || delta < -maxTimestampJump || delta > maxTimestampJump {
+		me.logger.Debugf(2, "Timestamp discontinuity: from %d to %d.", d.raw, raw)
+		delta = 0
+		d.discontinuity = false
+	}
+
+	d.raw = raw
+	d.clock += delta
+	return d.clock
+}
+
+// diff returns a - b of 33-bit timestamps, which takes a wrap into account.
+func diff(a int64, b int64) int64 {
+	delta := (a - b) % wrap
+	switch {
+	case delta > wrap/2:
+		delta -= wrap
+	case delta < -wrap/2:
+		delta += wrap
+	}
+	return delta
+}
+
+func readTimestamp(b []byte) uint64 {
+	return uint64(b[0]>>1&0x07)<<30 | uint64(b[1])<<22 | uint64(b[2]>>1)<<15 | uint64(b[3])<<7 | uint64(b[4]>>1)
+}
+
+// milliseconds converts the clock in 90kHz, which is clamped at 0.
+func milliseconds(clock int64) uint32 {
+	if clock < 0 {
+		return 0
+	}
+	return uint32(clock * 1000 / Timescale)
+}
+
+// demuxVideo converts the Annex B access unit into AVCC, and sinks a new decoder configuration record
+// if the in-band SPS or PPS changes.
+func (me *TS) demuxVideo(es *elementaryStream, clock int64, cts int64, data []byte) {
+	var (
+		nalus    []byte
+		keyframe bool
+	)
+
+	for _, nalu := range splitNalUnits(data) {
+		switch nalu[0] & 0x1F {
+		case avc.NAL_AUD:
+		case avc.NAL_SPS:
+			es.sps = nalu
+		case avc.NAL_PPS:
+			es.pps = nalu
+		case avc.NAL_IDR_SLICE:
+			keyframe = true
+			fallthrough
+		default:
+			n := len(nalus)
+			nalus = append(nalus, 0, 0, 0, 0)
+			binary.BigEndian.PutUint32(nalus[n:], uint32(len(nalu)))
+			nalus = append(nalus, nalu...)
+		}
+	}
+
+	if es.sps != nil && es.pps != nil {
+		config := decoderConfigurationRecord(es.sps, es.pps)
+		if !bytes.Equal(config, es.config) {
+			es.config = config
+			payload := append([]byte{0x17, avc.SEQUENCE_HEADER, 0x00, 0x00, 0x00}, config...)
+			me.sink(es, format.KindVideo, "AVC", milliseconds(clock), payload)
+		}
+	}
+	if es.config == nil || len(nalus) == 0 {
+		return
+	}
+
+	n := milliseconds(cts)
+	frametype := byte(0x20)
+	if keyframe {
+		frametype = 0x10
+	}
+	payload := append([]byte{frametype | 0x07, avc.NALU, byte(n >> 16), byte(n >> 8), byte(n)}, nalus...)
+	me.sink(es, format.KindVideo, "AVC", milliseconds(clock), payload)
+}
+
+// splitNalUnits returns the NAL units between start codes.
+func splitNalUnits(data []byte) [][]byte {
+	var (
+		nalus = make([][]byte, 0)
+		start = -1
+	)
+
+	for i := 0; i+3 <= len(data); /* void */ {
+		if data[i] != 0x00 || data[i+1] != 0x00 || data[i+2] != 0x01 {
+			i++
+			continue
+		}
+		if start >= 0 {
+			end := i
+			for end > start && data[end-1] == 0x00 { // trailing zero of a 4-byte start code
+				end--
+			}
+			if end > start {
+				nalus = append(nalus, data[start:end])
+			}
+		}
+		i += 3
+		start = i
+	}
+	if start >= 0 && start < len(data) {
+		nalus = append(nalus, data[start:])
+	}
+	return nalus
+}
+
+// decoderConfigurationRecord returns an AVC decoder configuration record with the only SPS and PPS.
+func decoderConfigurationRecord(sps []byte, pps []byte) []byte {
+	if len(sps) < 4 {
+		return nil
+	}
+
+	b := []byte{0x01, sps[1], sps[2], sps[3], 0xFF, 0xE1}
+	b = append(b, byte(len(sps)>>8), byte(len(sps)))
+	b = append(b, sps...)
+	b = append(b, 0x01, byte(len(pps)>>8), byte(len(pps)))
+	return append(b, pps...)
+}
+
+// demuxAudio strips the ADTS headers, and sinks a new AudioSpecificConfig if it changes.
+func (me *TS) demuxAudio(es *elementaryStream, clock int64, data []byte) {
+	for i, k := 0, int64(0); i+7 <= len(data); k++ {
+		h := data[i:]
+		if h[0] != 0xFF || h[1]&0xF0 != 0xF0 {
+			me.logger.Debugf(2, "Dropped %d bytes of invalid ADTS: pid=%d.", len(data)-i, es.pid)
+			return
+		}
+
+		header := 7
+		if h[1]&0x01 == 0 { // protection_absent
+			header = 9
+		}
+		size := int(h[3]&0x03)<<11 | int(h[4])<<3 | int(h[5])>>5
+		if size < header || i+size > len(data) {
+			me.logger.Debugf(2, "Dropped truncated ADTS frame: pid=%d.", es.pid)
+			return
+		}
+
+		profile := h[2] >> 6
+		index := (h[2] >> 2) & 0x0F
+		channels := (h[2]&0x01)<<2 | h[3]>>6
+		if int(index) >= len(aac.SamplingFrequencys) || aac.SamplingFrequencys[index] == 0 {
+			me.logger.Debugf(2, "Dropped ADTS with invalid sampling frequency index %d.", index)
+			return
+		}
+
+		config := []byte{(profile+1)<<3 | index>>1, (index&0x01)<<7 | channels<<3}
+		if !bytes.Equal(config, es.config) {
+			es.config = config
+			me.sink(es, format.KindAudio, "AAC", milliseconds(clock), append([]byte{0xAF, aac.SPECIFIC_CONFIG}, config...))
+		}
+
+		// Frames in a PES follow the first one, 1024 samples each.
+		timestamp := clock + k*1024*Timescale/int64(aac.SamplingFrequencys[index])
+		payload := append([]byte{0xAF, aac.RAW_FRAME_DATA}, h[header:size]...)
+		me.sink(es, format.KindAudio, "AAC", milliseconds(timestamp), payload)
+		i += size
+	}
+}
+
+// sink parses the payload in the layout of FLV tags with the source of the stream, which is created on the first packet.
+func (me *TS) sink(es *elementaryStream, kind string, name string, timestamp uint32, payload []byte) {
+	if es.source == nil {
+		es.source = codec.New(name, &me.Info, &format.LoggerFactory{Logger: me.logger})
+		if es.source == nil {
+			me.logger.Errorf("Unrecognized codec: %s", name)
+			return
+		}
+		me.AddTrack(new(format.MediaStreamTrack).Init(kind, es.source, me.logger))
+	}
+
+	pkt := new(av.Packet).Init()
+	pkt.Kind = kind
+	pkt.Codec = name
+	pkt.Length = uint32(len(payload))
+	pkt.Timestamp = timestamp
+	pkt.Payload = payload
+	pkt.Position = 1
+	pkt.Set("Keyframe", kind == format.KindAudio || payload[0]>>4 == 0x01)
+
+	err := es.source.Parse(pkt)
+	if err != nil {
+		return
+	}
+	es.source.Sink(pkt)
+}
@@ -0,0 +1,328 @@
+package ts
+
+import (
+	"container/list"
+	"encoding/binary"
+	"fmt"
+
+	"github.com/studease/common/av/utils/amf"
+)
+
+// Packet constants.
+const (
+	PacketSize = 188
+	SyncByte   = 0x47
+)
+
+// Well-known PIDs.
+const (
+	PID_PAT   uint16 = 0x0000
+	PID_PMT   uint16 = 0x1000
+	PID_VIDEO uint16 = 0x0100
+	PID_AUDIO uint16 = 0x0101
+	PID_ID3   uint16 = 0x0102
+	PID_NULL  uint16 = 0x1FFF
+)
+
+// Stream types of PMT.
+const (
+	STREAM_TYPE_AAC      byte = 0x0F
+	STREAM_TYPE_METADATA byte = 0x15
+	STREAM_TYPE_AVC      byte = 0x1B
+)
+
+// PES stream IDs.
+const (
+	STREAM_ID_PRIVATE_1 byte = 0xBD
+	STREAM_ID_AUDIO     byte = 0xC0
+	STREAM_ID_VIDEO     byte = 0xE0
+)
+
+// Static constants.
+const (
+	DefaultMuxDelay uint32 = 700 // milliseconds of PTS and DTS ahead of PCR
+	ProgramNumber   uint16 = 1
+	Timescale              = 90000
+	timestampMask          = 0x1FFFFFFFF // 33 bits
+)
+
+var (
+	crcTable [256]uint32
+
+	// HLS timed metadata, ID3 in a private stream.
+	metadataPointerDescriptor = []byte{
+		0x25, 0x0F,
+		0xFF, 0xFF, 'I', 'D', '3', ' ', // metadata_application_format, and its identifier
+		0xFF, 'I', 'D', '3', ' ', // metadata_format, and its identifier
+		0x00,       // metadata_service_id
+		0x1F,       // metadata_locator_record_flag, MPEG_carriage_flags, reserved
+		0x00, 0x01, // program_number
+	}
+	metadataDescriptor = []byte{
+		0x26, 0x0D,
+		0xFF, 0xFF, 'I', 'D', '3', ' ',
+		0xFF, 'I', 'D', '3', ' ',
+		0x00, // metadata_service_id
+		0x0F, // decoder_config_flags, DSM-CC_flag, reserved
+	}
+)
+
+func init() {
+	for i := range crcTable {
+		crc := uint32(i) << 24
+		for j := 0; j < 8; j++ {
+			if crc&0x80000000 != 0 {
+				crc = crc<<1 ^ 0x04C11DB7
+			} else {
+				crc <<= 1
+			}
+		}
+		crcTable[i] = crc
+	}
+}
+
+// CRC32 returns the MPEG-2 CRC of PSI sections.
+func CRC32(data []byte) uint32 {
+	crc := uint32(0xFFFFFFFF)
+	for _, b := range data {
+		crc = crc<<8 ^ crcTable[byte(crc>>24)^b]
+	}
+	return crc
+}
+
+// Stream describes an elementary stream of PMT.
+type Stream struct {
+	Type        byte
+	PID         uint16
+	Descriptors []byte
+}
+
+// PAT returns a program association section with the only program.
+func PAT() []byte {
+	section := []byte{
+		0x00,       // table_id
+		0xB0, 0x0D, // section_syntax_indicator, section_length
+		0x00, 0x01, // transport_stream_id
+		0xC1,       // version_number 0, current_next_indicator
+		0x00, 0x00, // section_number, last_section_number
+		byte(ProgramNumber >> 8), byte(ProgramNumber),
+		0xE0 | byte(PID_PMT>>8), byte(PID_PMT & 0xFF),
+	}
+	return appendCRC(section)
+}
+
+// PMT returns a program map section of the streams.
+func PMT(version byte, pcr uint16, info []byte, streams ...Stream) []byte {
+	section := []byte{
+		0x02,       // table_id
+		0xB0, 0x00, // section_syntax_indicator, section_length
+		byte(ProgramNumber >> 8), byte(ProgramNumber),
+		0xC1 | (version&0x1F)<<1,
+		0x00, 0x00,
+		0xE0 | byte(pcr>>8), byte(pcr),
+		0xF0 | byte(len(info)>>8), byte(len(info)),
+	}
+	section = append(section, info...)
+
+	for _, s := range streams {
+		section = append(section,
+			s.Type,
+			0xE0|byte(s.PID>>8), byte(s.PID),
+			0xF0|byte(len(s.Descriptors)>>8), byte(len(s.Descriptors)),
+		)
+		section = append(section, s.Descriptors...)
+	}
+
+	n := len(section) - 3 + 4
+	section[1] |= byte(n>>8) & 0x0F
+	section[2] = byte(n)
+	return appendCRC(section)
+}
+
+func appendCRC(section []byte) []byte {
+	crc := CRC32(section)
+	return append(section, byte(crc>>24), byte(crc>>16), byte(crc>>8), byte(crc))
+}
+
+// PES returns a PES packet with PTS, and DTS if differs, both in 90kHz.
+// The length is left 0 for video streams if it exceeds 16 bits.
+func PES(id byte, pts uint64, dts uint64, data []byte) []byte {
+	var (
+		flags  byte = 0x80
+		header      = 5
+	)
+
+	if dts != pts {
+		flags = 0xC0
+		header = 10
+	}
+
+	pes := make([]byte, 9+header, 9+header+len(data))
+	pes[0], pes[1], pes[2], pes[3] = 0x00, 0x00, 0x01, id
+
+	n := 3 + header + len(data)
+	if n > 0xFFFF {
+		n = 0
+	}
+	binary.BigEndian.PutUint16(pes[4:6], uint16(n))
+
+	pes[6] = 0x80 // marker bits
+	if id == STREAM_ID_PRIVATE_1 {
+		pes[6] |= 0x04 // data_alignment_indicator
+	}
+	pes[7] = flags
+	pes[8] = byte(header)
+
+	if flags == 0xC0 {
+		putTimestamp(pes[9:14], 0x3, pts)
+		putTimestamp(pes[14:19], 0x1, dts)
+	} else {
+		putTimestamp(pes[9:14], 0x2, pts)
+	}
+	return append(pes, data...)
+}
+
+func putTimestamp(b []byte, prefix byte, ts uint64) {
+	ts &= timestampMask
+	b[0] = prefix<<4 | byte(ts>>29)&0x0E | 0x01
+	b[1] = byte(ts >> 22)
+	b[2] = byte(ts>>14)&0xFE | 0x01
+	b[3] = byte(ts >> 7)
+	b[4] = byte(ts<<1)&0xFE | 0x01
+}
+
+// Section splits a PSI section into TS packets, which are padded with 0xFF.
+func Section(pid uint16, cc *byte, section []byte) []byte {
+	data := append([]byte{0x00}, section...) // pointer_field
+	n := (len(data) + 183) / 184
+
+	b := make([]byte, 0, n*PacketSize)
+	for i := 0; i < len(data); i += 184 {
+		pusi := byte(0)
+		if i == 0 {
+			pusi = 0x40
+		}
+		b = append(b, SyncByte, pusi|byte(pid>>8)&0x1F, byte(pid), 0x10|*cc&0x0F)
+		*cc = (*cc + 1) & 0x0F
+
+		end := i + 184
+		if end > len(data) {
+			end = len(data)
+		}
+		b = append(b, data[i:end]...)
+		for j := end - i; j < 184; j++ {
+			b = append(b, 0xFF)
+		}
+	}
+	return b
+}
+
+// Packetize splits a PES packet into TS packets. The first one carries PCR if pcr >= 0, and the random access indicator
+// if rai. The last one is stuffed with the adaptation field.
+func Packetize(pid uint16, cc *byte, pes []byte, pcr int64, rai bool) []byte {
+	n := (len(pes) + 183) / 184
+	b := make([]byte, 0, (n+1)*PacketSize)
+
+	for i := 0; i < len(pes); /* void */ {
+		var (
+			af    []byte
+			pusi  byte
+			first = i == 0
+		)
+
+		if first {
+			pusi = 0x40
+			if pcr >= 0 || rai {
+				af = []byte{0x00}
+				if rai {
+					af[0] |= 0x40
+				}
+				if pcr >= 0 {
+					af[0] |= 0x10
+					base := uint64(pcr) & timestampMask
+					af = append(af, byte(base>>25), byte(base>>17), byte(base>>9), byte(base>>1), byte(base<<7)|0x7E, 0x00)
+				}
+			}
+		}
+
+		space := 184
+		if af != nil {
+			space -= 1 + len(af)
+		}
+
+		left := len(pes) - i
+		if left < space {
+			stuffing := space - left
+			if af == nil {
+				// The length byte alone takes 1 byte, and the flags another.
+				af = make([]byte, 0, stuffing)
+				if stuffing > 1 {
+					af = append(af, 0x00)
+				}
+				stuffing -= 1 + len(af)
+			}
+			for j := 0; j < stuffing; j++ {
+				af = append(af, 0xFF)
+			}
+			space = left
+		}
+
+		control := byte(0x10)
+		if af != nil {
+			control = 0x30
+		}
+		b = append(b, SyncByte, pusi|byte(pid>>8)&0x1F, byte(pid), control|*cc&0x0F)
+		*cc = (*cc + 1) & 0x0F
+
+		if af != nil {
+			b = append(b, byte(len(af)))
+			b = append(b, af...)
+		}
+		b = append(b, pes[i:i+space]...)
+		i += space
+	}
+	return b
+}
+
+// ID3 returns an ID3v2.4 tag with a TXXX frame per scalar property of the data frame.
+func ID3(key string, v *amf.Value) []byte {
+	frames := make([]byte, 0)
+	frames = append(frames, txxx("", key)...)
+
+	if v != nil && (v.Type == amf.OBJECT || v.Type == amf.ECMA_ARRAY) {
+		if l, ok := v.Raw().(*list.List); ok {
+			for e := l.Front(); e != nil; e = e.Next() {
+				item := e.Value.(*amf.Value)
+				switch item.Type {
+				case amf.DOUBLE:
+					frames = append(frames, txxx(item.Key, fmt.Sprintf("%v", item.Double()))...)
+				case amf.BOOLEAN:
+					frames = append(frames, txxx(item.Key, fmt.Sprintf("%v", item.Bool()))...)
+				case amf.STRING, amf.LONG_STRING:
+					frames = append(frames, txxx(item.Key, item.String())...)
+				}
+			}
+		}
+	}
+
+	tag := []byte{'I', 'D', '3', 0x04, 0x00, 0x00, 0, 0, 0, 0}
+	putSyncsafe(tag[6:10], uint32(len(frames)))
+	return append(tag, frames...)
+}
+
+// txxx returns a user defined text frame in UTF-8.
+func txxx(description string, value string) []byte {
+	frame := []byte{'T', 'X', 'X', 'X', 0, 0, 0, 0, 0x00, 0x00, 0x03}
+	frame = append(frame, description...)
+	frame = append(frame, 0x00)
+	frame = append(frame, value...)
+	putSyncsafe(frame[4:8], uint32(len(frame)-10))
+	return frame
+}
+
+func putSyncsafe(b []byte, n uint32) {
+	b[0] = byte(n>>21) & 0x7F
+	b[1] = byte(n>>14) & 0x7F
+	b[2] = byte(n>>7) & 0x7F
+	b[3] = byte(n) & 0x7F
+}
@@ -0,0 +1,489 @@
+package ts
+
+import (
+	"encoding/binary"
+	"sync"
+	"sync/atomic"
+
+	"github.com/studease/common/av"
+	"github.com/studease/common/av/codec/aac"
+	"github.com/studease/common/av/codec/avc"
+	"github.com/studease/common/av/format"
+	"github.com/studease/common/av/utils/amf"
+	"github.com/studease/common/events"
+	ErrorEvent "github.com/studease/common/events/errorevent"
+	Event "github.com/studease/common/events/event"
+	MediaEvent "github.com/studease/common/events/mediaevent"
+	MediaStreamTrackEvent "github.com/studease/common/events/mediastreamtrackevent"
+	"github.com/studease/common/log"
+)
+
+func init() {
+	format.Register("TS", TS{})
+}
+
+// Static variables, should not change.
+var (
+	AUD = []byte{0x00, 0x00, 0x00, 0x01, avc.NAL_AUD, 0xF0}
+)
+
+// Static constants.
+const (
+	psiInterval uint32 = 1000 // of PAT and PMT in audio only streams, in milliseconds
+)
+
+// TS MediaStream, implements IDemuxer, IRemuxer.
+// Each emitted packet carries a whole PES in TS packets, and PAT and PMT are prepended on video keyframes,
+// or about every second if there's no video, in which case the packet is marked with "PSI".
+type TS struct {
+	format.MediaStream
+
+	Mode          uint32
+	TimedMetadata bool // whether to carry onMetaData and onTextData as timed ID3
+	logger        log.ILogger
+	mtx           sync.RWMutex
+	source        av.IMediaStream
+	readyState    uint32
+	version       byte            // of PMT, increased on track changes
+	counters      map[uint16]byte // continuity counters by PID
+	psi           uint32          // timestamp of the last PAT and PMT
+	psiWritten    bool
+	demuxer       demuxer
+
+	addtrackListener    *events.EventListener
+	removetrackListener *events.EventListener
+	packetListener      *events.EventListener
+	errorListener       *events.EventListener
+	closeListener       *events.EventListener
+}
+
+// Init this class.
+func (me *TS) Init(mode uint32, logger log.ILogger) av.IRemuxer {
+	me.MediaStream.Init(logger)
+	me.Mode = mode
+	me.logger = logger
+	me.readyState = format.RemuxInactive
+	me.version = 0
+	me.counters = make(map[uint16]byte)
+	me.psi = 0
+	me.psiWritten = false
+	me.demuxer.init()
+	me.addtrackListener = events.NewListener(me.onAddTrack, 0)
+	me.removetrackListener = events.NewListener(me.onRemoveTrack, 0)
+	me.packetListener = events.NewListener(me.onPacket, 0)
+	me.errorListener = events.NewListener(me.onError, 0)
+	me.closeListener = events.NewListener(me.onClose, 0)
+	return me
+}
+
+// Source attaches the IMediaStream as input.
+func (me *TS) Source(ms av.IMediaStream) {
+	if ms == nil {
+		me.Close()
+		return
+	}
+
+	me.mtx.Lock()
+	defer me.mtx.Unlock()
+
+	me.source = ms
+	atomic.StoreUint32(&me.readyState, format.RemuxWaiting)
+
+	for _, key := range []string{"onMetaData", "onTextData"} {
+		if pkt := ms.GetDataFrame(key); pkt != nil {
+			me.SetDataFrame(key, pkt)
+		}
+	}
+	tracks := ms.GetTracks()
+	for _, item := range tracks {
+		if item.Kind() == format.KindVideo && (me.Mode&av.ModeVideo&av.ModeKeyframe) == 0 || item.Kind() == format.KindAudio && (me.Mode&av.ModeAudio) == 0 {
+			continue
+		}
+		track := item.Clone()
+		me.AddTrack(track)
+		track.Source().AddEventListener(MediaEvent.PACKET, me.packetListener)
+	}
+
+	ms.AddEventListener(MediaStreamTrackEvent.ADDTRACK, me.addtrackListener)
+	ms.AddEventListener(MediaStreamTrackEvent.REMOVETRACK, me.removetrackListener)
+	ms.AddEventListener(MediaEvent.PACKET, me.packetListener)
+	ms.AddEventListener(ErrorEvent.ERROR, me.errorListener)
+	ms.AddEventListener(Event.CLOSE, me.closeListener)
+}
+
+func (me *TS) onAddTrack(e *MediaStreamTrackEvent.MediaStreamTrackEvent) {
+	switch e.Track.Kind() {
+	case format.KindVideo:
+		if (me.Mode & av.ModeVideo & av.ModeKeyframe) == 0 {
+			return
+		}
+	case format.KindAudio:
+		if (me.Mode & av.ModeAudio) == 0 {
+			return
+		}
+	default:
+		me.logger.Debugf(2, "Ignored unrecognized track: kind=%s.", e.Track.Kind())
+		return
+	}
+
+	source := e.Track.Source()
+	if me.Attached(source) == nil {
+		me.AddTrack(e.Track.Clone())
+		source.AddEventListener(MediaEvent.PACKET, me.packetListener)
+		me.version++
+		me.psiWritten = false
+	}
+}
+
+func (me *TS) onRemoveTrack(e *MediaStreamTrackEvent.MediaStreamTrackEvent) {
+	source := e.Track.Source()
+	track := me.Attached(source)
+	if track != nil {
+		source.RemoveEventListener(MediaEvent.PACKET, me.packetListener)
+		me.RemoveTrack(track)
+		me.version++
+		me.psiWritten = false
+	}
+}
+
+func (me *TS) onPacket(e *MediaEvent.MediaEvent) {
+	switch e.Packet.Kind {
+	case av.KindAudio:
+		me.onAudioPacket(e.Packet)
+	case av.KindVideo:
+		me.onVideoPacket(e.Packet)
+	case av.KindScript:
+		me.onDataPacket(e.Packet)
+	default:
+		me.logger.Errorf("Unrecognized packet: %s", e.Packet.Kind)
+	}
+}
+
+func (me *TS) onDataPacket(pkt *av.Packet) {
+	key, _ := pkt.Get("Key").(string)
+	me.SetDataFrame(key, pkt)
+
+	switch key {
+	case "onMetaData", "onTextData":
+	default:
+		me.logger.Debugf(2, "Ignored data frame: key=%s.", key)
+		return
+	}
+	if !me.TimedMetadata || atomic.LoadUint32(&me.readyState) != format.RemuxPumping {
+		return
+	}
+
+	value, _ := pkt.Get("Value").(*amf.Value)
+	ts := me.timestamp(pkt.Timestamp)
+	pes := PES(STREAM_ID_PRIVATE_1, me.clock(ts), me.clock(ts), ID3(key, value))
+	me.dispatch(pkt, ts, me.packetize(PID_ID3, pes, -1, false), nil)
+}
+
+func (me *TS) onAudioPacket(pkt *av.Packet) {
+	track := me.GetAudioTracks()[0]
+	source := track.Source()
+
+	switch pkt.Codec {
+	case "AAC":
+		if pkt.Get("DataType").(byte) != aac.RAW_FRAME_DATA {
+			return
+		}
+		if len(me.GetVideoTracks()) == 0 && atomic.CompareAndSwapUint32(&me.readyState, format.RemuxWaiting, format.RemuxPumping) {
+			me.Info.TimeBase = pkt.Timestamp
+		}
+		if source.GetInfoFrame() == nil || atomic.LoadUint32(&me.readyState) != format.RemuxPumping {
+			return
+		}
+	default:
+		me.logger.Errorf("Unrecognized codec: %s", pkt.Codec)
+		return
+	}
+
+	header := adts(source.GetInfoFrame(), len(pkt.Get("Data").([]byte)))
+	if header == nil {
+		me.logger.Debugf(2, "Ignored AAC frame without AudioSpecificConfig: timestamp=%d.", pkt.Timestamp)
+		return
+	}
+
+	ts := me.timestamp(pkt.Get("DTS").(uint32))
+	pes := PES(STREAM_ID_AUDIO, me.clock(ts), me.clock(ts), append(header, pkt.Get("Data").([]byte)...))
+
+	var (
+		psi []byte
+		pcr int64 = -1
+	)
+
+	if len(me.GetVideoTracks()) == 0 {
+		pcr = int64(ts) * Timescale / 1000
+		if !me.psiWritten || ts-me.psi >= psiInterval {
+			psi = me.PSI()
+			me.psi = ts
+		}
+	}
+	me.dispatch(pkt, ts, me.packetize(PID_AUDIO, pes, pcr, false), psi)
+}
+
+func (me *TS) onVideoPacket(pkt *av.Packet) {
+	track := me.GetVideoTracks()[0]
+	source := track.Source()
+
+	switch pkt.Codec {
+	case "AVC":
+		if pkt.Get("DataType").(byte) != avc.NALU {
+			return
+		}
+		keyframe, _ := pkt.Get("Keyframe").(bool)
+		if keyframe && atomic.CompareAndSwapUint32(&me.readyState, format.RemuxWaiting, format.RemuxPumping) {
+			me.Info.TimeBase = pkt.Timestamp
+		}
+		if source.GetInfoFrame() == nil || atomic.LoadUint32(&me.readyState) != format.RemuxPumping || (me.Mode&av.ModeKeyframe) == av.ModeKeyframe && !keyframe {
+			return
+		}
+	default:
+		me.logger.Errorf("Unrecognized codec: %s", pkt.Codec)
+		return
+	}
+
+	src, ok := source.(*avc.AVC)
+	if !ok {
+		return
+	}
+
+	keyframe, _ := pkt.Get("Keyframe").(bool)
+	cts, _ := pkt.Get("CTS").(uint32)
+	dts := me.timestamp(pkt.Get("DTS").(uint32))
+	pts := int64(dts) + int64(int32(cts<<8)>>8) // SI24
+
+	pes := PES(STREAM_ID_VIDEO, me.clock(uint32(pts)), me.clock(dts), annexB(src, pkt.Get("Data").([]byte), keyframe))
+
+	var (
+		psi []byte
+	)
+
+	if keyframe || !me.psiWritten {
+		psi = me.PSI()
+		me.psi = dts
+	}
+	me.dispatch(pkt, dts, me.packetize(PID_VIDEO, pes, int64(dts)*Timescale/1000, keyframe), psi)
+}
+
+func (me *TS) onError(e *ErrorEvent.ErrorEvent) {
+	me.logger.Debugf(0, "%s: %s", e.Name, e.Message)
+	me.Close()
+}
+
+func (me *TS) onClose(e *Event.Event) {
+	me.Close()
+}
+
+// timestamp returns the timestamp relative to the time base.
+func (me *TS) timestamp(n uint32) uint32 {
+	if n < me.Info.TimeBase {
+		return 0
+	}
+	return n - me.Info.TimeBase
+}
+
+// clock returns PTS or DTS in 90kHz of the timestamp, which is delayed from PCR.
+func (me *TS) clock(timestamp uint32) uint64 {
+	return uint64(timestamp+DefaultMuxDelay) * Timescale / 1000
+}
+
+// packetize splits the PES into TS packets, and keeps the continuity counter of the PID.
+func (me *TS) packetize(pid uint16, pes []byte, pcr int64, rai bool) []byte {
+	cc := me.counters[pid]
+	data := Packetize(pid, &cc, pes, pcr, rai)
+	me.counters[pid] = cc
+	return data
+}
+
+func (me *TS) dispatch(pkt *av.Packet, timestamp uint32, data []byte, psi []byte) {
+	if psi != nil {
+		data = append(psi, data...)
+	}
+
+	seg := new(av.Packet).Init()
+	seg.Kind = pkt.Kind
+	seg.Codec = pkt.Codec
+	seg.Length = uint32(len(data))
+	seg.Timestamp = timestamp
+	seg.StreamID = 0
+	seg.Position = 0
+	seg.Payload = data
+	seg.Extends(pkt)
+	if psi != nil {
+		seg.Set("PSI", true)
+	}
+	me.DispatchEvent(MediaEvent.New(MediaEvent.PACKET, me, seg))
+}
+
+// PSI returns PAT and PMT of the current tracks in TS packets.
+func (me *TS) PSI() []byte {
+	var (
+		info    []byte
+		streams = make([]Stream, 0, 3)
+		pcr     = PID_NULL
+	)
+
+	if len(me.GetVideoTracks()) > 0 {
+		streams = append(streams, Stream{Type: STREAM_TYPE_AVC, PID: PID_VIDEO})
+		pcr = PID_VIDEO
+	}
+	if len(me.GetAudioTracks()) > 0 {
+		streams = append(streams, Stream{Type: STREAM_TYPE_AAC, PID: PID_AUDIO})
+		if pcr == PID_NULL {
+			pcr = PID_AUDIO
+		}
+	}
+	if me.TimedMetadata {
+		info = metadataPointerDescriptor
+		streams = append(streams, Stream{Type: STREAM_TYPE_METADATA, PID: PID_ID3, Descriptors: metadataDescriptor})
+	}
+
+	pat := me.counters[PID_PAT]
+	pmt := me.counters[PID_PMT]
+	data := Section(PID_PAT, &pat, PAT())
+	data = append(data, Section(PID_PMT, &pmt, PMT(me.version, pcr, info, streams...))...)
+	me.counters[PID_PAT] = pat
+	me.counters[PID_PMT] = pmt
+	me.psiWritten = true
+	return data
+}
+
+// annexB converts the AVCC NAL units into Annex B, with an access unit delimiter ahead,
+// and SPS and PPS of the decoder configuration record ahead of a keyframe if not in-band.
+func annexB(src *avc.AVC, data []byte, keyframe bool) []byte {
+	var (
+		nalus     = make([][]byte, 0)
+		size      = int(src.NalLengthSize)
+		inband    bool
+		startcode = []byte{0x00, 0x00, 0x00, 0x01}
+	)
+
+	for i := 0; i+size <= len(data); /* void */ {
+		n := 0
+		for j := 0; j < size; j++ {
+			n = n<<8 | int(data[i+j])
+		}
+		i += size
+		if n <= 0 || i+n > len(data) {
+			break
+		}
+
+		nalu := data[i : i+n]
+		switch nalu[0] & 0x1F {
+		case avc.NAL_AUD:
+		case avc.NAL_SPS, avc.NAL_PPS:
+			inband = true
+			fallthrough
+		default:
+			nalus = append(nalus, nalu)
+		}
+		i += n
+	}
+
+	b := append([]byte(nil), AUD...)
+	if keyframe && !inband {
+		for _, ps := range parameterSets(src.AVCC) {
+			b = append(b, startcode...)
+			b = append(b, ps...)
+		}
+	}
+	for _, nalu := range nalus {
+		b = append(b, startcode...)
+		b = append(b, nalu...)
+	}
+	return b
+}
+
+// parameterSets returns SPS and PPS of the AVC decoder configuration record.
+func parameterSets(avcc []byte) [][]byte {
+	sets := make([][]byte, 0, 2)
+	if len(avcc) < 6 {
+		return sets
+	}
+
+	i := 5
+	for _, mask := range []byte{0x1F, 0xFF} {
+		if i >= len(avcc) {
+			break
+		}
+
+		n := int(avcc[i] & mask)
+		i++
+		for x := 0; x < n && i+2 <= len(avcc); x++ {
+			size := int(binary.BigEndian.Uint16(avcc[i : i+2]))
+			i += 2
+			if i+size > len(avcc) {
+				return sets
+			}
+			sets = append(sets, avcc[i:i+size])
+			i += size
+		}
+	}
+	return sets
+}
+
+// adts returns the ADTS header of a raw AAC frame, with the original AudioSpecificConfig in the info frame.
+func adts(infoframe *av.Packet, size int) []byte {
+	if infoframe == nil || len(infoframe.Payload) < 4 {
+		return nil
+	}
+
+	asc := infoframe.Payload[2:]
+	profile := asc[0]>>3 - 1
+	if profile > 3 { // HE-AAC is signaled implicitly
+		profile = 1
+	}
+	index := (asc[0]&0x07)<<1 | asc[1]>>7
+	channels := (asc[1] >> 3) & 0x0F
+
+	n := size + 7
+	return []byte{
+		0xFF, 0xF1, // syncword, MPEG-4, layer, protection_absent
+		profile<<6 | index<<2 | channels>>2,
+		(channels&0x03)<<6 | byte(n>>11),
+		byte(n >> 3),
+		byte(n<<5) | 0x1F,
+		0xFC,
+	}
+}
+
+// SetDataFrame stores a data frame with the given key.
+func (me *TS) SetDataFrame(key string, pkt *av.Packet) {
+	if me.source != nil {
+		base := me.Info.TimeBase
+		me.Info = *me.source.Information()
+		me.Info.TimeBase = base
+	}
+	me.MediaStream.SetDataFrame(key, pkt)
+}
+
+// Close detaches IRemuxer source, and closes IMediaStream.
+func (me *TS) Close() {
+	switch atomic.LoadUint32(&me.readyState) {
+	case format.RemuxWaiting:
+		fallthrough
+	case format.RemuxPumping:
+		me.mtx.Lock()
+		defer me.mtx.Unlock()
+
+		atomic.StoreUint32(&me.readyState, format.RemuxInactive)
+		me.DispatchEvent(Event.New(Event.CLOSE, me))
+
+		tracks := me.GetTracks()
+		for _, item := range tracks {
+			source := item.Source()
+			source.RemoveEventListener(MediaEvent.PACKET, me.packetListener)
+		}
+		if ms := me.source; ms != nil {
+			ms.RemoveEventListener(MediaStreamTrackEvent.ADDTRACK, me.addtrackListener)
+			ms.RemoveEventListener(MediaStreamTrackEvent.REMOVETRACK, me.removetrackListener)
+			ms.RemoveEventListener(MediaEvent.PACKET, me.packetListener)
+			ms.RemoveEventListener(ErrorEvent.ERROR, me.errorListener)
+			ms.RemoveEventListener(Event.CLOSE, me.closeListener)
+			me.source = nil
+		}
+		me.MediaStream.Close()
+	}
+}
@@ -0,0 +1,193 @@
+package ts
+
+import (
+	"encoding/binary"
+	"io/ioutil"
+	"testing"
+
+	"github.com/studease/common/av"
+	"github.com/studease/common/av/format"
+	_ "github.com/studease/common/av/format/flv"
+	"github.com/studease/common/events"
+	MediaEvent "github.com/studease/common/events/mediaevent"
+	MediaStreamTrackEvent "github.com/studease/common/events/mediastreamtrackevent"
+	"github.com/studease/common/log"
+)
+
+var (
+	testAVCC = []byte{
+		0x01, 0x42, 0xC0, 0x1E, 0xFF, 0xE1, 0x00, 0x08, 0x67, 0x42, 0xC0, 0x1E, 0xDA, 0x05, 0x07, 0xE4,
+		0x01, 0x00, 0x04, 0x68, 0xCE, 0x38, 0x80,
+	}
+	testASC = []byte{0x11, 0x90} // AAC LC, 48kHz, stereo
+)
+
+func testFactory() log.ILoggerFactory {
+	return new(log.DefaultLoggerFactory).Init(0x0800, ioutil.Discard)
+}
+
+func flvTag(typ byte, timestamp uint32, body []byte) []byte {
+	tag := make([]byte, 11, 11+len(body)+4)
+	tag[0] = typ
+	tag[1] = byte(len(body) >> 16)
+	tag[2] = byte(len(body) >> 8)
+	tag[3] = byte(len(body))
+	tag[4] = byte(timestamp >> 16)
+	tag[5] = byte(timestamp >> 8)
+	tag[6] = byte(timestamp)
+	tag[7] = byte(timestamp >> 24)
+	tag = append(tag, body...)
+	size := make([]byte, 4)
+	binary.BigEndian.PutUint32(size, uint32(11+len(body)))
+	return append(tag, size...)
+}
+
+type testFrame struct {
+	kind      string
+	timestamp uint32
+	cts       uint32
+	keyframe  bool
+}
+
+// testDemuxer returns a TS demuxer, and the frames sunk into its tracks so far, skipping the configs.
+func testDemuxer() (*TS, *[]testFrame) {
+	var (
+		demuxer = new(TS)
+		frames  = make([]testFrame, 0)
+	)
+
+	demuxer.Init(av.ModeAll, testFactory().NewLogger("TS"))
+
+	packetListener := events.NewListener(func(e *MediaEvent.MediaEvent) {
+		pkt := e.Packet
+		if pkt.Get("DataType").(byte) == 0 { // SEQUENCE_HEADER, or SPECIFIC_CONFIG
+			return
+		}
+		cts, _ := pkt.Get("CTS").(uint32)
+		keyframe, _ := pkt.Get("Keyframe").(bool)
+		frames = append(frames, testFrame{pkt.Kind, pkt.Timestamp, cts, keyframe})
+	}, 0)
+	demuxer.AddEventListener(MediaStreamTrackEvent.ADDTRACK, events.NewListener(func(e *MediaStreamTrackEvent.MediaStreamTrackEvent) {
+		e.Track.Source().AddEventListener(MediaEvent.PACKET, packetListener)
+	}, 0))
+	return demuxer, &frames
+}
+
+// TestRoundTrip remuxes an FLV into TS and demuxes it back, which must keep the timestamps, composition times and keyframes.
+func TestRoundTrip(t *testing.T) {
+	src := []byte{'F', 'L', 'V', 0x01, 0x05, 0, 0, 0, 0x09, 0, 0, 0, 0}
+	src = append(src, flvTag(9, 1000, append([]byte{0x17, 0, 0, 0, 0}, testAVCC...))...)
+	src = append(src, flvTag(8, 1000, append([]byte{0xAF, 0}, testASC...))...)
+
+	var expected []testFrame
+	for i := 0; i < 60; i++ {
+		var (
+			timestamp = 1000 + uint32(i*40)
+			keyframe  = i%25 == 0
+			cts       = uint32(0)
+			nalu      = make([]byte, 4+50)
+		)
+
+		binary.BigEndian.PutUint32(nalu, 50)
+		nalu[4] = 0x41
+		flag := byte(0x27)
+		if keyframe {
+			nalu[4] = 0x65
+			flag = 0x17
+		}
+		if i%2 == 1 {
+			cts = 80
+		}
+		src = append(src, flvTag(9, timestamp, append([]byte{flag, 1, 0, 0, byte(cts)}, nalu...))...)
+		src = append(src, flvTag(8, timestamp, append([]byte{0xAF, 1}, make([]byte, 20)...))...)
+		expected = append(expected, testFrame{"video", timestamp - 1000, cts, keyframe}, testFrame{"audio", timestamp - 1000, 0, true})
+	}
+
+	flv, ok := format.New("FLV", av.ModeAll, testFactory()).(av.IDemuxer)
+	if !ok {
+		t.Fatalf("Demuxer FLV not registered")
+	}
+	remuxer := new(TS)
+	remuxer.Init(av.ModeAll, testFactory().NewLogger("TS"))
+	remuxer.Source(flv)
+
+	var data []byte
+	remuxer.AddEventListener(MediaEvent.PACKET, events.NewListener(func(e *MediaEvent.MediaEvent) {
+		if len(e.Packet.Payload)%PacketSize != 0 {
+			t.Fatalf("Packet of %d bytes, not aligned to TS packets", len(e.Packet.Payload))
+		}
+		data = append(data, e.Packet.Payload...)
+	}, 0))
+	flv.Append(src)
+
+	// Appended in pieces not aligned to TS packets.
+	demuxer, frames := testDemuxer()
+	for i := 0; i < len(data); i += 1000 {
+		end := i + 1000
+		if end > len(data) {
+			end = len(data)
+		}
+		demuxer.Append(data[i:end])
+	}
+
+	// The last video PES is flushed on its length, while audio ones carry all the frames.
+	if len(*frames) != len(expected) {
+		t.Fatalf("Expected %d frames, got %d", len(expected), len(*frames))
+	}
+	for i, frame := range *frames {
+		if frame != expected[i] {
+			t.Fatalf("Frame %d: %+v, expected %+v", i, frame, expected[i])
+		}
+	}
+}
+
+// testStream returns PAT and PMT of an AAC stream, followed by the PES of ADTS frames of the 90kHz DTS.
+// The discontinuity indicator is set on the frames of the indexes in discontinuities.
+func testStream(dts []uint64, discontinuities map[int]bool) []byte {
+	var (
+		pat, pmt, cc byte
+		infoframe    = &av.Packet{Payload: append([]byte{0xAF, 0}, testASC...)}
+	)
+
+	b := Section(PID_PAT, &pat, PAT())
+	b = append(b, Section(PID_PMT, &pmt, PMT(0, PID_AUDIO, nil, Stream{Type: STREAM_TYPE_AAC, PID: PID_AUDIO}))...)
+	for i, n := range dts {
+		frame := append(adts(infoframe, 20), make([]byte, 20)...)
+		p := Packetize(PID_AUDIO, &cc, PES(STREAM_ID_AUDIO, n, n, frame), int64(n), false)
+		if discontinuities[i] {
+			p[5] |= 0x80 // discontinuity_indicator
+		}
+		b = append(b, p...)
+	}
+	return b
+}
+
+// TestUnwrap maps the 33-bit DTS onto a continuous timeline, over wraps, discontinuities and jumps.
+func TestUnwrap(t *testing.T) {
+	const frame = 1920 // 1024 samples at 48kHz, in 90kHz
+
+	for _, item := range []struct {
+		name            string
+		dts             []uint64
+		discontinuities map[int]bool
+		timestamps      []uint32
+	}{
+		{"continuous", []uint64{9000, 9000 + frame, 9000 + 2*frame}, nil, []uint32{0, 21, 42}},
+		{"wrap", []uint64{1<<33 - frame, 0, frame, 2 * frame}, nil, []uint32{0, 21, 42, 64}},
+		{"jump", []uint64{0, frame, 20 * Timescale, 20*Timescale + frame}, nil, []uint32{0, 21, 21, 42}},
+		{"jump across wrap", []uint64{1<<33 - frame, 20 * Timescale, 20*Timescale + frame}, nil, []uint32{0, 0, 21}},
+		{"discontinuity", []uint64{0, frame, 3 * frame, 4 * frame}, map[int]bool{2: true}, []uint32{0, 21, 21, 42}},
+	} {
+		demuxer, frames := testDemuxer()
+		demuxer.Append(testStream(item.dts, item.discontinuities))
+
+		if len(*frames) != len(item.timestamps) {
+			t.Fatalf("%s: expected %d frames, got %d", item.name, len(item.timestamps), len(*frames))
+		}
+		for i, frame := range *frames {
+			if frame.kind != "audio" || frame.timestamp != item.timestamps[i] {
+				t.Fatalf("%s: frame %d: %+v, expected at %d", item.name, i, frame, item.timestamps[i])
+			}
+		}
+	}
+}
@@ -0,0 +1,26 @@
+package mediarecorder
+
+import (
+	"github.com/studease/common/av"
+	"github.com/studease/common/av/format/cmaf"
+	"github.com/studease/common/log"
+)
+
+func init() {
+	Register("CMAF", CMAF{})
+}
+
+// CMAF implementions IMediaRecorder, which writes a CMAF header per track, and CMAF segments cut on keyframes.
+type CMAF struct {
+	fragmented
+}
+
+// Init this class.
+func (me *CMAF) Init(constraints *av.MediaRecorderConstraints, logger log.ILogger) av.IMediaRecorder {
+	remuxer := new(cmaf.CMAF).Init(constraints.Mode, logger)
+	me.fragmented.init(me, remuxer, map[string][2]string{
+		av.KindVideo: {".cmfv", ".cmfv"},
+		av.KindAudio: {".cmfa", ".cmfa"},
+	}, constraints, logger)
+	return me
+}
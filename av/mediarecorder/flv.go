@@ -9,6 +9,7 @@ import (
 
 	"github.com/studease/common/av"
 	"github.com/studease/common/av/format/flv"
+	"github.com/studease/common/av/utils/amf"
 	"github.com/studease/common/events"
 	ErrorEvent "github.com/studease/common/events/errorevent"
 	Event "github.com/studease/common/events/event"
@@ -21,7 +22,14 @@ func init() {
 	Register("FLV", FLV{})
 }
 
+var (
+	errChunksReached = fmt.Errorf("chunks reached")
+)
+
 // FLV implementions IMediaRecorder.
+// If any of MaxDuration, MaxSize and MaxFrames is set, the file is rotated on a keyframe, and named with time suffix.
+// Segments limits the files kept on disk, while Chunks limits the files recorded in total.
+// If Seekable, onMetaData is reserved at the head of each file, and filled with the keyframes once the file is finished.
 type FLV struct {
 	flv.FLV
 
@@ -30,6 +38,19 @@ type FLV struct {
 	mtx         sync.RWMutex
 	source      av.IMediaStream
 	file        *os.File
+	uri         string // of the current file
+	count       int    // of the files created
+	unix        int64  // time suffix of the current file
+	files       []string
+	began       bool // whether the current file has got any media tag
+	start       uint32
+	last        uint32
+	size        int64
+	frames      int64
+	metadata    []byte            // onMetaData tag
+	headers     map[string][]byte // sequence header tags by kind
+	index       *flvIndex         // of the current file if seekable
+	appended    bool              // to an existing file, which is scanned once finished
 	readyState  uint32
 
 	packetListener *events.EventListener
@@ -42,6 +63,9 @@ func (me *FLV) Init(constraints *av.MediaRecorderConstraints, logger log.ILogger
 	me.FLV.Init(constraints.Mode, logger)
 	me.constraints = constraints
 	me.logger = logger
+	me.count = 0
+	me.files = make([]string, 0)
+	me.headers = make(map[string][]byte)
 	me.readyState = StateInactive
 	me.packetListener = events.NewListener(me.onPacket, 0)
 	me.errorListener = events.NewListener(me.onError, 0)
@@ -61,19 +85,45 @@ func (me *FLV) Source(ms av.IMediaStream) {
 
 	err := os.MkdirAll(me.constraints.Directory, os.ModePerm)
 	if err != nil {
-		panic(fmt.Sprintf("%v", err))
+		me.DispatchEvent(ErrorEvent.New(ErrorEvent.ERROR, me, "NotAllowedError", err))
+		return
+	}
+
+	me.source = ms
+
+	err = me.open(me.constraints.Append)
+	if err != nil {
+		me.DispatchEvent(ErrorEvent.New(ErrorEvent.ERROR, me, "NotAllowedError", err))
+		return
 	}
 
+	me.AddEventListener(MediaEvent.PACKET, me.packetListener)
+	me.AddEventListener(ErrorEvent.ERROR, me.errorListener)
+	me.AddEventListener(Event.CLOSE, me.closeListener)
+}
+
+// limited returns whether the file should be rotated.
+func (me *FLV) limited() bool {
+	return me.constraints.MaxDuration > 0 || me.constraints.MaxSize > 0 || me.constraints.MaxFrames > 0
+}
+
+// open creates the next file, which is prefixed with the FLV header, onMetaData and sequence headers.
+func (me *FLV) open(append bool) error {
 	filename := me.constraints.FileName
-	if me.constraints.Unique {
-		now := time.Now()
-		filename += fmt.Sprintf("-%d.flv", now.Unix())
-	} else {
-		filename += ".flv"
+	if me.constraints.Unique || me.limited() {
+		now := time.Now().Unix()
+		filename += fmt.Sprintf("-%d", now)
+
+		// Files rotated within a second are numbered.
+		if now == me.unix {
+			filename += fmt.Sprintf("-%d", me.count)
+		}
+		me.unix = now
 	}
+	filename += ".flv"
 
-	perm := os.O_RDWR | os.O_CREATE
-	if me.constraints.Append {
+	perm := os.O_WRONLY | os.O_CREATE
+	if append {
 		perm |= os.O_APPEND
 	} else {
 		perm |= os.O_TRUNC
@@ -81,31 +131,262 @@ func (me *FLV) Source(ms av.IMediaStream) {
 
 	f, err := os.OpenFile(me.constraints.Directory+"/"+filename, perm, 0666)
 	if err != nil {
-		panic(fmt.Sprintf("%v", err))
+		return err
 	}
+
 	me.file = f
+	me.uri = filename
+	me.count++
+	me.began = false
+	me.start = 0
+	me.last = 0
+	me.size = 0
+	me.frames = 0
+	me.index = nil
+	me.appended = false
+
+	if append {
+		fi, err := f.Stat()
+		if err == nil && fi.Size() > 0 {
+			me.size = fi.Size()
+			me.appended = true
+			return nil
+		}
+	}
 
-	if !me.constraints.Append {
-		me.file.Write(flv.Header(me.Mode))
+	header := flv.Header(me.Mode)
+	_, err = me.file.Write(header)
+	if err != nil {
+		return err
 	}
+	me.size += int64(len(header))
 
-	me.source = ms
-	me.AddEventListener(MediaEvent.PACKET, me.packetListener)
-	me.AddEventListener(ErrorEvent.ERROR, me.errorListener)
-	me.AddEventListener(Event.CLOSE, me.closeListener)
+	metadata := me.metadata
+	if me.constraints.Seekable {
+		err = me.reserve()
+		if err != nil {
+			return err
+		}
+		metadata = nil
+	}
+
+	for _, tag := range [][]byte{metadata, me.headers[av.KindVideo], me.headers[av.KindAudio]} {
+		if tag == nil {
+			continue
+		}
+		_, err = me.file.Write(retime(tag, 0))
+		if err != nil {
+			return err
+		}
+		me.size += int64(len(tag))
+	}
+	return nil
+}
+
+// reserve writes an onMetaData tag large enough for the keyframes of the current file.
+func (me *FLV) reserve() error {
+	entries := DefaultKeyframesReserved
+	if n := me.constraints.MaxDuration; n > 0 {
+		entries = int(n) * 2 // keyframes could be 0.5s apart
+	}
+
+	me.index = new(flvIndex).init(me.properties())
+	me.index.offset = me.size
+	me.index.size = me.index.reserve(entries)
+
+	tag := me.index.tag(0, 0, me.index.size)
+	_, err := me.file.Write(tag)
+	me.size += int64(len(tag))
+	return err
+}
+
+// properties returns the latest onMetaData properties, or nil if not present.
+func (me *FLV) properties() *amf.Value {
+	if me.metadata != nil {
+		return decodeMetaData(me.metadata[11 : len(me.metadata)-4])
+	}
+	if me.source != nil {
+		if pkt := me.source.GetDataFrame("onMetaData"); pkt != nil {
+			if v, ok := pkt.Get("Value").(*amf.Value); ok {
+				return v
+			}
+		}
+	}
+	return nil
+}
+
+// finish closes the current file, and deletes the ones out of the sliding window.
+func (me *FLV) finish() *MediaRecorderEvent.MediaRecorderEvent {
+	if me.file == nil {
+		return nil
+	}
+
+	err := me.file.Close()
+	if err != nil {
+		me.logger.Debugf(3, "MediaRecorder failed to close %s: %v", me.uri, err)
+	}
+	me.file = nil
+
+	if me.constraints.Seekable {
+		path := me.constraints.Directory + "/" + me.uri
+		switch {
+		case me.index != nil:
+			me.index.properties = me.properties()
+			err = injectMetaData(path, me.index)
+		case me.appended:
+			err = InjectMetaData(path)
+		}
+		if err != nil {
+			me.logger.Debugf(3, "MediaRecorder failed to inject onMetaData into %s: %v", me.uri, err)
+		}
+		me.index = nil
+	}
+
+	if n := me.constraints.Segments; n > 0 {
+		me.files = append(me.files, me.uri)
+		for len(me.files) > n {
+			err = os.Remove(me.constraints.Directory + "/" + me.files[0])
+			if err != nil {
+				me.logger.Debugf(3, "MediaRecorder failed to remove %s: %v", me.files[0], err)
+			}
+			me.files = me.files[1:]
+		}
+	}
+
+	return MediaRecorderEvent.NewData(MediaRecorderEvent.DATAAVAILABLE, me, me.uri, me.last-me.start, me.size)
 }
 
 func (me *FLV) onPacket(e *MediaEvent.MediaEvent) {
-	if atomic.LoadUint32(&me.readyState) == StateRecording {
-		_, err := me.file.Write(e.Packet.Payload)
+	if atomic.LoadUint32(&me.readyState) != StateRecording {
+		return
+	}
+
+	me.mtx.Lock()
+	finished, err := me.write(e.Packet)
+	me.mtx.Unlock()
+
+	if finished != nil {
+		me.DispatchEvent(finished)
+	}
+	switch err {
+	case nil:
+	case errChunksReached:
+		me.logger.Debugf(3, "MediaRecorder reached %d chunks.", me.constraints.Chunks)
+		me.Stop()
+	default:
+		me.logger.Debugf(3, "MediaRecorder failed to write: %v", err)
+		me.DispatchEvent(ErrorEvent.New(ErrorEvent.ERROR, me, "UnknownError", err))
+		me.Stop()
+	}
+}
+
+// write writes the tag, and returns the event of the finished file if rotated.
+func (me *FLV) write(tag *av.Packet) (*MediaRecorderEvent.MediaRecorderEvent, error) {
+	var (
+		finished *MediaRecorderEvent.MediaRecorderEvent
+		data     = tag.Payload
+		media    bool
+		keyframe bool
+	)
+
+	if me.file == nil || len(data) < 13 {
+		return nil, nil
+	}
+
+	// The tag body starts at 11.
+	switch tag.Kind {
+	case av.KindScript:
+		me.metadata = append([]byte(nil), data...)
+		if me.index != nil {
+			return nil, nil // written once finished
+		}
+	case av.KindVideo:
+		if data[11]&0x0F == flv.AVC && data[12] == 0 { // AVC sequence header
+			me.headers[av.KindVideo] = append([]byte(nil), data...)
+		} else {
+			media = true
+			keyframe = data[11]>>4 == flv.KEYFRAME
+		}
+	case av.KindAudio:
+		if data[11]&0xF0 == flv.AAC && data[12] == 0 { // AAC sequence header
+			me.headers[av.KindAudio] = append([]byte(nil), data...)
+		} else {
+			media = true
+			keyframe = len(me.GetVideoTracks()) == 0
+		}
+	}
+
+	if media && me.began && keyframe && me.full(tag.Timestamp) {
+		finished = me.finish()
+		if n := me.constraints.Chunks; n > 0 && me.count >= n {
+			return finished, errChunksReached
+		}
+
+		err := me.open(false)
 		if err != nil {
-			me.logger.Debugf(3, "MediaRecorder failed to write: %v", err)
-			me.Stop()
+			return finished, err
 		}
 	}
+
+	if media {
+		if !me.began {
+			me.start = tag.Timestamp
+			me.began = true
+		}
+		me.last = tag.Timestamp
+		if tag.Kind == av.KindVideo || len(me.GetVideoTracks()) == 0 {
+			me.frames++
+		}
+	}
+
+	// Timestamps of the rotated files start from 0.
+	ts := tag.Timestamp
+	if me.start > 0 {
+		ts = 0
+		if tag.Timestamp > me.start {
+			ts = tag.Timestamp - me.start
+		}
+		data = retime(data, ts)
+	}
+
+	if media && me.index != nil {
+		switch {
+		case tag.Kind == av.KindVideo && keyframe:
+			me.index.add(ts, me.size, 0)
+		case tag.Kind == av.KindAudio && keyframe:
+			me.index.add(ts, me.size, flvAudioInterval)
+		}
+		if ts > me.index.lasttimestamp {
+			me.index.lasttimestamp = ts
+		}
+	}
+
+	n, err := me.file.Write(data)
+	me.size += int64(n)
+	return finished, err
+}
+
+// full returns whether any limit of the current file has been reached.
+func (me *FLV) full(timestamp uint32) bool {
+	return me.constraints.MaxDuration > 0 && timestamp-me.start >= me.constraints.MaxDuration*1000 ||
+		me.constraints.MaxSize > 0 && me.size >= me.constraints.MaxSize ||
+		me.constraints.MaxFrames > 0 && me.frames >= me.constraints.MaxFrames
+}
+
+// retime returns a copy of the tag with the timestamp.
+func retime(data []byte, timestamp uint32) []byte {
+	tag := append([]byte(nil), data...)
+	tag[4] = byte(timestamp >> 16)
+	tag[5] = byte(timestamp >> 8)
+	tag[6] = byte(timestamp)
+	tag[7] = byte(timestamp >> 24)
+	return tag
 }
 
 func (me *FLV) onError(e *ErrorEvent.ErrorEvent) {
+	if e.Target == me {
+		return
+	}
 	me.logger.Debugf(0, "%s: %s", e.Name, e.Message)
 	me.Stop()
 }
@@ -116,19 +397,25 @@ func (me *FLV) onClose(e *Event.Event) {
 
 // Start begins recording the source media stream.
 func (me *FLV) Start() {
+	if me.file == nil {
+		me.DispatchEvent(ErrorEvent.New(ErrorEvent.ERROR, me, "InvalidStateError", fmt.Errorf("The MediaRecorder has no file to write")))
+		return
+	}
 	if !atomic.CompareAndSwapUint32(&me.readyState, StateInactive, StateRecording) {
 		me.DispatchEvent(ErrorEvent.New(ErrorEvent.ERROR, me, "InvalidStateError", fmt.Errorf("The MediaRecorder is not in the inactive state")))
 		return
 	}
 
-	me.mtx.Lock()
-	defer me.mtx.Unlock()
-
 	// Note: If the observer decides to reject this event, just panic in its handler
 	// rather than calling any other interfaces, which will cause a deadlock. Then
 	// catch the exception outside and deal with that.
+	me.mtx.Lock()
 	me.DispatchEvent(MediaRecorderEvent.New(MediaRecorderEvent.START, me))
-	me.FLV.Source(me.source)
+	source := me.source
+	me.mtx.Unlock()
+
+	// Attaches out of the lock, as the cached headers are dispatched to onPacket at once.
+	me.FLV.Source(source)
 }
 
 // Pause is used to pause recording the source media stream.
@@ -177,14 +464,16 @@ func (me *FLV) Stop() {
 		me.mtx.Lock()
 		defer me.mtx.Unlock()
 
-		atomic.StoreUint32(&me.readyState, StateInactive)
+		if atomic.SwapUint32(&me.readyState, StateInactive) == StateInactive {
+			return
+		}
 
-		me.Close()
 		me.RemoveEventListener(MediaEvent.PACKET, me.packetListener)
 		me.RemoveEventListener(ErrorEvent.ERROR, me.errorListener)
 		me.RemoveEventListener(Event.CLOSE, me.closeListener)
-		if me.file != nil {
-			me.file.Close()
+		me.Close()
+		if finished := me.finish(); finished != nil {
+			me.DispatchEvent(finished)
 		}
 		me.DispatchEvent(MediaRecorderEvent.New(MediaRecorderEvent.STOP, me))
 	}
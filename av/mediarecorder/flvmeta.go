@@ -0,0 +1,316 @@
+package mediarecorder
+
+import (
+	"bufio"
+	"bytes"
+	"container/list"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/studease/common/av/format/flv"
+	"github.com/studease/common/av/utils/amf"
+)
+
+// Static constants.
+const (
+	DefaultKeyframesReserved = 3600 // keyframe entries reserved in onMetaData, if MaxDuration is not set
+
+	flvKeyframeEntrySize = 18   // a double in each of times and filepositions
+	flvMetaDataSlack     = 1024 // bytes reserved for the properties updated later
+	flvAudioInterval     = 1000 // between the seek points of an audio-only file, in milliseconds
+)
+
+// flvIndex collects the seek points of an FLV file, which are written into onMetaData as keyframes.
+type flvIndex struct {
+	properties    *amf.Value // live onMetaData, may be nil
+	times         []float64  // in seconds
+	positions     []float64  // of the tags in the file
+	lasttimestamp uint32     // in milliseconds
+	offset        int64      // of the onMetaData tag, 0 if not present
+	size          int64      // of the onMetaData tag and its back pointer
+}
+
+func (me *flvIndex) init(properties *amf.Value) *flvIndex {
+	me.properties = properties
+	me.times = make([]float64, 0)
+	me.positions = make([]float64, 0)
+	me.lasttimestamp = 0
+	me.offset = 0
+	me.size = 0
+	return me
+}
+
+// add appends a seek point, unless it's within interval since the last one.
+func (me *flvIndex) add(timestamp uint32, position int64, interval uint32) {
+	if n := len(me.times); n > 0 && float64(timestamp) < me.times[n-1]*1000+float64(interval) {
+		return
+	}
+	me.times = append(me.times, float64(timestamp)/1000)
+	me.positions = append(me.positions, float64(position))
+}
+
+// reserve returns the tag size which holds the properties and the keyframe entries.
+func (me *flvIndex) reserve(entries int) int64 {
+	return int64(len(me.tag(0, 0, 0))) + flvMetaDataSlack + int64(entries)*flvKeyframeEntrySize
+}
+
+// tag encodes the onMetaData tag, of which the file positions are shifted by delta.
+// If size is given, the tag is padded to that size, or nil is returned if it doesn't fit.
+func (me *flvIndex) tag(filesize int64, delta int64, size int64) []byte {
+	v := amf.NewValue(amf.ECMA_ARRAY).Set("", list.New())
+	if me.properties != nil && (me.properties.Type == amf.OBJECT || me.properties.Type == amf.ECMA_ARRAY) {
+		if l, ok := me.properties.Raw().(*list.List); ok {
+			for e := l.Front(); e != nil; e = e.Next() {
+				item := e.Value.(*amf.Value)
+				switch item.Key {
+				case "duration", "filesize", "lasttimestamp", "keyframes", "padding":
+				default:
+					v.Add(item)
+				}
+			}
+		}
+	}
+
+	times := amf.NewValue(amf.STRICT_ARRAY).Set("times", list.New())
+	positions := amf.NewValue(amf.STRICT_ARRAY).Set("filepositions", list.New())
+	for i, t := range me.times {
+		times.Add(amf.NewValue(amf.DOUBLE).Set("", t))
+		positions.Add(amf.NewValue(amf.DOUBLE).Set("", me.positions[i]+float64(delta)))
+	}
+
+	keyframes := amf.NewValue(amf.OBJECT).Set("keyframes", list.New())
+	keyframes.Add(times)
+	keyframes.Add(positions)
+
+	v.Add(amf.NewValue(amf.DOUBLE).Set("duration", float64(me.lasttimestamp)/1000))
+	v.Add(amf.NewValue(amf.DOUBLE).Set("filesize", float64(filesize)))
+	v.Add(amf.NewValue(amf.DOUBLE).Set("lasttimestamp", float64(me.lasttimestamp)/1000))
+	v.Add(keyframes)
+
+	if size > 0 {
+		n := int64(len(encodeMetaData(v)))
+		if n != size {
+			// Key of the padding, and the header of a string or a long string.
+			left := size - n - 9 - 3
+			if left >= 0xFFFF {
+				left -= 2
+				if left < 0xFFFF {
+					return nil
+				}
+			}
+			if left < 0 {
+				return nil
+			}
+			v.Add(amf.NewValue(amf.STRING).Set("padding", strings.Repeat(" ", int(left))))
+		}
+	}
+	return encodeMetaData(v)
+}
+
+// encodeMetaData returns a script tag of onMetaData with the back pointer.
+func encodeMetaData(v *amf.Value) []byte {
+	var (
+		b bytes.Buffer
+	)
+
+	b.Write(make([]byte, 11))
+	amf.EncodeString(&b, "onMetaData")
+	amf.Encode(&b, v)
+	b.Write(make([]byte, 4))
+
+	tag := b.Bytes()
+	n := len(tag) - 15
+	tag[0] = flv.KindScript
+	tag[1] = byte(n >> 16)
+	tag[2] = byte(n >> 8)
+	tag[3] = byte(n)
+	binary.BigEndian.PutUint32(tag[len(tag)-4:], uint32(n+11))
+	return tag
+}
+
+// decodeMetaData returns the properties of an onMetaData body, or nil if it's not.
+func decodeMetaData(data []byte) *amf.Value {
+	var (
+		key   amf.Value
+		value amf.Value
+	)
+
+	i, err := amf.Decode(&key, data)
+	if err != nil || key.Type != amf.STRING || key.String() != "onMetaData" {
+		return nil
+	}
+	_, err = amf.Decode(&value, data[i:])
+	if err != nil || value.Type != amf.OBJECT && value.Type != amf.ECMA_ARRAY {
+		return nil
+	}
+	return &value
+}
+
+// scanFLV walks through the tags of the FLV file at path, and collects the seek points.
+// Video keyframes are taken if present, otherwise audio frames about every second. A truncated tag ends the scan.
+func scanFLV(path string) (*flvIndex, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	r := bufio.NewReaderSize(f, 64*1024)
+	header := make([]byte, 13)
+	_, err = io.ReadFull(r, header)
+	if err != nil {
+		return nil, err
+	}
+	if string(header[0:3]) != "FLV" || binary.BigEndian.Uint32(header[5:9]) != 9 {
+		return nil, fmt.Errorf("not an FLV file")
+	}
+
+	var (
+		index    = new(flvIndex).init(nil)
+		audio    = new(flvIndex).init(nil)
+		position = int64(13)
+		b        = make([]byte, 11)
+	)
+
+	for {
+		_, err = io.ReadFull(r, b)
+		if err != nil {
+			break
+		}
+
+		size := int64(b[1])<<16 | int64(b[2])<<8 | int64(b[3])
+		timestamp := uint32(b[7])<<24 | uint32(b[4])<<16 | uint32(b[5])<<8 | uint32(b[6])
+		body := make([]byte, 2)
+		if b[0] == flv.KindScript && index.size == 0 {
+			body = make([]byte, size)
+		}
+		if size < int64(len(body)) {
+			body = body[:size]
+		}
+		_, err = io.ReadFull(r, body)
+		if err != nil {
+			break
+		}
+		_, err = r.Discard(int(size-int64(len(body))) + 4)
+		if err != nil {
+			break
+		}
+
+		switch b[0] {
+		case flv.KindScript:
+			if index.size == 0 {
+				if properties := decodeMetaData(body); properties != nil {
+					index.properties = properties
+					index.offset = position
+					index.size = 11 + size + 4
+				}
+			}
+		case flv.KindVideo:
+			if len(body) < 2 || body[0]&0x0F == flv.AVC && body[1] == 0 {
+				break
+			}
+			if body[0]>>4 == flv.KEYFRAME {
+				index.add(timestamp, position, 0)
+			}
+			if timestamp > index.lasttimestamp {
+				index.lasttimestamp = timestamp
+			}
+		case flv.KindAudio:
+			if len(body) < 2 || body[0]&0xF0 == flv.AAC && body[1] == 0 {
+				break
+			}
+			audio.add(timestamp, position, flvAudioInterval)
+			if timestamp > index.lasttimestamp {
+				index.lasttimestamp = timestamp
+			}
+		}
+
+		position += 11 + size + 4
+	}
+
+	if len(index.times) == 0 {
+		index.times = audio.times
+		index.positions = audio.positions
+	}
+	return index, nil
+}
+
+// injectMetaData writes onMetaData of the index into the FLV file at path, in place if the existing tag is large enough,
+// otherwise the file is rewritten with the tag replaced.
+func injectMetaData(path string, index *flvIndex) error {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+
+	if index.size > 0 {
+		if tag := index.tag(fi.Size(), 0, index.size); tag != nil {
+			f, err := os.OpenFile(path, os.O_WRONLY, 0666)
+			if err != nil {
+				return err
+			}
+			_, err = f.WriteAt(tag, index.offset)
+			if err != nil {
+				f.Close()
+				return err
+			}
+			return f.Close()
+		}
+	}
+
+	offset := index.offset
+	if index.size == 0 {
+		offset = 13
+	}
+
+	// The size of the tag doesn't depend on the values.
+	delta := int64(len(index.tag(0, 0, 0))) - index.size
+	tag := index.tag(fi.Size()+delta, delta, 0)
+
+	src, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	dst, err := os.OpenFile(path+".tmp", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0666)
+	if err != nil {
+		return err
+	}
+
+	w := bufio.NewWriterSize(dst, 64*1024)
+	_, err = io.CopyN(w, src, offset)
+	if err == nil {
+		_, err = w.Write(tag)
+	}
+	if err == nil {
+		_, err = src.Seek(offset+index.size, io.SeekStart)
+	}
+	if err == nil {
+		_, err = io.Copy(w, src)
+	}
+	if err == nil {
+		err = w.Flush()
+	}
+	if e := dst.Close(); err == nil {
+		err = e
+	}
+	if err != nil {
+		os.Remove(path + ".tmp")
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// InjectMetaData rebuilds onMetaData of the FLV file at path with duration, filesize, lasttimestamp and keyframes,
+// so that players could seek in it. Properties of the existing onMetaData are kept.
+func InjectMetaData(path string) error {
+	index, err := scanFLV(path)
+	if err != nil {
+		return err
+	}
+	return injectMetaData(path, index)
+}
@@ -0,0 +1,26 @@
+package mediarecorder
+
+import (
+	"github.com/studease/common/av"
+	"github.com/studease/common/av/format/fmp4"
+	"github.com/studease/common/log"
+)
+
+func init() {
+	Register("FMP4", FMP4{})
+}
+
+// FMP4 implementions IMediaRecorder, which writes an init segment per track, and media segments cut on keyframes.
+type FMP4 struct {
+	fragmented
+}
+
+// Init this class.
+func (me *FMP4) Init(constraints *av.MediaRecorderConstraints, logger log.ILogger) av.IMediaRecorder {
+	remuxer := new(fmp4.FMP4).Init(constraints.Mode&^av.ModeInterleaved, logger)
+	me.fragmented.init(me, remuxer, map[string][2]string{
+		av.KindVideo: {".mp4", ".m4s"},
+		av.KindAudio: {".mp4", ".m4s"},
+	}, constraints, logger)
+	return me
+}
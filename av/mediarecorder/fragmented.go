@@ -0,0 +1,223 @@
+package mediarecorder
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/studease/common/av"
+	"github.com/studease/common/av/format/cmaf"
+	"github.com/studease/common/events"
+	ErrorEvent "github.com/studease/common/events/errorevent"
+	Event "github.com/studease/common/events/event"
+	MediaEvent "github.com/studease/common/events/mediaevent"
+	MediaRecorderEvent "github.com/studease/common/events/mediarecorderevent"
+	"github.com/studease/common/log"
+)
+
+// fragmented implementions IMediaRecorder with a fragmented MP4 remuxer, which writes an init segment per track,
+// and media segments cut on keyframes. The file extensions of init and media segments are given by kind.
+type fragmented struct {
+	av.IRemuxer
+
+	target      av.IMediaRecorder // of the events
+	exts        map[string][2]string
+	constraints *av.MediaRecorderConstraints
+	logger      log.ILogger
+	mtx         sync.RWMutex
+	source      av.IMediaStream
+	segmenter   *segmenter
+	readyState  uint32
+
+	packetListener *events.EventListener
+	errorListener  *events.EventListener
+	closeListener  *events.EventListener
+}
+
+func (me *fragmented) init(target av.IMediaRecorder, remuxer av.IRemuxer, exts map[string][2]string, constraints *av.MediaRecorderConstraints, logger log.ILogger) *fragmented {
+	me.IRemuxer = remuxer
+	me.target = target
+	me.exts = exts
+	me.constraints = constraints
+	me.logger = logger
+	me.readyState = StateInactive
+	me.packetListener = events.NewListener(me.onPacket, 0)
+	me.errorListener = events.NewListener(me.onError, 0)
+	me.closeListener = events.NewListener(me.onClose, 0)
+	return me
+}
+
+// Source attaches the IMediaStream as input.
+func (me *fragmented) Source(ms av.IMediaStream) {
+	if ms == nil {
+		me.Stop()
+		return
+	}
+
+	me.mtx.Lock()
+	defer me.mtx.Unlock()
+
+	err := os.MkdirAll(me.constraints.Directory, os.ModePerm)
+	if err != nil {
+		me.DispatchEvent(ErrorEvent.New(ErrorEvent.ERROR, me.target, "NotAllowedError", err))
+		return
+	}
+
+	prefix := me.constraints.FileName
+	if me.constraints.Unique {
+		now := time.Now()
+		prefix += fmt.Sprintf("-%d", now.Unix())
+	}
+	me.segmenter = new(segmenter).init(me.constraints, prefix, me.exts, me.logger)
+
+	me.source = ms
+	me.AddEventListener(MediaEvent.PACKET, me.packetListener)
+	me.AddEventListener(ErrorEvent.ERROR, me.errorListener)
+	me.AddEventListener(Event.CLOSE, me.closeListener)
+}
+
+func (me *fragmented) onPacket(e *MediaEvent.MediaEvent) {
+	if atomic.LoadUint32(&me.readyState) != StateRecording {
+		return
+	}
+
+	me.mtx.Lock()
+	seg, err := me.segmenter.handle(e.Packet, me.trackSource(e.Packet.Kind))
+	me.mtx.Unlock()
+
+	if seg != nil {
+		me.dispatchSegment(seg)
+	}
+	if err != nil {
+		me.logger.Debugf(3, "MediaRecorder failed to write: %v", err)
+		me.DispatchEvent(ErrorEvent.New(ErrorEvent.ERROR, me.target, "UnknownError", err))
+		me.Stop()
+	}
+}
+
+func (me *fragmented) trackSource(kind string) av.IMediaStreamTrackSource {
+	var (
+		tracks []av.IMediaStreamTrack
+	)
+
+	switch kind {
+	case av.KindVideo:
+		tracks = me.GetVideoTracks()
+	case av.KindAudio:
+		tracks = me.GetAudioTracks()
+	}
+	if len(tracks) == 0 {
+		return nil
+	}
+	return tracks[0].Source()
+}
+
+func (me *fragmented) dispatchSegment(seg *cmaf.MediaSegment) {
+	me.DispatchEvent(MediaRecorderEvent.NewData(MediaRecorderEvent.DATAAVAILABLE, me.target, seg.URI, seg.Duration, int64(seg.Size)))
+}
+
+func (me *fragmented) onError(e *ErrorEvent.ErrorEvent) {
+	if e.Target == me.target {
+		return
+	}
+	me.logger.Debugf(0, "%s: %s", e.Name, e.Message)
+	me.Stop()
+}
+
+func (me *fragmented) onClose(e *Event.Event) {
+	me.Stop()
+}
+
+// Start begins recording the source media stream.
+func (me *fragmented) Start() {
+	if me.segmenter == nil {
+		me.DispatchEvent(ErrorEvent.New(ErrorEvent.ERROR, me.target, "InvalidStateError", fmt.Errorf("The MediaRecorder has no directory to write")))
+		return
+	}
+	if !atomic.CompareAndSwapUint32(&me.readyState, StateInactive, StateRecording) {
+		me.DispatchEvent(ErrorEvent.New(ErrorEvent.ERROR, me.target, "InvalidStateError", fmt.Errorf("The MediaRecorder is not in the inactive state")))
+		return
+	}
+
+	// Note: If the observer decides to reject this event, just panic in its handler
+	// rather than calling any other interfaces, which will cause a deadlock. Then
+	// catch the exception outside and deal with that.
+	me.mtx.Lock()
+	me.DispatchEvent(MediaRecorderEvent.New(MediaRecorderEvent.START, me.target))
+	source := me.source
+	me.mtx.Unlock()
+
+	// Attaches out of the lock, as the init segments of configured tracks are dispatched to onPacket at once.
+	me.IRemuxer.Source(source)
+}
+
+// Pause is used to pause recording the source media stream, which finishes the current segments.
+func (me *fragmented) Pause() {
+	switch atomic.LoadUint32(&me.readyState) {
+	case StateInactive:
+		me.DispatchEvent(ErrorEvent.New(ErrorEvent.ERROR, me.target, "InvalidStateError", fmt.Errorf("The MediaRecorder can't be paused while it's not active")))
+		return
+	case StateRecording:
+		me.mtx.Lock()
+		defer me.mtx.Unlock()
+
+		atomic.StoreUint32(&me.readyState, StatePaused)
+		for _, seg := range me.segmenter.close() {
+			me.dispatchSegment(seg)
+		}
+		me.DispatchEvent(MediaRecorderEvent.New(MediaRecorderEvent.PAUSE, me.target))
+	case StatePaused:
+		me.logger.Debugf(3, "MediaRecorder is already paused.")
+	}
+}
+
+// Resume is used to resume recording after when it has been previously paused.
+func (me *fragmented) Resume() {
+	switch atomic.LoadUint32(&me.readyState) {
+	case StateInactive:
+		me.DispatchEvent(ErrorEvent.New(ErrorEvent.ERROR, me.target, "InvalidStateError", fmt.Errorf("The MediaRecorder can't be resumed while it's not paused")))
+		return
+	case StateRecording:
+		me.logger.Debugf(3, "MediaRecorder is already recording.")
+	case StatePaused:
+		me.mtx.Lock()
+		defer me.mtx.Unlock()
+
+		atomic.StoreUint32(&me.readyState, StateRecording)
+		me.DispatchEvent(MediaRecorderEvent.New(MediaRecorderEvent.RESUME, me.target))
+	}
+}
+
+// Stop is used to stop recording the source media stream.
+func (me *fragmented) Stop() {
+	switch atomic.LoadUint32(&me.readyState) {
+	case StateInactive:
+		me.DispatchEvent(ErrorEvent.New(ErrorEvent.ERROR, me.target, "InvalidStateError", fmt.Errorf("The MediaRecorder can't be stopped while it's not active")))
+		return
+	case StateRecording:
+		fallthrough
+	case StatePaused:
+		me.mtx.Lock()
+		defer me.mtx.Unlock()
+
+		if atomic.SwapUint32(&me.readyState, StateInactive) == StateInactive {
+			return
+		}
+
+		me.RemoveEventListener(MediaEvent.PACKET, me.packetListener)
+		me.RemoveEventListener(ErrorEvent.ERROR, me.errorListener)
+		me.RemoveEventListener(Event.CLOSE, me.closeListener)
+		me.Close()
+		for _, seg := range me.segmenter.close() {
+			me.dispatchSegment(seg)
+		}
+		me.DispatchEvent(MediaRecorderEvent.New(MediaRecorderEvent.STOP, me.target))
+	}
+}
+
+// ReadyState returns ready state of this MediaRecorder.
+func (me *fragmented) ReadyState() uint32 {
+	return atomic.LoadUint32(&me.readyState)
+}
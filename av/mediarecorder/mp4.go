@@ -0,0 +1,356 @@
+package mediarecorder
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/studease/common/av"
+	"github.com/studease/common/av/codec/aac"
+	"github.com/studease/common/av/codec/avc"
+	"github.com/studease/common/av/utils/box"
+	"github.com/studease/common/events"
+	ErrorEvent "github.com/studease/common/events/errorevent"
+	Event "github.com/studease/common/events/event"
+	MediaEvent "github.com/studease/common/events/mediaevent"
+	MediaRecorderEvent "github.com/studease/common/events/mediarecorderevent"
+	MediaStreamTrackEvent "github.com/studease/common/events/mediastreamtrackevent"
+	"github.com/studease/common/log"
+)
+
+func init() {
+	Register("MP4", MP4{})
+}
+
+// MP4 implementions IMediaRecorder, which writes a progressive MP4 file with the moov ahead of the mdat on Stop.
+// Samples go into a part file meanwhile, and an unfinalized one could be rebuilt with RecoverMP4.
+type MP4 struct {
+	events.EventDispatcher
+
+	constraints *av.MediaRecorderConstraints
+	logger      log.ILogger
+	mtx         sync.Mutex
+	source      av.IMediaStream
+	file        *mp4File
+	readyState  uint32
+	tracks      map[av.IMediaStreamTrackSource]*mp4Track
+	waiting     bool   // for the first video keyframe
+	base        uint32 // DTS of the first sample
+	shift       uint32 // paused duration
+	resumed     bool
+
+	addtrackListener *events.EventListener
+	packetListener   *events.EventListener
+	errorListener    *events.EventListener
+	closeListener    *events.EventListener
+}
+
+// Init this class.
+func (me *MP4) Init(constraints *av.MediaRecorderConstraints, logger log.ILogger) av.IMediaRecorder {
+	me.EventDispatcher.Init(logger)
+	me.constraints = constraints
+	me.logger = logger
+	me.readyState = StateInactive
+	me.tracks = make(map[av.IMediaStreamTrackSource]*mp4Track)
+	me.addtrackListener = events.NewListener(me.onAddTrack, 0)
+	me.packetListener = events.NewListener(me.onPacket, 0)
+	me.errorListener = events.NewListener(me.onError, 0)
+	me.closeListener = events.NewListener(me.onClose, 0)
+	return me
+}
+
+// Source attaches the IMediaStream as input.
+func (me *MP4) Source(ms av.IMediaStream) {
+	if ms == nil {
+		me.Stop()
+		return
+	}
+
+	me.mtx.Lock()
+	defer me.mtx.Unlock()
+
+	if me.constraints.Append {
+		me.logger.Warnf("Appending is not supported by MP4, truncating.")
+	}
+
+	err := os.MkdirAll(me.constraints.Directory, os.ModePerm)
+	if err != nil {
+		me.DispatchEvent(ErrorEvent.New(ErrorEvent.ERROR, me, "NotAllowedError", err))
+		return
+	}
+
+	filename := me.constraints.FileName
+	if me.constraints.Unique {
+		now := time.Now()
+		filename += fmt.Sprintf("-%d.mp4", now.Unix())
+	} else {
+		filename += ".mp4"
+	}
+
+	file := new(mp4File).init(me.constraints.Directory + "/" + filename)
+	err = file.create()
+	if err != nil {
+		me.DispatchEvent(ErrorEvent.New(ErrorEvent.ERROR, me, "NotAllowedError", err))
+		return
+	}
+
+	me.file = file
+	me.source = ms
+}
+
+func (me *MP4) attach(ms av.IMediaStream) {
+	for _, track := range ms.GetTracks() {
+		track.Source().AddEventListener(MediaEvent.PACKET, me.packetListener)
+	}
+	ms.AddEventListener(MediaStreamTrackEvent.ADDTRACK, me.addtrackListener)
+	ms.AddEventListener(ErrorEvent.ERROR, me.errorListener)
+	ms.AddEventListener(Event.CLOSE, me.closeListener)
+}
+
+func (me *MP4) detach(ms av.IMediaStream) {
+	for _, track := range ms.GetTracks() {
+		track.Source().RemoveEventListener(MediaEvent.PACKET, me.packetListener)
+	}
+	ms.RemoveEventListener(MediaStreamTrackEvent.ADDTRACK, me.addtrackListener)
+	ms.RemoveEventListener(ErrorEvent.ERROR, me.errorListener)
+	ms.RemoveEventListener(Event.CLOSE, me.closeListener)
+}
+
+func (me *MP4) onAddTrack(e *MediaStreamTrackEvent.MediaStreamTrackEvent) {
+	e.Track.Source().AddEventListener(MediaEvent.PACKET, me.packetListener)
+}
+
+func (me *MP4) onPacket(e *MediaEvent.MediaEvent) {
+	source, ok := e.Target.(av.IMediaStreamTrackSource)
+	if !ok {
+		return
+	}
+
+	me.mtx.Lock()
+	err := me.write(source, e.Packet)
+	me.mtx.Unlock()
+
+	if err != nil {
+		me.logger.Debugf(3, "MediaRecorder failed to write: %v", err)
+		me.DispatchEvent(ErrorEvent.New(ErrorEvent.ERROR, me, "UnknownError", err))
+		me.Stop()
+	}
+}
+
+func (me *MP4) write(source av.IMediaStreamTrackSource, pkt *av.Packet) error {
+	if atomic.LoadUint32(&me.readyState) != StateRecording || me.file == nil {
+		return nil
+	}
+
+	var (
+		keyframe bool
+		cts      int32
+	)
+
+	switch pkt.Kind {
+	case av.KindVideo:
+		if (me.constraints.Mode&av.ModeVideo) == 0 || pkt.Codec != "AVC" || pkt.Get("DataType").(byte) != avc.NALU {
+			return nil
+		}
+		keyframe, _ = pkt.Get("Keyframe").(bool)
+		if !keyframe && (me.waiting || (me.constraints.Mode&av.ModeKeyframe) == av.ModeKeyframe) {
+			return nil
+		}
+		n, _ := pkt.Get("CTS").(uint32)
+		cts = int32(n<<8) >> 8 // SI24
+	case av.KindAudio:
+		if (me.constraints.Mode&av.ModeAudio) == 0 || pkt.Codec != "AAC" || pkt.Get("DataType").(byte) != aac.RAW_FRAME_DATA || me.waiting {
+			return nil
+		}
+		keyframe = true
+	default:
+		return nil
+	}
+
+	dts := pkt.Get("DTS").(uint32)
+	if me.file.last == nil {
+		me.base = dts
+	}
+	if me.resumed {
+		me.resume(dts)
+	}
+	if dts < me.base+me.shift {
+		return nil
+	}
+	dts -= me.base + me.shift
+
+	trk, err := me.track(source)
+	if trk == nil || err != nil {
+		return err
+	}
+
+	me.waiting = false
+	return me.file.writeSample(trk, dts, cts, keyframe, pkt.Get("Data").([]byte))
+}
+
+// track returns the mp4Track of the source, which is added on its first sample.
+func (me *MP4) track(source av.IMediaStreamTrackSource) (*mp4Track, error) {
+	if trk, ok := me.tracks[source]; ok {
+		return trk, nil
+	}
+
+	infoframe := source.GetInfoFrame()
+	if infoframe == nil {
+		return nil, nil
+	}
+
+	t := box.Track{}
+	switch src := source.(type) {
+	case *avc.AVC:
+		info := me.source.Information()
+		t.Handler = box.HANDLER_VIDEO
+		t.Config = src.AVCC
+		t.Width = info.Width
+		t.Height = info.Height
+	case *aac.AAC:
+		t.Handler = box.HANDLER_SOUND
+		t.Config = infoframe.Payload[2:] // AudioSpecificConfig as is, rather than the forced SBR one
+		t.SampleRate = src.SamplingFrequency
+		t.Channels = src.Channels
+	default:
+		return nil, nil
+	}
+
+	trk, err := me.file.addTrack(t)
+	me.tracks[source] = trk
+	return trk, err
+}
+
+// resume removes the pause from the timeline, so that the first sample follows the last one seamlessly.
+func (me *MP4) resume(dts uint32) {
+	var (
+		end uint32
+	)
+
+	for _, trk := range me.file.tracks {
+		n := len(trk.table.Durations)
+		if n == 0 {
+			continue
+		}
+
+		d := trk.dts
+		if n > 1 {
+			d += trk.table.Durations[n-2]
+		}
+		if d > end {
+			end = d
+		}
+	}
+
+	if dts > me.base+me.shift+end {
+		me.shift = dts - me.base - end
+	}
+	me.resumed = false
+}
+
+func (me *MP4) onError(e *ErrorEvent.ErrorEvent) {
+	me.logger.Debugf(0, "%s: %s", e.Name, e.Message)
+	me.Stop()
+}
+
+func (me *MP4) onClose(e *Event.Event) {
+	me.Stop()
+}
+
+// Start begins recording the source media stream.
+func (me *MP4) Start() {
+	if me.file == nil {
+		me.DispatchEvent(ErrorEvent.New(ErrorEvent.ERROR, me, "InvalidStateError", fmt.Errorf("The MediaRecorder has no file to write")))
+		return
+	}
+	if !atomic.CompareAndSwapUint32(&me.readyState, StateInactive, StateRecording) {
+		me.DispatchEvent(ErrorEvent.New(ErrorEvent.ERROR, me, "InvalidStateError", fmt.Errorf("The MediaRecorder is not in the inactive state")))
+		return
+	}
+
+	me.mtx.Lock()
+	defer me.mtx.Unlock()
+
+	me.waiting = (me.constraints.Mode&av.ModeVideo) != 0 && len(me.source.GetVideoTracks()) > 0
+	me.shift = 0
+	me.resumed = false
+
+	// Note: If the observer decides to reject this event, just panic in its handler
+	// rather than calling any other interfaces, which will cause a deadlock. Then
+	// catch the exception outside and deal with that.
+	me.DispatchEvent(MediaRecorderEvent.New(MediaRecorderEvent.START, me))
+	me.attach(me.source)
+}
+
+// Pause is used to pause recording the source media stream.
+func (me *MP4) Pause() {
+	switch atomic.LoadUint32(&me.readyState) {
+	case StateInactive:
+		me.DispatchEvent(ErrorEvent.New(ErrorEvent.ERROR, me, "InvalidStateError", fmt.Errorf("The MediaRecorder can't be paused while it's not active")))
+		return
+	case StateRecording:
+		me.mtx.Lock()
+		defer me.mtx.Unlock()
+
+		atomic.StoreUint32(&me.readyState, StatePaused)
+		me.DispatchEvent(MediaRecorderEvent.New(MediaRecorderEvent.PAUSE, me))
+	case StatePaused:
+		me.logger.Debugf(3, "MediaRecorder is already paused.")
+	}
+}
+
+// Resume is used to resume recording after when it has been previously paused.
+func (me *MP4) Resume() {
+	switch atomic.LoadUint32(&me.readyState) {
+	case StateInactive:
+		me.DispatchEvent(ErrorEvent.New(ErrorEvent.ERROR, me, "InvalidStateError", fmt.Errorf("The MediaRecorder can't be resumed while it's not paused")))
+		return
+	case StateRecording:
+		me.logger.Debugf(3, "MediaRecorder is already recording.")
+	case StatePaused:
+		me.mtx.Lock()
+		defer me.mtx.Unlock()
+
+		// Decoding restarts from a keyframe.
+		me.waiting = (me.constraints.Mode&av.ModeVideo) != 0 && len(me.source.GetVideoTracks()) > 0
+		me.resumed = len(me.file.tracks) > 0
+		atomic.StoreUint32(&me.readyState, StateRecording)
+		me.DispatchEvent(MediaRecorderEvent.New(MediaRecorderEvent.RESUME, me))
+	}
+}
+
+// Stop is used to stop recording the source media stream, and finalizes the file.
+func (me *MP4) Stop() {
+	switch atomic.LoadUint32(&me.readyState) {
+	case StateInactive:
+		me.DispatchEvent(ErrorEvent.New(ErrorEvent.ERROR, me, "InvalidStateError", fmt.Errorf("The MediaRecorder can't be stopped while it's not active")))
+		return
+	case StateRecording:
+		fallthrough
+	case StatePaused:
+		me.mtx.Lock()
+		defer me.mtx.Unlock()
+
+		if atomic.SwapUint32(&me.readyState, StateInactive) == StateInactive {
+			return
+		}
+
+		me.detach(me.source)
+		if me.file != nil {
+			err := me.file.finalize()
+			if err != nil {
+				me.logger.Errorf("Failed to finalize %s: %v", me.file.path, err)
+				me.DispatchEvent(ErrorEvent.New(ErrorEvent.ERROR, me, "UnknownError", err))
+			}
+			me.file = nil
+		}
+		me.DispatchEvent(MediaRecorderEvent.New(MediaRecorderEvent.STOP, me))
+	}
+}
+
+// ReadyState returns ready state of this MediaRecorder.
+func (me *MP4) ReadyState() uint32 {
+	return atomic.LoadUint32(&me.readyState)
+}
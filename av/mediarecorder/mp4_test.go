@@ -0,0 +1,356 @@
+package mediarecorder
+
+import (
+	"encoding/binary"
+	"io/ioutil"
+	"math"
+	"os"
+	"testing"
+
+	"github.com/studease/common/av"
+	"github.com/studease/common/av/format"
+	_ "github.com/studease/common/av/format/flv"
+	"github.com/studease/common/av/utils/box"
+	"github.com/studease/common/log"
+)
+
+var (
+	testAVCC = []byte{
+		0x01, 0x42, 0xC0, 0x1E, 0xFF, 0xE1, 0x00, 0x08, 0x67, 0x42, 0xC0, 0x1E, 0xDA, 0x05, 0x07, 0xE4,
+		0x01, 0x00, 0x04, 0x68, 0xCE, 0x38, 0x80,
+	}
+	testASC = []byte{0x11, 0x90} // AAC LC, 48kHz, stereo
+)
+
+func testFactory() log.ILoggerFactory {
+	return new(log.DefaultLoggerFactory).Init(0x0800, ioutil.Discard)
+}
+
+func flvTag(typ byte, timestamp uint32, body []byte) []byte {
+	tag := make([]byte, 11, 11+len(body)+4)
+	tag[0] = typ
+	tag[1] = byte(len(body) >> 16)
+	tag[2] = byte(len(body) >> 8)
+	tag[3] = byte(len(body))
+	tag[4] = byte(timestamp >> 16)
+	tag[5] = byte(timestamp >> 8)
+	tag[6] = byte(timestamp)
+	tag[7] = byte(timestamp >> 24)
+	tag = append(tag, body...)
+	size := make([]byte, 4)
+	binary.BigEndian.PutUint32(size, uint32(11+len(body)))
+	return append(tag, size...)
+}
+
+// testTags returns the FLV tags of n video and audio frames of 40ms, with a keyframe every 25.
+// Each frame is filled with its index, so that the samples could be told apart.
+func testTags(n int) []byte {
+	var b []byte
+	for i := 0; i < n; i++ {
+		nalu := make([]byte, 4+50)
+		binary.BigEndian.PutUint32(nalu, 50)
+		for j := 5; j < len(nalu); j++ {
+			nalu[j] = byte(i)
+		}
+		nalu[4] = 0x41
+		flag := byte(0x27)
+		if i%25 == 0 {
+			nalu[4] = 0x65
+			flag = 0x17
+		}
+		audio := make([]byte, 20)
+		for j := range audio {
+			audio[j] = byte(i)
+		}
+		b = append(b, flvTag(9, uint32(i*40), append([]byte{flag, 1, 0, 0, 0}, nalu...))...)
+		b = append(b, flvTag(8, uint32(i*40), append([]byte{0xAF, 1}, audio...))...)
+	}
+	return b
+}
+
+// testRecord records n frames of each kind into dir/test.mp4, and returns the recorder without stopping it.
+func testRecord(t *testing.T, dir string, n int) *MP4 {
+	demuxer, ok := format.New("FLV", av.ModeAll, testFactory()).(av.IDemuxer)
+	if !ok {
+		t.Fatalf("Demuxer FLV not registered")
+	}
+	demuxer.Append([]byte{'F', 'L', 'V', 0x01, 0x05, 0, 0, 0, 0x09, 0, 0, 0, 0})
+	demuxer.Append(flvTag(9, 0, append([]byte{0x17, 0, 0, 0, 0}, testAVCC...)))
+	demuxer.Append(flvTag(8, 0, append([]byte{0xAF, 0}, testASC...)))
+
+	me := new(MP4)
+	me.Init(&av.MediaRecorderConstraints{Mode: av.ModeAll, Directory: dir, FileName: "test"}, testLogger())
+	me.Source(demuxer)
+	me.Start()
+	if me.ReadyState() != StateRecording {
+		t.Fatalf("Recorder not started")
+	}
+	demuxer.Append(testTags(n))
+	return me
+}
+
+type testSample struct {
+	offset uint64
+	size   uint32
+}
+
+type testTrack struct {
+	handler string
+	config  []byte
+	samples []testSample
+	syncs   int // -1 if stss is absent
+	co64    bool
+}
+
+// testParse checks that a progressive MP4 is ftyp, moov and mdat in a row, and returns the tracks in moov.
+func testParse(t *testing.T, data []byte) []testTrack {
+	var (
+		types  []string
+		tracks []testTrack
+	)
+
+	err := box.Children(data, func(typ string, payload []byte) error {
+		types = append(types, typ)
+		if typ != "moov" {
+			return nil
+		}
+		tracks = testMoov(t, payload)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Failed to parse: %v", err)
+	}
+	if len(types) != 3 || types[0] != "ftyp" || types[1] != "moov" || types[2] != "mdat" {
+		t.Fatalf("Unexpected boxes %v", types)
+	}
+	return tracks
+}
+
+// testMoov returns the tracks of the moov payload.
+func testMoov(t *testing.T, b []byte) []testTrack {
+	var (
+		tracks []testTrack
+	)
+
+	err := box.Children(b, func(typ string, payload []byte) error {
+		if typ != "trak" {
+			return nil
+		}
+		trk, err := box.ParseTrack(payload)
+		if err != nil {
+			return err
+		}
+		tracks = append(tracks, testTable(t, trk, payload))
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Failed to parse moov: %v", err)
+	}
+	return tracks
+}
+
+// testTable returns the samples of the trak payload, located by stsz, stsc, and stco or co64.
+func testTable(t *testing.T, trk *box.Track, b []byte) testTrack {
+	var (
+		stbl    = make(map[string][]byte)
+		visit   func(typ string, payload []byte) error
+		track   = testTrack{handler: trk.Handler, config: trk.Config, syncs: -1}
+		offsets []uint64
+	)
+
+	visit = func(typ string, payload []byte) error {
+		switch typ {
+		case "mdia", "minf", "stbl":
+			return box.Children(payload, visit)
+		default:
+			stbl[typ] = payload
+		}
+		return nil
+	}
+	box.Children(b, visit)
+
+	if p, ok := stbl["co64"]; ok {
+		track.co64 = true
+		for i := 8; i+8 <= len(p); i += 8 {
+			offsets = append(offsets, binary.BigEndian.Uint64(p[i:]))
+		}
+	} else {
+		p = stbl["stco"]
+		for i := 8; i+4 <= len(p); i += 4 {
+			offsets = append(offsets, uint64(binary.BigEndian.Uint32(p[i:])))
+		}
+	}
+	if p, ok := stbl["stss"]; ok {
+		track.syncs = int(binary.BigEndian.Uint32(p[4:8]))
+	}
+
+	sizes := stbl["stsz"]
+	stsc := stbl["stsc"]
+	entries := int(binary.BigEndian.Uint32(stsc[4:8]))
+	for e, k := 0, 12; e < entries; e++ {
+		first := int(binary.BigEndian.Uint32(stsc[8+12*e:]))
+		n := int(binary.BigEndian.Uint32(stsc[12+12*e:]))
+		last := len(offsets)
+		if e+1 < entries {
+			last = int(binary.BigEndian.Uint32(stsc[8+12*(e+1):])) - 1
+		}
+		for c := first - 1; c < last; c++ {
+			offset := offsets[c]
+			for s := 0; s < n; s++ {
+				size := binary.BigEndian.Uint32(sizes[k:])
+				track.samples = append(track.samples, testSample{offset, size})
+				offset += uint64(size)
+				k += 4
+			}
+		}
+	}
+	if len(track.samples) != int(binary.BigEndian.Uint32(sizes[8:12])) {
+		t.Fatalf("%s: %d samples in chunks, %d in stsz", trk.Handler, len(track.samples), binary.BigEndian.Uint32(sizes[8:12]))
+	}
+	return track
+}
+
+// testCheck checks the tracks of the file, of which the samples must be the frames from 0 in the mdat.
+func testCheck(t *testing.T, name string, data []byte, video int, audio int) {
+	tracks := testParse(t, data)
+	if len(tracks) != 2 {
+		t.Fatalf("%s: expected 2 tracks, got %d", name, len(tracks))
+	}
+
+	for _, item := range []struct {
+		handler string
+		config  []byte
+		size    uint32
+		n       int
+		syncs   int
+	}{
+		{box.HANDLER_VIDEO, testAVCC, 54, video, (video + 24) / 25},
+		{box.HANDLER_SOUND, testASC, 20, audio, -1},
+	} {
+		var trk *testTrack
+		for i := range tracks {
+			if tracks[i].handler == item.handler {
+				trk = &tracks[i]
+			}
+		}
+		if trk == nil || string(trk.config) != string(item.config) || trk.co64 {
+			t.Fatalf("%s: unexpected %s track %+v", name, item.handler, trk)
+		}
+		if len(trk.samples) != item.n || trk.syncs != item.syncs {
+			t.Fatalf("%s: %s track of %d samples, %d sync, expected %d, %d", name, item.handler, len(trk.samples), trk.syncs, item.n, item.syncs)
+		}
+		for i, s := range trk.samples {
+			if s.size != item.size || s.offset+uint64(s.size) > uint64(len(data)) || data[s.offset+uint64(s.size)-1] != byte(i) {
+				t.Fatalf("%s: %s sample %d at %d of %d bytes, not the frame", name, item.handler, i, s.offset, s.size)
+			}
+		}
+	}
+}
+
+// TestMP4Stop finalizes the recording with the moov ahead of the mdat, and removes the part file and the sidecar index.
+func TestMP4Stop(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mp4")
+	if err != nil {
+		t.Fatalf("Failed to create directory: %v", err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	me := testRecord(t, dir, 60)
+	me.Stop()
+
+	data, err := ioutil.ReadFile(dir + "/test.mp4")
+	if err != nil {
+		t.Fatalf("Failed to read: %v", err)
+	}
+	testCheck(t, "stop", data, 60, 60)
+
+	for _, ext := range []string{".part", ".idx"} {
+		if _, err := os.Stat(dir + "/test.mp4" + ext); !os.IsNotExist(err) {
+			t.Fatalf("%s not removed: %v", ext, err)
+		}
+	}
+}
+
+// TestRecoverMP4 rebuilds a recording interrupted with the part file and the sidecar index truncated,
+// of which the records pointing beyond the data are dropped.
+func TestRecoverMP4(t *testing.T) {
+	for _, item := range []struct {
+		name  string
+		part  int64 // bytes cut off
+		index int64
+		video int
+		audio int
+	}{
+		{"intact", 0, 0, 60, 60},
+		{"record cut off", 0, 10, 60, 59}, // of the last audio sample
+		{"data cut off", 30, 0, 59, 59},   // of the last audio sample, and the last video one partly
+		{"both cut off", 100, 30, 58, 58},
+	} {
+		dir, err := ioutil.TempDir("", "mp4")
+		if err != nil {
+			t.Fatalf("Failed to create directory: %v", err)
+		}
+		defer os.RemoveAll(dir)
+
+		// Crashed, leaving the files as they are.
+		me := testRecord(t, dir, 60)
+		me.file.part.Close()
+		me.file.index.Close()
+
+		path := dir + "/test.mp4"
+		for ext, n := range map[string]int64{".part": item.part, ".idx": item.index} {
+			fi, err := os.Stat(path + ext)
+			if err != nil {
+				t.Fatalf("%s: %v", item.name, err)
+			}
+			os.Truncate(path+ext, fi.Size()-n)
+		}
+
+		err = RecoverMP4(path)
+		if err != nil {
+			t.Fatalf("%s: failed to recover: %v", item.name, err)
+		}
+
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatalf("%s: failed to read: %v", item.name, err)
+		}
+		testCheck(t, item.name, data, item.video, item.audio)
+	}
+}
+
+// TestMP4Large switches stco to co64 once any chunk offset shifted by the moov exceeds 32 bits.
+func TestMP4Large(t *testing.T) {
+	me := new(mp4File).init("")
+	video, _ := me.addTrack(box.Track{Handler: box.HANDLER_VIDEO, Config: testAVCC})
+	audio, _ := me.addTrack(box.Track{Handler: box.HANDLER_SOUND, Config: testASC, SampleRate: 48000, Channels: 2})
+	for i := 0; i < 10; i++ {
+		me.addSample(video, uint32(i*40), 0, i == 0, 54, me.size)
+		me.addSample(audio, uint32(i*40), 0, true, 20, me.size)
+	}
+
+	for _, item := range []struct {
+		base uint64
+		co64 bool
+	}{
+		{0, false},
+		{math.MaxUint32 - 74*10, false},
+		{math.MaxUint32 - 74*9, true}, // of the last audio chunk only
+	} {
+		moov := me.moov(item.base)
+		for _, trk := range testMoov(t, moov[8:]) {
+			if trk.co64 != (item.co64 && trk.handler == box.HANDLER_SOUND) || len(trk.samples) != 10 {
+				t.Fatalf("%d: %s track of %d samples, co64=%v", item.base, trk.handler, len(trk.samples), trk.co64)
+			}
+			for i, s := range trk.samples {
+				offset := item.base + uint64(i*74)
+				if trk.handler == box.HANDLER_SOUND {
+					offset += 54
+				}
+				if s.offset != offset {
+					t.Fatalf("%d: %s sample %d at %d, expected %d", item.base, trk.handler, i, s.offset, offset)
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,343 @@
+package mediarecorder
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+
+	"github.com/studease/common/av/utils/box"
+)
+
+// Sidecar index records.
+const (
+	mp4RecordTrack  byte = 'T'
+	mp4RecordSample byte = 'S'
+
+	mp4SampleRecordSize = 26
+	mp4Timescale        = 1000
+)
+
+// mp4Track collects the sample table of a track, with chunk offsets relative to the mdat payload.
+type mp4Track struct {
+	box.Track
+
+	table box.SampleTable
+	dts   uint32 // of the last sample
+}
+
+// mp4File writes sample data into a part file, and records each sample in a sidecar index,
+// so that an unfinalized file can be rebuilt after a crash.
+type mp4File struct {
+	path   string
+	part   *os.File
+	index  *os.File
+	size   uint64 // of the sample data
+	tracks []*mp4Track
+	last   *mp4Track // owner of the current chunk
+}
+
+func (me *mp4File) init(path string) *mp4File {
+	me.path = path
+	me.part = nil
+	me.index = nil
+	me.size = 0
+	me.tracks = nil
+	me.last = nil
+	return me
+}
+
+// create truncates the part file and the sidecar index.
+func (me *mp4File) create() error {
+	part, err := os.OpenFile(me.path+".part", os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
+	if err != nil {
+		return err
+	}
+
+	index, err := os.OpenFile(me.path+".idx", os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
+	if err != nil {
+		part.Close()
+		return err
+	}
+
+	me.part = part
+	me.index = index
+	return nil
+}
+
+// addTrack appends a track with the next ID, and records it unless recovering.
+func (me *mp4File) addTrack(t box.Track) (*mp4Track, error) {
+	trk := &mp4Track{Track: t}
+	trk.ID = uint32(len(me.tracks) + 1)
+	trk.Timescale = mp4Timescale
+	trk.table.AllSync = trk.Handler == box.HANDLER_SOUND
+	me.tracks = append(me.tracks, trk)
+
+	if me.index == nil {
+		return trk, nil
+	}
+
+	b := make([]byte, 25, 25+len(t.Config))
+	b[0] = mp4RecordTrack
+	binary.BigEndian.PutUint32(b[1:5], trk.ID)
+	copy(b[5:9], trk.Handler)
+	binary.BigEndian.PutUint32(b[9:13], trk.Width)
+	binary.BigEndian.PutUint32(b[13:17], trk.Height)
+	binary.BigEndian.PutUint32(b[17:21], trk.SampleRate)
+	binary.BigEndian.PutUint16(b[21:23], trk.Channels)
+	binary.BigEndian.PutUint16(b[23:25], uint16(len(trk.Config)))
+	b = append(b, trk.Config...)
+	_, err := me.index.Write(b)
+	return trk, err
+}
+
+// writeSample writes the data ahead of its index record, so that a record never points to missing data.
+func (me *mp4File) writeSample(trk *mp4Track, dts uint32, cts int32, keyframe bool, data []byte) error {
+	offset := me.size
+	_, err := me.part.Write(data)
+	if err != nil {
+		return err
+	}
+
+	me.addSample(trk, dts, cts, keyframe, uint32(len(data)), offset)
+
+	b := make([]byte, mp4SampleRecordSize)
+	b[0] = mp4RecordSample
+	binary.BigEndian.PutUint32(b[1:5], trk.ID)
+	binary.BigEndian.PutUint32(b[5:9], dts)
+	binary.BigEndian.PutUint32(b[9:13], uint32(cts))
+	binary.BigEndian.PutUint32(b[13:17], uint32(len(data)))
+	if keyframe {
+		b[17] = 1
+	}
+	binary.BigEndian.PutUint64(b[18:26], offset)
+	_, err = me.index.Write(b)
+	return err
+}
+
+func (me *mp4File) addSample(trk *mp4Track, dts uint32, cts int32, keyframe bool, size uint32, offset uint64) {
+	table := &trk.table
+	n := len(table.Sizes)
+	if n > 0 {
+		var delta uint32
+		if dts > trk.dts {
+			delta = dts - trk.dts
+		}
+		table.Durations[n-1] = delta
+	}
+
+	table.Durations = append(table.Durations, 0)
+	table.CompositionTimeOffsets = append(table.CompositionTimeOffsets, cts)
+	table.Sizes = append(table.Sizes, size)
+	if keyframe {
+		table.SyncSamples = append(table.SyncSamples, uint32(n+1))
+	}
+
+	// Samples written in a row by the same track share a chunk.
+	if me.last == trk && offset == me.size && len(table.Chunks) > 0 {
+		table.Chunks[len(table.Chunks)-1].Samples++
+	} else {
+		table.Chunks = append(table.Chunks, box.Chunk{Offset: offset, Samples: 1})
+	}
+
+	trk.dts = dts
+	me.last = trk
+	me.size = offset + uint64(size)
+}
+
+// finalize writes ftyp, moov and mdat into the destination file, and then removes the part file and the sidecar index.
+func (me *mp4File) finalize() error {
+	if me.index != nil {
+		me.index.Close()
+		me.index = nil
+	}
+	if me.part == nil {
+		return fmt.Errorf("no media data")
+	}
+	defer func() {
+		me.part.Close()
+		me.part = nil
+	}()
+
+	if len(me.tracks) == 0 || me.size == 0 {
+		me.remove()
+		return nil
+	}
+
+	ftyp := box.FTYP("isom", 0x200, "isom", "iso2", "avc1", "mp41")
+
+	header := 8
+	if me.size+8 > math.MaxUint32 {
+		header = 16
+	}
+
+	// The moov grows if any offset requires co64, which moves the mdat in turn.
+	var (
+		moov []byte
+		base uint64
+	)
+	for {
+		moov = me.moov(base)
+		n := uint64(len(ftyp) + len(moov) + header)
+		if n == base {
+			break
+		}
+		base = n
+	}
+
+	f, err := os.OpenFile(me.path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0666)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	w := bufio.NewWriterSize(f, 64*1024)
+	w.Write(ftyp)
+	w.Write(moov)
+
+	mdat := make([]byte, header)
+	if header == 16 {
+		binary.BigEndian.PutUint32(mdat[0:4], 1)
+		copy(mdat[4:8], "mdat")
+		binary.BigEndian.PutUint64(mdat[8:16], me.size+16)
+	} else {
+		binary.BigEndian.PutUint32(mdat[0:4], uint32(me.size+8))
+		copy(mdat[4:8], "mdat")
+	}
+	w.Write(mdat)
+
+	_, err = me.part.Seek(0, io.SeekStart)
+	if err != nil {
+		return err
+	}
+	_, err = io.CopyN(w, me.part, int64(me.size))
+	if err != nil {
+		return err
+	}
+	err = w.Flush()
+	if err != nil {
+		return err
+	}
+
+	me.remove()
+	return nil
+}
+
+// moov returns the movie box, of which the chunk offsets are shifted by base.
+func (me *mp4File) moov(base uint64) []byte {
+	var (
+		duration uint32
+	)
+
+	trks := make([]*box.Track, 0, len(me.tracks))
+	for _, trk := range me.tracks {
+		table := trk.table
+		if len(table.Sizes) == 0 {
+			continue
+		}
+
+		// The last sample lasts as long as the previous one.
+		table.Durations = append([]uint32(nil), table.Durations...)
+		if n := len(table.Durations); n > 1 {
+			table.Durations[n-1] = table.Durations[n-2]
+		}
+		table.Chunks = make([]box.Chunk, len(trk.table.Chunks))
+		for i, c := range trk.table.Chunks {
+			table.Chunks[i] = box.Chunk{Offset: base + c.Offset, Samples: c.Samples}
+		}
+
+		t := trk.Track
+		t.Table = &table
+		t.Duration = uint32(table.Duration())
+		if t.Duration > duration {
+			duration = t.Duration
+		}
+		trks = append(trks, &t)
+	}
+	return box.MOOV(mp4Timescale, duration, false, trks...)
+}
+
+func (me *mp4File) remove() {
+	os.Remove(me.path + ".part")
+	os.Remove(me.path + ".idx")
+}
+
+// RecoverMP4 rebuilds the MP4 file at path from the part file and the sidecar index left by an unfinalized recording.
+// Records pointing beyond the written data, and anything after a corrupted record, are dropped.
+func RecoverMP4(path string) error {
+	part, err := os.Open(path + ".part")
+	if err != nil {
+		return err
+	}
+
+	fi, err := part.Stat()
+	if err != nil {
+		part.Close()
+		return err
+	}
+
+	index, err := ioutil.ReadFile(path + ".idx")
+	if err != nil {
+		part.Close()
+		return err
+	}
+
+	me := new(mp4File).init(path)
+	me.part = part
+
+	tracks := make(map[uint32]*mp4Track)
+	for i := 0; i < len(index); /* void */ {
+		switch index[i] {
+		case mp4RecordTrack:
+			if i+25 > len(index) {
+				i = len(index)
+				break
+			}
+
+			b := index[i:]
+			size := int(binary.BigEndian.Uint16(b[23:25]))
+			if i+25+size > len(index) {
+				i = len(index)
+				break
+			}
+
+			t := box.Track{
+				Handler:    string(b[5:9]),
+				Width:      binary.BigEndian.Uint32(b[9:13]),
+				Height:     binary.BigEndian.Uint32(b[13:17]),
+				SampleRate: binary.BigEndian.Uint32(b[17:21]),
+				Channels:   binary.BigEndian.Uint16(b[21:23]),
+				Config:     append([]byte(nil), b[25:25+size]...),
+			}
+			trk, _ := me.addTrack(t)
+			tracks[binary.BigEndian.Uint32(b[1:5])] = trk
+			i += 25 + size
+
+		case mp4RecordSample:
+			if i+mp4SampleRecordSize > len(index) {
+				i = len(index)
+				break
+			}
+
+			b := index[i:]
+			trk := tracks[binary.BigEndian.Uint32(b[1:5])]
+			size := binary.BigEndian.Uint32(b[13:17])
+			offset := binary.BigEndian.Uint64(b[18:26])
+			if trk == nil || offset+uint64(size) > uint64(fi.Size()) {
+				i = len(index)
+				break
+			}
+
+			me.addSample(trk, binary.BigEndian.Uint32(b[5:9]), int32(binary.BigEndian.Uint32(b[9:13])), b[17] != 0, size, offset)
+			i += mp4SampleRecordSize
+
+		default:
+			// Nothing valid follows a corrupted record.
+			i = len(index)
+		}
+	}
+	return me.finalize()
+}
@@ -0,0 +1,271 @@
+package mediarecorder
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/studease/common/av"
+	"github.com/studease/common/av/codec/aac"
+	"github.com/studease/common/av/codec/avc"
+	"github.com/studease/common/av/format"
+	"github.com/studease/common/av/format/cmaf"
+	"github.com/studease/common/log"
+)
+
+// Static constants.
+const (
+	DefaultSegmentDuration uint32 = 6 // seconds
+)
+
+// segmentTrack holds the segments of a track on disk.
+type segmentTrack struct {
+	*cmaf.MediaStreamTrack
+
+	frames int64 // of the uncompleted segment
+	last   uint32
+}
+
+// segmenter writes an init segment per track, and media segments cut on keyframes by the constraints.
+// Audio segments follow the video cuts if any, so that the segments of the tracks are aligned.
+type segmenter struct {
+	constraints *av.MediaRecorderConstraints
+	logger      log.ILogger
+	prefix      string
+	exts        map[string][2]string // init and media segment extensions by kind
+	tracks      map[string]*segmentTrack
+	target      uint32 // in milliseconds
+	boundary    uint32 // timestamp of the last video cut
+}
+
+func (me *segmenter) init(constraints *av.MediaRecorderConstraints, prefix string, exts map[string][2]string, logger log.ILogger) *segmenter {
+	me.constraints = constraints
+	me.logger = logger
+	me.prefix = prefix
+	me.exts = exts
+	me.tracks = make(map[string]*segmentTrack)
+	me.target = constraints.MaxDuration * 1000
+	if me.target == 0 && constraints.MaxSize <= 0 && constraints.MaxFrames <= 0 {
+		me.target = DefaultSegmentDuration * 1000
+	}
+	me.boundary = 0
+	return me
+}
+
+func (me *segmenter) track(kind string, source av.IMediaStreamTrackSource) *segmentTrack {
+	trk, ok := me.tracks[kind]
+	if !ok {
+		trk = &segmentTrack{MediaStreamTrack: new(cmaf.MediaStreamTrack).Init(kind, source, me.logger)}
+		me.tracks[kind] = trk
+	}
+	return trk
+}
+
+func (me *segmenter) path(uri string) string {
+	return me.constraints.Directory + "/" + uri
+}
+
+// handle writes an init segment or a moof and mdat pair from the remuxer, and returns the finished media segment if cut.
+func (me *segmenter) handle(pkt *av.Packet, source av.IMediaStreamTrackSource) (*cmaf.MediaSegment, error) {
+	datatype, _ := pkt.Get("DataType").(byte)
+
+	switch {
+	case pkt.Kind == format.KindVideo && pkt.Codec == "AVC" && datatype == avc.SEQUENCE_HEADER:
+		fallthrough
+	case pkt.Kind == format.KindAudio && pkt.Codec == "AAC" && datatype == aac.SPECIFIC_CONFIG:
+		return nil, me.writeInit(pkt.Kind, source, pkt.Payload)
+	case pkt.Kind == format.KindVideo && pkt.Codec == "AVC" && datatype == avc.NALU:
+		fallthrough
+	case pkt.Kind == format.KindAudio && pkt.Codec == "AAC" && datatype == aac.RAW_FRAME_DATA:
+		return me.write(pkt.Kind, source, pkt)
+	}
+
+	// Interleaved init segments and the end of sequence are not written.
+	return nil, nil
+}
+
+// writeInit replaces the init segment of the track.
+func (me *segmenter) writeInit(kind string, source av.IMediaStreamTrackSource, data []byte) error {
+	trk := me.track(kind, source)
+	uri := fmt.Sprintf("%s-%s-init%s", me.prefix, kind, me.exts[kind][0])
+
+	err := ioutil.WriteFile(me.path(uri), data, 0666)
+	if err != nil {
+		return err
+	}
+
+	trk.InitSegment = new(cmaf.MediaChunk).Init(0)
+	trk.InitSegment.URI = uri
+	trk.InitSegment.Size = uint32(len(data))
+	return nil
+}
+
+// write appends a moof and mdat pair of the packet, and returns the finished segment if cut.
+func (me *segmenter) write(kind string, source av.IMediaStreamTrackSource, pkt *av.Packet) (*cmaf.MediaSegment, error) {
+	var (
+		finished *cmaf.MediaSegment
+		err      error
+	)
+
+	trk := me.track(kind, source)
+	keyframe := true
+	if kind == format.KindVideo {
+		keyframe, _ = pkt.Get("Keyframe").(bool)
+	}
+
+	if seg := trk.Segment; seg != nil && keyframe && me.full(trk, pkt.Timestamp) {
+		finished, err = me.finish(trk, pkt.Timestamp)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if trk.Segment == nil {
+		if !keyframe {
+			return finished, nil
+		}
+		if kind == format.KindVideo {
+			me.boundary = pkt.Timestamp
+		}
+		err = me.open(trk, pkt.Timestamp)
+		if err != nil {
+			return finished, err
+		}
+	}
+
+	seg := trk.Segment
+	me.chunk(trk, pkt.Timestamp, keyframe)
+
+	_, err = trk.File.Write(pkt.Payload)
+	if err != nil {
+		return finished, err
+	}
+
+	seg.Size += uint32(len(pkt.Payload))
+	seg.Chunk.Size += uint32(len(pkt.Payload))
+	trk.frames++
+	trk.last = pkt.Timestamp
+	return finished, nil
+}
+
+// full returns whether the uncompleted segment should be cut before the sample at the timestamp.
+func (me *segmenter) full(trk *segmentTrack, timestamp uint32) bool {
+	seg := trk.Segment
+	if trk.Kind() == format.KindAudio {
+		if v, ok := me.tracks[format.KindVideo]; ok && v.Segment != nil {
+			return seg.Timestamp < me.boundary && timestamp >= me.boundary
+		}
+	}
+
+	return me.target > 0 && timestamp-seg.Timestamp >= me.target ||
+		me.constraints.MaxSize > 0 && int64(seg.Size) >= me.constraints.MaxSize ||
+		me.constraints.MaxFrames > 0 && trk.frames >= me.constraints.MaxFrames
+}
+
+// chunk starts a new chunk of the uncompleted segment if the current one lasts long enough.
+func (me *segmenter) chunk(trk *segmentTrack, timestamp uint32, independent bool) {
+	seg := trk.Segment
+	if c := seg.Chunk; c != nil {
+		if me.constraints.Chunks <= 0 || timestamp-c.Timestamp < me.interval(trk) {
+			return
+		}
+		c.Duration = timestamp - c.Timestamp
+		seg.Chunks = append(seg.Chunks, c)
+	}
+
+	c := new(cmaf.MediaChunk).Init(len(seg.Chunks))
+	c.URI = seg.URI
+	c.Timestamp = timestamp
+	c.Offset = seg.Size
+	c.Independent = independent
+	seg.Chunk = c
+}
+
+// interval returns the duration of chunks, by the target duration, or by the last segment of the track if cut by size or frames.
+func (me *segmenter) interval(trk *segmentTrack) uint32 {
+	d := me.target
+	if d == 0 {
+		d = DefaultSegmentDuration * 1000
+		if n := len(trk.Segments); n > 0 && trk.Segments[n-1].Duration > 0 {
+			d = trk.Segments[n-1].Duration
+		}
+	}
+	return d / uint32(me.constraints.Chunks)
+}
+
+func (me *segmenter) open(trk *segmentTrack, timestamp uint32) error {
+	major := 0
+	if n := len(trk.Segments); n > 0 {
+		major = trk.Segments[n-1].Major + 1
+	}
+
+	seg := new(cmaf.MediaSegment).Init(major)
+	seg.URI = fmt.Sprintf("%s-%s-%d%s", me.prefix, trk.Kind(), major, me.exts[trk.Kind()][1])
+	seg.Timestamp = timestamp
+	seg.Independent = true
+
+	f, err := os.OpenFile(me.path(seg.URI), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0666)
+	if err != nil {
+		return err
+	}
+
+	trk.File = f
+	trk.Segment = seg
+	trk.frames = 0
+	return nil
+}
+
+// finish closes the uncompleted segment which ends at the timestamp, and deletes the ones out of the sliding window.
+func (me *segmenter) finish(trk *segmentTrack, timestamp uint32) (*cmaf.MediaSegment, error) {
+	seg := trk.Segment
+	seg.Duration = timestamp - seg.Timestamp
+	if c := seg.Chunk; c != nil {
+		c.Duration = timestamp - c.Timestamp
+		seg.Chunks = append(seg.Chunks, c)
+		seg.Chunk = nil
+	}
+
+	err := trk.File.Close()
+	trk.File = nil
+	trk.Segment = nil
+	trk.Segments = append(trk.Segments, seg)
+
+	// Only the last one is kept to number the next, if not in a sliding window.
+	window := me.constraints.Segments
+	if window <= 0 {
+		window = 1
+	}
+	for len(trk.Segments) > window {
+		old := trk.Segments[0]
+		trk.Segments = trk.Segments[1:]
+		if me.constraints.Segments > 0 {
+			e := os.Remove(me.path(old.URI))
+			if e != nil {
+				me.logger.Debugf(3, "Failed to remove segment %s: %v", old.URI, e)
+			}
+		}
+	}
+	return seg, err
+}
+
+// close finishes the uncompleted segments, which are assumed to last one more sample.
+func (me *segmenter) close() []*cmaf.MediaSegment {
+	segments := make([]*cmaf.MediaSegment, 0, len(me.tracks))
+	for _, trk := range me.tracks {
+		if trk.Segment == nil {
+			continue
+		}
+
+		end := trk.last
+		if source := trk.Source(); source != nil {
+			end += source.Context().RefSampleDuration
+		}
+
+		seg, err := me.finish(trk, end)
+		if err != nil {
+			me.logger.Debugf(3, "Failed to close segment %s: %v", seg.URI, err)
+		}
+		segments = append(segments, seg)
+	}
+	return segments
+}
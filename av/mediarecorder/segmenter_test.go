@@ -0,0 +1,74 @@
+package mediarecorder
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/studease/common/av"
+	"github.com/studease/common/av/format"
+	"github.com/studease/common/av/format/cmaf"
+	"github.com/studease/common/log"
+)
+
+func testLogger() log.ILogger {
+	return new(log.DefaultLoggerFactory).Init(0x0800, ioutil.Discard).NewLogger("Recorder")
+}
+
+// testSegment writes n audio frames of 40ms from the timestamp, and returns the segments finished.
+func testSegment(t *testing.T, me *segmenter, from uint32, n int) []*cmaf.MediaSegment {
+	var segments []*cmaf.MediaSegment
+
+	for i := 0; i < n; i++ {
+		pkt := new(av.Packet).Init()
+		pkt.Kind = format.KindAudio
+		pkt.Timestamp = from + uint32(i*40)
+		pkt.Payload = make([]byte, 100)
+
+		seg, err := me.write(format.KindAudio, nil, pkt)
+		if err != nil {
+			t.Fatalf("Failed to write: %v", err)
+		}
+		if seg != nil {
+			segments = append(segments, seg)
+		}
+	}
+	return segments
+}
+
+// TestChunkInterval chunks the segments cut by frames, which have no target duration.
+func TestChunkInterval(t *testing.T) {
+	dir, err := ioutil.TempDir("", "segmenter")
+	if err != nil {
+		t.Fatalf("Failed to create directory: %v", err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	me := new(segmenter).init(&av.MediaRecorderConstraints{Directory: dir, MaxFrames: 50, Chunks: 4}, "test", map[string][2]string{
+		format.KindAudio: {".mp4", ".m4s"},
+	}, testLogger())
+
+	// The first segment is chunked by the default duration, and the next ones by the duration of the last, 2s.
+	segments := testSegment(t, me, 0, 151)
+	if len(segments) != 3 {
+		t.Fatalf("Expected 3 segments, got %d", len(segments))
+	}
+	for i, item := range []struct {
+		chunks   int
+		interval uint32
+	}{
+		{2, 1500},
+		{4, 500},
+		{4, 500},
+	} {
+		seg := segments[i]
+		if seg.Duration != 2000 || len(seg.Chunks) != item.chunks {
+			t.Fatalf("Segment %d: duration=%d, chunks=%d, expected %d", i, seg.Duration, len(seg.Chunks), item.chunks)
+		}
+		for j, c := range seg.Chunks[:len(seg.Chunks)-1] {
+			if c.Duration < item.interval {
+				t.Fatalf("Segment %d: chunk %d lasts %d, expected %d at least", i, j, c.Duration, item.interval)
+			}
+		}
+	}
+}
@@ -0,0 +1,128 @@
+// Package box writes ISO/IEC 14496-12 (ISO-BMFF) boxes of fragmented and progressive MP4.
+package box
+
+import (
+	"encoding/binary"
+	"time"
+)
+
+// Handler types.
+const (
+	HANDLER_VIDEO = "vide"
+	HANDLER_SOUND = "soun"
+)
+
+var (
+	// Unity matrix of mvhd and tkhd.
+	matrix = []byte{
+		0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+		0x00, 0x00, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+		0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x40, 0x00, 0x00, 0x00,
+	}
+
+	// NTP epoch, 1900-01-01 00:00:00 UTC.
+	ntpEpoch = time.Date(1900, 1, 1, 0, 0, 0, 0, time.UTC)
+)
+
+// Box returns a box of the type, with the payloads as its content.
+func Box(typ string, payloads ...[]byte) []byte {
+	size := 8
+	for _, p := range payloads {
+		size += len(p)
+	}
+
+	b := make([]byte, 8, size)
+	binary.BigEndian.PutUint32(b, uint32(size))
+	copy(b[4:8], typ)
+	for _, p := range payloads {
+		b = append(b, p...)
+	}
+	return b
+}
+
+// FullBox returns a box with version and flags ahead of the payloads.
+func FullBox(typ string, version byte, flags uint32, payloads ...[]byte) []byte {
+	header := []byte{version, byte(flags >> 16), byte(flags >> 8), byte(flags)}
+	return Box(typ, append([][]byte{header}, payloads...)...)
+}
+
+// Merge concatenates the boxes.
+func Merge(boxes ...[]byte) []byte {
+	size := 0
+	for _, b := range boxes {
+		size += len(b)
+	}
+
+	data := make([]byte, 0, size)
+	for _, b := range boxes {
+		data = append(data, b...)
+	}
+	return data
+}
+
+// SampleFlags packs the sample flags.
+func SampleFlags(isLeading, dependsOn, isDependedOn, hasRedundancy, isNonSync byte) uint32 {
+	return uint32(isLeading&0x03)<<26 |
+		uint32(dependsOn&0x03)<<24 |
+		uint32(isDependedOn&0x03)<<22 |
+		uint32(hasRedundancy&0x03)<<20 |
+		uint32(isNonSync&0x01)<<16
+}
+
+// NTP converts the time to a 64-bit NTP timestamp.
+func NTP(t time.Time) uint64 {
+	d := t.Sub(ntpEpoch)
+	sec := uint64(d / time.Second)
+	frac := uint64(d%time.Second) << 32 / uint64(time.Second)
+	return sec<<32 | frac
+}
+
+// FTYP returns a file type box.
+func FTYP(major string, minor uint32, compatibles ...string) []byte {
+	b := make([]byte, 8+4*len(compatibles))
+	copy(b[0:4], major)
+	binary.BigEndian.PutUint32(b[4:8], minor)
+	for i, brand := range compatibles {
+		copy(b[8+4*i:], brand)
+	}
+	return Box("ftyp", b)
+}
+
+// STYP returns a segment type box.
+func STYP(major string, minor uint32, compatibles ...string) []byte {
+	b := FTYP(major, minor, compatibles...)
+	copy(b[4:8], "styp")
+	return b
+}
+
+// MDAT returns a media data box.
+func MDAT(data ...[]byte) []byte {
+	return Box("mdat", data...)
+}
+
+// PRFT returns a producer reference time box, which maps the media time of the track to the NTP time.
+func PRFT(trackID uint32, ntp uint64, mediaTime uint64) []byte {
+	b := make([]byte, 20)
+	binary.BigEndian.PutUint32(b[0:4], trackID)
+	binary.BigEndian.PutUint64(b[4:12], ntp)
+	binary.BigEndian.PutUint64(b[12:20], mediaTime)
+	return FullBox("prft", 1, 0, b)
+}
+
+func u16(n uint16) []byte {
+	b := make([]byte, 2)
+	binary.BigEndian.PutUint16(b, n)
+	return b
+}
+
+func u32(n uint32) []byte {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, n)
+	return b
+}
+
+func u64(n uint64) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, n)
+	return b
+}
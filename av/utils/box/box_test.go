@@ -0,0 +1,232 @@
+package box
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+var (
+	testAVCC = []byte{
+		0x01, 0x42, 0xC0, 0x1E, 0xFF, 0xE1, 0x00, 0x08, 0x67, 0x42, 0xC0, 0x1E, 0xDA, 0x05, 0x07, 0xE4,
+		0x01, 0x00, 0x04, 0x68, 0xCE, 0x38, 0x80,
+	}
+	testASC = []byte{0x11, 0x88} // AAC LC, 96kHz, stereo
+)
+
+// containers hold nothing but child boxes.
+var containers = map[string]bool{
+	"moov": true, "trak": true, "mdia": true, "minf": true, "dinf": true, "stbl": true, "mvex": true,
+	"moof": true, "traf": true,
+}
+
+// testWalk checks that the sizes of the boxes in b add up exactly, recursing into containers.
+// It returns the paths of the boxes walked through, e.g. moov.trak.mdia.
+func testWalk(t *testing.T, prefix string, b []byte) []string {
+	var paths []string
+
+	for len(b) > 0 {
+		if len(b) < 8 {
+			t.Fatalf("Trailing %d bytes in %s", len(b), prefix)
+		}
+		typ, header, size := readHeader(b)
+		if size < int64(header) || size > int64(len(b)) {
+			t.Fatalf("Invalid size %d of %s%s, %d bytes left", size, prefix, typ, len(b))
+		}
+
+		paths = append(paths, prefix+typ)
+		if containers[typ] {
+			paths = append(paths, testWalk(t, prefix+typ+".", b[header:size])...)
+		}
+		b = b[size:]
+	}
+	return paths
+}
+
+func testHas(t *testing.T, paths []string, path string) {
+	for _, item := range paths {
+		if item == path {
+			return
+		}
+	}
+	t.Fatalf("Box %s not found in %v", path, paths)
+}
+
+func TestInitSegment(t *testing.T) {
+	video := &Track{ID: 1, Handler: HANDLER_VIDEO, Timescale: 1000, Config: testAVCC, Width: 640, Height: 360}
+	audio := &Track{ID: 2, Handler: HANDLER_SOUND, Timescale: 1000, Config: testASC, SampleRate: 96000, Channels: 2, Bitrate: 128000}
+	data := Merge(FTYP("isom", 0x200, "isom", "iso6", "avc1", "mp41"), MOOV(1000, 0, true, video, audio))
+
+	paths := testWalk(t, "", data)
+	for _, path := range []string{"ftyp", "moov.mvhd", "moov.trak.tkhd", "moov.trak.mdia.minf.stbl.stsd", "moov.mvex.trex"} {
+		testHas(t, paths, path)
+	}
+
+	tracks, frames, err := new(Parser).Init().Append(data)
+	if err != nil {
+		t.Fatalf("Failed to parse: %v", err)
+	}
+	if len(tracks) != 2 || len(frames) != 0 {
+		t.Fatalf("Expected 2 tracks and no frames, got %d and %d", len(tracks), len(frames))
+	}
+
+	v, a := tracks[0], tracks[1]
+	if v.Format != "avc1" || !bytes.Equal(v.Config, testAVCC) || v.Width != 640 || v.Height != 360 {
+		t.Fatalf("Unexpected video track: %+v", v)
+	}
+	if a.Format != "mp4a" || !bytes.Equal(a.Config, testASC) || a.Channels != 2 {
+		t.Fatalf("Unexpected audio track: %+v", a)
+	}
+
+	// 96kHz doesn't fit 16.16, and is left to the AudioSpecificConfig.
+	if a.SampleRate != 0 {
+		t.Fatalf("Expected sample rate 0 above 65535, got %d", a.SampleRate)
+	}
+}
+
+func TestMediaSegment(t *testing.T) {
+	payloads := [][]byte{bytes.Repeat([]byte{0x01}, 100), bytes.Repeat([]byte{0x02}, 50), bytes.Repeat([]byte{0x03}, 70)}
+	samples := []*Sample{
+		{Duration: 40, Size: 100, Flags: SampleFlags(0, 2, 1, 0, 0), CompositionTimeOffset: 80},
+		{Duration: 40, Size: 50, Flags: SampleFlags(0, 1, 0, 0, 1), CompositionTimeOffset: -40},
+		{Duration: 33, Size: 70, Flags: SampleFlags(0, 1, 0, 0, 1)},
+	}
+	moof := MOOF(7, 1, 90000, samples...)
+	mdat := MDAT(payloads...)
+	data := Merge(moof, mdat)
+
+	paths := testWalk(t, "", data)
+	for _, path := range []string{"moof.mfhd", "moof.traf.tfhd", "moof.traf.tfdt", "moof.traf.trun", "mdat"} {
+		testHas(t, paths, path)
+	}
+
+	// The data offset of trun points to the first byte of the mdat payload, relative to moof.
+	i := bytes.Index(moof, []byte("trun"))
+	if i < 4 {
+		t.Fatalf("trun not found")
+	}
+	trun := moof[i-4:]
+	if n := binary.BigEndian.Uint32(trun[12:16]); n != uint32(len(samples)) {
+		t.Fatalf("Expected sample count %d, got %d", len(samples), n)
+	}
+	if offset := binary.BigEndian.Uint32(trun[16:20]); offset != uint32(len(moof)+8) {
+		t.Fatalf("Expected data offset %d, got %d", len(moof)+8, offset)
+	}
+
+	// Without init segment, the track is unknown to the parser. Prepends one.
+	init := MOOV(1000, 0, true, &Track{ID: 1, Handler: HANDLER_VIDEO, Timescale: 1000, Config: testAVCC})
+	_, frames, err := new(Parser).Init().Append(Merge(init, data))
+	if err != nil {
+		t.Fatalf("Failed to parse: %v", err)
+	}
+	if len(frames) != len(samples) {
+		t.Fatalf("Expected %d frames, got %d", len(samples), len(frames))
+	}
+
+	dts := uint64(90000)
+	for i, f := range frames {
+		s := samples[i]
+		if f.TrackID != 1 || f.DTS != dts || f.Duration != s.Duration || f.CompositionTimeOffset != s.CompositionTimeOffset {
+			t.Fatalf("Unexpected frame %d: %+v", i, f)
+		}
+		if f.Keyframe != (i == 0) {
+			t.Fatalf("Expected frame %d keyframe=%v", i, i == 0)
+		}
+		if !bytes.Equal(f.Data, payloads[i]) {
+			t.Fatalf("Unexpected data of frame %d", i)
+		}
+		dts += uint64(s.Duration)
+	}
+}
+
+// TestRunSampleCount rejects a trun with a sample count out of bounds, which has no per-sample fields to bound it.
+func TestRunSampleCount(t *testing.T) {
+	init := MOOV(1000, 0, true, &Track{ID: 1, Handler: HANDLER_VIDEO, Timescale: 1000, Config: testAVCC})
+	moof := Box("moof",
+		FullBox("mfhd", 0, 0, u32(1)),
+		Box("traf",
+			FullBox("tfhd", 0, TFHD_DEFAULT_BASE_IS_MOOF|TFHD_DEFAULT_SAMPLE_SIZE, u32(1), u32(100)),
+			FullBox("trun", 0, 0, u32(0xFFFFFFFF)),
+		),
+	)
+
+	_, _, err := new(Parser).Init().Append(Merge(init, moof))
+	if err == nil {
+		t.Fatalf("Expected error of too many samples")
+	}
+}
+
+// testSIDX returns a sidx of the references, each of which is the size and duration of a subsegment.
+func testSIDX(version byte, ept uint64, offset uint64, refs ...[2]uint32) []byte {
+	b := Merge(u32(1), u32(1000))
+	if version == 0 {
+		b = Merge(b, u32(uint32(ept)), u32(uint32(offset)))
+	} else {
+		b = Merge(b, u64(ept), u64(offset))
+	}
+	b = Merge(b, u16(0), u16(uint16(len(refs))))
+	for _, ref := range refs {
+		b = Merge(b, u32(ref[0]), u32(ref[1]), u32(0x90000000))
+	}
+	return FullBox("sidx", version, 0, b)
+}
+
+func TestParseSIDX(t *testing.T) {
+	for _, item := range []struct {
+		name    string
+		data    []byte
+		end     int
+		ept     uint64
+		offset  uint64
+		sizes   []uint32
+		invalid bool
+	}{
+		{
+			name:  "version 0",
+			data:  testSIDX(0, 1000, 0, [2]uint32{100, 2000}, [2]uint32{200, 2000}),
+			end:   32 + 2*12,
+			ept:   1000,
+			sizes: []uint32{100, 200},
+		},
+		{
+			name:   "version 1 after styp",
+			data:   Merge(FTYP("msdh", 0, "msdh", "msix"), testSIDX(1, 1<<40, 16, [2]uint32{300, 2000})),
+			end:    24 + 40 + 12,
+			ept:    1 << 40,
+			offset: 16,
+			sizes:  []uint32{300},
+		},
+		{
+			name:    "not found",
+			data:    FTYP("msdh", 0, "msdh"),
+			invalid: true,
+		},
+		{
+			name:    "truncated references",
+			data:    testSIDX(0, 0, 0, [2]uint32{100, 2000})[:40],
+			invalid: true,
+		},
+	} {
+		sidx, end, err := ParseSIDX(item.data)
+		if item.invalid {
+			if err == nil {
+				t.Fatalf("%s: expected error", item.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%s: %v", item.name, err)
+		}
+		if end != item.end || sidx.Timescale != 1000 || sidx.EarliestPresentationTime != item.ept || sidx.FirstOffset != item.offset {
+			t.Fatalf("%s: end=%d, timescale=%d, ept=%d, offset=%d", item.name, end, sidx.Timescale, sidx.EarliestPresentationTime, sidx.FirstOffset)
+		}
+		if len(sidx.References) != len(item.sizes) {
+			t.Fatalf("%s: %d references, expected %d", item.name, len(sidx.References), len(item.sizes))
+		}
+		for i, ref := range sidx.References {
+			if ref.Type != 0 || ref.Size != item.sizes[i] || ref.Duration != 2000 || !ref.StartsWithSAP {
+				t.Fatalf("%s: reference %d is %+v", item.name, i, ref)
+			}
+		}
+	}
+}
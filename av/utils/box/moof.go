@@ -0,0 +1,49 @@
+package box
+
+import (
+	"encoding/binary"
+)
+
+// Sample describes a sample of a track fragment.
+type Sample struct {
+	Duration              uint32
+	Size                  uint32
+	Flags                 uint32
+	CompositionTimeOffset int32
+}
+
+// MOOF returns a movie fragment box of the track, followed by the samples in mdat.
+func MOOF(sequence uint32, trackID uint32, baseMediaDecodeTime uint64, samples ...*Sample) []byte {
+	mfhd := FullBox("mfhd", 0, 0, u32(sequence))
+	tfhd := FullBox("tfhd", 0, 0x020000, u32(trackID)) // default-base-is-moof
+	tfdt := FullBox("tfdt", 1, 0, u64(baseMediaDecodeTime))
+
+	// Data offset is relative to the start of moof, up to the payload of mdat.
+	size := 8 + len(mfhd) + 8 + len(tfhd) + len(tfdt) + trunSize(len(samples))
+	trun := TRUN(uint32(size+8), samples...)
+
+	return Box("moof", mfhd, Box("traf", tfhd, tfdt, trun))
+}
+
+// TRUN returns a track fragment run box, with duration, size, flags and composition time offset of each sample.
+func TRUN(dataOffset uint32, samples ...*Sample) []byte {
+	b := make([]byte, 8+16*len(samples))
+	binary.BigEndian.PutUint32(b[0:4], uint32(len(samples)))
+	binary.BigEndian.PutUint32(b[4:8], dataOffset)
+
+	i := 8
+	for _, s := range samples {
+		binary.BigEndian.PutUint32(b[i:i+4], s.Duration)
+		binary.BigEndian.PutUint32(b[i+4:i+8], s.Size)
+		binary.BigEndian.PutUint32(b[i+8:i+12], s.Flags)
+		binary.BigEndian.PutUint32(b[i+12:i+16], uint32(s.CompositionTimeOffset))
+		i += 16
+	}
+
+	// Version 1 for signed composition time offsets.
+	return FullBox("trun", 1, 0x000F01, b)
+}
+
+func trunSize(n int) int {
+	return 12 + 8 + 16*n
+}
@@ -0,0 +1,265 @@
+package box
+
+import (
+	"encoding/binary"
+)
+
+// Track describes a track of the movie.
+type Track struct {
+	ID        uint32
+	Handler   string // HANDLER_VIDEO or HANDLER_SOUND
+	Timescale uint32
+	Duration  uint32       // in Timescale, 0 if fragmented
+	Config    []byte       // AVCDecoderConfigurationRecord of avc1, or AudioSpecificConfig of mp4a
+	Format    string       // sample entry type, e.g. "avc1", "mp4a", only set by Parser
+	Table     *SampleTable // nil if fragmented
+
+	// Video
+	Width  uint32
+	Height uint32
+
+	// Audio
+	SampleRate uint32
+	Channels   uint16
+	SampleSize uint16
+	Bitrate    uint32
+}
+
+// MOOV returns a movie box of the tracks.
+// If fragmented, the sample tables are left empty, and mvex is appended.
+func MOOV(timescale uint32, duration uint32, fragmented bool, tracks ...*Track) []byte {
+	var (
+		next uint32 = 1
+	)
+
+	boxes := [][]byte{nil}
+	for _, t := range tracks {
+		boxes = append(boxes, TRAK(t, timescale, STBL(t)))
+		if t.ID >= next {
+			next = t.ID + 1
+		}
+	}
+	boxes[0] = MVHD(timescale, duration, next)
+	if fragmented {
+		boxes = append(boxes, MVEX(tracks...))
+	}
+	return Box("moov", boxes...)
+}
+
+// MVHD returns a movie header box.
+func MVHD(timescale uint32, duration uint32, nextTrackID uint32) []byte {
+	b := make([]byte, 96)
+	binary.BigEndian.PutUint32(b[8:12], timescale)
+	binary.BigEndian.PutUint32(b[12:16], duration)
+	binary.BigEndian.PutUint32(b[16:20], 0x00010000) // rate 1.0
+	binary.BigEndian.PutUint16(b[20:22], 0x0100)     // volume 1.0
+	copy(b[32:68], matrix)
+	binary.BigEndian.PutUint32(b[92:96], nextTrackID)
+	return FullBox("mvhd", 0, 0, b)
+}
+
+// TRAK returns a track box with the sample table box.
+func TRAK(t *Track, timescale uint32, stbl []byte) []byte {
+	return Box("trak", TKHD(t, timescale), MDIA(t, stbl))
+}
+
+// TKHD returns a track header box, of which the duration is in the movie timescale.
+func TKHD(t *Track, timescale uint32) []byte {
+	var (
+		duration uint32
+	)
+
+	if t.Timescale > 0 {
+		duration = uint32(uint64(t.Duration) * uint64(timescale) / uint64(t.Timescale))
+	}
+
+	b := make([]byte, 80)
+	binary.BigEndian.PutUint32(b[8:12], t.ID)
+	binary.BigEndian.PutUint32(b[16:20], duration)
+	if t.Handler == HANDLER_SOUND {
+		binary.BigEndian.PutUint16(b[32:34], 0x0100) // volume 1.0
+	}
+	copy(b[36:72], matrix)
+	binary.BigEndian.PutUint32(b[72:76], t.Width<<16)
+	binary.BigEndian.PutUint32(b[76:80], t.Height<<16)
+	return FullBox("tkhd", 0, 0x000007, b) // enabled, in movie, in preview
+}
+
+// MDIA returns a media box.
+func MDIA(t *Track, stbl []byte) []byte {
+	return Box("mdia", MDHD(t), HDLR(t.Handler), MINF(t, stbl))
+}
+
+// MDHD returns a media header box.
+func MDHD(t *Track) []byte {
+	b := make([]byte, 20)
+	binary.BigEndian.PutUint32(b[8:12], t.Timescale)
+	binary.BigEndian.PutUint32(b[12:16], t.Duration)
+	binary.BigEndian.PutUint16(b[16:18], 0x55C4) // "und"
+	return FullBox("mdhd", 0, 0, b)
+}
+
+// HDLR returns a handler reference box.
+func HDLR(handler string) []byte {
+	var (
+		name string
+	)
+
+	switch handler {
+	case HANDLER_VIDEO:
+		name = "VideoHandler"
+	case HANDLER_SOUND:
+		name = "SoundHandler"
+	}
+
+	b := make([]byte, 20, 21+len(name))
+	copy(b[4:8], handler)
+	b = append(b, name...)
+	b = append(b, 0x00)
+	return FullBox("hdlr", 0, 0, b)
+}
+
+// MINF returns a media information box.
+func MINF(t *Track, stbl []byte) []byte {
+	var (
+		header []byte
+	)
+
+	switch t.Handler {
+	case HANDLER_VIDEO:
+		header = FullBox("vmhd", 0, 1, make([]byte, 8))
+	default:
+		header = FullBox("smhd", 0, 0, make([]byte, 4))
+	}
+
+	url := FullBox("url ", 0, 1) // media data in the same file
+	dinf := Box("dinf", FullBox("dref", 0, 0, u32(1), url))
+	return Box("minf", header, dinf, stbl)
+}
+
+// STBL returns a sample table box, of which the tables are empty if the track has no SampleTable.
+func STBL(t *Track) []byte {
+	if t.Table != nil {
+		return t.Table.box(STSD(t))
+	}
+	return Box("stbl",
+		STSD(t),
+		FullBox("stts", 0, 0, u32(0)),
+		FullBox("stsc", 0, 0, u32(0)),
+		FullBox("stsz", 0, 0, u32(0), u32(0)),
+		FullBox("stco", 0, 0, u32(0)),
+	)
+}
+
+// STSD returns a sample description box with avc1 or mp4a.
+func STSD(t *Track) []byte {
+	var (
+		entry []byte
+	)
+
+	switch t.Handler {
+	case HANDLER_VIDEO:
+		entry = AVC1(t)
+	default:
+		entry = MP4A(t)
+	}
+	return FullBox("stsd", 0, 0, u32(1), entry)
+}
+
+// AVC1 returns an AVC sample entry.
+func AVC1(t *Track) []byte {
+	b := make([]byte, 78)
+	binary.BigEndian.PutUint16(b[6:8], 1) // data_reference_index
+	binary.BigEndian.PutUint16(b[24:26], uint16(t.Width))
+	binary.BigEndian.PutUint16(b[26:28], uint16(t.Height))
+	binary.BigEndian.PutUint32(b[28:32], 0x00480000) // horizresolution 72 dpi
+	binary.BigEndian.PutUint32(b[32:36], 0x00480000) // vertresolution 72 dpi
+	binary.BigEndian.PutUint16(b[40:42], 1)          // frame_count
+	binary.BigEndian.PutUint16(b[74:76], 0x0018)     // depth
+	binary.BigEndian.PutUint16(b[76:78], 0xFFFF)     // pre_defined
+	return Box("avc1", b, Box("avcC", t.Config))
+}
+
+// MP4A returns an MPEG-4 audio sample entry.
+func MP4A(t *Track) []byte {
+	var (
+		channels   = t.Channels
+		samplesize = t.SampleSize
+	)
+
+	if channels == 0 {
+		channels = 2
+	}
+	if samplesize == 0 {
+		samplesize = 16
+	}
+
+	b := make([]byte, 28)
+	binary.BigEndian.PutUint16(b[6:8], 1) // data_reference_index
+	binary.BigEndian.PutUint16(b[16:18], channels)
+	binary.BigEndian.PutUint16(b[18:20], samplesize)
+	if t.SampleRate <= 0xFFFF {
+		// 16.16 fixed point, or else 0, as the rate is given by AudioSpecificConfig in esds anyway.
+		binary.BigEndian.PutUint32(b[24:28], t.SampleRate<<16)
+	}
+	return Box("mp4a", b, ESDS(t))
+}
+
+// ESDS returns an elementary stream descriptor box, ISO/IEC 14496-1 7.2.6.5.
+func ESDS(t *Track) []byte {
+	// DecoderSpecificInfo
+	dsi := descriptor(0x05, t.Config)
+
+	// DecoderConfigDescriptor
+	dcd := make([]byte, 13)
+	dcd[0] = 0x40        // objectTypeIndication, Audio ISO/IEC 14496-3
+	dcd[1] = 0x05<<2 | 1 // streamType AudioStream, upStream 0, reserved 1
+	binary.BigEndian.PutUint32(dcd[5:9], t.Bitrate)
+	binary.BigEndian.PutUint32(dcd[9:13], t.Bitrate)
+
+	// ES_Descriptor
+	es := make([]byte, 3)
+	binary.BigEndian.PutUint16(es[0:2], uint16(t.ID))
+
+	// SLConfigDescriptor, predefined for MP4 files.
+	sl := descriptor(0x06, []byte{0x02})
+
+	return FullBox("esds", 0, 0, descriptor(0x03, es, descriptor(0x04, dcd, dsi), sl))
+}
+
+// descriptor returns a base descriptor, with the size in the 4-byte expandable form.
+func descriptor(tag byte, payloads ...[]byte) []byte {
+	size := 0
+	for _, p := range payloads {
+		size += len(p)
+	}
+
+	b := make([]byte, 5, 5+size)
+	b[0] = tag
+	b[1] = byte(size>>21)&0x7F | 0x80
+	b[2] = byte(size>>14)&0x7F | 0x80
+	b[3] = byte(size>>7)&0x7F | 0x80
+	b[4] = byte(size) & 0x7F
+	for _, p := range payloads {
+		b = append(b, p...)
+	}
+	return b
+}
+
+// MVEX returns a movie extends box of the tracks.
+func MVEX(tracks ...*Track) []byte {
+	boxes := make([][]byte, 0, len(tracks))
+	for _, t := range tracks {
+		boxes = append(boxes, TREX(t.ID))
+	}
+	return Box("mvex", boxes...)
+}
+
+// TREX returns a track extends box.
+func TREX(trackID uint32) []byte {
+	b := make([]byte, 20)
+	binary.BigEndian.PutUint32(b[0:4], trackID)
+	binary.BigEndian.PutUint32(b[4:8], 1) // default_sample_description_index
+	binary.BigEndian.PutUint32(b[16:20], SampleFlags(0, 1, 0, 0, 1))
+	return FullBox("trex", 0, 0, b)
+}
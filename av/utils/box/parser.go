@@ -0,0 +1,569 @@
+package box
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// Track fragment header flags.
+const (
+	TFHD_BASE_DATA_OFFSET         = 0x000001
+	TFHD_SAMPLE_DESCRIPTION_INDEX = 0x000002
+	TFHD_DEFAULT_SAMPLE_DURATION  = 0x000008
+	TFHD_DEFAULT_SAMPLE_SIZE      = 0x000010
+	TFHD_DEFAULT_SAMPLE_FLAGS     = 0x000020
+	TFHD_DURATION_IS_EMPTY        = 0x010000
+	TFHD_DEFAULT_BASE_IS_MOOF     = 0x020000
+)
+
+// Track fragment run flags.
+const (
+	TRUN_DATA_OFFSET                    = 0x000001
+	TRUN_FIRST_SAMPLE_FLAGS             = 0x000004
+	TRUN_SAMPLE_DURATION                = 0x000100
+	TRUN_SAMPLE_SIZE                    = 0x000200
+	TRUN_SAMPLE_FLAGS                   = 0x000400
+	TRUN_SAMPLE_COMPOSITION_TIME_OFFSET = 0x000800
+)
+
+// MaxRunSamples bounds the sample count of a trun without per-sample fields, which is not bounded by the box size.
+const MaxRunSamples = 1 << 16
+
+// Frame is a sample of a track, extracted from moof and mdat.
+type Frame struct {
+	TrackID               uint32
+	DTS                   uint64 // in the track timescale
+	Duration              uint32
+	CompositionTimeOffset int32
+	Keyframe              bool
+	Data                  []byte
+}
+
+type defaults struct {
+	duration uint32
+	size     uint32
+	flags    uint32
+}
+
+// run is a track fragment run waiting for mdat, the offset is absolute in the stream.
+type run struct {
+	offset int64
+	frames []*Frame
+	sizes  []uint32
+}
+
+// Parser parses boxes of fragmented MP4 from a byte stream, into tracks of moov, and frames of moof and mdat.
+type Parser struct {
+	buffer   []byte
+	offset   int64 // stream offset of buffer[0]
+	tracks   map[uint32]*Track
+	defaults map[uint32]*defaults
+	runs     []*run
+}
+
+// Init this class.
+func (me *Parser) Init() *Parser {
+	me.buffer = nil
+	me.offset = 0
+	me.tracks = make(map[uint32]*Track)
+	me.defaults = make(map[uint32]*defaults)
+	me.runs = nil
+	return me
+}
+
+// Track returns the track parsed from moov by the ID.
+func (me *Parser) Track(id uint32) *Track {
+	return me.tracks[id]
+}
+
+// Append parses the buffer, returns tracks of any complete moov, and frames of any complete mdat.
+func (me *Parser) Append(data []byte) ([]*Track, []*Frame, error) {
+	var (
+		tracks []*Track
+		frames []*Frame
+	)
+
+	me.buffer = append(me.buffer, data...)
+
+	for len(me.buffer) >= 8 {
+		typ, header, size := readHeader(me.buffer)
+		if size == 0 {
+			return tracks, frames, fmt.Errorf("box %s with size to the end not supported", typ)
+		}
+		if size < int64(header) {
+			return tracks, frames, fmt.Errorf("invalid box size %d of %s", size, typ)
+		}
+		if int64(len(me.buffer)) < size {
+			break
+		}
+
+		b := me.buffer[header:size]
+		switch typ {
+		case "moov":
+			t, err := me.parseMOOV(b)
+			if err != nil {
+				return tracks, frames, err
+			}
+			tracks = append(tracks, t...)
+
+		case "moof":
+			err := me.parseMOOF(b, me.offset)
+			if err != nil {
+				return tracks, frames, err
+			}
+
+		case "mdat":
+			frames = append(frames, me.parseMDAT(b, me.offset+int64(header))...)
+
+		default:
+			// ftyp, styp, sidx, prft, emsg, free, etc.
+		}
+
+		me.buffer = me.buffer[size:]
+		me.offset += size
+	}
+
+	// Release the consumed memory.
+	if len(me.buffer) == 0 {
+		me.buffer = nil
+	}
+	return tracks, frames, nil
+}
+
+// readHeader returns type, header size and box size, which is 0 if extended to the end.
+func readHeader(b []byte) (string, int, int64) {
+	size := int64(binary.BigEndian.Uint32(b[0:4]))
+	typ := string(b[4:8])
+	header := 8
+
+	if size == 1 {
+		if len(b) < 16 {
+			return typ, 16, 1<<63 - 1
+		}
+		size = int64(binary.BigEndian.Uint64(b[8:16]))
+		header = 16
+	}
+	return typ, header, size
+}
+
+// Children calls fn with each child box in b.
+func Children(b []byte, fn func(typ string, payload []byte) error) error {
+	for len(b) >= 8 {
+		typ, header, size := readHeader(b)
+		if size == 0 {
+			size = int64(len(b))
+		}
+		if size < int64(header) || size > int64(len(b)) {
+			return fmt.Errorf("invalid box size %d of %s", size, typ)
+		}
+
+		err := fn(typ, b[header:size])
+		if err != nil {
+			return err
+		}
+		b = b[size:]
+	}
+	return nil
+}
+
+func (me *Parser) parseMOOV(b []byte) ([]*Track, error) {
+	var (
+		tracks []*Track
+	)
+
+	err := Children(b, func(typ string, payload []byte) error {
+		switch typ {
+		case "trak":
+			t := new(Track)
+			err := parseTRAK(t, payload)
+			if err != nil {
+				return err
+			}
+			me.tracks[t.ID] = t
+			tracks = append(tracks, t)
+
+		case "mvex":
+			return Children(payload, func(typ string, payload []byte) error {
+				if typ == "trex" && len(payload) >= 24 {
+					me.defaults[binary.BigEndian.Uint32(payload[4:8])] = &defaults{
+						duration: binary.BigEndian.Uint32(payload[12:16]),
+						size:     binary.BigEndian.Uint32(payload[16:20]),
+						flags:    binary.BigEndian.Uint32(payload[20:24]),
+					}
+				}
+				return nil
+			})
+		}
+		return nil
+	})
+	return tracks, err
+}
+
+// ParseTrack returns the track of a trak payload, e.g. of progressive MP4, without the sample tables.
+func ParseTrack(b []byte) (*Track, error) {
+	t := new(Track)
+	err := parseTRAK(t, b)
+	return t, err
+}
+
+func parseTRAK(t *Track, b []byte) error {
+	return Children(b, func(typ string, payload []byte) error {
+		switch typ {
+		case "tkhd":
+			if len(payload) < 4 {
+				return fmt.Errorf("data not enough while parsing tkhd")
+			}
+			i := 12
+			if payload[0] == 1 {
+				i = 20
+			}
+			if len(payload) < i+4 {
+				return fmt.Errorf("data not enough while parsing tkhd")
+			}
+			t.ID = binary.BigEndian.Uint32(payload[i : i+4])
+
+		case "mdia", "minf", "stbl":
+			return parseTRAK(t, payload)
+
+		case "mdhd":
+			if len(payload) < 4 {
+				return fmt.Errorf("data not enough while parsing mdhd")
+			}
+			i := 12
+			if payload[0] == 1 {
+				i = 20
+			}
+			if len(payload) < i+4 {
+				return fmt.Errorf("data not enough while parsing mdhd")
+			}
+			t.Timescale = binary.BigEndian.Uint32(payload[i : i+4])
+
+		case "hdlr":
+			if len(payload) < 12 {
+				return fmt.Errorf("data not enough while parsing hdlr")
+			}
+			t.Handler = string(payload[8:12])
+
+		case "stsd":
+			if len(payload) < 8 {
+				return fmt.Errorf("data not enough while parsing stsd")
+			}
+			// Only the first sample entry is used.
+			return Children(payload[8:], func(typ string, payload []byte) error {
+				if t.Format == "" {
+					t.Format = typ
+					return parseSampleEntry(t, typ, payload)
+				}
+				return nil
+			})
+		}
+		return nil
+	})
+}
+
+func parseSampleEntry(t *Track, typ string, b []byte) error {
+	switch typ {
+	case "avc1", "avc3":
+		if len(b) < 78 {
+			return fmt.Errorf("data not enough while parsing %s", typ)
+		}
+		t.Width = uint32(binary.BigEndian.Uint16(b[24:26]))
+		t.Height = uint32(binary.BigEndian.Uint16(b[26:28]))
+		return Children(b[78:], func(typ string, payload []byte) error {
+			if typ == "avcC" {
+				t.Config = payload
+			}
+			return nil
+		})
+
+	case "mp4a":
+		if len(b) < 28 {
+			return fmt.Errorf("data not enough while parsing %s", typ)
+		}
+
+		// QuickTime sound sample description version 1 and 2.
+		i := 28
+		switch binary.BigEndian.Uint16(b[8:10]) {
+		case 1:
+			i += 16
+		case 2:
+			i += 36
+		}
+		if len(b) < i {
+			return fmt.Errorf("data not enough while parsing %s", typ)
+		}
+
+		t.Channels = binary.BigEndian.Uint16(b[16:18])
+		t.SampleSize = binary.BigEndian.Uint16(b[18:20])
+		t.SampleRate = binary.BigEndian.Uint32(b[24:28]) >> 16
+		return Children(b[i:], func(typ string, payload []byte) error {
+			if typ == "esds" && len(payload) > 4 {
+				t.Config = parseDescriptor(payload[4:])
+			}
+			return nil
+		})
+	}
+	return nil
+}
+
+// parseDescriptor returns DecoderSpecificInfo in the ES_Descriptor.
+func parseDescriptor(b []byte) []byte {
+	for len(b) >= 2 {
+		tag := b[0]
+		size := 0
+		i := 1
+		for ; i < len(b) && i <= 4; i++ {
+			size = size<<7 | int(b[i]&0x7F)
+			if b[i]&0x80 == 0 {
+				break
+			}
+		}
+		i++
+		if i+size > len(b) {
+			return nil
+		}
+
+		payload := b[i : i+size]
+		switch tag {
+		case 0x03: // ES_Descriptor
+			if len(payload) < 3 {
+				return nil
+			}
+			flags := payload[2]
+			j := 3
+			if flags&0x80 != 0 {
+				j += 2
+			}
+			if flags&0x40 != 0 && j < len(payload) {
+				j += int(payload[j]) + 1
+			}
+			if flags&0x20 != 0 {
+				j += 2
+			}
+			if j > len(payload) {
+				return nil
+			}
+			return parseDescriptor(payload[j:])
+
+		case 0x04: // DecoderConfigDescriptor
+			if len(payload) < 13 {
+				return nil
+			}
+			return parseDescriptor(payload[13:])
+
+		case 0x05: // DecoderSpecificInfo
+			return payload
+		}
+		b = b[i+size:]
+	}
+	return nil
+}
+
+func (me *Parser) parseMOOF(b []byte, start int64) error {
+	return Children(b, func(typ string, payload []byte) error {
+		if typ == "traf" {
+			return me.parseTRAF(payload, start)
+		}
+		return nil
+	})
+}
+
+func (me *Parser) parseTRAF(b []byte, start int64) error {
+	var (
+		trackID uint32
+		dflt    defaults
+		base    = start
+		dts     uint64
+		next    int64 = -1
+	)
+
+	return Children(b, func(typ string, payload []byte) error {
+		switch typ {
+		case "tfhd":
+			if len(payload) < 8 {
+				return fmt.Errorf("data not enough while parsing tfhd")
+			}
+			flags := binary.BigEndian.Uint32(payload[0:4]) & 0xFFFFFF
+			trackID = binary.BigEndian.Uint32(payload[4:8])
+			if d := me.defaults[trackID]; d != nil {
+				dflt = *d
+			}
+
+			i := 8
+			read := func(n int) []byte {
+				if len(payload) < i+n {
+					return nil
+				}
+				i += n
+				return payload[i-n : i]
+			}
+			if flags&TFHD_BASE_DATA_OFFSET != 0 {
+				if v := read(8); v != nil {
+					base = int64(binary.BigEndian.Uint64(v))
+				}
+			}
+			if flags&TFHD_SAMPLE_DESCRIPTION_INDEX != 0 {
+				read(4)
+			}
+			if flags&TFHD_DEFAULT_SAMPLE_DURATION != 0 {
+				if v := read(4); v != nil {
+					dflt.duration = binary.BigEndian.Uint32(v)
+				}
+			}
+			if flags&TFHD_DEFAULT_SAMPLE_SIZE != 0 {
+				if v := read(4); v != nil {
+					dflt.size = binary.BigEndian.Uint32(v)
+				}
+			}
+			if flags&TFHD_DEFAULT_SAMPLE_FLAGS != 0 {
+				if v := read(4); v != nil {
+					dflt.flags = binary.BigEndian.Uint32(v)
+				}
+			}
+
+		case "tfdt":
+			if len(payload) < 8 {
+				return fmt.Errorf("data not enough while parsing tfdt")
+			}
+			if payload[0] == 1 {
+				if len(payload) < 12 {
+					return fmt.Errorf("data not enough while parsing tfdt")
+				}
+				dts = binary.BigEndian.Uint64(payload[4:12])
+			} else {
+				dts = uint64(binary.BigEndian.Uint32(payload[4:8]))
+			}
+
+		case "trun":
+			r, err := parseTRUN(payload, trackID, &dflt, base, next, dts)
+			if err != nil {
+				return err
+			}
+			me.runs = append(me.runs, r)
+
+			// The next run without data offset follows this one.
+			for _, f := range r.frames {
+				dts += uint64(f.Duration)
+			}
+			if r.offset >= 0 {
+				next = r.offset
+				for _, size := range r.sizes {
+					next += int64(size)
+				}
+			}
+		}
+		return nil
+	})
+}
+
+func parseTRUN(b []byte, trackID uint32, dflt *defaults, base int64, next int64, dts uint64) (*run, error) {
+	if len(b) < 8 {
+		return nil, fmt.Errorf("data not enough while parsing trun")
+	}
+
+	version := b[0]
+	flags := binary.BigEndian.Uint32(b[0:4]) & 0xFFFFFF
+	count := binary.BigEndian.Uint32(b[4:8])
+
+	r := &run{offset: next}
+	i := 8
+	if flags&TRUN_DATA_OFFSET != 0 {
+		if len(b) < i+4 {
+			return nil, fmt.Errorf("data not enough while parsing trun")
+		}
+		r.offset = base + int64(int32(binary.BigEndian.Uint32(b[i:i+4])))
+		i += 4
+	}
+
+	first := dflt.flags
+	hasFirst := false
+	if flags&TRUN_FIRST_SAMPLE_FLAGS != 0 {
+		if len(b) < i+4 {
+			return nil, fmt.Errorf("data not enough while parsing trun")
+		}
+		first = binary.BigEndian.Uint32(b[i : i+4])
+		hasFirst = true
+		i += 4
+	}
+
+	per := 0
+	for _, f := range []uint32{TRUN_SAMPLE_DURATION, TRUN_SAMPLE_SIZE, TRUN_SAMPLE_FLAGS, TRUN_SAMPLE_COMPOSITION_TIME_OFFSET} {
+		if flags&f != 0 {
+			per += 4
+		}
+	}
+	if uint64(len(b)-i) < uint64(count)*uint64(per) {
+		return nil, fmt.Errorf("data not enough while parsing trun samples")
+	}
+	if per == 0 && count > MaxRunSamples {
+		return nil, fmt.Errorf("too many samples in trun: %d", count)
+	}
+
+	r.frames = make([]*Frame, count)
+	r.sizes = make([]uint32, count)
+	for n := uint32(0); n < count; n++ {
+		f := &Frame{TrackID: trackID, DTS: dts, Duration: dflt.duration}
+		size := dflt.size
+		sflags := dflt.flags
+		if n == 0 && hasFirst {
+			sflags = first
+		}
+
+		if flags&TRUN_SAMPLE_DURATION != 0 {
+			f.Duration = binary.BigEndian.Uint32(b[i : i+4])
+			i += 4
+		}
+		if flags&TRUN_SAMPLE_SIZE != 0 {
+			size = binary.BigEndian.Uint32(b[i : i+4])
+			i += 4
+		}
+		if flags&TRUN_SAMPLE_FLAGS != 0 {
+			sflags = binary.BigEndian.Uint32(b[i : i+4])
+			i += 4
+		}
+		if flags&TRUN_SAMPLE_COMPOSITION_TIME_OFFSET != 0 {
+			v := binary.BigEndian.Uint32(b[i : i+4])
+			if version == 0 {
+				f.CompositionTimeOffset = int32(v & 0x7FFFFFFF) // unsigned, but never that large in practice
+			} else {
+				f.CompositionTimeOffset = int32(v)
+			}
+			i += 4
+		}
+
+		f.Keyframe = sflags&0x00010000 == 0
+		dts += uint64(f.Duration)
+		r.frames[n] = f
+		r.sizes[n] = size
+	}
+	return r, nil
+}
+
+// parseMDAT extracts the frames of the pending runs, from the payload starting at the stream offset.
+func (me *Parser) parseMDAT(b []byte, start int64) []*Frame {
+	var (
+		frames []*Frame
+	)
+
+	end := start + int64(len(b))
+	for _, r := range me.runs {
+		offset := r.offset
+		if offset < 0 {
+			offset = start
+		}
+
+		for i, f := range r.frames {
+			size := int64(r.sizes[i])
+			if offset < start || offset+size > end {
+				break
+			}
+
+			f.Data = b[offset-start : offset-start+size]
+			frames = append(frames, f)
+			offset += size
+		}
+	}
+
+	me.runs = nil
+	return frames
+}
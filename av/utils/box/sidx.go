@@ -0,0 +1,89 @@
+package box
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// Reference to a subsegment, or to another sidx if Type is 1.
+type Reference struct {
+	Type          byte
+	Size          uint32
+	Duration      uint32
+	StartsWithSAP bool
+}
+
+// SegmentIndex parsed from sidx.
+type SegmentIndex struct {
+	ReferenceID              uint32
+	Timescale                uint32
+	EarliestPresentationTime uint64
+	FirstOffset              uint64 // from the end of sidx to the first subsegment
+	References               []Reference
+}
+
+// ParseSIDX parses the first sidx in b, and returns it with the offset of its end in b.
+func ParseSIDX(b []byte) (*SegmentIndex, int, error) {
+	for i := 0; i+8 <= len(b); /* void */ {
+		typ, header, size := readHeader(b[i:])
+		if size == 0 {
+			size = int64(len(b) - i)
+		}
+		if size < int64(header) || int64(i)+size > int64(len(b)) {
+			return nil, 0, fmt.Errorf("invalid box size %d of %s", size, typ)
+		}
+		if typ == "sidx" {
+			sidx, err := parseSIDX(b[i+header : i+int(size)])
+			return sidx, i + int(size), err
+		}
+		i += int(size)
+	}
+	return nil, 0, fmt.Errorf("sidx not found")
+}
+
+func parseSIDX(b []byte) (*SegmentIndex, error) {
+	if len(b) < 12 {
+		return nil, fmt.Errorf("sidx too short")
+	}
+
+	sidx := new(SegmentIndex)
+	version := b[0]
+	sidx.ReferenceID = binary.BigEndian.Uint32(b[4:8])
+	sidx.Timescale = binary.BigEndian.Uint32(b[8:12])
+
+	i := 12
+	if version == 0 {
+		if len(b) < i+12 {
+			return nil, fmt.Errorf("sidx too short")
+		}
+		sidx.EarliestPresentationTime = uint64(binary.BigEndian.Uint32(b[i : i+4]))
+		sidx.FirstOffset = uint64(binary.BigEndian.Uint32(b[i+4 : i+8]))
+		i += 8
+	} else {
+		if len(b) < i+20 {
+			return nil, fmt.Errorf("sidx too short")
+		}
+		sidx.EarliestPresentationTime = binary.BigEndian.Uint64(b[i : i+8])
+		sidx.FirstOffset = binary.BigEndian.Uint64(b[i+8 : i+16])
+		i += 16
+	}
+
+	count := int(binary.BigEndian.Uint16(b[i+2 : i+4]))
+	i += 4
+	if len(b) < i+count*12 {
+		return nil, fmt.Errorf("sidx references truncated")
+	}
+
+	sidx.References = make([]Reference, count)
+	for k := range sidx.References {
+		n := binary.BigEndian.Uint32(b[i : i+4])
+		sidx.References[k] = Reference{
+			Type:          byte(n >> 31),
+			Size:          n & 0x7FFFFFFF,
+			Duration:      binary.BigEndian.Uint32(b[i+4 : i+8]),
+			StartsWithSAP: b[i+8]&0x80 != 0,
+		}
+		i += 12
+	}
+	return sidx, nil
+}
@@ -0,0 +1,158 @@
+package box
+
+import (
+	"encoding/binary"
+	"math"
+)
+
+// Chunk is a run of contiguous samples of a track.
+type Chunk struct {
+	Offset  uint64 // absolute in the file
+	Samples uint32
+}
+
+// SampleTable holds the samples of a progressive MP4 track.
+type SampleTable struct {
+	Durations              []uint32
+	CompositionTimeOffsets []int32
+	Sizes                  []uint32
+	SyncSamples            []uint32 // 1-based sample numbers
+	Chunks                 []Chunk
+	AllSync                bool // stss is omitted if every sample is a sync sample
+}
+
+// Duration returns the sum of the sample durations.
+func (me *SampleTable) Duration() uint64 {
+	var (
+		d uint64
+	)
+
+	for _, n := range me.Durations {
+		d += uint64(n)
+	}
+	return d
+}
+
+// Large returns whether any chunk offset exceeds 32 bits, which requires co64 instead of stco.
+func (me *SampleTable) Large() bool {
+	for _, c := range me.Chunks {
+		if c.Offset > math.MaxUint32 {
+			return true
+		}
+	}
+	return false
+}
+
+func (me *SampleTable) box(stsd []byte) []byte {
+	boxes := [][]byte{stsd, me.stts()}
+	if ctts := me.ctts(); ctts != nil {
+		boxes = append(boxes, ctts)
+	}
+	if !me.AllSync {
+		boxes = append(boxes, me.stss())
+	}
+	boxes = append(boxes, me.stsc(), me.stsz(), me.stco())
+	return Box("stbl", boxes...)
+}
+
+// stts is run-length encoded sample durations.
+func (me *SampleTable) stts() []byte {
+	b := make([]byte, 4, 4+8*len(me.Durations))
+	n := uint32(0)
+	for i := 0; i < len(me.Durations); {
+		j := i
+		for j < len(me.Durations) && me.Durations[j] == me.Durations[i] {
+			j++
+		}
+		b = append(b, u32(uint32(j-i))...)
+		b = append(b, u32(me.Durations[i])...)
+		n++
+		i = j
+	}
+	binary.BigEndian.PutUint32(b[0:4], n)
+	return FullBox("stts", 0, 0, b)
+}
+
+// ctts is run-length encoded composition offsets, nil if all zero.
+func (me *SampleTable) ctts() []byte {
+	zero := true
+	for _, o := range me.CompositionTimeOffsets {
+		if o != 0 {
+			zero = false
+			break
+		}
+	}
+	if zero {
+		return nil
+	}
+
+	b := make([]byte, 4, 4+8*len(me.CompositionTimeOffsets))
+	n := uint32(0)
+	for i := 0; i < len(me.CompositionTimeOffsets); {
+		j := i
+		for j < len(me.CompositionTimeOffsets) && me.CompositionTimeOffsets[j] == me.CompositionTimeOffsets[i] {
+			j++
+		}
+		b = append(b, u32(uint32(j-i))...)
+		b = append(b, u32(uint32(me.CompositionTimeOffsets[i]))...)
+		n++
+		i = j
+	}
+	binary.BigEndian.PutUint32(b[0:4], n)
+
+	// Version 1 for signed offsets.
+	return FullBox("ctts", 1, 0, b)
+}
+
+func (me *SampleTable) stss() []byte {
+	b := make([]byte, 4, 4+4*len(me.SyncSamples))
+	binary.BigEndian.PutUint32(b[0:4], uint32(len(me.SyncSamples)))
+	for _, n := range me.SyncSamples {
+		b = append(b, u32(n)...)
+	}
+	return FullBox("stss", 0, 0, b)
+}
+
+// stsc has an entry only where samples per chunk changes.
+func (me *SampleTable) stsc() []byte {
+	b := make([]byte, 4, 4+12*len(me.Chunks))
+	n := uint32(0)
+	for i, c := range me.Chunks {
+		if i > 0 && me.Chunks[i-1].Samples == c.Samples {
+			continue
+		}
+		b = append(b, u32(uint32(i+1))...)
+		b = append(b, u32(c.Samples)...)
+		b = append(b, u32(1)...) // sample_description_index
+		n++
+	}
+	binary.BigEndian.PutUint32(b[0:4], n)
+	return FullBox("stsc", 0, 0, b)
+}
+
+func (me *SampleTable) stsz() []byte {
+	b := make([]byte, 8, 8+4*len(me.Sizes))
+	binary.BigEndian.PutUint32(b[4:8], uint32(len(me.Sizes)))
+	for _, n := range me.Sizes {
+		b = append(b, u32(n)...)
+	}
+	return FullBox("stsz", 0, 0, b)
+}
+
+func (me *SampleTable) stco() []byte {
+	if me.Large() {
+		b := make([]byte, 4, 4+8*len(me.Chunks))
+		binary.BigEndian.PutUint32(b[0:4], uint32(len(me.Chunks)))
+		for _, c := range me.Chunks {
+			b = append(b, u64(c.Offset)...)
+		}
+		return FullBox("co64", 0, 0, b)
+	}
+
+	b := make([]byte, 4, 4+4*len(me.Chunks))
+	binary.BigEndian.PutUint32(b[0:4], uint32(len(me.Chunks)))
+	for _, c := range me.Chunks {
+		b = append(b, u32(uint32(c.Offset))...)
+	}
+	return FullBox("stco", 0, 0, b)
+}
@@ -0,0 +1,103 @@
+package m3u8
+
+import (
+	"time"
+)
+
+const (
+	// cueTolerance of the segment boundaries, which drift by the rounding of EXTINF
+	cueTolerance = 50 * time.Millisecond
+)
+
+// AddCues sets EXT-X-CUE-OUT and EXT-X-CUE-IN on the segments where the date ranges with SCTE35-OUT or SCTE35-IN
+// start and end, for legacy players which don't support EXT-X-DATERANGE.
+// The segments are dated by EXT-X-PROGRAM-DATE-TIME, so nothing is set before the first one.
+// A date range starting or ending within a segment marks that segment, and one ending after the last segment marks nothing.
+func (me *MediaPlaylist) AddCues() {
+	var (
+		starts = make([]time.Time, len(me.MediaSegments))
+		t      time.Time
+	)
+
+	for i, item := range me.MediaSegments {
+		if item.EXT_X_PROGRAM_DATE_TIME != "" {
+			if v, err := time.Parse(time.RFC3339Nano, item.EXT_X_PROGRAM_DATE_TIME); err == nil {
+				t = v
+			}
+		}
+		starts[i] = t
+		if !t.IsZero() {
+			t = t.Add(time.Duration(item.EXTINF.Duration * float64(time.Second)))
+		}
+	}
+
+	// find returns the index of the segment containing t, or -1.
+	find := func(t time.Time) int {
+		for i, start := range starts {
+			if start.IsZero() {
+				continue
+			}
+			end := start.Add(time.Duration(me.MediaSegments[i].EXTINF.Duration * float64(time.Second)))
+			if end.Sub(t) > cueTolerance {
+				if t.Sub(start) < -cueTolerance {
+					return -1
+				}
+				return i
+			}
+		}
+		return -1
+	}
+
+	for _, item := range me.EXT_X_DATERANGE {
+		if item.SCTE35_OUT == nil && item.SCTE35_IN == nil {
+			continue
+		}
+		start, end, err := item.Span()
+		if err != nil {
+			continue
+		}
+
+		var duration float64
+		if !end.IsZero() {
+			duration = end.Sub(start).Seconds()
+		}
+
+		if i := find(start); i >= 0 {
+			seg := &me.MediaSegments[i]
+			if seg.EXT_X_CUE_OUT == nil {
+				seg.EXT_X_CUE_OUT = new(CueOutAttributes)
+			}
+			if duration > seg.EXT_X_CUE_OUT.DURATION {
+				seg.EXT_X_CUE_OUT.DURATION = duration
+			}
+		}
+		if duration > 0 {
+			if i := find(start.Add(time.Duration(duration * float64(time.Second)))); i >= 0 {
+				me.MediaSegments[i].EXT_X_CUE_IN = true
+			}
+		}
+	}
+}
+
+// Span returns the start and the end of the date range, by DURATION, END-DATE or PLANNED-DURATION in order.
+// The end is zero if unknown.
+func (me *DateRangeAttributes) Span() (time.Time, time.Time, error) {
+	start, err := time.Parse(time.RFC3339Nano, me.START_DATE)
+	if err != nil {
+		return start, time.Time{}, err
+	}
+
+	duration := me.DURATION
+	if duration == 0 && me.END_DATE != "" {
+		if end, err := time.Parse(time.RFC3339Nano, me.END_DATE); err == nil {
+			return start, end, nil
+		}
+	}
+	if duration == 0 {
+		duration = me.PLANNED_DURATION
+	}
+	if duration == 0 {
+		return start, time.Time{}, nil
+	}
+	return start, start.Add(time.Duration(duration * float64(time.Second))), nil
+}
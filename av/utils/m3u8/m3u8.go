@@ -3,6 +3,8 @@ package m3u8
 import (
 	"bytes"
 	"fmt"
+	"strconv"
+	"strings"
 )
 
 const (
@@ -17,6 +19,7 @@ type MediaPlaylist struct {
 	MediaMetadataTags
 	MediaSegments []MediaSegmentTags
 	chunks        int
+	variables     map[string]string
 	buffer        bytes.Buffer
 }
 
@@ -34,30 +37,12 @@ func (me *MediaPlaylist) Marshal() ([]byte, error) {
 
 	// basic tags
 	me.buffer.WriteString("#EXTM3U\n")
-	me.buffer.WriteString(fmt.Sprintf("#EXT-X-VERSION:%d\n", me.EXT_X_VERSION))
+	if me.EXT_X_VERSION > 0 {
+		me.buffer.WriteString(fmt.Sprintf("#EXT-X-VERSION:%d\n", me.EXT_X_VERSION))
+	}
 
 	// media playlist tags
-	if me.EXT_X_INDEPENDENT_SEGMENTS {
-		me.buffer.WriteString("#EXT-X-INDEPENDENT-SEGMENTS\n")
-	}
-	if me.EXT_X_START.TIME_OFFSET > 0 {
-		me.buffer.WriteString("#EXT-X-START:")
-		me.buffer.WriteString(fmt.Sprintf("TIME-OFFSET=%.5f", me.EXT_X_START.TIME_OFFSET))
-		if me.EXT_X_START.PRECISE != "" {
-			me.buffer.WriteString(fmt.Sprintf(",PRECISE:%s", me.EXT_X_START.PRECISE))
-		}
-		me.buffer.WriteString("\n")
-	}
-	if me.EXT_X_DEFINE.VALUE != "" {
-		me.buffer.WriteString("#EXT-X-DEFINE:")
-		if me.EXT_X_DEFINE.NAME != "" {
-			me.buffer.WriteString(fmt.Sprintf("NAME=%s", me.EXT_X_DEFINE.NAME))
-		}
-		if me.EXT_X_DEFINE.IMPORT != "" {
-			me.buffer.WriteString(fmt.Sprintf("IMPORT=%s", me.EXT_X_DEFINE.IMPORT))
-		}
-		me.buffer.WriteString(fmt.Sprintf(",VALUE=%s\n", me.EXT_X_DEFINE.VALUE))
-	}
+	me.MediaOrMasterPlaylistTags.marshal(&me.buffer)
 	me.buffer.WriteString(fmt.Sprintf("#EXT-X-TARGETDURATION:%d\n", me.EXT_X_TARGETDURATION))
 	if me.EXT_X_DISCONTINUITY_SEQUENCE != 0 {
 		me.buffer.WriteString(fmt.Sprintf("#EXT-X-DISCONTINUITY-SEQUENCE:%d\n", me.EXT_X_DISCONTINUITY_SEQUENCE))
@@ -70,46 +55,23 @@ func (me *MediaPlaylist) Marshal() ([]byte, error) {
 	}
 	if me.EXT_X_PART_INF.PART_TARGET > 0 {
 		me.buffer.WriteString("#EXT-X-PART-INF:")
-		me.buffer.WriteString(fmt.Sprintf("PART-TARGET=%.5f", me.EXT_X_PART_INF.PART_TARGET))
+		me.buffer.WriteString(fmt.Sprintf("PART-TARGET=%s", decimal(me.EXT_X_PART_INF.PART_TARGET, 5)))
 		me.buffer.WriteString("\n")
-
+	}
+	if attrs := me.EXT_X_SERVER_CONTROL.attributes(); len(attrs) > 0 {
 		me.buffer.WriteString("#EXT-X-SERVER-CONTROL:")
-		me.buffer.WriteString(fmt.Sprintf("PART-HOLD-BACK=%.1f", me.EXT_X_SERVER_CONTROL.PART_HOLD_BACK))
-		if me.EXT_X_SERVER_CONTROL.CAN_SKIP_UNTIL > 0 {
-			me.buffer.WriteString(fmt.Sprintf(",CAN-SKIP-UNTIL=%.1f", me.EXT_X_SERVER_CONTROL.CAN_SKIP_UNTIL))
-		}
-		if me.EXT_X_SERVER_CONTROL.CAN_SKIP_DATERANGES != "" {
-			me.buffer.WriteString(fmt.Sprintf(",CAN-SKIP-DATERANGES=%s", me.EXT_X_SERVER_CONTROL.CAN_SKIP_DATERANGES))
-		}
-		if me.EXT_X_SERVER_CONTROL.HOLD_BACK > 0 {
-			me.buffer.WriteString(fmt.Sprintf(",HOLD-BACK=%.1f", me.EXT_X_SERVER_CONTROL.HOLD_BACK))
-		}
-		if me.EXT_X_SERVER_CONTROL.CAN_BLOCK_RELOAD != "" {
-			me.buffer.WriteString(fmt.Sprintf(",CAN-BLOCK-RELOAD=%s", me.EXT_X_SERVER_CONTROL.CAN_BLOCK_RELOAD))
-		}
+		me.buffer.WriteString(strings.Join(attrs, ","))
 		me.buffer.WriteString("\n")
 	}
 
 	// media metadata tags
-	if me.EXT_X_DATERANGE.ID != "" {
-		me.buffer.WriteString("#EXT-X-DATERANGE:")
-		me.buffer.WriteString(fmt.Sprintf("ID=%s", me.EXT_X_DATERANGE.ID))
-		if me.EXT_X_DATERANGE.CLASS != "" {
-			me.buffer.WriteString(fmt.Sprintf(",CLASS=%s", me.EXT_X_DATERANGE.CLASS))
-		}
-		me.buffer.WriteString(fmt.Sprintf(",START-DATE=%s", me.EXT_X_DATERANGE.START_DATE))
-		if me.EXT_X_DATERANGE.END_DATE != "" {
-			me.buffer.WriteString(fmt.Sprintf(",END-DATE=%s", me.EXT_X_DATERANGE.END_DATE))
-		}
-		if me.EXT_X_DATERANGE.DURATION > 0 {
-			me.buffer.WriteString(fmt.Sprintf(",DURATION=%.3f", me.EXT_X_DATERANGE.DURATION))
-		}
-		if me.EXT_X_DATERANGE.PLANNED_DURATION > 0 {
-			me.buffer.WriteString(fmt.Sprintf(",PLANNED-DURATION=%.3f", me.EXT_X_DATERANGE.PLANNED_DURATION))
-		}
-		if me.EXT_X_DATERANGE.END_ON_NEXT != "" {
-			me.buffer.WriteString(fmt.Sprintf(",END-ON-NEXT=%s", me.EXT_X_DATERANGE.END_ON_NEXT))
+	for _, item := range me.EXT_X_DATERANGE {
+		attrs, err := item.attributes()
+		if err != nil {
+			return nil, err
 		}
+		me.buffer.WriteString("#EXT-X-DATERANGE:")
+		me.buffer.WriteString(attrs)
 		me.buffer.WriteString("\n")
 	}
 	if me.EXT_X_MEDIA_SEQUENCE != 0 {
@@ -119,26 +81,16 @@ func (me *MediaPlaylist) Marshal() ([]byte, error) {
 		me.buffer.WriteString("#EXT-X-SKIP:")
 		me.buffer.WriteString(fmt.Sprintf("SKIPPED-SEGMENTS=%s", me.EXT_X_SKIP.SKIPPED_SEGMENTS))
 		if me.EXT_X_SKIP.RECENTLY_REMOVED_DATERANGES != "" {
-			me.buffer.WriteString(fmt.Sprintf(",RECENTLY-REMOVED-DATERANGES=%s", me.EXT_X_SKIP.RECENTLY_REMOVED_DATERANGES))
+			me.buffer.WriteString(fmt.Sprintf(",RECENTLY-REMOVED-DATERANGES=\"%s\"", me.EXT_X_SKIP.RECENTLY_REMOVED_DATERANGES))
 		}
 		me.buffer.WriteString("\n")
 	}
 
 	// media segment tags
 	for _, item := range me.MediaSegments {
-		if item.EXT_X_KEY.METHOD != "" && item.EXT_X_KEY.URI != "" {
+		if item.EXT_X_KEY.METHOD != "" {
 			me.buffer.WriteString("#EXT-X-KEY:")
-			me.buffer.WriteString(fmt.Sprintf("METHOD=%s", item.EXT_X_KEY.METHOD))
-			me.buffer.WriteString(fmt.Sprintf(",URI=\"%s\"", item.EXT_X_KEY.URI))
-			if item.EXT_X_KEY.IV != "" {
-				me.buffer.WriteString(fmt.Sprintf(",IV=%s", item.EXT_X_KEY.IV))
-			}
-			if item.EXT_X_KEY.KEYFORMAT != "" {
-				me.buffer.WriteString(fmt.Sprintf(",KEYFORMAT=%s", item.EXT_X_KEY.KEYFORMAT))
-			}
-			if item.EXT_X_KEY.KEYFORMATVERSIONS != "" {
-				me.buffer.WriteString(fmt.Sprintf(",KEYFORMATVERSIONS=%s", item.EXT_X_KEY.KEYFORMATVERSIONS))
-			}
+			me.buffer.WriteString(item.EXT_X_KEY.attributes())
 			me.buffer.WriteString("\n")
 		}
 		if item.EXT_X_DISCONTINUITY {
@@ -147,17 +99,27 @@ func (me *MediaPlaylist) Marshal() ([]byte, error) {
 		if item.EXT_X_PROGRAM_DATE_TIME != "" {
 			me.buffer.WriteString(fmt.Sprintf("#EXT-X-PROGRAM-DATE-TIME:%s\n", item.EXT_X_PROGRAM_DATE_TIME))
 		}
+		if item.EXT_X_CUE_IN {
+			me.buffer.WriteString("#EXT-X-CUE-IN\n")
+		}
+		if item.EXT_X_CUE_OUT != nil {
+			me.buffer.WriteString("#EXT-X-CUE-OUT")
+			if item.EXT_X_CUE_OUT.DURATION > 0 {
+				me.buffer.WriteString(fmt.Sprintf(":%s", decimal(item.EXT_X_CUE_OUT.DURATION, 3)))
+			}
+			me.buffer.WriteString("\n")
+		}
 		if item.EXT_X_MAP.URI != "" {
 			me.buffer.WriteString("#EXT-X-MAP:")
 			me.buffer.WriteString(fmt.Sprintf("URI=\"%s\"", item.EXT_X_MAP.URI))
 			if item.EXT_X_MAP.BYTERANGE != "" {
-				me.buffer.WriteString(fmt.Sprintf(",BYTERANGE=%s", item.EXT_X_MAP.BYTERANGE))
+				me.buffer.WriteString(fmt.Sprintf(",BYTERANGE=\"%s\"", item.EXT_X_MAP.BYTERANGE))
 			}
 			me.buffer.WriteString("\n")
 		}
 		if item.EXT_X_BYTERANGE.N > 0 {
 			me.buffer.WriteString(fmt.Sprintf("#EXT-X-BYTERANGE:%d", item.EXT_X_BYTERANGE.N))
-			if item.EXT_X_BYTERANGE.O > 0 {
+			if item.EXT_X_BYTERANGE.O > 0 || item.EXT_X_BYTERANGE.HasOffset {
 				me.buffer.WriteString(fmt.Sprintf("@%d", item.EXT_X_BYTERANGE.O))
 			}
 			me.buffer.WriteString("\n")
@@ -173,23 +135,25 @@ func (me *MediaPlaylist) Marshal() ([]byte, error) {
 			if part.DURATION == 0 || part.URI == "" {
 				continue
 			}
-			me.buffer.WriteString(fmt.Sprintf("#EXT-X-PART:DURATION=%.5f,URI=\"%s\"", part.DURATION, part.URI))
+			me.buffer.WriteString(fmt.Sprintf("#EXT-X-PART:DURATION=%s,URI=\"%s\"", decimal(part.DURATION, 5), part.URI))
 			if part.INDEPENDENT != "" {
 				me.buffer.WriteString(fmt.Sprintf(",INDEPENDENT=%s", part.INDEPENDENT))
 			}
 			if part.BYTERANGE.N > 0 {
-				me.buffer.WriteString(fmt.Sprintf(",BYTERANGE=%d", part.BYTERANGE.N))
-				if part.BYTERANGE.O > 0 {
+				me.buffer.WriteString(fmt.Sprintf(",BYTERANGE=\"%d", part.BYTERANGE.N))
+				if part.BYTERANGE.O > 0 || part.BYTERANGE.HasOffset {
 					me.buffer.WriteString(fmt.Sprintf("@%d", part.BYTERANGE.O))
 				}
+				me.buffer.WriteString("\"")
 			}
 			if part.GAP != "" {
 				me.buffer.WriteString(fmt.Sprintf(",GAP=%s", part.GAP))
 			}
 			me.buffer.WriteString("\n")
 		}
-		if len(item.EXT_X_PART) >= me.chunks {
-			me.buffer.WriteString(fmt.Sprintf("#EXTINF:%.5f,%s\n%s\n", item.EXTINF.Duration, item.EXTINF.Title, item.URI))
+		// The uncompleted segment has parts only.
+		if item.URI != "" && len(item.EXT_X_PART) >= me.chunks {
+			me.buffer.WriteString(fmt.Sprintf("#EXTINF:%s,%s\n%s\n", decimal(item.EXTINF.Duration, 5), item.EXTINF.Title, item.URI))
 		}
 	}
 
@@ -236,7 +200,29 @@ type BasicTags struct {
 type MediaOrMasterPlaylistTags struct {
 	EXT_X_INDEPENDENT_SEGMENTS bool
 	EXT_X_START                StartAttributes
-	EXT_X_DEFINE               DefineAttributes
+	EXT_X_DEFINE               []DefineAttributes
+}
+
+func (me *MediaOrMasterPlaylistTags) marshal(buffer *bytes.Buffer) {
+	if me.EXT_X_INDEPENDENT_SEGMENTS {
+		buffer.WriteString("#EXT-X-INDEPENDENT-SEGMENTS\n")
+	}
+	if me.EXT_X_START.TIME_OFFSET != 0 {
+		buffer.WriteString("#EXT-X-START:")
+		buffer.WriteString(fmt.Sprintf("TIME-OFFSET=%s", decimal(me.EXT_X_START.TIME_OFFSET, 5)))
+		if me.EXT_X_START.PRECISE != "" {
+			buffer.WriteString(fmt.Sprintf(",PRECISE=%s", me.EXT_X_START.PRECISE))
+		}
+		buffer.WriteString("\n")
+	}
+	for _, item := range me.EXT_X_DEFINE {
+		switch {
+		case item.NAME != "":
+			buffer.WriteString(fmt.Sprintf("#EXT-X-DEFINE:NAME=\"%s\",VALUE=\"%s\"\n", item.NAME, item.VALUE))
+		case item.IMPORT != "":
+			buffer.WriteString(fmt.Sprintf("#EXT-X-DEFINE:IMPORT=\"%s\"\n", item.IMPORT))
+		}
+	}
 }
 
 // StartAttributes defined for #EXT-X-START
@@ -279,9 +265,29 @@ type ServerControlAttributes struct {
 	CAN_BLOCK_RELOAD    string // 'YES'
 }
 
+func (me *ServerControlAttributes) attributes() []string {
+	attrs := make([]string, 0)
+	if me.PART_HOLD_BACK > 0 {
+		attrs = append(attrs, fmt.Sprintf("PART-HOLD-BACK=%s", decimal(me.PART_HOLD_BACK, 1)))
+	}
+	if me.CAN_SKIP_UNTIL > 0 {
+		attrs = append(attrs, fmt.Sprintf("CAN-SKIP-UNTIL=%s", decimal(me.CAN_SKIP_UNTIL, 1)))
+	}
+	if me.CAN_SKIP_DATERANGES != "" {
+		attrs = append(attrs, fmt.Sprintf("CAN-SKIP-DATERANGES=%s", me.CAN_SKIP_DATERANGES))
+	}
+	if me.HOLD_BACK > 0 {
+		attrs = append(attrs, fmt.Sprintf("HOLD-BACK=%s", decimal(me.HOLD_BACK, 1)))
+	}
+	if me.CAN_BLOCK_RELOAD != "" {
+		attrs = append(attrs, fmt.Sprintf("CAN-BLOCK-RELOAD=%s", me.CAN_BLOCK_RELOAD))
+	}
+	return attrs
+}
+
 // MediaMetadataTags of m3u8
 type MediaMetadataTags struct {
-	EXT_X_DATERANGE        DateRangeAttributes
+	EXT_X_DATERANGE        []DateRangeAttributes
 	EXT_X_SKIP             SkipAttributes
 	EXT_X_PRELOAD_HINT     PreloadHintAttributes
 	EXT_X_RENDITION_REPORT []RenditionReportAttributes
@@ -296,13 +302,90 @@ type DateRangeAttributes struct {
 	DURATION            float64
 	PLANNED_DURATION    float64
 	X_CLIENT_ATTRIBUTES []XClientAttribute
+	SCTE35_CMD          []byte
+	SCTE35_OUT          []byte
+	SCTE35_IN           []byte
 	END_ON_NEXT         string // 'YES'
 }
 
-// XClientAttribute defined for X-<client-attribute>
+func (me DateRangeAttributes) attributes() (string, error) {
+	if me.ID == "" || me.START_DATE == "" {
+		return "", fmt.Errorf("date range without ID or START-DATE")
+	}
+	for _, s := range []string{me.ID, me.CLASS, me.START_DATE, me.END_DATE} {
+		if !quotable(s) {
+			return "", fmt.Errorf("bad quoted-string of date range %s: %q", me.ID, s)
+		}
+	}
+
+	s := fmt.Sprintf("ID=\"%s\"", me.ID)
+	if me.CLASS != "" {
+		s += fmt.Sprintf(",CLASS=\"%s\"", me.CLASS)
+	}
+	s += fmt.Sprintf(",START-DATE=\"%s\"", me.START_DATE)
+	if me.END_DATE != "" {
+		s += fmt.Sprintf(",END-DATE=\"%s\"", me.END_DATE)
+	}
+	if me.DURATION > 0 {
+		s += fmt.Sprintf(",DURATION=%s", decimal(me.DURATION, 3))
+	}
+	if me.PLANNED_DURATION > 0 {
+		s += fmt.Sprintf(",PLANNED-DURATION=%s", decimal(me.PLANNED_DURATION, 3))
+	}
+	for _, attr := range me.X_CLIENT_ATTRIBUTES {
+		value, err := attr.value()
+		if err != nil {
+			return "", err
+		}
+		s += fmt.Sprintf(",%s=%s", attr.Key, value)
+	}
+	if me.SCTE35_CMD != nil {
+		s += fmt.Sprintf(",SCTE35-CMD=0x%X", me.SCTE35_CMD)
+	}
+	if me.SCTE35_OUT != nil {
+		s += fmt.Sprintf(",SCTE35-OUT=0x%X", me.SCTE35_OUT)
+	}
+	if me.SCTE35_IN != nil {
+		s += fmt.Sprintf(",SCTE35-IN=0x%X", me.SCTE35_IN)
+	}
+	if me.END_ON_NEXT != "" {
+		s += fmt.Sprintf(",END-ON-NEXT=%s", me.END_ON_NEXT)
+	}
+	return s, nil
+}
+
+// XClientAttribute defined for X-<client-attribute>.
+// Value is a string for quoted-string, []byte for hexadecimal-sequence, or float64 for decimal-floating-point.
 type XClientAttribute struct {
 	Key   string
-	Value string
+	Value interface{}
+}
+
+func (me XClientAttribute) value() (string, error) {
+	if len(me.Key) <= 2 || !strings.HasPrefix(me.Key, "X-") || strings.IndexFunc(me.Key, func(r rune) bool {
+		return (r < 'A' || r > 'Z') && (r < '0' || r > '9') && r != '-'
+	}) >= 0 {
+		return "", fmt.Errorf("bad client attribute name %q", me.Key)
+	}
+
+	switch v := me.Value.(type) {
+	case string:
+		if !quotable(v) {
+			return "", fmt.Errorf("bad quoted-string of %s: %q", me.Key, v)
+		}
+		return fmt.Sprintf("\"%s\"", v), nil
+	case []byte:
+		return fmt.Sprintf("0x%X", v), nil
+	case float64:
+		return decimal(v, 3), nil
+	default:
+		return "", fmt.Errorf("bad value type of %s: %T", me.Key, me.Value)
+	}
+}
+
+// quotable returns whether s could be a quoted-string, which must not contain double quotes, CR or LF.
+func quotable(s string) bool {
+	return !strings.ContainsAny(s, "\"\r\n")
 }
 
 // SkipAttributes defined for #EXT-X-SKIP
@@ -334,6 +417,8 @@ type MediaSegmentTags struct {
 	EXT_X_KEY               KeyAttributes
 	EXT_X_MAP               MapAttributes
 	EXT_X_PROGRAM_DATE_TIME string // 2010-02-19T14:54:23.031+08:00
+	EXT_X_CUE_OUT           *CueOutAttributes
+	EXT_X_CUE_IN            bool
 	EXT_X_GAP               bool
 	EXT_X_BITRATE           uint
 	EXT_X_PART              []PartAttributes
@@ -346,10 +431,16 @@ type InfAttributes struct {
 	Title    string
 }
 
+// CueOutAttributes defined for #EXT-X-CUE-OUT, which is not in the RFC, but used by legacy players for ad breaks
+type CueOutAttributes struct {
+	DURATION float64 // 0 if unknown
+}
+
 // ByteRange defined for #EXT-X-BYTERANGE
 type ByteRange struct {
-	N uint
-	O uint
+	N         uint
+	O         uint
+	HasOffset bool // whether O is given, even if 0
 }
 
 // KeyAttributes defined for #EXT-X-KEY
@@ -361,6 +452,23 @@ type KeyAttributes struct {
 	KEYFORMATVERSIONS string
 }
 
+func (me KeyAttributes) attributes() string {
+	s := fmt.Sprintf("METHOD=%s", me.METHOD)
+	if me.URI != "" {
+		s += fmt.Sprintf(",URI=\"%s\"", me.URI)
+	}
+	if me.IV != "" {
+		s += fmt.Sprintf(",IV=%s", me.IV)
+	}
+	if me.KEYFORMAT != "" {
+		s += fmt.Sprintf(",KEYFORMAT=\"%s\"", me.KEYFORMAT)
+	}
+	if me.KEYFORMATVERSIONS != "" {
+		s += fmt.Sprintf(",KEYFORMATVERSIONS=\"%s\"", me.KEYFORMATVERSIONS)
+	}
+	return s
+}
+
 // MapAttributes defined for #EXT-X-MAP
 type MapAttributes struct {
 	URI       string
@@ -380,7 +488,8 @@ type PartAttributes struct {
 type MasterPlaylist struct {
 	BasicTags
 	MasterPlaylistTags
-	buffer bytes.Buffer
+	variables map[string]string
+	buffer    bytes.Buffer
 }
 
 // Init this class
@@ -395,29 +504,12 @@ func (me *MasterPlaylist) Marshal() ([]byte, error) {
 
 	// basic tags
 	me.buffer.WriteString("#EXTM3U\n")
+	if me.EXT_X_VERSION > 0 {
+		me.buffer.WriteString(fmt.Sprintf("#EXT-X-VERSION:%d\n", me.EXT_X_VERSION))
+	}
 
 	// master playlist tags
-	if me.EXT_X_INDEPENDENT_SEGMENTS {
-		me.buffer.WriteString("#EXT-X-INDEPENDENT-SEGMENTS\n")
-	}
-	if me.EXT_X_START.TIME_OFFSET > 0 {
-		me.buffer.WriteString("#EXT-X-START:")
-		me.buffer.WriteString(fmt.Sprintf("TIME-OFFSET=%.5f", me.EXT_X_START.TIME_OFFSET))
-		if me.EXT_X_START.PRECISE != "" {
-			me.buffer.WriteString(fmt.Sprintf(",PRECISE:%s", me.EXT_X_START.PRECISE))
-		}
-		me.buffer.WriteString("\n")
-	}
-	if me.EXT_X_DEFINE.VALUE != "" {
-		me.buffer.WriteString("#EXT-X-DEFINE:")
-		if me.EXT_X_DEFINE.NAME != "" {
-			me.buffer.WriteString(fmt.Sprintf("NAME=%s", me.EXT_X_DEFINE.NAME))
-		}
-		if me.EXT_X_DEFINE.IMPORT != "" {
-			me.buffer.WriteString(fmt.Sprintf("IMPORT=%s", me.EXT_X_DEFINE.IMPORT))
-		}
-		me.buffer.WriteString(fmt.Sprintf(",VALUE=%s\n", me.EXT_X_DEFINE.VALUE))
-	}
+	me.MediaOrMasterPlaylistTags.marshal(&me.buffer)
 
 	for i, item := range me.EXT_X_MEDIA {
 		if item.TYPE == "" || item.GROUP_ID == "" || item.NAME == "" {
@@ -446,13 +538,13 @@ func (me *MasterPlaylist) Marshal() ([]byte, error) {
 			me.buffer.WriteString(fmt.Sprintf(",FORCED=%s", item.FORCED))
 		}
 		if item.INSTREAM_ID != "" && item.TYPE == "CLOSED-CAPTIONS" {
-			me.buffer.WriteString(fmt.Sprintf(",INSTREAM-ID=%s", item.INSTREAM_ID))
+			me.buffer.WriteString(fmt.Sprintf(",INSTREAM-ID=\"%s\"", item.INSTREAM_ID))
 		}
 		if item.CHARACTERISTICS != "" {
-			me.buffer.WriteString(fmt.Sprintf(",CHARACTERISTICS=%s", item.CHARACTERISTICS))
+			me.buffer.WriteString(fmt.Sprintf(",CHARACTERISTICS=\"%s\"", item.CHARACTERISTICS))
 		}
 		if item.CHANNELS != "" {
-			me.buffer.WriteString(fmt.Sprintf(",CHANNELS=%s", item.CHANNELS))
+			me.buffer.WriteString(fmt.Sprintf(",CHANNELS=\"%s\"", item.CHANNELS))
 		}
 		if item.URI != "" {
 			me.buffer.WriteString(fmt.Sprintf(",URI=\"%s\"", item.URI))
@@ -474,13 +566,13 @@ func (me *MasterPlaylist) Marshal() ([]byte, error) {
 			me.buffer.WriteString(fmt.Sprintf(",RESOLUTION=%s", item.RESOLUTION))
 		}
 		if item.FRAME_RATE > 0 {
-			me.buffer.WriteString(fmt.Sprintf(",FRAME-RATE=%.3f", item.FRAME_RATE))
+			me.buffer.WriteString(fmt.Sprintf(",FRAME-RATE=%s", decimal(item.FRAME_RATE, 3)))
 		}
 		if item.HDCP_LEVEL != "" {
 			me.buffer.WriteString(fmt.Sprintf(",HDCP-LEVEL=%s", item.HDCP_LEVEL))
 		}
 		if item.ALLOWED_CPC != "" {
-			me.buffer.WriteString(fmt.Sprintf(",ALLOWED-CPC=%s", item.ALLOWED_CPC))
+			me.buffer.WriteString(fmt.Sprintf(",ALLOWED-CPC=\"%s\"", item.ALLOWED_CPC))
 		}
 		if item.VIDEO_RANGE != "" {
 			me.buffer.WriteString(fmt.Sprintf(",VIDEO-RANGE=%s", item.VIDEO_RANGE))
@@ -494,16 +586,19 @@ func (me *MasterPlaylist) Marshal() ([]byte, error) {
 		if item.SUBTITLES != "" {
 			me.buffer.WriteString(fmt.Sprintf(",SUBTITLES=\"%s\"", item.SUBTITLES))
 		}
-		if item.CLOSED_CAPTIONS != "" {
-			me.buffer.WriteString(fmt.Sprintf(",CLOSED-CAPTIONS=%s", item.CLOSED_CAPTIONS))
+		if item.CLOSED_CAPTIONS == "NONE" {
+			me.buffer.WriteString(",CLOSED-CAPTIONS=NONE")
+		} else if item.CLOSED_CAPTIONS != "" {
+			me.buffer.WriteString(fmt.Sprintf(",CLOSED-CAPTIONS=\"%s\"", item.CLOSED_CAPTIONS))
 		}
 		me.buffer.WriteString(fmt.Sprintf("\n%s\n", item.URI))
 		if len(me.EXT_X_I_FRAME_STREAM_INF) > i {
-			me.buffer.WriteString("#EXT-X-I-FRAME-STREAM-INF:")
-			me.buffer.WriteString(fmt.Sprintf("BANDWIDTH=%d", item.BANDWIDTH))
-			me.buffer.WriteString(fmt.Sprintf(",URI=\"%s\"\n", me.EXT_X_I_FRAME_STREAM_INF[i].URI))
+			me.EXT_X_I_FRAME_STREAM_INF[i].marshal(&me.buffer, item.BANDWIDTH)
 		}
 	}
+	for i := len(me.EXT_X_STREAM_INF); i < len(me.EXT_X_I_FRAME_STREAM_INF); i++ {
+		me.EXT_X_I_FRAME_STREAM_INF[i].marshal(&me.buffer, 0)
+	}
 
 	for i, item := range me.EXT_X_SESSION_DATA {
 		if i == 0 {
@@ -520,6 +615,7 @@ func (me *MasterPlaylist) Marshal() ([]byte, error) {
 		if item.URI != "" {
 			me.buffer.WriteString(fmt.Sprintf(",URI=\"%s\"", item.URI))
 		}
+		me.buffer.WriteString("\n")
 	}
 
 	for i, item := range me.EXT_X_SESSION_KEY {
@@ -530,17 +626,7 @@ func (me *MasterPlaylist) Marshal() ([]byte, error) {
 			me.buffer.WriteString("\n")
 		}
 		me.buffer.WriteString("#EXT-X-SESSION-KEY:")
-		me.buffer.WriteString(fmt.Sprintf("METHOD=%s", item.METHOD))
-		me.buffer.WriteString(fmt.Sprintf(",URI=%s", item.URI))
-		if item.IV != "" {
-			me.buffer.WriteString(fmt.Sprintf(",IV=%s", item.IV))
-		}
-		if item.KEYFORMAT != "" {
-			me.buffer.WriteString(fmt.Sprintf(",KEYFORMAT=%s", item.KEYFORMAT))
-		}
-		if item.KEYFORMATVERSIONS != "" {
-			me.buffer.WriteString(fmt.Sprintf(",KEYFORMATVERSIONS=%s", item.KEYFORMATVERSIONS))
-		}
+		me.buffer.WriteString(KeyAttributes(item).attributes())
 		me.buffer.WriteString("\n")
 	}
 
@@ -592,7 +678,46 @@ type StreamInfAttributes struct {
 
 // IFrameStreamInfAttributes defined for #EXT-X-I-FRAME-STREAM-INF
 type IFrameStreamInfAttributes struct {
-	URI string
+	BANDWIDTH         uint
+	AVERAGE_BANDWIDTH uint
+	CODECS            string
+	RESOLUTION        string
+	HDCP_LEVEL        string
+	ALLOWED_CPC       string
+	VIDEO_RANGE       string
+	VIDEO             string
+	URI               string
+}
+
+// marshal writes the tag, with the BANDWIDTH of the stream it follows if not set.
+func (me IFrameStreamInfAttributes) marshal(buffer *bytes.Buffer, bandwidth uint) {
+	if me.BANDWIDTH > 0 {
+		bandwidth = me.BANDWIDTH
+	}
+	buffer.WriteString("#EXT-X-I-FRAME-STREAM-INF:")
+	buffer.WriteString(fmt.Sprintf("BANDWIDTH=%d", bandwidth))
+	if me.AVERAGE_BANDWIDTH > 0 {
+		buffer.WriteString(fmt.Sprintf(",AVERAGE-BANDWIDTH=%d", me.AVERAGE_BANDWIDTH))
+	}
+	if me.CODECS != "" {
+		buffer.WriteString(fmt.Sprintf(",CODECS=\"%s\"", me.CODECS))
+	}
+	if me.RESOLUTION != "" {
+		buffer.WriteString(fmt.Sprintf(",RESOLUTION=%s", me.RESOLUTION))
+	}
+	if me.HDCP_LEVEL != "" {
+		buffer.WriteString(fmt.Sprintf(",HDCP-LEVEL=%s", me.HDCP_LEVEL))
+	}
+	if me.ALLOWED_CPC != "" {
+		buffer.WriteString(fmt.Sprintf(",ALLOWED-CPC=\"%s\"", me.ALLOWED_CPC))
+	}
+	if me.VIDEO_RANGE != "" {
+		buffer.WriteString(fmt.Sprintf(",VIDEO-RANGE=%s", me.VIDEO_RANGE))
+	}
+	if me.VIDEO != "" {
+		buffer.WriteString(fmt.Sprintf(",VIDEO=\"%s\"", me.VIDEO))
+	}
+	buffer.WriteString(fmt.Sprintf(",URI=\"%s\"\n", me.URI))
 }
 
 // SessionDataAttributes defined for #EXT-X-SESSION-DATA
@@ -605,3 +730,12 @@ type SessionDataAttributes struct {
 
 // SessionKeyAttributes defined for #EXT-X-SESSION-KEY
 type SessionKeyAttributes KeyAttributes
+
+// decimal formats a decimal-floating-point with at least prec digits after the point, or more to be exact.
+func decimal(f float64, prec int) string {
+	exact := strconv.FormatFloat(f, 'f', -1, 64)
+	if s := strconv.FormatFloat(f, 'f', prec, 64); len(s) >= len(exact) {
+		return s
+	}
+	return exact
+}
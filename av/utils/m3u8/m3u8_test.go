@@ -0,0 +1,210 @@
+package m3u8
+
+import (
+	"strings"
+	"testing"
+)
+
+func lines(items ...string) string {
+	return strings.Join(items, "\n") + "\n"
+}
+
+// TestMediaRoundTrip unmarshals each playlist, which must be marshaled back as is.
+func TestMediaRoundTrip(t *testing.T) {
+	for _, item := range []struct {
+		name string
+		data string
+	}{
+		{"segments", lines(
+			"#EXTM3U",
+			"#EXT-X-VERSION:7",
+			"#EXT-X-TARGETDURATION:4",
+			"#EXT-X-DISCONTINUITY-SEQUENCE:2",
+			"#EXT-X-MEDIA-SEQUENCE:10",
+			"#EXT-X-MAP:URI=\"init.mp4\"",
+			"#EXTINF:4.00000,",
+			"seg10.m4s",
+			"#EXT-X-DISCONTINUITY",
+			"#EXT-X-PROGRAM-DATE-TIME:2021-01-01T00:00:04.000Z",
+			"#EXTINF:3.96000,title",
+			"seg11.m4s",
+			"#EXT-X-GAP",
+			"#EXTINF:4.00000,",
+			"seg12.m4s",
+			"#EXT-X-ENDLIST",
+		)},
+		{"byte ranges", lines(
+			"#EXTM3U",
+			"#EXT-X-VERSION:7",
+			"#EXT-X-TARGETDURATION:4",
+			"#EXT-X-MAP:URI=\"main.mp4\",BYTERANGE=\"720@0\"",
+			"#EXT-X-BYTERANGE:1000@0",
+			"#EXTINF:4.00000,",
+			"main.mp4",
+			"#EXT-X-BYTERANGE:500",
+			"#EXTINF:4.00000,",
+			"main.mp4",
+			"#EXT-X-BYTERANGE:700@1720",
+			"#EXTINF:4.00000,",
+			"main.mp4",
+		)},
+		{"parts", lines(
+			"#EXTM3U",
+			"#EXT-X-VERSION:9",
+			"#EXT-X-TARGETDURATION:4",
+			"#EXT-X-PART-INF:PART-TARGET=1.00000",
+			"#EXT-X-SERVER-CONTROL:PART-HOLD-BACK=3.0,CAN-BLOCK-RELOAD=YES",
+			"#EXT-X-MEDIA-SEQUENCE:3",
+			"#EXT-X-PART:DURATION=1.00000,URI=\"seg3.m4s\",INDEPENDENT=YES,BYTERANGE=\"100@0\"",
+			"#EXT-X-PART:DURATION=1.00000,URI=\"seg3.m4s\",BYTERANGE=\"80\"",
+			"#EXTINF:2.00000,",
+			"seg3.m4s",
+			"#EXT-X-PART:DURATION=1.00000,URI=\"seg4.0.m4s\",INDEPENDENT=YES",
+			"#EXT-X-PRELOAD-HINT:TYPE=PART,URI=\"seg4.1.m4s\"",
+			"",
+			"#EXT-X-RENDITION-REPORT:URI=\"low.m3u8\",LAST-MSN=4,LAST-PART=0",
+		)},
+		{"variables", lines(
+			"#EXTM3U",
+			"#EXT-X-VERSION:8",
+			"#EXT-X-DEFINE:NAME=\"host\",VALUE=\"https://cdn.example.com\"",
+			"#EXT-X-DEFINE:NAME=\"path\",VALUE=\"{$host}/live\"",
+			"#EXT-X-DEFINE:IMPORT=\"token\"",
+			"#EXT-X-TARGETDURATION:4",
+			"#EXT-X-MAP:URI=\"{$path}/init.mp4\"",
+			"#EXTINF:4.00000,",
+			"{$path}/seg0.m4s?token={$token}",
+		)},
+		{"date ranges", lines(
+			"#EXTM3U",
+			"#EXT-X-VERSION:7",
+			"#EXT-X-TARGETDURATION:4",
+			"#EXT-X-DATERANGE:ID=\"ad-1\",CLASS=\"com.example.ad\",START-DATE=\"2021-01-01T00:00:04.000Z\",DURATION=8.000,X-AD-ID=\"1234\",SCTE35-OUT=0xFC30",
+			"#EXT-X-PROGRAM-DATE-TIME:2021-01-01T00:00:00.000Z",
+			"#EXTINF:4.00000,",
+			"seg0.ts",
+			"#EXT-X-CUE-OUT:8.000",
+			"#EXTINF:4.00000,",
+			"seg1.ts",
+			"#EXTINF:4.00000,",
+			"seg2.ts",
+			"#EXT-X-CUE-IN",
+			"#EXTINF:4.00000,",
+			"seg3.ts",
+		)},
+	} {
+		t.Run(item.name, func(t *testing.T) {
+			pl := new(MediaPlaylist)
+			err := pl.Unmarshal([]byte(item.data), map[string]string{"token": "abc"})
+			if err != nil {
+				t.Fatalf("Failed to unmarshal: %v", err)
+			}
+			data, err := pl.Marshal()
+			if err != nil {
+				t.Fatalf("Failed to marshal: %v", err)
+			}
+			if string(data) != item.data {
+				t.Fatalf("Expected:\n%s\ngot:\n%s", item.data, data)
+			}
+		})
+	}
+}
+
+// TestMasterRoundTrip unmarshals each playlist, which must be marshaled back as is.
+func TestMasterRoundTrip(t *testing.T) {
+	for _, item := range []struct {
+		name string
+		data string
+	}{
+		{"variants", lines(
+			"#EXTM3U",
+			"#EXT-X-VERSION:7",
+			"#EXT-X-INDEPENDENT-SEGMENTS",
+			"",
+			"#EXT-X-MEDIA:TYPE=AUDIO,GROUP-ID=\"aac\",NAME=\"English\",LANGUAGE=\"en\",DEFAULT=YES,AUTOSELECT=YES,URI=\"audio/en.m3u8\"",
+			"",
+			"#EXT-X-STREAM-INF:BANDWIDTH=1280000,CODECS=\"avc1.4d401f,mp4a.40.2\",AVERAGE-BANDWIDTH=1000000,RESOLUTION=1280x720,FRAME-RATE=30.000,AUDIO=\"aac\"",
+			"mid/index.m3u8",
+			"#EXT-X-STREAM-INF:BANDWIDTH=640000,CODECS=\"avc1.42c01e,mp4a.40.2\",RESOLUTION=640x360,AUDIO=\"aac\"",
+			"low/index.m3u8",
+		)},
+		{"I-frame streams", lines(
+			"#EXTM3U",
+			"#EXT-X-VERSION:7",
+			"",
+			"#EXT-X-STREAM-INF:BANDWIDTH=1280000,CODECS=\"avc1.4d401f,mp4a.40.2\",RESOLUTION=1280x720",
+			"mid/index.m3u8",
+			"#EXT-X-I-FRAME-STREAM-INF:BANDWIDTH=86000,AVERAGE-BANDWIDTH=80000,CODECS=\"avc1.4d401f\",RESOLUTION=1280x720,VIDEO-RANGE=SDR,URI=\"mid/iframes.m3u8\"",
+			"#EXT-X-STREAM-INF:BANDWIDTH=640000,CODECS=\"avc1.42c01e,mp4a.40.2\",RESOLUTION=640x360",
+			"low/index.m3u8",
+			"#EXT-X-I-FRAME-STREAM-INF:BANDWIDTH=42000,CODECS=\"avc1.42c01e\",RESOLUTION=640x360,HDCP-LEVEL=NONE,URI=\"low/iframes.m3u8\"",
+			"#EXT-X-I-FRAME-STREAM-INF:BANDWIDTH=20000,CODECS=\"avc1.42c01e\",RESOLUTION=320x180,URI=\"lowest/iframes.m3u8\"",
+		)},
+		{"variables", lines(
+			"#EXTM3U",
+			"#EXT-X-VERSION:8",
+			"#EXT-X-DEFINE:NAME=\"host\",VALUE=\"https://cdn.example.com\"",
+			"",
+			"#EXT-X-STREAM-INF:BANDWIDTH=1280000,CODECS=\"avc1.4d401f,mp4a.40.2\"",
+			"{$host}/mid/index.m3u8",
+		)},
+	} {
+		t.Run(item.name, func(t *testing.T) {
+			pl := new(MasterPlaylist)
+			err := pl.Unmarshal([]byte(item.data))
+			if err != nil {
+				t.Fatalf("Failed to unmarshal: %v", err)
+			}
+			data, err := pl.Marshal()
+			if err != nil {
+				t.Fatalf("Failed to marshal: %v", err)
+			}
+			if string(data) != item.data {
+				t.Fatalf("Expected:\n%s\ngot:\n%s", item.data, data)
+			}
+		})
+	}
+}
+
+func TestSubstitute(t *testing.T) {
+	master := new(MasterPlaylist)
+	err := master.Unmarshal([]byte(lines(
+		"#EXTM3U",
+		"#EXT-X-DEFINE:NAME=\"token\",VALUE=\"abc\"",
+		"#EXT-X-STREAM-INF:BANDWIDTH=1280000",
+		"mid/index.m3u8?token={$token}",
+	)))
+	if err != nil {
+		t.Fatalf("Failed to unmarshal master: %v", err)
+	}
+	if s := master.Substitute(master.EXT_X_STREAM_INF[0].URI); s != "mid/index.m3u8?token=abc" {
+		t.Fatalf("Unexpected variant URI %s", s)
+	}
+
+	pl := new(MediaPlaylist)
+	err = pl.Unmarshal([]byte(lines(
+		"#EXTM3U",
+		"#EXT-X-DEFINE:IMPORT=\"token\"",
+		"#EXT-X-DEFINE:NAME=\"path\",VALUE=\"live/{$token}\"",
+		"#EXT-X-TARGETDURATION:4",
+		"#EXTINF:4.00000,",
+		"{$path}/seg0.ts",
+	)), master.Variables())
+	if err != nil {
+		t.Fatalf("Failed to unmarshal media: %v", err)
+	}
+	if s := pl.Substitute(pl.MediaSegments[0].URI); s != "live/abc/seg0.ts" {
+		t.Fatalf("Unexpected segment URI %s", s)
+	}
+
+	// References must be defined before use.
+	err = new(MediaPlaylist).Unmarshal([]byte(lines(
+		"#EXTM3U",
+		"#EXT-X-TARGETDURATION:4",
+		"#EXTINF:4.00000,",
+		"{$path}/seg0.ts",
+	)), nil)
+	if err == nil {
+		t.Fatalf("Expected error of undefined variable")
+	}
+}
@@ -0,0 +1,922 @@
+package m3u8
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// attribute of an attribute-list, e.g. URI="a.ts".
+type attribute struct {
+	Key    string
+	Value  string
+	Quoted bool
+}
+
+// parser keeps the state shared by both of the playlists.
+type parser struct {
+	line      int
+	variables map[string]string
+	imports   map[string]string
+}
+
+func (me *parser) init(imports map[string]string) *parser {
+	me.line = 0
+	me.variables = make(map[string]string)
+	me.imports = imports
+	return me
+}
+
+func (me *parser) errorf(format string, args ...interface{}) error {
+	return fmt.Errorf("line %d: %s", me.line, fmt.Sprintf(format, args...))
+}
+
+// scan calls fn with each tag and its value, or with an empty tag and the URI line.
+// Blank lines and comments are skipped.
+func (me *parser) scan(data []byte, fn func(tag string, value string) error) error {
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(make([]byte, 0, 4096), len(data)+1)
+
+	for scanner.Scan() {
+		me.line++
+		line := strings.TrimSpace(scanner.Text())
+		if me.line == 1 {
+			if line != "#EXTM3U" {
+				return me.errorf("missing #EXTM3U")
+			}
+			continue
+		}
+		if line == "" || strings.HasPrefix(line, "#") && !strings.HasPrefix(line, "#EXT") {
+			continue
+		}
+		if line[0] != '#' {
+			if _, err := me.substitute(line); err != nil {
+				return err
+			}
+			if err := fn("", line); err != nil {
+				return err
+			}
+			continue
+		}
+
+		tag, value := line, ""
+		if i := strings.IndexByte(line, ':'); i >= 0 {
+			tag, value = line[:i], line[i+1:]
+		}
+		if err := fn(tag, value); err != nil {
+			return err
+		}
+	}
+	if me.line == 0 {
+		me.line = 1
+		return me.errorf("missing #EXTM3U")
+	}
+	return scanner.Err()
+}
+
+// attributes parses an attribute-list. Variable references in the quoted-strings are checked, but kept as is.
+func (me *parser) attributes(s string) ([]attribute, error) {
+	attrs := make([]attribute, 0)
+
+	for i := 0; i < len(s); /* void */ {
+		j := strings.IndexByte(s[i:], '=')
+		if j <= 0 {
+			return nil, me.errorf("bad attribute-list: %s", s)
+		}
+		attr := attribute{Key: s[i : i+j]}
+		i += j + 1
+
+		if i < len(s) && s[i] == '"' {
+			k := strings.IndexByte(s[i+1:], '"')
+			if k < 0 {
+				return nil, me.errorf("unterminated quoted-string of %s", attr.Key)
+			}
+			attr.Value = s[i+1 : i+1+k]
+			attr.Quoted = true
+			if _, err := me.substitute(attr.Value); err != nil {
+				return nil, err
+			}
+			i += k + 2
+		} else {
+			k := strings.IndexByte(s[i:], ',')
+			if k < 0 {
+				k = len(s) - i
+			}
+			attr.Value = s[i : i+k]
+			i += k
+		}
+		attrs = append(attrs, attr)
+
+		if i < len(s) {
+			if s[i] != ',' {
+				return nil, me.errorf("bad attribute-list: %s", s)
+			}
+			i++
+		}
+	}
+	return attrs, nil
+}
+
+// substitute replaces the variable references, e.g. {$name}, with the values defined so far.
+func (me *parser) substitute(s string) (string, error) {
+	v, err := substitute(s, me.variables)
+	if err != nil {
+		return "", me.errorf("%v", err)
+	}
+	return v, nil
+}
+
+// substitute replaces the variable references in s with the values.
+func substitute(s string, variables map[string]string) (string, error) {
+	var b strings.Builder
+
+	for {
+		i := strings.Index(s, "{$")
+		if i < 0 {
+			break
+		}
+		j := strings.IndexByte(s[i:], '}')
+		if j < 0 {
+			break
+		}
+		name := s[i+2 : i+j]
+		value, ok := variables[name]
+		if !ok {
+			return "", fmt.Errorf("undefined variable %s", name)
+		}
+		b.WriteString(s[:i])
+		b.WriteString(value)
+		s = s[i+j+1:]
+	}
+	b.WriteString(s)
+	return b.String(), nil
+}
+
+func (me *parser) define(s string) (DefineAttributes, error) {
+	var item DefineAttributes
+
+	attrs, err := me.attributes(s)
+	if err != nil {
+		return item, err
+	}
+	for _, attr := range attrs {
+		switch attr.Key {
+		case "NAME":
+			item.NAME = attr.Value
+		case "VALUE":
+			item.VALUE = attr.Value
+		case "IMPORT":
+			item.IMPORT = attr.Value
+		}
+	}
+
+	switch {
+	case item.NAME != "":
+		value, err := me.substitute(item.VALUE)
+		if err != nil {
+			return item, err
+		}
+		me.variables[item.NAME] = value
+	case item.IMPORT != "":
+		value, ok := me.imports[item.IMPORT]
+		if !ok {
+			return item, me.errorf("variable %s not imported", item.IMPORT)
+		}
+		me.variables[item.IMPORT] = value
+	default:
+		return item, me.errorf("EXT-X-DEFINE without NAME or IMPORT")
+	}
+	return item, nil
+}
+
+func (me *parser) start(s string) (StartAttributes, error) {
+	var item StartAttributes
+
+	attrs, err := me.attributes(s)
+	if err != nil {
+		return item, err
+	}
+	for _, attr := range attrs {
+		switch attr.Key {
+		case "TIME-OFFSET":
+			item.TIME_OFFSET, err = me.float(attr)
+		case "PRECISE":
+			item.PRECISE = attr.Value
+		}
+		if err != nil {
+			return item, err
+		}
+	}
+	return item, nil
+}
+
+func (me *parser) key(s string) (KeyAttributes, error) {
+	var item KeyAttributes
+
+	attrs, err := me.attributes(s)
+	if err != nil {
+		return item, err
+	}
+	for _, attr := range attrs {
+		switch attr.Key {
+		case "METHOD":
+			item.METHOD = attr.Value
+		case "URI":
+			item.URI = attr.Value
+		case "IV":
+			item.IV = attr.Value
+		case "KEYFORMAT":
+			item.KEYFORMAT = attr.Value
+		case "KEYFORMATVERSIONS":
+			item.KEYFORMATVERSIONS = attr.Value
+		}
+	}
+	if item.METHOD == "" {
+		return item, me.errorf("key without METHOD")
+	}
+	if item.METHOD != "NONE" && item.URI == "" {
+		return item, me.errorf("key without URI")
+	}
+	return item, nil
+}
+
+// byteRange parses <n>[@<o>].
+func (me *parser) byteRange(s string) (ByteRange, error) {
+	var item ByteRange
+
+	n, o := s, ""
+	if i := strings.IndexByte(s, '@'); i >= 0 {
+		n, o = s[:i], s[i+1:]
+		item.HasOffset = true
+	}
+	v, err := strconv.ParseUint(n, 10, 64)
+	if err != nil {
+		return item, me.errorf("bad byte range %s", s)
+	}
+	item.N = uint(v)
+	if item.HasOffset {
+		v, err = strconv.ParseUint(o, 10, 64)
+		if err != nil {
+			return item, me.errorf("bad byte range %s", s)
+		}
+		item.O = uint(v)
+	}
+	return item, nil
+}
+
+func (me *parser) uint(attr attribute) (uint, error) {
+	v, err := strconv.ParseUint(attr.Value, 10, 64)
+	if err != nil {
+		return 0, me.errorf("bad decimal-integer of %s: %s", attr.Key, attr.Value)
+	}
+	return uint(v), nil
+}
+
+func (me *parser) float(attr attribute) (float64, error) {
+	v, err := strconv.ParseFloat(attr.Value, 64)
+	if err != nil {
+		return 0, me.errorf("bad decimal-floating-point of %s: %s", attr.Key, attr.Value)
+	}
+	return v, nil
+}
+
+// hex parses a hexadecimal-sequence, e.g. 0xFC30.
+func (me *parser) hex(attr attribute) ([]byte, error) {
+	if attr.Quoted || len(attr.Value) < 2 || attr.Value[0] != '0' || attr.Value[1] != 'x' && attr.Value[1] != 'X' {
+		return nil, me.errorf("bad hexadecimal-sequence of %s: %s", attr.Key, attr.Value)
+	}
+	s := attr.Value[2:]
+	if len(s)%2 != 0 {
+		s = "0" + s
+	}
+	v, err := hex.DecodeString(s)
+	if err != nil {
+		return nil, me.errorf("bad hexadecimal-sequence of %s: %s", attr.Key, attr.Value)
+	}
+	return v, nil
+}
+
+// client parses an X-<client-attribute>, the type of which is told by the value.
+func (me *parser) client(attr attribute) (XClientAttribute, error) {
+	var (
+		item = XClientAttribute{Key: attr.Key}
+		err  error
+	)
+
+	switch {
+	case attr.Quoted:
+		item.Value = attr.Value
+	case strings.HasPrefix(attr.Value, "0x") || strings.HasPrefix(attr.Value, "0X"):
+		item.Value, err = me.hex(attr)
+	default:
+		item.Value, err = me.float(attr)
+	}
+	return item, err
+}
+
+// cueOut parses the value of EXT-X-CUE-OUT, which is the duration in seconds, DURATION=<n>, or nothing.
+func (me *parser) cueOut(s string) (*CueOutAttributes, error) {
+	item := new(CueOutAttributes)
+
+	s = strings.TrimPrefix(s, "DURATION=")
+	if s == "" {
+		return item, nil
+	}
+	v, err := me.float(attribute{Key: "EXT-X-CUE-OUT", Value: s})
+	if err != nil {
+		return nil, err
+	}
+	item.DURATION = v
+	return item, nil
+}
+
+// Unmarshal parses a media playlist. Variables referred by EXT-X-DEFINE:IMPORT are looked up in imports,
+// which usually come from MasterPlaylist.Variables.
+// Variable references are kept in the values, so that Marshal gives them back, and are resolved by Substitute.
+// Segment tags are kept on the segment they precede, like they are marshaled, e.g. EXT-X-KEY and EXT-X-MAP
+// apply to the following segments until the next ones. Parts after the last URI make up an uncompleted segment.
+func (me *MediaPlaylist) Unmarshal(data []byte, imports map[string]string) error {
+	var (
+		p    = new(parser).init(imports)
+		item MediaSegmentTags
+		inf  bool // whether EXTINF is waiting for the URI
+	)
+
+	me.BasicTags = BasicTags{}
+	me.MediaPlaylistTags = MediaPlaylistTags{}
+	me.MediaMetadataTags = MediaMetadataTags{}
+	me.MediaSegments = make([]MediaSegmentTags, 0)
+
+	err := p.scan(data, func(tag string, value string) error {
+		var err error
+
+		switch tag {
+		case "":
+			if !inf {
+				return p.errorf("URI without EXTINF: %s", value)
+			}
+			item.URI = value
+			me.MediaSegments = append(me.MediaSegments, item)
+			item = MediaSegmentTags{}
+			inf = false
+
+		// basic tags
+		case "#EXT-X-VERSION":
+			me.EXT_X_VERSION, err = p.uint(attribute{Key: tag, Value: value})
+
+		// media or master playlist tags
+		case "#EXT-X-INDEPENDENT-SEGMENTS":
+			me.EXT_X_INDEPENDENT_SEGMENTS = true
+		case "#EXT-X-START":
+			me.EXT_X_START, err = p.start(value)
+		case "#EXT-X-DEFINE":
+			var define DefineAttributes
+			define, err = p.define(value)
+			me.EXT_X_DEFINE = append(me.EXT_X_DEFINE, define)
+
+		// media playlist tags
+		case "#EXT-X-TARGETDURATION":
+			me.EXT_X_TARGETDURATION, err = p.uint(attribute{Key: tag, Value: value})
+		case "#EXT-X-MEDIA-SEQUENCE":
+			me.EXT_X_MEDIA_SEQUENCE, err = p.uint(attribute{Key: tag, Value: value})
+		case "#EXT-X-DISCONTINUITY-SEQUENCE":
+			me.EXT_X_DISCONTINUITY_SEQUENCE, err = p.uint(attribute{Key: tag, Value: value})
+		case "#EXT-X-ENDLIST":
+			me.EXT_X_ENDLIST = true
+		case "#EXT-X-PLAYLIST-TYPE":
+			me.EXT_X_PLAYLIST_TYPE = value
+		case "#EXT-X-I-FRAMES-ONLY":
+			me.EXT_X_I_FRAMES_ONLY = true
+		case "#EXT-X-PART-INF":
+			err = me.unmarshalPartInf(p, value)
+		case "#EXT-X-SERVER-CONTROL":
+			err = me.unmarshalServerControl(p, value)
+
+		// media metadata tags
+		case "#EXT-X-DATERANGE":
+			err = me.unmarshalDateRange(p, value)
+		case "#EXT-X-SKIP":
+			err = me.unmarshalSkip(p, value)
+		case "#EXT-X-PRELOAD-HINT":
+			err = me.unmarshalPreloadHint(p, value)
+		case "#EXT-X-RENDITION-REPORT":
+			err = me.unmarshalRenditionReport(p, value)
+
+		// media segment tags
+		case "#EXTINF":
+			err = item.unmarshalInf(p, value)
+			inf = true
+		case "#EXT-X-BYTERANGE":
+			item.EXT_X_BYTERANGE, err = p.byteRange(value)
+		case "#EXT-X-DISCONTINUITY":
+			item.EXT_X_DISCONTINUITY = true
+		case "#EXT-X-KEY":
+			item.EXT_X_KEY, err = p.key(value)
+		case "#EXT-X-MAP":
+			err = item.unmarshalMap(p, value)
+		case "#EXT-X-PROGRAM-DATE-TIME":
+			item.EXT_X_PROGRAM_DATE_TIME = value
+		case "#EXT-X-CUE-OUT":
+			item.EXT_X_CUE_OUT, err = p.cueOut(value)
+		case "#EXT-X-CUE-IN":
+			item.EXT_X_CUE_IN = true
+		case "#EXT-X-GAP":
+			item.EXT_X_GAP = true
+		case "#EXT-X-BITRATE":
+			item.EXT_X_BITRATE, err = p.uint(attribute{Key: tag, Value: value})
+		case "#EXT-X-PART":
+			err = item.unmarshalPart(p, value)
+
+		case "#EXT-X-STREAM-INF", "#EXT-X-MEDIA", "#EXT-X-I-FRAME-STREAM-INF", "#EXT-X-SESSION-DATA", "#EXT-X-SESSION-KEY":
+			return p.errorf("%s in media playlist", tag)
+		}
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	if inf {
+		return p.errorf("EXTINF without URI")
+	}
+	if len(item.EXT_X_PART) > 0 {
+		me.MediaSegments = append(me.MediaSegments, item)
+	}
+	me.variables = p.variables
+	return nil
+}
+
+// Substitute replaces the variable references in a value of the parsed playlist, e.g. a URI, with the defined values.
+func (me *MediaPlaylist) Substitute(s string) string {
+	v, err := substitute(s, me.variables)
+	if err != nil {
+		return s
+	}
+	return v
+}
+
+func (me *MediaPlaylist) unmarshalPartInf(p *parser, s string) error {
+	attrs, err := p.attributes(s)
+	if err != nil {
+		return err
+	}
+	for _, attr := range attrs {
+		switch attr.Key {
+		case "PART-TARGET":
+			me.EXT_X_PART_INF.PART_TARGET, err = p.float(attr)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (me *MediaPlaylist) unmarshalServerControl(p *parser, s string) error {
+	attrs, err := p.attributes(s)
+	if err != nil {
+		return err
+	}
+	for _, attr := range attrs {
+		switch attr.Key {
+		case "CAN-SKIP-UNTIL":
+			me.EXT_X_SERVER_CONTROL.CAN_SKIP_UNTIL, err = p.float(attr)
+		case "CAN-SKIP-DATERANGES":
+			me.EXT_X_SERVER_CONTROL.CAN_SKIP_DATERANGES = attr.Value
+		case "HOLD-BACK":
+			me.EXT_X_SERVER_CONTROL.HOLD_BACK, err = p.float(attr)
+		case "PART-HOLD-BACK":
+			me.EXT_X_SERVER_CONTROL.PART_HOLD_BACK, err = p.float(attr)
+		case "CAN-BLOCK-RELOAD":
+			me.EXT_X_SERVER_CONTROL.CAN_BLOCK_RELOAD = attr.Value
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (me *MediaPlaylist) unmarshalDateRange(p *parser, s string) error {
+	var item DateRangeAttributes
+
+	attrs, err := p.attributes(s)
+	if err != nil {
+		return err
+	}
+	for _, attr := range attrs {
+		switch attr.Key {
+		case "ID":
+			item.ID = attr.Value
+		case "CLASS":
+			item.CLASS = attr.Value
+		case "START-DATE":
+			item.START_DATE = attr.Value
+		case "END-DATE":
+			item.END_DATE = attr.Value
+		case "DURATION":
+			item.DURATION, err = p.float(attr)
+		case "PLANNED-DURATION":
+			item.PLANNED_DURATION, err = p.float(attr)
+		case "SCTE35-CMD":
+			item.SCTE35_CMD, err = p.hex(attr)
+		case "SCTE35-OUT":
+			item.SCTE35_OUT, err = p.hex(attr)
+		case "SCTE35-IN":
+			item.SCTE35_IN, err = p.hex(attr)
+		case "END-ON-NEXT":
+			item.END_ON_NEXT = attr.Value
+		default:
+			if strings.HasPrefix(attr.Key, "X-") {
+				var x XClientAttribute
+				x, err = p.client(attr)
+				item.X_CLIENT_ATTRIBUTES = append(item.X_CLIENT_ATTRIBUTES, x)
+			}
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if item.ID == "" {
+		return p.errorf("date range without ID")
+	}
+	me.EXT_X_DATERANGE = append(me.EXT_X_DATERANGE, item)
+	return nil
+}
+
+func (me *MediaPlaylist) unmarshalSkip(p *parser, s string) error {
+	attrs, err := p.attributes(s)
+	if err != nil {
+		return err
+	}
+	for _, attr := range attrs {
+		switch attr.Key {
+		case "SKIPPED-SEGMENTS":
+			_, err = p.uint(attr)
+			me.EXT_X_SKIP.SKIPPED_SEGMENTS = attr.Value
+		case "RECENTLY-REMOVED-DATERANGES":
+			me.EXT_X_SKIP.RECENTLY_REMOVED_DATERANGES = attr.Value
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (me *MediaPlaylist) unmarshalPreloadHint(p *parser, s string) error {
+	attrs, err := p.attributes(s)
+	if err != nil {
+		return err
+	}
+	for _, attr := range attrs {
+		switch attr.Key {
+		case "TYPE":
+			me.EXT_X_PRELOAD_HINT.TYPE = attr.Value
+		case "URI":
+			me.EXT_X_PRELOAD_HINT.URI = attr.Value
+		case "BYTERANGE-START":
+			me.EXT_X_PRELOAD_HINT.BYTERANGE_START, err = p.uint(attr)
+		case "BYTERANGE-LENGTH":
+			me.EXT_X_PRELOAD_HINT.BYTERANGE_LENGTH, err = p.uint(attr)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (me *MediaPlaylist) unmarshalRenditionReport(p *parser, s string) error {
+	var item RenditionReportAttributes
+
+	attrs, err := p.attributes(s)
+	if err != nil {
+		return err
+	}
+	for _, attr := range attrs {
+		switch attr.Key {
+		case "URI":
+			item.URI = attr.Value
+		case "LAST-MSN":
+			item.LAST_MSN, err = p.uint(attr)
+		case "LAST-PART":
+			item.LAST_PART, err = p.uint(attr)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	me.EXT_X_RENDITION_REPORT = append(me.EXT_X_RENDITION_REPORT, item)
+	return nil
+}
+
+func (me *MediaSegmentTags) unmarshalInf(p *parser, s string) error {
+	duration, title := s, ""
+	if i := strings.IndexByte(s, ','); i >= 0 {
+		duration, title = s[:i], s[i+1:]
+	}
+	v, err := p.float(attribute{Key: "EXTINF", Value: duration})
+	if err != nil {
+		return err
+	}
+	me.EXTINF.Duration = v
+	me.EXTINF.Title = title
+	return nil
+}
+
+func (me *MediaSegmentTags) unmarshalMap(p *parser, s string) error {
+	attrs, err := p.attributes(s)
+	if err != nil {
+		return err
+	}
+	for _, attr := range attrs {
+		switch attr.Key {
+		case "URI":
+			me.EXT_X_MAP.URI = attr.Value
+		case "BYTERANGE":
+			var v string
+			if v, err = p.substitute(attr.Value); err == nil {
+				_, err = p.byteRange(v)
+			}
+			me.EXT_X_MAP.BYTERANGE = attr.Value
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if me.EXT_X_MAP.URI == "" {
+		return p.errorf("map without URI")
+	}
+	return nil
+}
+
+func (me *MediaSegmentTags) unmarshalPart(p *parser, s string) error {
+	var item PartAttributes
+
+	attrs, err := p.attributes(s)
+	if err != nil {
+		return err
+	}
+	for _, attr := range attrs {
+		switch attr.Key {
+		case "URI":
+			item.URI = attr.Value
+		case "DURATION":
+			item.DURATION, err = p.float(attr)
+		case "INDEPENDENT":
+			item.INDEPENDENT = attr.Value
+		case "BYTERANGE":
+			item.BYTERANGE, err = p.byteRange(attr.Value)
+		case "GAP":
+			item.GAP = attr.Value
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if item.URI == "" || item.DURATION == 0 {
+		return p.errorf("part without URI or DURATION")
+	}
+	me.EXT_X_PART = append(me.EXT_X_PART, item)
+	return nil
+}
+
+// Unmarshal parses a master playlist. The variables defined are available by Variables afterwards.
+// Variable references are kept in the values, so that Marshal gives them back, and are resolved by Substitute.
+func (me *MasterPlaylist) Unmarshal(data []byte) error {
+	var (
+		p   = new(parser).init(nil)
+		inf *StreamInfAttributes // waiting for the URI
+	)
+
+	me.BasicTags = BasicTags{}
+	me.MasterPlaylistTags = MasterPlaylistTags{}
+
+	err := p.scan(data, func(tag string, value string) error {
+		var err error
+
+		if inf != nil && tag != "" {
+			return p.errorf("EXT-X-STREAM-INF without URI")
+		}
+
+		switch tag {
+		case "":
+			if inf == nil {
+				return p.errorf("URI without EXT-X-STREAM-INF: %s", value)
+			}
+			inf.URI = value
+			me.EXT_X_STREAM_INF = append(me.EXT_X_STREAM_INF, *inf)
+			inf = nil
+
+		// basic tags
+		case "#EXT-X-VERSION":
+			me.EXT_X_VERSION, err = p.uint(attribute{Key: tag, Value: value})
+
+		// media or master playlist tags
+		case "#EXT-X-INDEPENDENT-SEGMENTS":
+			me.EXT_X_INDEPENDENT_SEGMENTS = true
+		case "#EXT-X-START":
+			me.EXT_X_START, err = p.start(value)
+		case "#EXT-X-DEFINE":
+			var define DefineAttributes
+			define, err = p.define(value)
+			me.EXT_X_DEFINE = append(me.EXT_X_DEFINE, define)
+
+		// master playlist tags
+		case "#EXT-X-MEDIA":
+			err = me.unmarshalMedia(p, value)
+		case "#EXT-X-STREAM-INF":
+			inf, err = me.unmarshalStreamInf(p, value)
+		case "#EXT-X-I-FRAME-STREAM-INF":
+			err = me.unmarshalIFrameStreamInf(p, value)
+		case "#EXT-X-SESSION-DATA":
+			err = me.unmarshalSessionData(p, value)
+		case "#EXT-X-SESSION-KEY":
+			var key KeyAttributes
+			key, err = p.key(value)
+			me.EXT_X_SESSION_KEY = append(me.EXT_X_SESSION_KEY, SessionKeyAttributes(key))
+
+		case "#EXTINF", "#EXT-X-TARGETDURATION", "#EXT-X-MEDIA-SEQUENCE", "#EXT-X-PART":
+			return p.errorf("%s in master playlist", tag)
+		}
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	if inf != nil {
+		return p.errorf("EXT-X-STREAM-INF without URI")
+	}
+	me.variables = p.variables
+	return nil
+}
+
+// Variables returns the variables defined in the master playlist, which could be imported by the media playlists.
+func (me *MasterPlaylist) Variables() map[string]string {
+	return me.variables
+}
+
+// Substitute replaces the variable references in a value of the parsed playlist, e.g. a URI, with the defined values.
+func (me *MasterPlaylist) Substitute(s string) string {
+	v, err := substitute(s, me.variables)
+	if err != nil {
+		return s
+	}
+	return v
+}
+
+func (me *MasterPlaylist) unmarshalMedia(p *parser, s string) error {
+	var item MediaAttributes
+
+	attrs, err := p.attributes(s)
+	if err != nil {
+		return err
+	}
+	for _, attr := range attrs {
+		switch attr.Key {
+		case "TYPE":
+			item.TYPE = attr.Value
+		case "URI":
+			item.URI = attr.Value
+		case "GROUP-ID":
+			item.GROUP_ID = attr.Value
+		case "LANGUAGE":
+			item.LANGUAGE = attr.Value
+		case "ASSOC-LANGUAGE":
+			item.ASSOC_LANGUAGE = attr.Value
+		case "NAME":
+			item.NAME = attr.Value
+		case "DEFAULT":
+			item.DEFAULT = attr.Value
+		case "AUTOSELECT":
+			item.AUTOSELECT = attr.Value
+		case "FORCED":
+			item.FORCED = attr.Value
+		case "INSTREAM-ID":
+			item.INSTREAM_ID = attr.Value
+		case "CHARACTERISTICS":
+			item.CHARACTERISTICS = attr.Value
+		case "CHANNELS":
+			item.CHANNELS = attr.Value
+		}
+	}
+	if item.TYPE == "" || item.GROUP_ID == "" || item.NAME == "" {
+		return p.errorf("media without TYPE, GROUP-ID or NAME")
+	}
+	me.EXT_X_MEDIA = append(me.EXT_X_MEDIA, item)
+	return nil
+}
+
+func (me *MasterPlaylist) unmarshalStreamInf(p *parser, s string) (*StreamInfAttributes, error) {
+	item := new(StreamInfAttributes)
+
+	attrs, err := p.attributes(s)
+	if err != nil {
+		return nil, err
+	}
+	for _, attr := range attrs {
+		switch attr.Key {
+		case "BANDWIDTH":
+			item.BANDWIDTH, err = p.uint(attr)
+		case "AVERAGE-BANDWIDTH":
+			item.AVERAGE_BANDWIDTH, err = p.uint(attr)
+		case "CODECS":
+			item.CODECS = attr.Value
+		case "RESOLUTION":
+			item.RESOLUTION = attr.Value
+		case "FRAME-RATE":
+			item.FRAME_RATE, err = p.float(attr)
+		case "HDCP-LEVEL":
+			item.HDCP_LEVEL = attr.Value
+		case "ALLOWED-CPC":
+			item.ALLOWED_CPC = attr.Value
+		case "VIDEO-RANGE":
+			item.VIDEO_RANGE = attr.Value
+		case "AUDIO":
+			item.AUDIO = attr.Value
+		case "VIDEO":
+			item.VIDEO = attr.Value
+		case "SUBTITLES":
+			item.SUBTITLES = attr.Value
+		case "CLOSED-CAPTIONS":
+			item.CLOSED_CAPTIONS = attr.Value
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	if item.BANDWIDTH == 0 {
+		return nil, p.errorf("stream without BANDWIDTH")
+	}
+	return item, nil
+}
+
+func (me *MasterPlaylist) unmarshalIFrameStreamInf(p *parser, s string) error {
+	var item IFrameStreamInfAttributes
+
+	attrs, err := p.attributes(s)
+	if err != nil {
+		return err
+	}
+	for _, attr := range attrs {
+		switch attr.Key {
+		case "BANDWIDTH":
+			item.BANDWIDTH, err = p.uint(attr)
+		case "AVERAGE-BANDWIDTH":
+			item.AVERAGE_BANDWIDTH, err = p.uint(attr)
+		case "CODECS":
+			item.CODECS = attr.Value
+		case "RESOLUTION":
+			item.RESOLUTION = attr.Value
+		case "HDCP-LEVEL":
+			item.HDCP_LEVEL = attr.Value
+		case "ALLOWED-CPC":
+			item.ALLOWED_CPC = attr.Value
+		case "VIDEO-RANGE":
+			item.VIDEO_RANGE = attr.Value
+		case "VIDEO":
+			item.VIDEO = attr.Value
+		case "URI":
+			item.URI = attr.Value
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if item.URI == "" {
+		return p.errorf("I-frame stream without URI")
+	}
+	me.EXT_X_I_FRAME_STREAM_INF = append(me.EXT_X_I_FRAME_STREAM_INF, item)
+	return nil
+}
+
+func (me *MasterPlaylist) unmarshalSessionData(p *parser, s string) error {
+	var item SessionDataAttributes
+
+	attrs, err := p.attributes(s)
+	if err != nil {
+		return err
+	}
+	for _, attr := range attrs {
+		switch attr.Key {
+		case "DATA-ID":
+			item.DATA_ID = attr.Value
+		case "VALUE":
+			item.VALUE = attr.Value
+		case "URI":
+			item.URI = attr.Value
+		case "LANGUAGE":
+			item.LANGUAGE = attr.Value
+		}
+	}
+	if item.DATA_ID == "" {
+		return p.errorf("session data without DATA-ID")
+	}
+	me.EXT_X_SESSION_DATA = append(me.EXT_X_SESSION_DATA, item)
+	return nil
+}
@@ -3,6 +3,7 @@ package mpd
 import (
 	"encoding/xml"
 	"fmt"
+	"strconv"
 	"time"
 
 	"github.com/studease/common/av"
@@ -57,6 +58,7 @@ type MPD struct {
 	Location                   []string             `xml:"Location,omitempty"`                        // 0...N
 	Period                     []Period             `xml:"Period"`                                    // 1...N
 	Metrics                    []Metrics            `xml:"Metrics,omitempty"`                         // 0...N
+	UTCTiming                  []Descriptor         `xml:"UTCTiming,omitempty"`                       // 0...N
 }
 
 // Init this class
@@ -197,15 +199,16 @@ type Subset struct {
 
 // SegmentBase element (inheritable)
 type SegmentBase struct {
-	Timescale                uint     `xml:"timescale,attr,omitempty"`                // O - default: 1
-	PresentationTimeOffset   uint64   `xml:"presentationTimeOffset,attr,omitempty"`   // O
-	TimeShiftBufferDepth     Duration `xml:"timeShiftBufferDepth,attr,omitempty"`     // O
-	IndexRange               string   `xml:"indexRange,attr,omitempty"`               // O
-	IndexRangeExact          bool     `xml:"indexRangeExact,attr,omitempty"`          // OD - default: false
-	AvailabilityTimeOffset   float64  `xml:"availabilityTimeOffset,attr,omitempty"`   // O
-	AvailabilityTimeComplete bool     `xml:"availabilityTimeComplete,attr,omitempty"` // O
-	Initialization           []URL    `xml:"Initialization,omitempty"`                // 0...1
-	RepresentationIndex      []URL    `xml:"RepresentationIndex,omitempty"`           // 0...1
+	Timescale                  uint       `xml:"timescale,attr,omitempty"`                  // O - default: 1
+	PresentationTimeOffset     uint64     `xml:"presentationTimeOffset,attr,omitempty"`     // O
+	TimeShiftBufferDepth       Duration   `xml:"timeShiftBufferDepth,attr,omitempty"`       // O
+	IndexRange                 string     `xml:"indexRange,attr,omitempty"`                 // O
+	IndexRangeExact            bool       `xml:"indexRangeExact,attr,omitempty"`            // OD - default: false
+	AvailabilityTimeOffset     float64    `xml:"availabilityTimeOffset,attr,omitempty"`     // O
+	AvailabilityTimeComplete   bool       `xml:"availabilityTimeComplete,attr,omitempty"`   // O
+	AvailabilityTimeIncomplete Incomplete `xml:"availabilityTimeIncomplete,attr,omitempty"` // written as availabilityTimeComplete="false"
+	Initialization             []URL      `xml:"Initialization,omitempty"`                  // 0...1
+	RepresentationIndex        []URL      `xml:"RepresentationIndex,omitempty"`             // 0...1
 }
 
 // MultipleSegmentBase element in SegmentList, SegmentTemplate
@@ -361,7 +364,7 @@ func FormatDuration(d time.Duration) Duration {
 	}
 
 	if n = d / time.Millisecond; n > 0 || tmp == "PT" {
-		tmp += fmt.Sprintf("%.3gS", float64(n)/1000)
+		tmp += strconv.FormatFloat(float64(n)/1000, 'f', -1, 64) + "S"
 	}
 
 	return Duration(tmp)
@@ -382,3 +385,14 @@ func FormatRatio(w uint32, h uint32) Ratio {
 
 	return Ratio(fmt.Sprintf("%d:%d", w, h))
 }
+
+// Incomplete is written as availabilityTimeComplete="false" if true, which is omitted by the bool of SegmentBase.
+type Incomplete bool
+
+// MarshalXMLAttr implements xml.MarshalerAttr.
+func (me Incomplete) MarshalXMLAttr(name xml.Name) (xml.Attr, error) {
+	if !me {
+		return xml.Attr{}, nil
+	}
+	return xml.Attr{Name: xml.Name{Local: "availabilityTimeComplete"}, Value: "false"}, nil
+}
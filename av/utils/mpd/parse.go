@@ -0,0 +1,122 @@
+package mpd
+
+import (
+	"encoding/xml"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Unmarshal parses the XML encoding of MPD.
+func (me *MPD) Unmarshal(data []byte) error {
+	*me = MPD{}
+
+	err := xml.Unmarshal(data, me)
+	if err != nil {
+		return err
+	}
+
+	if len(me.Period) == 0 {
+		return fmt.Errorf("MPD without Period")
+	}
+	if me.Type == TYPE_DYNAMIC && me.AvailabilityStartTime == "" {
+		return fmt.Errorf("dynamic MPD without availabilityStartTime")
+	}
+	for _, d := range []Duration{
+		me.MediaPresentationDuration, me.MinimumUpdatePeriod, me.MinBufferTime, me.TimeShiftBufferDepth,
+		me.SuggestedPresentationDelay, me.MaxSegmentDuration, me.MaxSubsegmentDuration,
+	} {
+		if _, err = ParseDuration(d); err != nil {
+			return err
+		}
+	}
+	for _, t := range []DateTime{me.AvailabilityStartTime, me.PublishTime, me.AvailabilityEndTime} {
+		if _, err = ParseDateTime(t); err != nil {
+			return err
+		}
+	}
+	for _, p := range me.Period {
+		if _, err = ParseDuration(p.Start); err != nil {
+			return err
+		}
+		if _, err = ParseDuration(p.Duration); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ParseDuration returns the duration of the formated string, 0 if empty.
+// A year is 365 days, and a month is 30 days, the same as FormatDuration.
+func ParseDuration(s Duration) (time.Duration, error) {
+	var (
+		d    time.Duration
+		str  = string(s)
+		date = true
+	)
+
+	if str == "" {
+		return 0, nil
+	}
+	if !strings.HasPrefix(str, "P") {
+		return 0, fmt.Errorf("bad duration %s", s)
+	}
+
+	for i := 1; i < len(str); /* void */ {
+		if str[i] == 'T' {
+			date = false
+			i++
+			continue
+		}
+
+		j := i
+		for j < len(str) && (str[j] >= '0' && str[j] <= '9' || str[j] == '.') {
+			j++
+		}
+		if j == i || j == len(str) {
+			return 0, fmt.Errorf("bad duration %s", s)
+		}
+		n, err := strconv.ParseFloat(str[i:j], 64)
+		if err != nil {
+			return 0, fmt.Errorf("bad duration %s", s)
+		}
+
+		var unit time.Duration
+		switch {
+		case date && str[j] == 'Y':
+			unit = 365 * 24 * time.Hour
+		case date && str[j] == 'M':
+			unit = 30 * 24 * time.Hour
+		case date && str[j] == 'D':
+			unit = 24 * time.Hour
+		case !date && str[j] == 'H':
+			unit = time.Hour
+		case !date && str[j] == 'M':
+			unit = time.Minute
+		case !date && str[j] == 'S':
+			unit = time.Second
+		default:
+			return 0, fmt.Errorf("bad duration %s", s)
+		}
+		d += time.Duration(n * float64(unit))
+		i = j + 1
+	}
+	return d, nil
+}
+
+// ParseDateTime returns the time of the formated string, zero if empty. It's in UTC if without a time zone.
+func ParseDateTime(s DateTime) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+
+	t, err := time.Parse(time.RFC3339Nano, string(s))
+	if err != nil {
+		t, err = time.ParseInLocation("2006-01-02T15:04:05.999999999", string(s), time.UTC)
+		if err != nil {
+			return t, fmt.Errorf("bad date time %s", s)
+		}
+	}
+	return t, nil
+}
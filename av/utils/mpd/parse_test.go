@@ -0,0 +1,94 @@
+package mpd
+
+import (
+	"encoding/xml"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestUnmarshal(t *testing.T) {
+	var m MPD
+
+	err := m.Unmarshal([]byte(manifest(`type="dynamic" availabilityStartTime="2021-01-01T00:00:00Z" minimumUpdatePeriod="PT2S"`,
+		`><SegmentTimeline><S t="0" d="2000" r="-1"/></SegmentTimeline></SegmentTemplate>`)))
+	if err != nil {
+		t.Fatalf("Failed to unmarshal: %v", err)
+	}
+	if m.Type != TYPE_DYNAMIC || m.MinimumUpdatePeriod != "PT2S" || len(m.Period) != 1 {
+		t.Fatalf("Unexpected MPD: type=%s, minimumUpdatePeriod=%s, periods=%d", m.Type, m.MinimumUpdatePeriod, len(m.Period))
+	}
+	set := &m.Period[0].AdaptationSet[0]
+	if set.MimeType != "video/mp4" || len(set.Representation) != 1 || set.Representation[0].Id != "v0" || set.Representation[0].Bandwidth != 800000 {
+		t.Fatalf("Unexpected AdaptationSet: %+v", set)
+	}
+	s := set.SegmentTemplate[0].SegmentTimeline[0].S[0]
+	if s.T != "0" || s.D != "2000" || s.R != -1 {
+		t.Fatalf("Unexpected S: %+v", s)
+	}
+
+	for _, item := range []struct {
+		name string
+		data string
+	}{
+		{"without Period", `<MPD xmlns="urn:mpeg:dash:schema:mpd:2011" profiles="urn:mpeg:dash:profile:isoff-live:2011" minBufferTime="PT2S"/>`},
+		{"dynamic without availabilityStartTime", manifest(`type="dynamic"`, `duration="2000"/>`)},
+		{"bad duration", manifest(`mediaPresentationDuration="10S"`, `duration="2000"/>`)},
+		{"bad date time", manifest(`type="dynamic" availabilityStartTime="yesterday"`, `duration="2000"/>`)},
+		{"not XML", "#EXTM3U"},
+	} {
+		if err := new(MPD).Unmarshal([]byte(item.data)); err == nil {
+			t.Fatalf("%s: expected error", item.name)
+		}
+	}
+}
+
+func TestParseDuration(t *testing.T) {
+	for _, item := range []struct {
+		s Duration
+		d time.Duration
+	}{
+		{"", 0},
+		{"PT0S", 0},
+		{"PT1.5S", 1500 * time.Millisecond},
+		{"PT1H2M3S", time.Hour + 2*time.Minute + 3*time.Second},
+		{"P1DT12H", 36 * time.Hour},
+		{"P1Y1M", 395 * 24 * time.Hour},
+	} {
+		d, err := ParseDuration(item.s)
+		if err != nil || d != item.d {
+			t.Fatalf("%s: %v, %v, expected %v", item.s, d, err, item.d)
+		}
+		if item.s != "" {
+			if d, _ = ParseDuration(FormatDuration(item.d)); d != item.d {
+				t.Fatalf("%s: formated as %s", item.s, FormatDuration(item.d))
+			}
+		}
+	}
+
+	for _, s := range []Duration{"1S", "PTS", "PT1", "P1H", "PT1D", "PT1..5S"} {
+		if _, err := ParseDuration(s); err == nil {
+			t.Fatalf("%s: expected error", s)
+		}
+	}
+}
+
+func TestMarshalAvailabilityTimeComplete(t *testing.T) {
+	for _, item := range []struct {
+		name string
+		base SegmentBase
+		attr string
+	}{
+		{"unset", SegmentBase{}, ""},
+		{"complete", SegmentBase{AvailabilityTimeComplete: true}, `availabilityTimeComplete="true"`},
+		{"incomplete", SegmentBase{AvailabilityTimeIncomplete: true}, `availabilityTimeComplete="false"`},
+	} {
+		data, err := xml.Marshal(&item.base)
+		if err != nil {
+			t.Fatalf("%s: failed to marshal: %v", item.name, err)
+		}
+		if n := strings.Count(string(data), "availabilityTimeComplete"); item.attr == "" && n != 0 || item.attr != "" && (n != 1 || !strings.Contains(string(data), item.attr)) {
+			t.Fatalf("%s: unexpected %s", item.name, data)
+		}
+	}
+}
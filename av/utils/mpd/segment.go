@@ -0,0 +1,500 @@
+package mpd
+
+import (
+	"fmt"
+	"math"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/studease/common/av/utils/box"
+)
+
+// MaxSegments bounds the segments resolved of a Representation.
+const MaxSegments = 1 << 20
+
+var (
+	widthTag = regexp.MustCompile(`^%0[0-9]+d$`)
+)
+
+// Segment of a Representation, resolved from SegmentTemplate, SegmentList or SegmentBase.
+type Segment struct {
+	URL      string
+	Range    string // of the URL, e.g. "0-1023", empty for the whole
+	Number   uint64
+	Time     uint64 // in the timescale of the Index, without presentationTimeOffset subtracted
+	Duration uint64
+}
+
+// Index of a Representation, with the segment information inherited from its AdaptationSet and Period.
+type Index struct {
+	Timescale              uint64
+	PresentationTimeOffset uint64
+	Init                   Segment   // URL is empty if none
+	Index                  Segment   // sidx of SegmentBase, which is resolved into Segments by ParseSIDX
+	Segments               []Segment // available ones if dynamic
+}
+
+// ParseSIDX resolves the Segments from the sidx fetched by Index.
+func (me *Index) ParseSIDX(data []byte) error {
+	sidx, end, err := box.ParseSIDX(data)
+	if err != nil {
+		return err
+	}
+
+	var first uint64
+	if me.Index.Range != "" {
+		fmt.Sscanf(me.Index.Range, "%d-", &first)
+	}
+
+	offset := first + uint64(end) + sidx.FirstOffset
+	t := sidx.EarliestPresentationTime
+	me.Timescale = uint64(sidx.Timescale)
+	me.Segments = make([]Segment, 0, len(sidx.References))
+	for i, ref := range sidx.References {
+		if ref.Type != 0 {
+			return fmt.Errorf("hierarchical sidx not supported")
+		}
+		me.Segments = append(me.Segments, Segment{
+			URL:      me.Index.URL,
+			Range:    fmt.Sprintf("%d-%d", offset, offset+uint64(ref.Size)-1),
+			Number:   uint64(i + 1),
+			Time:     t,
+			Duration: uint64(ref.Duration),
+		})
+		offset += uint64(ref.Size)
+		t += uint64(ref.Duration)
+	}
+	return nil
+}
+
+// Expand substitutes the identifiers of a SegmentTemplate, e.g. $Number%05d$, with the given values.
+// Unknown identifiers are left as they are.
+func Expand(s string, id string, number uint64, bandwidth uint, t uint64) string {
+	var b strings.Builder
+
+	for {
+		i := strings.IndexByte(s, '$')
+		if i < 0 {
+			break
+		}
+		j := strings.IndexByte(s[i+1:], '$')
+		if j < 0 {
+			break
+		}
+		b.WriteString(s[:i])
+		ident := s[i+1 : i+1+j]
+		s = s[i+2+j:]
+
+		name, tag := ident, "%d"
+		if k := strings.IndexByte(ident, '%'); k >= 0 {
+			name, tag = ident[:k], ident[k:]
+			if !widthTag.MatchString(tag) {
+				tag = "%d"
+			}
+		}
+
+		switch name {
+		case "":
+			b.WriteByte('$')
+		case "RepresentationID":
+			b.WriteString(id)
+		case "Number":
+			b.WriteString(fmt.Sprintf(tag, number))
+		case "Bandwidth":
+			b.WriteString(fmt.Sprintf(tag, bandwidth))
+		case "Time":
+			b.WriteString(fmt.Sprintf(tag, t))
+		default:
+			b.WriteString("$" + ident + "$")
+		}
+	}
+	b.WriteString(s)
+	return b.String()
+}
+
+// PeriodStart returns the start of the Period, and its duration, which is 0 if unknown yet.
+func (me *MPD) PeriodStart(period *Period) (time.Duration, time.Duration) {
+	var (
+		start    time.Duration
+		duration time.Duration
+	)
+
+	for i := range me.Period {
+		p := &me.Period[i]
+		if p.Start != "" {
+			start, _ = ParseDuration(p.Start)
+		} else if i > 0 {
+			start += duration
+		}
+		duration, _ = ParseDuration(p.Duration)
+		if duration == 0 {
+			if i+1 < len(me.Period) && me.Period[i+1].Start != "" {
+				next, _ := ParseDuration(me.Period[i+1].Start)
+				duration = next - start
+			} else if i+1 == len(me.Period) && me.MediaPresentationDuration != "" {
+				total, _ := ParseDuration(me.MediaPresentationDuration)
+				duration = total - start
+			}
+		}
+		if p == period {
+			break
+		}
+	}
+	return start, duration
+}
+
+// Resolve returns the Index of the Representation, with URLs resolved against the BaseURLs and uri of the MPD.
+// Segments of a dynamic MPD are the ones available at now, within timeShiftBufferDepth.
+func (me *MPD) Resolve(uri string, period *Period, set *AdaptationSet, rep *Representation, now time.Time) (*Index, error) {
+	var (
+		base     = uri
+		template *SegmentTemplate
+		list     *SegmentList
+		single   *SegmentBase
+	)
+
+	for _, urls := range [][]BaseURL{me.BaseURL, period.BaseURL, set.BaseURL, rep.BaseURL} {
+		if len(urls) > 0 {
+			base = resolve(base, strings.TrimSpace(urls[0].Content))
+		}
+	}
+
+	for _, arr := range [][]SegmentTemplate{period.SegmentTemplate, set.SegmentTemplate, rep.SegmentTemplate} {
+		if len(arr) > 0 {
+			if template == nil {
+				template = new(SegmentTemplate)
+			}
+			template.merge(&arr[0])
+		}
+	}
+	for _, arr := range [][]SegmentList{period.SegmentList, set.SegmentList, rep.SegmentList} {
+		if len(arr) > 0 {
+			if list == nil {
+				list = new(SegmentList)
+			}
+			list.merge(&arr[0])
+		}
+	}
+	for _, arr := range [][]SegmentBase{period.SegmentBase, set.SegmentBase, rep.SegmentBase} {
+		if len(arr) > 0 {
+			if single == nil {
+				single = new(SegmentBase)
+			}
+			single.merge(&arr[0])
+		}
+	}
+
+	switch {
+	case template != nil:
+		return me.resolveTemplate(base, template, period, rep, now)
+	case list != nil:
+		return me.resolveList(base, list, period, now)
+	case single != nil:
+		idx := single.index(base)
+		idx.Index = Segment{URL: base, Range: single.IndexRange}
+		if len(single.RepresentationIndex) > 0 {
+			idx.Index = single.RepresentationIndex[0].segment(base)
+		}
+		if idx.Index.Range == "" {
+			return nil, fmt.Errorf("SegmentBase without indexRange")
+		}
+		return idx, nil
+	default:
+		// The whole resource is the only segment.
+		return &Index{Timescale: 1, Segments: []Segment{{URL: base, Number: 1}}}, nil
+	}
+}
+
+func (me *MPD) resolveTemplate(base string, t *SegmentTemplate, period *Period, rep *Representation, now time.Time) (*Index, error) {
+	idx := t.index(base)
+	if t.Initialization != "" {
+		idx.Init = Segment{URL: resolve(base, Expand(t.Initialization, rep.Id, 0, rep.Bandwidth, 0))}
+	}
+	if t.Media == "" {
+		return nil, fmt.Errorf("SegmentTemplate without media")
+	}
+
+	times, err := me.times(&t.MultipleSegmentBase, idx, period, now, -1)
+	if err != nil {
+		return nil, err
+	}
+	for _, seg := range times {
+		seg.URL = resolve(base, Expand(t.Media, rep.Id, seg.Number, rep.Bandwidth, seg.Time))
+		idx.Segments = append(idx.Segments, seg)
+	}
+	return idx, nil
+}
+
+func (me *MPD) resolveList(base string, l *SegmentList, period *Period, now time.Time) (*Index, error) {
+	idx := l.index(base)
+
+	times, err := me.times(&l.MultipleSegmentBase, idx, period, now, len(l.SegmentURL))
+	if err != nil {
+		return nil, err
+	}
+	for _, seg := range times {
+		item := l.SegmentURL[seg.Number-startNumber(&l.MultipleSegmentBase)]
+		seg.URL = base
+		if item.Media != "" {
+			seg.URL = resolve(base, item.Media)
+		}
+		seg.Range = item.MediaRange
+		idx.Segments = append(idx.Segments, seg)
+	}
+	return idx, nil
+}
+
+// times returns the numbers and times of the segments, by the SegmentTimeline or duration.
+// If count is not negative, it's the number of segments listed, which limits the ones returned.
+func (me *MPD) times(m *MultipleSegmentBase, idx *Index, period *Period, now time.Time, count int) ([]Segment, error) {
+	var (
+		segments = make([]Segment, 0)
+		number   = startNumber(m)
+		dynamic  = me.Type == TYPE_DYNAMIC
+	)
+
+	start, duration := me.PeriodStart(period)
+	end := uint64(math.MaxUint64) // of the period, or available media
+	if duration > 0 {
+		end = idx.PresentationTimeOffset + uint64(duration.Seconds()*float64(idx.Timescale))
+	}
+	if dynamic {
+		ast, _ := ParseDateTime(me.AvailabilityStartTime)
+		elapsed := now.Sub(ast) - start
+		if elapsed < 0 {
+			return segments, nil
+		}
+		if n := idx.PresentationTimeOffset + uint64(elapsed.Seconds()*float64(idx.Timescale)); n < end {
+			end = n
+		}
+	}
+
+	// Start of the time shift buffer, before which segments are no longer available.
+	var from uint64
+	if depth, _ := ParseDuration(me.TimeShiftBufferDepth); dynamic && depth > 0 {
+		if n := uint64(depth.Seconds() * float64(idx.Timescale)); n < end {
+			from = end - n
+		}
+	}
+
+	if len(m.SegmentTimeline) > 0 {
+		var t uint64
+		arr := m.SegmentTimeline[0].S
+		for i, s := range arr {
+			if s.T != "" {
+				v, err := strconv.ParseUint(s.T, 10, 64)
+				if err != nil {
+					return nil, fmt.Errorf("bad S@t %s", s.T)
+				}
+				t = v
+			}
+			d, err := strconv.ParseUint(s.D, 10, 64)
+			if err != nil || d == 0 {
+				return nil, fmt.Errorf("bad S@d %s", s.D)
+			}
+
+			// Segments of this S, by the repeat count, or up to the next S@t or the end if -1.
+			n := uint64(s.R) + 1
+			if s.R < 0 {
+				limit := end
+				if i+1 < len(arr) && arr[i+1].T != "" {
+					limit, _ = strconv.ParseUint(arr[i+1].T, 10, 64)
+				}
+				if limit == math.MaxUint64 || limit <= t {
+					return nil, fmt.Errorf("S@r of -1 without the end")
+				}
+				n = (limit - t + d - 1) / d
+			}
+
+			// Within the end, which a dynamic segment must not exceed, and a static one must start before.
+			last := n
+			if end != math.MaxUint64 {
+				last = 0
+				if dynamic && end > t && end-t >= d {
+					last = (end - t) / d
+				} else if !dynamic && end > t {
+					last = (end - t + d - 1) / d
+				}
+				if last > n {
+					last = n
+				}
+			}
+			var first uint64
+			if from > t {
+				first = (from - t) / d
+			}
+			if last > first && uint64(len(segments))+last-first > MaxSegments {
+				return nil, fmt.Errorf("too many segments in SegmentTimeline")
+			}
+
+			for k := first; k < last; k++ {
+				segments = append(segments, Segment{Number: number + k, Time: t + k*d, Duration: d})
+			}
+			number += n
+			t += n * d
+		}
+	} else {
+		d := uint64(m.Duration)
+		if d == 0 {
+			if count == 1 {
+				return []Segment{{Number: number, Time: idx.PresentationTimeOffset}}, nil
+			}
+			return nil, fmt.Errorf("segments without duration or SegmentTimeline")
+		}
+		if end == math.MaxUint64 && count < 0 {
+			return nil, fmt.Errorf("segments without the end of Period")
+		}
+
+		var first, last uint64 // by the index from 0
+		if end != math.MaxUint64 {
+			n := end - idx.PresentationTimeOffset
+			last = (n + d - 1) / d
+			if dynamic {
+				last = n / d
+			}
+		}
+		if count >= 0 && (end == math.MaxUint64 || last > uint64(count)) {
+			last = uint64(count)
+		}
+		if from > idx.PresentationTimeOffset {
+			first = (from - idx.PresentationTimeOffset) / d
+		}
+		if last > first && last-first > MaxSegments {
+			return nil, fmt.Errorf("too many segments")
+		}
+		for k := first; k < last; k++ {
+			segments = append(segments, Segment{Number: number + k, Time: idx.PresentationTimeOffset + k*d, Duration: d})
+		}
+	}
+
+	// Segments listed are limited to the count.
+	if count >= 0 && len(segments) > count {
+		segments = segments[:count]
+	}
+	return segments, nil
+}
+
+// startNumber returns startNumber of the segments, 1 by default.
+func startNumber(m *MultipleSegmentBase) uint64 {
+	if m.StartNumber == "" {
+		return 1
+	}
+	n, err := strconv.ParseUint(m.StartNumber, 10, 64)
+	if err != nil {
+		return 1
+	}
+	return n
+}
+
+func (me *SegmentBase) index(base string) *Index {
+	idx := &Index{
+		Timescale:              uint64(me.Timescale),
+		PresentationTimeOffset: me.PresentationTimeOffset,
+	}
+	if idx.Timescale == 0 {
+		idx.Timescale = 1
+	}
+	if len(me.Initialization) > 0 {
+		idx.Init = me.Initialization[0].segment(base)
+	}
+	return idx
+}
+
+// merge overrides the attributes by the ones present in src.
+func (me *SegmentBase) merge(src *SegmentBase) {
+	if src.Timescale != 0 {
+		me.Timescale = src.Timescale
+	}
+	if src.PresentationTimeOffset != 0 {
+		me.PresentationTimeOffset = src.PresentationTimeOffset
+	}
+	if src.TimeShiftBufferDepth != "" {
+		me.TimeShiftBufferDepth = src.TimeShiftBufferDepth
+	}
+	if src.IndexRange != "" {
+		me.IndexRange = src.IndexRange
+		me.IndexRangeExact = src.IndexRangeExact
+	}
+	if src.AvailabilityTimeOffset != 0 {
+		me.AvailabilityTimeOffset = src.AvailabilityTimeOffset
+	}
+	if src.AvailabilityTimeComplete {
+		me.AvailabilityTimeComplete = true
+	}
+	if src.AvailabilityTimeIncomplete {
+		me.AvailabilityTimeIncomplete = true
+	}
+	if len(src.Initialization) > 0 {
+		me.Initialization = src.Initialization
+	}
+	if len(src.RepresentationIndex) > 0 {
+		me.RepresentationIndex = src.RepresentationIndex
+	}
+}
+
+func (me *MultipleSegmentBase) merge(src *MultipleSegmentBase) {
+	me.SegmentBase.merge(&src.SegmentBase)
+	if src.Duration != 0 {
+		me.Duration = src.Duration
+	}
+	if src.StartNumber != "" {
+		me.StartNumber = src.StartNumber
+	}
+	if len(src.SegmentTimeline) > 0 {
+		me.SegmentTimeline = src.SegmentTimeline
+	}
+	if len(src.BitstreamSwitching) > 0 {
+		me.BitstreamSwitching = src.BitstreamSwitching
+	}
+}
+
+func (me *SegmentTemplate) merge(src *SegmentTemplate) {
+	me.MultipleSegmentBase.merge(&src.MultipleSegmentBase)
+	if src.Media != "" {
+		me.Media = src.Media
+	}
+	if src.Index != "" {
+		me.Index = src.Index
+	}
+	if src.Initialization != "" {
+		me.Initialization = src.Initialization
+	}
+	if src.BitstreamSwitching != "" {
+		me.BitstreamSwitching = src.BitstreamSwitching
+	}
+}
+
+func (me *SegmentList) merge(src *SegmentList) {
+	me.MultipleSegmentBase.merge(&src.MultipleSegmentBase)
+	if len(src.SegmentURL) > 0 {
+		me.SegmentURL = src.SegmentURL
+	}
+}
+
+// segment returns the URL of sourceURL, or the base if absent, with the byte range.
+func (me *URL) segment(base string) Segment {
+	seg := Segment{URL: base, Range: me.Range}
+	if me.SourceURL != "" {
+		seg.URL = resolve(base, me.SourceURL)
+	}
+	return seg
+}
+
+// resolve returns the URI relative to the base.
+func resolve(base string, uri string) string {
+	if uri == "" {
+		return base
+	}
+	b, err := url.Parse(base)
+	if err != nil {
+		return uri
+	}
+	u, err := url.Parse(uri)
+	if err != nil {
+		return uri
+	}
+	return b.ResolveReference(u).String()
+}
@@ -0,0 +1,287 @@
+package mpd
+
+import (
+	"encoding/binary"
+	"fmt"
+	"testing"
+	"time"
+)
+
+var ast = time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// manifest returns an MPD of one Representation, with the attributes of MPD and the SegmentTemplate given.
+func manifest(attrs string, template string) string {
+	return fmt.Sprintf(`<?xml version="1.0" encoding="UTF-8"?>
+<MPD xmlns="urn:mpeg:dash:schema:mpd:2011" profiles="urn:mpeg:dash:profile:isoff-live:2011" minBufferTime="PT2S" %s>
+  <Period id="0" start="PT0S">
+    <BaseURL>http://example.com/live/</BaseURL>
+    <AdaptationSet mimeType="video/mp4">
+      <SegmentTemplate timescale="1000" initialization="$RepresentationID$/init.mp4" media="$RepresentationID$/$Number$-$Time$.m4s" %s
+      <Representation id="v0" bandwidth="800000"/>
+    </AdaptationSet>
+  </Period>
+</MPD>`, attrs, template)
+}
+
+// TestResolve resolves the segments by SegmentTimeline or duration, within the period, or the availability window if dynamic.
+func TestResolve(t *testing.T) {
+	for _, item := range []struct {
+		name     string
+		attrs    string
+		template string
+		now      time.Duration // since availabilityStartTime
+		numbers  []uint64
+		times    []uint64
+		err      bool
+	}{
+		{
+			name:     "timeline",
+			attrs:    `mediaPresentationDuration="PT10S"`,
+			template: `><SegmentTimeline><S t="0" d="2000" r="2"/><S d="1000" r="3"/></SegmentTimeline></SegmentTemplate>`,
+			numbers:  []uint64{1, 2, 3, 4, 5, 6, 7},
+			times:    []uint64{0, 2000, 4000, 6000, 7000, 8000, 9000},
+		},
+		{
+			name:     "timeline beyond the period",
+			attrs:    `mediaPresentationDuration="PT5S"`,
+			template: `><SegmentTimeline><S t="0" d="2000" r="9"/></SegmentTimeline></SegmentTemplate>`,
+			numbers:  []uint64{1, 2, 3},
+			times:    []uint64{0, 2000, 4000},
+		},
+		{
+			name:     "repeat until the next S@t",
+			attrs:    `mediaPresentationDuration="PT10S"`,
+			template: `startNumber="5"><SegmentTimeline><S t="0" d="2000" r="-1"/><S t="5000" d="1000"/></SegmentTimeline></SegmentTemplate>`,
+			numbers:  []uint64{5, 6, 7, 8},
+			times:    []uint64{0, 2000, 4000, 5000},
+		},
+		{
+			name:     "repeat until the period end",
+			attrs:    `mediaPresentationDuration="PT7S"`,
+			template: `><SegmentTimeline><S t="1000" d="2000" r="-1"/></SegmentTimeline></SegmentTemplate>`,
+			numbers:  []uint64{1, 2, 3},
+			times:    []uint64{1000, 3000, 5000},
+		},
+		{
+			name:     "repeat without the end",
+			template: `><SegmentTimeline><S t="0" d="2000" r="-1"/></SegmentTimeline></SegmentTemplate>`,
+			err:      true,
+		},
+		{
+			name:     "repeat within the period",
+			attrs:    `mediaPresentationDuration="PT3S"`,
+			template: `><SegmentTimeline><S t="0" d="1000" r="-1"/><S t="4611686018427387904" d="1000"/></SegmentTimeline></SegmentTemplate>`,
+			numbers:  []uint64{1, 2, 3},
+			times:    []uint64{0, 1000, 2000},
+		},
+		{
+			name:     "repeat too many",
+			template: `><SegmentTimeline><S t="0" d="1" r="-1"/><S t="4611686018427387904" d="1"/></SegmentTimeline></SegmentTemplate>`,
+			err:      true,
+		},
+		{
+			name:     "duration",
+			attrs:    `mediaPresentationDuration="PT9S"`,
+			template: `duration="2000" startNumber="0"/>`,
+			numbers:  []uint64{0, 1, 2, 3, 4},
+			times:    []uint64{0, 2000, 4000, 6000, 8000},
+		},
+		{
+			name:     "dynamic timeline",
+			attrs:    `type="dynamic" availabilityStartTime="2021-01-01T00:00:00Z" timeShiftBufferDepth="PT4S"`,
+			template: `><SegmentTimeline><S t="0" d="2000" r="9"/></SegmentTimeline></SegmentTemplate>`,
+			now:      11 * time.Second,
+			numbers:  []uint64{4, 5},
+			times:    []uint64{6000, 8000},
+		},
+		{
+			name:     "dynamic repeat",
+			attrs:    `type="dynamic" availabilityStartTime="2021-01-01T00:00:00Z" timeShiftBufferDepth="PT4S"`,
+			template: `><SegmentTimeline><S t="0" d="2000" r="-1"/></SegmentTimeline></SegmentTemplate>`,
+			now:      9 * time.Second,
+			numbers:  []uint64{3, 4},
+			times:    []uint64{4000, 6000},
+		},
+		{
+			name:     "dynamic duration",
+			attrs:    `type="dynamic" availabilityStartTime="2021-01-01T00:00:00Z" timeShiftBufferDepth="PT4S"`,
+			template: `duration="2000"/>`,
+			now:      11 * time.Second,
+			numbers:  []uint64{4, 5},
+			times:    []uint64{6000, 8000},
+		},
+		{
+			name:     "dynamic before available",
+			attrs:    `type="dynamic" availabilityStartTime="2021-01-01T00:00:00Z"`,
+			template: `duration="2000"/>`,
+			now:      -time.Second,
+		},
+	} {
+		var m MPD
+
+		err := m.Unmarshal([]byte(manifest(item.attrs, item.template)))
+		if err != nil {
+			t.Fatalf("%s: %v", item.name, err)
+		}
+
+		period := &m.Period[0]
+		set := &period.AdaptationSet[0]
+		idx, err := m.Resolve("http://example.com/live/test.mpd", period, set, &set.Representation[0], ast.Add(item.now))
+		if item.err {
+			if err == nil {
+				t.Fatalf("%s: expected error, got %d segments", item.name, len(idx.Segments))
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%s: %v", item.name, err)
+		}
+
+		if idx.Init.URL != "http://example.com/live/v0/init.mp4" {
+			t.Fatalf("%s: init %s", item.name, idx.Init.URL)
+		}
+		if len(idx.Segments) != len(item.numbers) {
+			t.Fatalf("%s: %d segments, expected %d", item.name, len(idx.Segments), len(item.numbers))
+		}
+		for i, seg := range idx.Segments {
+			if seg.Number != item.numbers[i] || seg.Time != item.times[i] {
+				t.Fatalf("%s: segment %d is %d@%d, expected %d@%d", item.name, i, seg.Number, seg.Time, item.numbers[i], item.times[i])
+			}
+			if url := fmt.Sprintf("http://example.com/live/v0/%d-%d.m4s", seg.Number, seg.Time); seg.URL != url {
+				t.Fatalf("%s: segment %d at %s, expected %s", item.name, i, seg.URL, url)
+			}
+		}
+	}
+}
+
+func TestExpand(t *testing.T) {
+	for _, item := range []struct {
+		template string
+		expanded string
+	}{
+		{"$RepresentationID$/$Number$.m4s", "v0/7.m4s"},
+		{"$RepresentationID$/$Number%05d$.m4s", "v0/00007.m4s"},
+		{"$Bandwidth$/$Time$.m4s", "800000/12000.m4s"},
+		{"$Time%x$.m4s", "12000.m4s"},
+		{"$$$Number$$$.m4s", "$7$.m4s"},
+		{"$Unknown$/$Number$.m4s", "$Unknown$/7.m4s"},
+		{"$Number.m4s", "$Number.m4s"},
+	} {
+		if s := Expand(item.template, "v0", 7, 800000, 12000); s != item.expanded {
+			t.Fatalf("%s: expanded to %s, expected %s", item.template, s, item.expanded)
+		}
+	}
+}
+
+func TestResolveList(t *testing.T) {
+	var m MPD
+
+	err := m.Unmarshal([]byte(`<MPD xmlns="urn:mpeg:dash:schema:mpd:2011" profiles="urn:mpeg:dash:profile:full:2011" minBufferTime="PT2S" mediaPresentationDuration="PT6S">
+  <Period>
+    <AdaptationSet mimeType="video/mp4">
+      <Representation id="v0" bandwidth="800000">
+        <SegmentList timescale="1000" duration="2000">
+          <Initialization sourceURL="init.mp4"/>
+          <SegmentURL media="seg1.m4s"/>
+          <SegmentURL media="seg2.m4s"/>
+          <SegmentURL mediaRange="100-199"/>
+          <SegmentURL media="seg4.m4s"/>
+        </SegmentList>
+      </Representation>
+    </AdaptationSet>
+  </Period>
+</MPD>`))
+	if err != nil {
+		t.Fatalf("Failed to unmarshal: %v", err)
+	}
+
+	// The 4th segment is beyond the period.
+	period := &m.Period[0]
+	set := &period.AdaptationSet[0]
+	idx, err := m.Resolve("http://example.com/vod/test.mpd", period, set, &set.Representation[0], time.Now())
+	if err != nil {
+		t.Fatalf("Failed to resolve: %v", err)
+	}
+	if idx.Init.URL != "http://example.com/vod/init.mp4" {
+		t.Fatalf("Unexpected init %s", idx.Init.URL)
+	}
+	for i, seg := range []Segment{
+		{URL: "http://example.com/vod/seg1.m4s", Number: 1, Time: 0, Duration: 2000},
+		{URL: "http://example.com/vod/seg2.m4s", Number: 2, Time: 2000, Duration: 2000},
+		{URL: "http://example.com/vod/test.mpd", Range: "100-199", Number: 3, Time: 4000, Duration: 2000},
+	} {
+		if i >= len(idx.Segments) || idx.Segments[i] != seg {
+			t.Fatalf("Segment %d: %+v, expected %+v", i, idx.Segments, seg)
+		}
+	}
+	if len(idx.Segments) != 3 {
+		t.Fatalf("Expected 3 segments, got %d", len(idx.Segments))
+	}
+}
+
+// TestResolveBase resolves the segments of SegmentBase from the sidx at its indexRange.
+func TestResolveBase(t *testing.T) {
+	var m MPD
+
+	err := m.Unmarshal([]byte(`<MPD xmlns="urn:mpeg:dash:schema:mpd:2011" profiles="urn:mpeg:dash:profile:isoff-on-demand:2011" minBufferTime="PT2S" mediaPresentationDuration="PT4S">
+  <Period>
+    <AdaptationSet mimeType="video/mp4">
+      <Representation id="v0" bandwidth="800000">
+        <BaseURL>v0.mp4</BaseURL>
+        <SegmentBase indexRange="700-755">
+          <Initialization range="0-699"/>
+        </SegmentBase>
+      </Representation>
+    </AdaptationSet>
+  </Period>
+</MPD>`))
+	if err != nil {
+		t.Fatalf("Failed to unmarshal: %v", err)
+	}
+
+	period := &m.Period[0]
+	set := &period.AdaptationSet[0]
+	idx, err := m.Resolve("http://example.com/vod/test.mpd", period, set, &set.Representation[0], time.Now())
+	if err != nil {
+		t.Fatalf("Failed to resolve: %v", err)
+	}
+	if idx.Init != (Segment{URL: "http://example.com/vod/v0.mp4", Range: "0-699"}) || idx.Index != (Segment{URL: "http://example.com/vod/v0.mp4", Range: "700-755"}) {
+		t.Fatalf("Unexpected init %+v, index %+v", idx.Init, idx.Index)
+	}
+
+	// sidx of version 0, with 2 references, and 10 bytes between the sidx and the first subsegment.
+	sidx := make([]byte, 56)
+	binary.BigEndian.PutUint32(sidx[0:], 56)
+	copy(sidx[4:], "sidx")
+	binary.BigEndian.PutUint32(sidx[12:], 1)    // reference_ID
+	binary.BigEndian.PutUint32(sidx[16:], 1000) // timescale
+	binary.BigEndian.PutUint32(sidx[20:], 500)  // earliest_presentation_time
+	binary.BigEndian.PutUint32(sidx[24:], 10)   // first_offset
+	binary.BigEndian.PutUint16(sidx[30:], 2)    // reference_count
+	for i, size := range []uint32{1000, 2000} {
+		binary.BigEndian.PutUint32(sidx[32+i*12:], size)
+		binary.BigEndian.PutUint32(sidx[36+i*12:], 2000)
+	}
+
+	err = idx.ParseSIDX(sidx)
+	if err != nil {
+		t.Fatalf("Failed to parse sidx: %v", err)
+	}
+	if idx.Timescale != 1000 {
+		t.Fatalf("Unexpected timescale %d", idx.Timescale)
+	}
+	for i, seg := range []Segment{
+		{URL: "http://example.com/vod/v0.mp4", Range: "766-1765", Number: 1, Time: 500, Duration: 2000},
+		{URL: "http://example.com/vod/v0.mp4", Range: "1766-3765", Number: 2, Time: 2500, Duration: 2000},
+	} {
+		if i >= len(idx.Segments) || idx.Segments[i] != seg {
+			t.Fatalf("Segment %d: %+v, expected %+v", i, idx.Segments, seg)
+		}
+	}
+
+	// Hierarchical sidx is not supported.
+	sidx[32] |= 0x80
+	if err = idx.ParseSIDX(sidx); err == nil {
+		t.Fatalf("Expected error of hierarchical sidx")
+	}
+}
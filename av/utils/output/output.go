@@ -0,0 +1,149 @@
+// Package output registers live outputs served over HTTP by the URL path of their manifests, e.g. HLS and DASH,
+// and blocks requests until the outputs change.
+package output
+
+import (
+	"net/http"
+	"path"
+	"sync"
+	"time"
+)
+
+// Output is a live output, which serves its manifest and media.
+type Output interface {
+	http.Handler
+	Ended() bool
+}
+
+// Registry holds the outputs by the URL path of the manifest.
+// Media are named after the manifest, e.g. /live/test-1.ts belongs to /live/test.m3u8.
+type Registry struct {
+	mtx     sync.RWMutex
+	outputs map[string]Output
+	ext     string // of the manifest
+}
+
+// Init this class.
+func (me *Registry) Init(ext string) *Registry {
+	me.outputs = make(map[string]Output)
+	me.ext = ext
+	return me
+}
+
+// Open returns the output registered at the path if not ended, or registers the one created.
+func (me *Registry) Open(path string, create func() Output) Output {
+	me.mtx.Lock()
+	defer me.mtx.Unlock()
+
+	if o, ok := me.outputs[path]; ok && !o.Ended() {
+		return o
+	}
+	o := create()
+	me.outputs[path] = o
+	return o
+}
+
+// Find returns the output registered at the path.
+func (me *Registry) Find(path string) Output {
+	me.mtx.RLock()
+	defer me.mtx.RUnlock()
+
+	return me.outputs[path]
+}
+
+// Unregister removes the output, if it's still the one registered at the path.
+func (me *Registry) Unregister(path string, o Output) {
+	me.mtx.Lock()
+	defer me.mtx.Unlock()
+
+	if me.outputs[path] == o {
+		delete(me.outputs, path)
+	}
+}
+
+// Range calls fn with each output, with the read lock held.
+func (me *Registry) Range(fn func(o Output)) {
+	me.mtx.RLock()
+	defer me.mtx.RUnlock()
+
+	for _, o := range me.outputs {
+		fn(o)
+	}
+}
+
+// Lookup returns the output of the manifest or media at the URL path, or nil if not found.
+func (me *Registry) Lookup(name string) Output {
+	name = path.Clean("/" + name)
+	dir, base := path.Split(name)
+
+	o := me.Find(name)
+	for i := 0; o == nil && i < len(base); i++ {
+		if base[i] == '-' {
+			o = me.Find(dir + base[:i] + me.ext)
+		}
+	}
+	return o
+}
+
+// ServeHTTP implements http.Handler.
+func (me *Registry) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	o := me.Lookup(r.URL.Path)
+	if o == nil {
+		http.NotFound(w, r)
+		return
+	}
+	o.ServeHTTP(w, r)
+}
+
+// Signal wakes up the requests waiting for changes of an output, guarded by the lock of the output.
+type Signal struct {
+	mtx    *sync.RWMutex
+	notify chan struct{}
+}
+
+// Init this class.
+func (me *Signal) Init(mtx *sync.RWMutex) *Signal {
+	me.mtx = mtx
+	me.notify = make(chan struct{})
+	return me
+}
+
+// C returns the channel closed on the next Wake, with the lock held.
+func (me *Signal) C() <-chan struct{} {
+	return me.notify
+}
+
+// Wake wakes up the waiting requests, with the write lock held.
+func (me *Signal) Wake() {
+	close(me.notify)
+	me.notify = make(chan struct{})
+}
+
+// Wait blocks until ready returns true, ended returns true, the request is canceled, or the timeout.
+// ready is called with the read lock held.
+func (me *Signal) Wait(r *http.Request, timeout time.Duration, ended func() bool, ready func() bool) bool {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	for {
+		me.mtx.RLock()
+		ok := ready()
+		notify := me.notify
+		me.mtx.RUnlock()
+
+		if ok {
+			return true
+		}
+		if ended() {
+			return false
+		}
+
+		select {
+		case <-notify:
+		case <-timer.C:
+			return false
+		case <-r.Context().Done():
+			return false
+		}
+	}
+}
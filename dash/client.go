@@ -0,0 +1,456 @@
+package dash
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/studease/common/av"
+	"github.com/studease/common/av/format"
+	"github.com/studease/common/av/utils/mpd"
+	Event "github.com/studease/common/events/event"
+	"github.com/studease/common/log"
+	"github.com/studease/common/utils/fetch"
+)
+
+// Static constants.
+const (
+	liveEdge          = 3 // segments from the end of a live MPD to start at
+	maxReloadFailures = 3
+)
+
+// stream is a Representation picked from an AdaptationSet, demuxed with its own demuxer.
+type stream struct {
+	kind    string
+	id      string // of the Representation
+	demuxer av.IDemuxer
+	init    mpd.Segment
+	index   *mpd.Index // resolved from the sidx of SegmentBase, which is kept in the same period
+	next    uint64     // time of the next segment in the timescale of the Index
+	started bool
+}
+
+// Client pulls a remote DASH stream, and demuxes the fMP4 segments into the tracks of this IMediaStream.
+// A Representation of video and one of audio are picked, and their segments are interleaved by timestamps.
+// Timestamps go on continuously over periods, and segments failed to load.
+type Client struct {
+	format.Joiner
+
+	URL       string
+	Fetcher   fetch.IFetcher
+	Bandwidth uint   // of the video Representation picked at most, 0 for the highest
+	Height    uint32 // of the video Representation at most, 0 for any
+	logger    log.ILogger
+	factory   log.ILoggerFactory
+	streams   []*stream
+	periodID  string // of the current period
+	opened    bool
+	target    time.Duration
+}
+
+// Init this class.
+func (me *Client) Init(uri string, fetcher fetch.IFetcher, factory log.ILoggerFactory) *Client {
+	me.Joiner.Init(factory.NewLogger("DASH"), factory)
+	me.URL = uri
+	me.Fetcher = fetcher
+	if me.Fetcher == nil {
+		me.Fetcher = new(fetch.HTTPFetcher)
+	}
+	me.logger = factory.NewLogger("DASH")
+	me.factory = factory
+	me.streams = nil
+	me.opened = false
+	me.periodID = ""
+	me.target = time.Duration(DefaultTargetDuration) * time.Second
+	return me
+}
+
+// Run pulls the stream until the MPD ends, an error, or ctx done, and then dispatches CLOSE.
+// A static or ended MPD is pulled period by period from the start. A live MPD is started 3 segments from the end of the last period,
+// and reloaded every minimumUpdatePeriod, or half of it if unchanged. It ends once updates stop.
+func (me *Client) Run(ctx context.Context) error {
+	defer me.DispatchEvent(Event.New(Event.CLOSE, me))
+	defer me.close()
+
+	failures := 0
+	for {
+		start := time.Now()
+		data, err := me.Fetcher.Fetch(ctx, me.URL, "")
+		m := new(mpd.MPD)
+		if err == nil {
+			err = m.Unmarshal(data)
+		}
+
+		if err != nil {
+			if e := ctx.Err(); e != nil {
+				return e
+			}
+			failures++
+			if failures > maxReloadFailures {
+				return err
+			}
+			me.logger.Warnf("Failed to load MPD %s: %v", me.URL, err)
+			err = me.sleep(ctx, start.Add(me.target/2))
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		failures = 0
+
+		changed, err := me.load(ctx, m, start)
+		if err != nil {
+			return err
+		}
+		if m.Type != mpd.TYPE_DYNAMIC || m.MinimumUpdatePeriod == "" {
+			return nil
+		}
+
+		interval, _ := mpd.ParseDuration(m.MinimumUpdatePeriod)
+		if interval <= 0 {
+			interval = me.target
+		}
+		if !changed {
+			interval /= 2
+		}
+		err = me.sleep(ctx, start.Add(interval))
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (me *Client) sleep(ctx context.Context, t time.Time) error {
+	timer := time.NewTimer(time.Until(t))
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// load demuxes the available segments of the periods from the current one, and returns whether any was new.
+func (me *Client) load(ctx context.Context, m *mpd.MPD, now time.Time) (bool, error) {
+	var (
+		from    = 0
+		live    = !me.opened && m.Type == mpd.TYPE_DYNAMIC && m.MinimumUpdatePeriod != ""
+		changed = false
+	)
+
+	switch {
+	case live:
+		from = len(m.Period) - 1
+	case me.opened:
+		from = -1
+		for i := range m.Period {
+			if m.Period[i].Id == me.periodID {
+				from = i
+			}
+		}
+		if from < 0 {
+			me.logger.Warnf("Period %s expired in MPD %s.", me.periodID, me.URL)
+			from = len(m.Period) - 1
+		}
+	}
+
+	for i := from; i < len(m.Period); i++ {
+		p := &m.Period[i]
+		if !me.opened || p.Id != me.periodID || p.Id == "" && i != from {
+			err := me.open(m, p)
+			if err != nil {
+				return changed, err
+			}
+		}
+		me.opened = true
+
+		ok, err := me.segments(ctx, p, m, now, live)
+		if err != nil {
+			return changed, err
+		}
+		changed = changed || ok
+	}
+	return changed, nil
+}
+
+// open picks the Representations of the period, and creates a demuxer for each, the timeline of which goes on from the last packet.
+func (me *Client) open(m *mpd.MPD, p *mpd.Period) error {
+	me.close()
+
+	for i := range p.AdaptationSet {
+		set := &p.AdaptationSet[i]
+		kind := kindOf(set)
+		if kind != av.KindVideo && kind != av.KindAudio || me.find(kind) != nil {
+			continue
+		}
+
+		var rep *mpd.Representation
+		if kind == av.KindVideo {
+			rep = Pick(set, me.Bandwidth, me.Height)
+		} else {
+			rep = Pick(set, 0, 0)
+		}
+		if rep == nil {
+			continue
+		}
+		if mime := mimeOf(set, rep); mime != "" && !strings.HasSuffix(mime, "/mp4") {
+			me.logger.Warnf("Ignored %s Representation %s of %s.", kind, rep.Id, mime)
+			continue
+		}
+
+		demuxer, ok := format.New("FMP4", av.ModeAll, me.factory).(av.IDemuxer)
+		if !ok {
+			return fmt.Errorf("demuxer FMP4 not registered")
+		}
+		me.Attach(demuxer)
+		me.streams = append(me.streams, &stream{
+			kind:    kind,
+			id:      rep.Id,
+			demuxer: demuxer,
+		})
+		me.logger.Debugf(4, "Picked %s Representation %s: bandwidth=%d.", kind, rep.Id, rep.Bandwidth)
+	}
+	if len(me.streams) == 0 {
+		return fmt.Errorf("no Representation of fMP4 in period %s", p.Id)
+	}
+
+	me.Break()
+	me.periodID = p.Id
+	return nil
+}
+
+// segments demuxes the available segments of the period, by steps of one segment of each stream, and returns whether any was new.
+// If live, the streams start 3 segments from the end. Segments failed to load are skipped, which the timeline goes on over.
+func (me *Client) segments(ctx context.Context, p *mpd.Period, m *mpd.MPD, now time.Time, live bool) (bool, error) {
+	var (
+		pending = make([][]mpd.Segment, len(me.streams))
+		indexes = make([]*mpd.Index, len(me.streams))
+		edge    = -1.0 // in seconds, where the streams start if live
+		changed = false
+	)
+
+	for i, s := range me.streams {
+		idx, err := me.resolve(ctx, m, p, s, now)
+		if err != nil {
+			if e := ctx.Err(); e != nil {
+				return false, e
+			}
+			me.logger.Warnf("Failed to resolve %s Representation %s: %v", s.kind, s.id, err)
+			continue
+		}
+		indexes[i] = idx
+
+		if d := me.longest(idx); d > me.target {
+			me.target = d
+		}
+		if live && edge < 0 && len(idx.Segments) > liveEdge {
+			edge = seconds(idx, idx.Segments[len(idx.Segments)-liveEdge].Time)
+		}
+	}
+
+	for i, s := range me.streams {
+		idx := indexes[i]
+		if idx == nil {
+			continue
+		}
+		for j, seg := range idx.Segments {
+			if s.started && seg.Time < s.next {
+				continue
+			}
+			// The segment containing the edge starts.
+			if !s.started && edge >= 0 && j+1 < len(idx.Segments) && seconds(idx, idx.Segments[j+1].Time) <= edge {
+				continue
+			}
+			pending[i] = append(pending[i], seg)
+		}
+	}
+
+	for step := 0; ; step++ {
+		var done = true
+
+		for i, s := range me.streams {
+			if step >= len(pending[i]) {
+				continue
+			}
+			done = false
+			changed = true
+
+			seg := pending[i][step]
+			s.next = seg.Time + seg.Duration
+			if seg.Duration == 0 {
+				s.next = seg.Time + 1
+			}
+
+			err := me.segment(ctx, s, indexes[i], &seg)
+			if err != nil {
+				if e := ctx.Err(); e != nil {
+					return changed, e
+				}
+				me.logger.Warnf("Failed to load segment %s: %v", seg.URL, err)
+				me.Break()
+			}
+		}
+		if done {
+			break
+		}
+
+		err := me.Flush(ctx)
+		if err != nil {
+			return changed, err
+		}
+	}
+	return changed, nil
+}
+
+// resolve returns the Index of the stream, with the segments of SegmentBase resolved from its sidx.
+func (me *Client) resolve(ctx context.Context, m *mpd.MPD, p *mpd.Period, s *stream, now time.Time) (*mpd.Index, error) {
+	set, rep := find(p, s.id)
+	if rep == nil {
+		return nil, fmt.Errorf("not found in period %s", p.Id)
+	}
+
+	idx, err := m.Resolve(me.URL, p, set, rep, now)
+	if err != nil {
+		return nil, err
+	}
+	if idx.Index.URL == "" {
+		return idx, nil
+	}
+	if s.index != nil && s.index.Index == idx.Index {
+		return s.index, nil
+	}
+
+	data, err := me.Fetcher.Fetch(ctx, idx.Index.URL, idx.Index.Range)
+	if err != nil {
+		return nil, err
+	}
+	err = idx.ParseSIDX(data)
+	if err != nil {
+		return nil, err
+	}
+	s.index = idx
+	return idx, nil
+}
+
+// segment fetches and appends a segment to the demuxer of the stream, after the init segment if changed.
+func (me *Client) segment(ctx context.Context, s *stream, idx *mpd.Index, seg *mpd.Segment) error {
+	data, err := me.Fetcher.Fetch(ctx, seg.URL, seg.Range)
+	if err != nil {
+		return err
+	}
+
+	if idx.Init.URL != "" && idx.Init != s.init {
+		b, err := me.Fetcher.Fetch(ctx, idx.Init.URL, idx.Init.Range)
+		if err != nil {
+			return err
+		}
+		s.demuxer.Append(b)
+		s.init = idx.Init
+	}
+	s.started = true
+	return format.ReadFrom(ctx, s.demuxer, bytes.NewReader(data), false)
+}
+
+// longest returns the duration of the longest segment.
+func (me *Client) longest(idx *mpd.Index) time.Duration {
+	var d uint64
+	for _, seg := range idx.Segments {
+		if seg.Duration > d {
+			d = seg.Duration
+		}
+	}
+	return time.Duration(float64(d) / float64(idx.Timescale) * float64(time.Second))
+}
+
+func (me *Client) find(kind string) *stream {
+	for _, s := range me.streams {
+		if s.kind == kind {
+			return s
+		}
+	}
+	return nil
+}
+
+func (me *Client) close() {
+	for _, s := range me.streams {
+		me.Detach(s.demuxer)
+	}
+	me.streams = nil
+}
+
+// Pick returns the Representation of the highest bandwidth within bandwidth, and of the height within height,
+// either of which is ignored if 0. The Representation of the lowest bandwidth is returned if none matches.
+func Pick(set *mpd.AdaptationSet, bandwidth uint, height uint32) *mpd.Representation {
+	var (
+		picked *mpd.Representation
+		lowest *mpd.Representation
+	)
+
+	for i := range set.Representation {
+		item := &set.Representation[i]
+		if lowest == nil || item.Bandwidth < lowest.Bandwidth {
+			lowest = item
+		}
+		if bandwidth > 0 && item.Bandwidth > bandwidth {
+			continue
+		}
+		h := item.Height
+		if h == 0 {
+			h = set.Height
+		}
+		if height > 0 && h > uint(height) {
+			continue
+		}
+		if picked == nil || item.Bandwidth > picked.Bandwidth {
+			picked = item
+		}
+	}
+	if picked == nil {
+		return lowest
+	}
+	return picked
+}
+
+// find returns the Representation of the id in the period, with its AdaptationSet.
+func find(p *mpd.Period, id string) (*mpd.AdaptationSet, *mpd.Representation) {
+	for i := range p.AdaptationSet {
+		set := &p.AdaptationSet[i]
+		for j := range set.Representation {
+			if set.Representation[j].Id == id {
+				return set, &set.Representation[j]
+			}
+		}
+	}
+	return nil, nil
+}
+
+// kindOf returns the kind of the AdaptationSet, by contentType or mimeType.
+func kindOf(set *mpd.AdaptationSet) string {
+	if set.ContentType != "" {
+		return set.ContentType
+	}
+	mime := set.MimeType
+	if mime == "" && len(set.Representation) > 0 {
+		mime = set.Representation[0].MimeType
+	}
+	if i := strings.IndexByte(mime, '/'); i > 0 {
+		return mime[:i]
+	}
+	return ""
+}
+
+func mimeOf(set *mpd.AdaptationSet, rep *mpd.Representation) string {
+	if rep.MimeType != "" {
+		return rep.MimeType
+	}
+	return set.MimeType
+}
+
+// seconds returns the media time of the segment since the start of the period.
+func seconds(idx *mpd.Index, t uint64) float64 {
+	return (float64(t) - float64(idx.PresentationTimeOffset)) / float64(idx.Timescale)
+}
@@ -0,0 +1,399 @@
+package dash
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/studease/common/av"
+	"github.com/studease/common/av/codec/aac"
+	"github.com/studease/common/av/codec/avc"
+	"github.com/studease/common/av/format"
+	_ "github.com/studease/common/av/format/flv"
+	"github.com/studease/common/av/utils/mpd"
+	"github.com/studease/common/events"
+	MediaEvent "github.com/studease/common/events/mediaevent"
+	MediaStreamTrackEvent "github.com/studease/common/events/mediastreamtrackevent"
+	"github.com/studease/common/log"
+)
+
+const (
+	testFrames   = 25 // per segment
+	testInterval = 40 // ms between frames
+)
+
+var (
+	testAVCC = []byte{
+		0x01, 0x42, 0xC0, 0x1E, 0xFF, 0xE1, 0x00, 0x08, 0x67, 0x42, 0xC0, 0x1E, 0xDA, 0x05, 0x07, 0xE4,
+		0x01, 0x00, 0x04, 0x68, 0xCE, 0x38, 0x80,
+	}
+	testASC = []byte{0x12, 0x10}
+)
+
+func testFactory() log.ILoggerFactory {
+	return new(log.DefaultLoggerFactory).Init(0x0800, ioutil.Discard)
+}
+
+func flvTag(typ byte, timestamp uint32, body []byte) []byte {
+	tag := make([]byte, 11, 11+len(body)+4)
+	tag[0] = typ
+	tag[1] = byte(len(body) >> 16)
+	tag[2] = byte(len(body) >> 8)
+	tag[3] = byte(len(body))
+	tag[4] = byte(timestamp >> 16)
+	tag[5] = byte(timestamp >> 8)
+	tag[6] = byte(timestamp)
+	tag[7] = byte(timestamp >> 24)
+	tag = append(tag, body...)
+	return append(tag, byte((11+len(body))>>24), byte((11+len(body))>>16), byte((11+len(body))>>8), byte(11+len(body)))
+}
+
+// testFLV returns an FLV of the kind from 0, with a keyframe leading each segment.
+func testFLV(kind string, segments int) []byte {
+	b := []byte{'F', 'L', 'V', 0x01, 0x01, 0, 0, 0, 0x09, 0, 0, 0, 0}
+	if kind == av.KindVideo {
+		b = append(b, flvTag(9, 0, append([]byte{0x17, 0, 0, 0, 0}, testAVCC...))...)
+	} else {
+		b[4] = 0x04
+		b = append(b, flvTag(8, 0, append([]byte{0xAF, 0}, testASC...))...)
+	}
+	for i := 0; i < segments*testFrames; i++ {
+		timestamp := uint32(i * testInterval)
+		if kind == av.KindAudio {
+			b = append(b, flvTag(8, timestamp, append([]byte{0xAF, 1}, make([]byte, 20)...))...)
+			continue
+		}
+
+		nalu := make([]byte, 4+50)
+		binary.BigEndian.PutUint32(nalu, 50)
+		nalu[4] = 0x41
+		flag := byte(0x27)
+		if i%testFrames == 0 {
+			nalu[4] = 0x65
+			flag = 0x17
+		}
+		b = append(b, flvTag(9, timestamp, append([]byte{flag, 1, 0, 0, 0}, nalu...))...)
+	}
+	return b
+}
+
+// testSegments remuxes n segments of frames of the kind into fMP4, each of which is testFrames long.
+// The timeline of the segments is continuous from 0.
+func testSegments(t *testing.T, kind string, n int) (init []byte, segments [][]byte) {
+	var (
+		factory = testFactory()
+		frames  = 0
+	)
+
+	demuxer, ok := format.New("FLV", format.DefaultPipeMode, factory).(av.IDemuxer)
+	if !ok {
+		t.Fatalf("Demuxer FLV not registered")
+	}
+	mode := av.ModeVideo | av.ModeInterleaved
+	if kind == av.KindAudio {
+		mode = av.ModeAudio | av.ModeInterleaved
+	}
+	remuxer := format.New("FMP4", mode, factory)
+	if remuxer == nil {
+		t.Fatalf("Remuxer FMP4 not registered")
+	}
+
+	remuxer.AddEventListener(MediaEvent.PACKET, events.NewListener(func(e *MediaEvent.MediaEvent) {
+		pkt := e.Packet
+		if pkt.Kind == av.KindScript {
+			init = pkt.Payload
+			return
+		}
+		datatype, _ := pkt.Get("DataType").(byte)
+		if pkt.Kind == av.KindVideo && datatype != avc.NALU || pkt.Kind == av.KindAudio && datatype != aac.RAW_FRAME_DATA {
+			return
+		}
+
+		if frames%testFrames == 0 {
+			segments = append(segments, nil)
+		}
+		segments[len(segments)-1] = append(segments[len(segments)-1], pkt.Payload...)
+		frames++
+	}, 0))
+	remuxer.Source(demuxer)
+	demuxer.Append(testFLV(kind, n))
+	remuxer.Close()
+
+	if len(segments) != n {
+		t.Fatalf("Expected %d segments, got %d", n, len(segments))
+	}
+	return init, segments
+}
+
+type testOrigin struct {
+	sync.Mutex
+	files    map[string][]byte
+	requests []string
+}
+
+// ServeHTTP serves the files, with byte ranges.
+func (me *testOrigin) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	me.Lock()
+	data, ok := me.files[r.URL.Path]
+	me.requests = append(me.requests, r.URL.Path)
+	me.Unlock()
+
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(data))
+}
+
+func (me *testOrigin) set(path string, data []byte) {
+	me.Lock()
+	me.files[path] = data
+	me.Unlock()
+}
+
+func (me *testOrigin) requested(path string) bool {
+	me.Lock()
+	defer me.Unlock()
+
+	for _, item := range me.requests {
+		if item == path {
+			return true
+		}
+	}
+	return false
+}
+
+func testServer(t *testing.T) (*testOrigin, *httptest.Server) {
+	origin := &testOrigin{files: make(map[string][]byte)}
+	srv := httptest.NewServer(origin)
+	t.Cleanup(srv.Close)
+	return origin, srv
+}
+
+// testStatic sets the init and n segments of each kind to /<prefix>/<kind>/, numbered from 1.
+func testStatic(t *testing.T, origin *testOrigin, prefix string, n int) {
+	for _, kind := range []string{av.KindVideo, av.KindAudio} {
+		init, segments := testSegments(t, kind, n)
+		origin.set(fmt.Sprintf("/%s/%s/init.mp4", prefix, kind), init)
+		for i, data := range segments {
+			origin.set(fmt.Sprintf("/%s/%s/%d.m4s", prefix, kind, i+1), data)
+		}
+	}
+}
+
+// testPeriod returns a Period of a video AdaptationSet and an audio one, with the SegmentTemplate inherited by both.
+func testPeriod(attrs string, template string) string {
+	return fmt.Sprintf(`<Period %s>%s
+    <AdaptationSet mimeType="video/mp4"><Representation id="video" bandwidth="800000"/></AdaptationSet>
+    <AdaptationSet mimeType="audio/mp4"><Representation id="audio" bandwidth="64000"/></AdaptationSet>
+  </Period>`, attrs, template)
+}
+
+func testMPD(attrs string, periods ...string) []byte {
+	s := fmt.Sprintf(`<?xml version="1.0" encoding="UTF-8"?>
+<MPD xmlns="urn:mpeg:dash:schema:mpd:2011" profiles="urn:mpeg:dash:profile:isoff-live:2011" minBufferTime="PT1S" %s>`, attrs)
+	for _, p := range periods {
+		s += "\n  " + p
+	}
+	return []byte(s + "\n</MPD>\n")
+}
+
+// testRun pulls the MPD, and returns the timestamps of frames by kind.
+func testRun(t *testing.T, c *Client) map[string][]uint32 {
+	var (
+		mtx        sync.Mutex
+		timestamps = make(map[string][]uint32)
+	)
+
+	packetListener := events.NewListener(func(e *MediaEvent.MediaEvent) {
+		if datatype, _ := e.Packet.Get("DataType").(byte); datatype == 0 {
+			return
+		}
+		mtx.Lock()
+		timestamps[e.Packet.Kind] = append(timestamps[e.Packet.Kind], e.Packet.Timestamp)
+		mtx.Unlock()
+	}, 0)
+	c.AddEventListener(MediaStreamTrackEvent.ADDTRACK, events.NewListener(func(e *MediaStreamTrackEvent.MediaStreamTrackEvent) {
+		e.Track.Source().AddEventListener(MediaEvent.PACKET, packetListener)
+	}, 0))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	err := c.Run(ctx)
+	if err != nil {
+		t.Fatalf("Failed to run: %v", err)
+	}
+	return timestamps
+}
+
+// testContinuous checks that frames of each kind are n, spaced by testInterval from 0.
+func testContinuous(t *testing.T, timestamps map[string][]uint32, n int) {
+	for _, kind := range []string{av.KindVideo, av.KindAudio} {
+		items := timestamps[kind]
+		if len(items) != n {
+			t.Fatalf("Expected %d %s frames, got %d", n, kind, len(items))
+		}
+		for i, timestamp := range items {
+			if timestamp != uint32(i*testInterval) {
+				t.Fatalf("Expected %s frame %d at %d, got %d", kind, i, i*testInterval, timestamp)
+			}
+		}
+	}
+}
+
+const testTemplate = `
+    <SegmentTemplate timescale="1000" duration="1000" initialization="$RepresentationID$/init.mp4" media="$RepresentationID$/$Number$.m4s"/>`
+
+func TestClientTemplate(t *testing.T) {
+	origin, srv := testServer(t)
+	testStatic(t, origin, "vod", 3)
+	origin.set("/vod/index.mpd", testMPD(`mediaPresentationDuration="PT3S"`, testPeriod(`id="0"`, testTemplate)))
+
+	c := new(Client).Init(srv.URL+"/vod/index.mpd", nil, testFactory())
+	testContinuous(t, testRun(t, c), 3*testFrames)
+}
+
+func TestClientTimeline(t *testing.T) {
+	origin, srv := testServer(t)
+	for _, kind := range []string{av.KindVideo, av.KindAudio} {
+		init, segments := testSegments(t, kind, 3)
+		origin.set("/vod/"+kind+"/init.mp4", init)
+		for i, data := range segments {
+			origin.set(fmt.Sprintf("/vod/%s/%d.m4s", kind, i*1000), data)
+		}
+	}
+	template := `
+    <SegmentTemplate timescale="1000" initialization="$RepresentationID$/init.mp4" media="$RepresentationID$/$Time$.m4s">
+      <SegmentTimeline><S t="0" d="1000" r="-1"/></SegmentTimeline>
+    </SegmentTemplate>`
+	origin.set("/vod/index.mpd", testMPD(`mediaPresentationDuration="PT3S"`, testPeriod(`id="0"`, template)))
+
+	c := new(Client).Init(srv.URL+"/vod/index.mpd", nil, testFactory())
+	testContinuous(t, testRun(t, c), 3*testFrames)
+}
+
+// TestClientBase pulls the segments of SegmentBase by the byte ranges in sidx.
+func TestClientBase(t *testing.T) {
+	var reps []string
+
+	origin, srv := testServer(t)
+	for _, kind := range []string{av.KindVideo, av.KindAudio} {
+		init, segments := testSegments(t, kind, 3)
+
+		sidx := make([]byte, 32+12*len(segments))
+		binary.BigEndian.PutUint32(sidx[0:], uint32(len(sidx)))
+		copy(sidx[4:], "sidx")
+		binary.BigEndian.PutUint32(sidx[12:], 1)    // reference_ID
+		binary.BigEndian.PutUint32(sidx[16:], 1000) // timescale
+		binary.BigEndian.PutUint16(sidx[30:], uint16(len(segments)))
+		for i, data := range segments {
+			binary.BigEndian.PutUint32(sidx[32+i*12:], uint32(len(data)))
+			binary.BigEndian.PutUint32(sidx[36+i*12:], 1000)
+		}
+
+		file := append(append([]byte{}, init...), sidx...)
+		for _, data := range segments {
+			file = append(file, data...)
+		}
+		origin.set("/vod/"+kind+".mp4", file)
+
+		reps = append(reps, fmt.Sprintf(`<AdaptationSet mimeType="%s/mp4"><Representation id="%s" bandwidth="800000">
+      <BaseURL>%s.mp4</BaseURL>
+      <SegmentBase indexRange="%d-%d"><Initialization range="0-%d"/></SegmentBase>
+    </Representation></AdaptationSet>`, kind, kind, kind, len(init), len(init)+len(sidx)-1, len(init)-1))
+	}
+	origin.set("/vod/index.mpd", testMPD(`mediaPresentationDuration="PT3S"`, "<Period>\n    "+strings.Join(reps, "\n    ")+"\n  </Period>"))
+
+	c := new(Client).Init(srv.URL+"/vod/index.mpd", nil, testFactory())
+	testContinuous(t, testRun(t, c), 3*testFrames)
+}
+
+// TestClientPeriods goes on over periods, the segments of which restart from 0.
+func TestClientPeriods(t *testing.T) {
+	origin, srv := testServer(t)
+	testStatic(t, origin, "p0", 2)
+	testStatic(t, origin, "p1", 1)
+	origin.set("/index.mpd", testMPD(`mediaPresentationDuration="PT3S"`,
+		testPeriod(`id="0" start="PT0S"`, "<BaseURL>p0/</BaseURL>"+testTemplate),
+		testPeriod(`id="1" start="PT2S"`, "<BaseURL>p1/</BaseURL>"+testTemplate),
+	))
+
+	c := new(Client).Init(srv.URL+"/index.mpd", nil, testFactory())
+	testContinuous(t, testRun(t, c), 3*testFrames)
+}
+
+func TestClientFailedSegment(t *testing.T) {
+	origin, srv := testServer(t)
+
+	// The 2nd segments are missing, and the timeline goes on over them.
+	testStatic(t, origin, "vod", 3)
+	origin.Lock()
+	delete(origin.files, "/vod/video/2.m4s")
+	delete(origin.files, "/vod/audio/2.m4s")
+	origin.Unlock()
+	origin.set("/vod/index.mpd", testMPD(`mediaPresentationDuration="PT3S"`, testPeriod(`id="0"`, testTemplate)))
+
+	c := new(Client).Init(srv.URL+"/vod/index.mpd", nil, testFactory())
+	testContinuous(t, testRun(t, c), 2*testFrames)
+	if !origin.requested("/vod/video/2.m4s") {
+		t.Fatalf("Expected video/2.m4s requested")
+	}
+}
+
+func TestClientLive(t *testing.T) {
+	origin, srv := testServer(t)
+	testStatic(t, origin, "live", 7)
+
+	// 5 segments are available, and it starts 3 segments from the end. Then the MPD ends on reload.
+	ast := mpd.FormatDateTime(time.Now().Add(-5500 * time.Millisecond))
+	origin.set("/live/index.mpd", testMPD(fmt.Sprintf(`type="dynamic" availabilityStartTime="%s" minimumUpdatePeriod="PT0.2S"`, ast),
+		testPeriod(`id="0" start="PT0S"`, testTemplate)))
+	go func() {
+		for !origin.requested("/live/video/5.m4s") {
+			time.Sleep(10 * time.Millisecond)
+		}
+		origin.set("/live/index.mpd", testMPD(`mediaPresentationDuration="PT7S"`, testPeriod(`id="0" start="PT0S"`, testTemplate)))
+	}()
+
+	c := new(Client).Init(srv.URL+"/live/index.mpd", nil, testFactory())
+	testContinuous(t, testRun(t, c), 5*testFrames)
+	if origin.requested("/live/video/2.m4s") || !origin.requested("/live/video/7.m4s") {
+		t.Fatalf("Expected video/3.m4s to video/7.m4s requested")
+	}
+}
+
+func TestPick(t *testing.T) {
+	set := &mpd.AdaptationSet{Representation: []mpd.Representation{
+		{Id: "mid", Bandwidth: 1000000},
+		{Id: "low", Bandwidth: 500000},
+		{Id: "high", Bandwidth: 3000000},
+	}}
+	set.Representation[0].Height = 720
+	set.Representation[1].Height = 360
+	set.Representation[2].Height = 1080
+
+	for _, item := range []struct {
+		bandwidth uint
+		height    uint32
+		id        string
+	}{
+		{0, 0, "high"},
+		{2000000, 0, "mid"},
+		{0, 360, "low"},
+		{0, 720, "mid"},
+		{100000, 0, "low"},
+	} {
+		if rep := Pick(set, item.bandwidth, item.height); rep.Id != item.id {
+			t.Fatalf("Picked %s for bandwidth=%d, height=%d, expected %s", rep.Id, item.bandwidth, item.height, item.id)
+		}
+	}
+}
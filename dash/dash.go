@@ -0,0 +1,768 @@
+package dash
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/studease/common/av"
+	"github.com/studease/common/av/codec/aac"
+	"github.com/studease/common/av/codec/avc"
+	"github.com/studease/common/av/format"
+	"github.com/studease/common/av/format/cmaf"
+	_ "github.com/studease/common/av/format/fmp4" // Register FMP4 remuxer.
+	"github.com/studease/common/av/utils/mpd"
+	"github.com/studease/common/av/utils/output"
+	"github.com/studease/common/events"
+	Event "github.com/studease/common/events/event"
+	MediaEvent "github.com/studease/common/events/mediaevent"
+	"github.com/studease/common/log"
+)
+
+// Static constants.
+const (
+	DefaultTargetDuration uint32 = 4 // seconds
+	DefaultWindow                = 6 // segments in the time shift buffer
+
+	timescale          = 1000 // of the fMP4 segments, in milliseconds
+	audioConfiguration = "urn:mpeg:dash:23003:3:audio_channel_configuration:2011"
+	utcTimingDirect    = "urn:mpeg:dash:utc:direct:2014"
+)
+
+// Segment is a media segment of a representation.
+// The uncompleted one is kept in memory, so that it could be served by chunked transfer while being written.
+type Segment struct {
+	*cmaf.MediaSegment
+
+	data []byte // of the uncompleted segment
+}
+
+// Representation is a track of a period, with its init segment and the segments in the time shift buffer.
+type Representation struct {
+	ID       string // kind of the track
+	Codecs   string
+	Init     string // URI of the init segment
+	Info     av.Information
+	Segments []*Segment      // finished
+	Segment  *Segment        // uncompleted
+	pending  *Representation // with the new init segment, which starts the next period
+	last     uint32
+	frame    uint32 // duration of the last sample
+}
+
+// Period starts with each source, and on each change of the init segments.
+type Period struct {
+	ID              int
+	Start           uint32 // milliseconds since availabilityStartTime
+	Offset          uint32 // media time at the start, as presentationTimeOffset
+	Representations []*Representation
+	started         bool
+}
+
+func (me *Period) find(kind string) *Representation {
+	for _, rep := range me.Representations {
+		if rep.ID == kind {
+			return rep
+		}
+	}
+	return nil
+}
+
+// end returns the time of the end of the last finished segment since availabilityStartTime.
+func (me *Period) end() uint32 {
+	end := me.Start
+	for _, rep := range me.Representations {
+		if n := len(rep.Segments); n > 0 {
+			seg := rep.Segments[n-1]
+			if t := me.Start + seg.Timestamp + seg.Duration - me.Offset; t > end {
+				end = t
+			}
+		}
+	}
+	return end
+}
+
+// DASH packages a live IMediaStream into a dynamic MPD, with an fMP4 init segment and a SegmentTimeline per track.
+// Segments are kept in memory if Directory is empty, otherwise written there with the MPD.
+// Once the source closes, the MPD waits for another one to continue in a new period,
+// and ends if none arrives within the time shift buffer.
+// If LowLatency, the uncompleted segments are announced with availabilityTimeOffset, and served by chunked transfer.
+type DASH struct {
+	events.EventDispatcher
+
+	Path        string // URL path of the MPD
+	LowLatency  bool   // whether the uncompleted segments are served by chunked transfer
+	constraints *av.MediaRecorderConstraints
+	logger      log.ILogger
+	factory     log.ILoggerFactory
+	mtx         sync.RWMutex
+	remuxer     av.IRemuxer
+	source      av.IMediaStream
+	data        []byte            // marshaled MPD
+	files       map[string][]byte // in memory
+	periods     []*Period         // the last of which is current
+	target      uint32            // in milliseconds
+	window      int
+	inits       int       // init segments created
+	epoch       time.Time // availabilityStartTime
+	published   time.Time
+	restart     bool // whether the next keyframe starts a new period
+	ended       uint32
+	signal      output.Signal // wakes up on changes of the MPD and the uncompleted segments
+	timer       *time.Timer
+
+	packetListener *events.EventListener
+	closeListener  *events.EventListener
+}
+
+// Init this class.
+func (me *DASH) Init(path string, constraints *av.MediaRecorderConstraints, factory log.ILoggerFactory) *DASH {
+	me.EventDispatcher.Init(factory.NewLogger("DASH"))
+	me.Path = path
+	me.constraints = constraints
+	me.logger = factory.NewLogger("DASH")
+	me.factory = factory
+	me.files = make(map[string][]byte)
+	me.periods = make([]*Period, 0)
+	me.target = constraints.MaxDuration * 1000
+	if me.target == 0 {
+		me.target = DefaultTargetDuration * 1000
+	}
+	me.window = constraints.Segments
+	if me.window <= 0 {
+		me.window = DefaultWindow
+	}
+	me.inits = 0
+	me.restart = false
+	me.ended = 0
+	me.signal.Init(&me.mtx)
+	me.packetListener = events.NewListener(me.onPacket, 0)
+	me.closeListener = events.NewListener(me.onClose, 0)
+	return me
+}
+
+// Source attaches the IMediaStream as input, which starts a new period.
+func (me *DASH) Source(ms av.IMediaStream) error {
+	if ms == nil {
+		me.Close()
+		return nil
+	}
+
+	me.mtx.Lock()
+	if me.Ended() {
+		me.mtx.Unlock()
+		return fmt.Errorf("presentation ended")
+	}
+	if me.timer != nil {
+		me.timer.Stop()
+		me.timer = nil
+	}
+	prev := me.remuxer
+	me.mtx.Unlock()
+
+	// Finishes the segments of the previous source, out of the lock.
+	if prev != nil {
+		prev.Close()
+	}
+
+	if me.constraints.Directory != "" {
+		err := os.MkdirAll(me.constraints.Directory, os.ModePerm)
+		if err != nil {
+			return err
+		}
+	}
+
+	// An init segment per track.
+	remuxer := format.New("FMP4", me.constraints.Mode&^av.ModeInterleaved, me.factory)
+	if remuxer == nil {
+		return fmt.Errorf("remuxer FMP4 not registered")
+	}
+
+	me.mtx.Lock()
+	me.remuxer = remuxer
+	me.source = ms
+	if n := len(me.periods); n > 0 && !me.periods[n-1].started {
+		// Nothing was published by the previous source.
+		old := me.periods[n-1]
+		me.periods = me.periods[:n-1]
+		for _, rep := range old.Representations {
+			me.release(rep.Init)
+		}
+	}
+	me.periods = append(me.periods, me.newPeriod(nil))
+	me.restart = false
+	me.mtx.Unlock()
+
+	remuxer.AddEventListener(MediaEvent.PACKET, me.packetListener)
+	remuxer.AddEventListener(Event.CLOSE, me.closeListener)
+	remuxer.Source(ms)
+	return nil
+}
+
+// newPeriod returns a period following the current one, with the init segments of prev if any.
+func (me *DASH) newPeriod(prev *Period) *Period {
+	p := &Period{Representations: make([]*Representation, 0)}
+	if n := len(me.periods); n > 0 {
+		p.ID = me.periods[n-1].ID + 1
+	}
+	if prev != nil {
+		for _, rep := range prev.Representations {
+			if rep.pending != nil {
+				rep = rep.pending
+			}
+			p.Representations = append(p.Representations, &Representation{
+				ID:     rep.ID,
+				Codecs: rep.Codecs,
+				Init:   rep.Init,
+				Info:   rep.Info,
+			})
+		}
+	}
+	return p
+}
+
+func (me *DASH) current() *Period {
+	return me.periods[len(me.periods)-1]
+}
+
+func (me *DASH) onPacket(e *MediaEvent.MediaEvent) {
+	pkt := e.Packet
+
+	me.mtx.Lock()
+	defer me.mtx.Unlock()
+
+	if me.Ended() || e.Target != me.remuxer {
+		return
+	}
+
+	datatype, _ := pkt.Get("DataType").(byte)
+	switch {
+	case pkt.Kind == av.KindVideo && datatype == avc.SEQUENCE_HEADER, pkt.Kind == av.KindAudio && datatype == aac.SPECIFIC_CONFIG:
+		me.writeInit(pkt)
+		return
+	case pkt.Kind == av.KindVideo && datatype == avc.NALU, pkt.Kind == av.KindAudio && datatype == aac.RAW_FRAME_DATA:
+	default:
+		// The init segment with all of the tracks, and the end of sequence.
+		return
+	}
+
+	independent := me.independent(pkt)
+	if me.restart && independent && (pkt.Kind == av.KindVideo || len(me.remuxer.GetVideoTracks()) == 0) {
+		me.split(pkt.Timestamp)
+	}
+
+	p := me.current()
+	rep := p.find(pkt.Kind)
+	if rep == nil || rep.Init == "" {
+		return
+	}
+	if !p.started {
+		if !independent || len(me.remuxer.GetVideoTracks()) > 0 && pkt.Kind != av.KindVideo {
+			return
+		}
+		me.begin(p, pkt.Timestamp)
+	}
+	if int32(pkt.Timestamp-p.Offset) < 0 {
+		return // ahead of the period
+	}
+
+	if seg := rep.Segment; seg != nil && me.cuttable(p, rep, pkt, independent) {
+		me.finish(rep, pkt.Timestamp-seg.Timestamp)
+	}
+	if rep.Segment == nil {
+		if pkt.Kind == av.KindVideo && !independent {
+			return
+		}
+		me.open(p, rep, pkt.Timestamp)
+	}
+
+	seg := rep.Segment
+	seg.data = append(seg.data, pkt.Payload...)
+	seg.Size += uint32(len(pkt.Payload))
+	if pkt.Timestamp > rep.last {
+		rep.frame = pkt.Timestamp - rep.last
+	}
+	rep.last = pkt.Timestamp
+
+	if me.LowLatency {
+		me.signal.Wake()
+	}
+}
+
+// independent returns whether a segment could start with the packet.
+func (me *DASH) independent(pkt *av.Packet) bool {
+	if pkt.Kind != av.KindVideo {
+		return true
+	}
+	keyframe, _ := pkt.Get("Keyframe").(bool)
+	return keyframe
+}
+
+// cuttable returns whether the uncompleted segment of the representation should be finished before the packet.
+// Audio segments are aligned with the video ones if any.
+func (me *DASH) cuttable(p *Period, rep *Representation, pkt *av.Packet, independent bool) bool {
+	seg := rep.Segment
+	if pkt.Kind == av.KindAudio {
+		if video := p.find(av.KindVideo); video != nil && video.Segment != nil {
+			return video.Segment.Timestamp > seg.Timestamp && pkt.Timestamp >= video.Segment.Timestamp
+		}
+	}
+	return independent && pkt.Timestamp-seg.Timestamp >= me.target
+}
+
+// begin starts the period at the timestamp, which is mapped to the wall clock,
+// or to the end of the previous period if it's later.
+func (me *DASH) begin(p *Period, timestamp uint32) {
+	now := time.Now()
+	if me.epoch.IsZero() {
+		me.epoch = now
+	}
+	p.Start = uint32(now.Sub(me.epoch) / time.Millisecond)
+	if n := len(me.periods); n > 1 {
+		if end := me.periods[n-2].end(); end > p.Start {
+			p.Start = end
+		}
+	}
+	p.Offset = timestamp
+	p.started = true
+}
+
+// split finishes the current period at the timestamp, and starts another one with the new init segments.
+func (me *DASH) split(timestamp uint32) {
+	p := me.current()
+	for _, rep := range p.Representations {
+		if rep.Segment != nil {
+			me.finish(rep, timestamp-rep.Segment.Timestamp)
+		}
+	}
+
+	next := me.newPeriod(p)
+	next.Start = p.Start + timestamp - p.Offset
+	next.Offset = timestamp
+	next.started = true
+	me.periods = append(me.periods, next)
+	me.restart = false
+}
+
+func (me *DASH) onClose(e *Event.Event) {
+	me.mtx.Lock()
+	defer me.mtx.Unlock()
+
+	if e.Target != me.remuxer {
+		return
+	}
+	e.Target.(av.IRemuxer).RemoveEventListener(MediaEvent.PACKET, me.packetListener)
+	e.Target.(av.IRemuxer).RemoveEventListener(Event.CLOSE, me.closeListener)
+	me.remuxer = nil
+	me.source = nil
+
+	p := me.current()
+	for _, rep := range p.Representations {
+		if seg := rep.Segment; seg != nil {
+			me.finish(rep, rep.last+rep.frame-seg.Timestamp)
+		}
+	}
+	if !me.Ended() {
+		me.timer = time.AfterFunc(time.Duration(me.target)*time.Duration(me.window)*time.Millisecond, me.Close)
+	}
+}
+
+// writeInit stores the init segment of a track. If the track has got any segment in the current period,
+// the next keyframe starts a new period with it.
+func (me *DASH) writeInit(pkt *av.Packet) {
+	uri := fmt.Sprintf("%s-%s-init-%d.mp4", me.constraints.FileName, pkt.Kind, me.inits)
+	me.inits++
+
+	if me.constraints.Directory == "" {
+		me.files[uri] = pkt.Payload
+	} else {
+		err := ioutil.WriteFile(me.path(uri), pkt.Payload, 0666)
+		if err != nil {
+			me.logger.Errorf("Failed to write init segment %s: %v", uri, err)
+			return
+		}
+	}
+
+	p := me.current()
+	rep := p.find(pkt.Kind)
+	if rep == nil {
+		rep = &Representation{ID: pkt.Kind}
+		if pkt.Kind == av.KindVideo {
+			// Video goes first.
+			p.Representations = append([]*Representation{rep}, p.Representations...)
+		} else {
+			p.Representations = append(p.Representations, rep)
+		}
+	}
+	if rep.Segment != nil || len(rep.Segments) > 0 {
+		if rep.pending != nil {
+			me.remove(rep.pending.Init)
+		}
+		rep.pending = &Representation{ID: rep.ID}
+		rep = rep.pending
+		me.restart = true
+	}
+	old := rep.Init
+	rep.Init = uri
+	rep.Codecs = me.codecs(pkt.Kind)
+	if me.source != nil {
+		rep.Info = *me.source.Information()
+	}
+	me.release(old)
+}
+
+// codecs returns the RFC 6381 codecs parameter of the track, e.g. avc1.64001F or mp4a.40.2.
+func (me *DASH) codecs(kind string) string {
+	tracks := me.remuxer.GetAudioTracks()
+	if kind == av.KindVideo {
+		tracks = me.remuxer.GetVideoTracks()
+	}
+	if len(tracks) == 0 {
+		return ""
+	}
+	return tracks[0].Source().Context().Codec
+}
+
+func (me *DASH) path(uri string) string {
+	return filepath.Join(me.constraints.Directory, uri)
+}
+
+// media returns the URI template of the segments of the representation, which are addressed by $Time$.
+func (me *DASH) media(p *Period, rep *Representation) string {
+	return fmt.Sprintf("%s-%d-%s-$Time$.m4s", me.constraints.FileName, p.ID, rep.ID)
+}
+
+func (me *DASH) open(p *Period, rep *Representation, timestamp uint32) {
+	seg := &Segment{MediaSegment: new(cmaf.MediaSegment).Init(len(rep.Segments))}
+	seg.URI = fmt.Sprintf("%s-%d-%s-%d.m4s", me.constraints.FileName, p.ID, rep.ID, timestamp)
+	seg.Timestamp = timestamp
+	seg.Independent = true
+	seg.data = make([]byte, 0)
+	rep.Segment = seg
+}
+
+// finish completes the uncompleted segment of the representation, deletes the expired ones, and updates the MPD.
+// Segments are kept for another time shift buffer, as clients may still be loading them.
+func (me *DASH) finish(rep *Representation, duration uint32) {
+	seg := rep.Segment
+	seg.Duration = duration
+
+	if me.constraints.Directory == "" {
+		me.files[seg.URI] = seg.data
+	} else {
+		err := ioutil.WriteFile(me.path(seg.URI), seg.data, 0666)
+		if err != nil {
+			me.logger.Errorf("Failed to write segment %s: %v", seg.URI, err)
+		}
+	}
+	seg.data = nil
+	rep.Segment = nil
+	rep.Segments = append(rep.Segments, seg)
+
+	for _, p := range me.periods {
+		for _, item := range p.Representations {
+			for len(item.Segments) > 0 && me.expired(p, item.Segments[0]) {
+				me.remove(item.Segments[0].URI)
+				item.Segments = item.Segments[1:]
+			}
+		}
+	}
+	for len(me.periods) > 1 && me.empty(me.periods[0]) {
+		old := me.periods[0]
+		me.periods = me.periods[1:]
+		for _, item := range old.Representations {
+			me.release(item.Init)
+		}
+	}
+	me.update()
+}
+
+// expired returns whether the segment left the time shift buffer more than a buffer ago.
+func (me *DASH) expired(p *Period, seg *Segment) bool {
+	end := p.Start + seg.Timestamp + seg.Duration - p.Offset
+	return end+2*uint32(me.window)*me.target < me.current().end()
+}
+
+func (me *DASH) empty(p *Period) bool {
+	for _, rep := range p.Representations {
+		if rep.Segment != nil || len(rep.Segments) > 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// release deletes the init segment if no longer referred.
+func (me *DASH) release(uri string) {
+	if uri == "" {
+		return
+	}
+	for _, p := range me.periods {
+		for _, rep := range p.Representations {
+			if rep.Init == uri {
+				return
+			}
+		}
+	}
+	me.remove(uri)
+}
+
+func (me *DASH) remove(uri string) {
+	if me.constraints.Directory == "" {
+		delete(me.files, uri)
+		return
+	}
+	err := os.Remove(me.path(uri))
+	if err != nil {
+		me.logger.Debugf(3, "Failed to remove %s: %v", uri, err)
+	}
+}
+
+// update rebuilds the MPD, writes it if not in memory, and wakes up the blocking requests.
+func (me *DASH) update() {
+	me.published = time.Now()
+	me.data = me.render(me.published)
+
+	if me.constraints.Directory != "" && me.data != nil {
+		// Replaced as a whole, so that clients never read a partial MPD.
+		name := me.path(me.constraints.FileName + ".mpd")
+		err := ioutil.WriteFile(name+".tmp", me.data, 0666)
+		if err == nil {
+			err = os.Rename(name+".tmp", name)
+		}
+		if err != nil {
+			me.logger.Errorf("Failed to write MPD %s: %v", name, err)
+		}
+	}
+	me.signal.Wake()
+}
+
+// render marshals the MPD with the segments in the time shift buffer, nil if nothing is available yet.
+// The wall clock is given in UTCTiming, so that clients could be synchronized without another request.
+func (me *DASH) render(now time.Time) []byte {
+	var (
+		m       = new(mpd.MPD).Init(mpd.PROFILE_ISOFF_LIVE, mpd.TYPE_DYNAMIC)
+		depth   = time.Duration(me.window) * time.Duration(me.target) * time.Millisecond
+		edge    = me.current().end()
+		longest uint32
+	)
+
+	for _, p := range me.periods {
+		period := mpd.Period{
+			Id:    strconv.Itoa(p.ID),
+			Start: mpd.FormatDuration(time.Duration(p.Start) * time.Millisecond),
+		}
+
+		for i, rep := range p.Representations {
+			timeline := mpd.SegmentTimeline{S: make([]mpd.S, 0)}
+			size := uint64(0)
+			duration := uint32(0)
+			next := uint32(0)
+			for _, seg := range rep.Segments {
+				// Listed within the time shift buffer.
+				if p.Start+seg.Timestamp+seg.Duration-p.Offset+uint32(depth/time.Millisecond) <= edge {
+					continue
+				}
+				if n := len(timeline.S); n > 0 && seg.Timestamp == next && timeline.S[n-1].D == strconv.Itoa(int(seg.Duration)) {
+					timeline.S[n-1].R++
+				} else {
+					timeline.S = append(timeline.S, mpd.S{
+						T: strconv.FormatUint(uint64(seg.Timestamp), 10),
+						D: strconv.FormatUint(uint64(seg.Duration), 10),
+					})
+				}
+				next = seg.Timestamp + seg.Duration
+				size += uint64(seg.Size)
+				duration += seg.Duration
+				if seg.Duration > longest {
+					longest = seg.Duration
+				}
+			}
+			if len(timeline.S) == 0 || duration == 0 {
+				continue
+			}
+
+			template := mpd.SegmentTemplate{
+				Media:          me.media(p, rep),
+				Initialization: rep.Init,
+			}
+			template.Timescale = timescale
+			template.PresentationTimeOffset = uint64(p.Offset)
+			template.SegmentTimeline = []mpd.SegmentTimeline{timeline}
+			if me.LowLatency && !me.Ended() {
+				template.AvailabilityTimeOffset = float64(me.target-rep.frame) / 1000
+				template.AvailabilityTimeIncomplete = true
+			}
+
+			representation := mpd.Representation{
+				Id:              rep.ID,
+				Bandwidth:       uint(size * 8 * 1000 / uint64(duration)),
+				SegmentTemplate: []mpd.SegmentTemplate{template},
+			}
+			representation.Codecs = rep.Codecs
+			representation.StartWithSAP = 1
+
+			set := mpd.AdaptationSet{
+				Id:               uint(i + 1),
+				ContentType:      rep.ID,
+				SegmentAlignment: true,
+				Representation:   []mpd.Representation{representation},
+			}
+			set.MimeType = rep.ID + "/mp4"
+			switch rep.ID {
+			case av.KindVideo:
+				set.Width = uint(rep.Info.Width)
+				set.Height = uint(rep.Info.Height)
+				set.Par = mpd.FormatRatio(rep.Info.Width, rep.Info.Height)
+				set.Sar = "1:1"
+				if rate := rep.Info.FrameRate; rate.Num > 0 && rate.Den > 0 {
+					set.FrameRate = strconv.FormatFloat(rate.Num, 'f', -1, 64)
+					if rate.Den != 1 {
+						set.FrameRate += "/" + strconv.FormatFloat(rate.Den, 'f', -1, 64)
+					}
+				}
+			case av.KindAudio:
+				set.Lang = "und"
+				set.AudioSamplingRate = strconv.Itoa(int(rep.Info.SampleRate))
+				set.AudioChannelConfiguration = []mpd.Descriptor{{SchemeIdUri: audioConfiguration, Value: strconv.Itoa(int(rep.Info.Channels))}}
+			}
+			period.AdaptationSet = append(period.AdaptationSet, set)
+		}
+
+		if len(period.AdaptationSet) > 0 {
+			m.Period = append(m.Period, period)
+		}
+	}
+	if len(m.Period) == 0 {
+		return nil
+	}
+
+	m.AvailabilityStartTime = mpd.FormatDateTime(me.epoch)
+	m.PublishTime = mpd.FormatDateTime(me.published)
+	m.MinBufferTime = mpd.FormatDuration(time.Duration(me.target) * time.Millisecond)
+	m.MaxSegmentDuration = mpd.FormatDuration(time.Duration(longest) * time.Millisecond)
+	m.TimeShiftBufferDepth = mpd.FormatDuration(depth)
+	if me.Ended() {
+		m.MediaPresentationDuration = mpd.FormatDuration(time.Duration(edge) * time.Millisecond)
+	} else {
+		m.MinimumUpdatePeriod = mpd.FormatDuration(time.Duration(me.target) * time.Millisecond)
+		delay := 2 * me.target
+		if me.LowLatency {
+			delay = me.target / 2
+		}
+		m.SuggestedPresentationDelay = mpd.FormatDuration(time.Duration(delay) * time.Millisecond)
+	}
+	m.UTCTiming = []mpd.Descriptor{{SchemeIdUri: utcTimingDirect, Value: string(mpd.FormatDateTime(now))}}
+
+	data, err := m.Marshal()
+	if err != nil {
+		me.logger.Errorf("Failed to marshal MPD: %v", err)
+		return nil
+	}
+	return append([]byte(xml.Header), data...)
+}
+
+// Manifest returns the current MPD, nil if nothing is available yet.
+func (me *DASH) Manifest() []byte {
+	me.mtx.RLock()
+	defer me.mtx.RUnlock()
+
+	if me.data == nil {
+		return nil
+	}
+	return me.render(time.Now())
+}
+
+// Segment returns the data of an init segment or a finished media segment by the URI.
+func (me *DASH) Segment(uri string) ([]byte, bool) {
+	me.mtx.RLock()
+	defer me.mtx.RUnlock()
+
+	return me.read(uri)
+}
+
+func (me *DASH) read(uri string) ([]byte, bool) {
+	if me.constraints.Directory == "" {
+		data, ok := me.files[uri]
+		return data, ok
+	}
+	if !me.exists(uri) {
+		return nil, false
+	}
+	data, err := ioutil.ReadFile(me.path(uri))
+	return data, err == nil
+}
+
+// exists returns whether the init segment or the finished media segment is available.
+func (me *DASH) exists(uri string) bool {
+	for _, p := range me.periods {
+		for _, rep := range p.Representations {
+			if rep.Init == uri {
+				return true
+			}
+			for _, seg := range rep.Segments {
+				if seg.URI == uri {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// uncompleted returns the segment being written by the URI.
+func (me *DASH) uncompleted(uri string) *Segment {
+	if len(me.periods) == 0 {
+		return nil
+	}
+	for _, rep := range me.current().Representations {
+		if seg := rep.Segment; seg != nil && seg.URI == uri {
+			return seg
+		}
+	}
+	return nil
+}
+
+// Ended returns whether the presentation has ended.
+func (me *DASH) Ended() bool {
+	return atomic.LoadUint32(&me.ended) != 0
+}
+
+// Close detaches the source, ends the presentation with mediaPresentationDuration, and unregisters it.
+func (me *DASH) Close() {
+	me.mtx.Lock()
+	if me.Ended() {
+		me.mtx.Unlock()
+		return
+	}
+	if me.timer != nil {
+		me.timer.Stop()
+		me.timer = nil
+	}
+	remuxer := me.remuxer
+	me.mtx.Unlock()
+
+	if remuxer != nil {
+		remuxer.Close()
+	}
+
+	me.mtx.Lock()
+	if me.timer != nil {
+		me.timer.Stop()
+		me.timer = nil
+	}
+	atomic.StoreUint32(&me.ended, 1)
+	if len(me.periods) > 0 {
+		me.update()
+	}
+	me.mtx.Unlock()
+
+	outputs.Unregister(me.Path, me)
+	me.DispatchEvent(Event.New(Event.CLOSE, me))
+}
@@ -0,0 +1,220 @@
+package dash
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/studease/common/av"
+	"github.com/studease/common/av/format"
+	"github.com/studease/common/av/utils/mpd"
+)
+
+// testHeader returns the FLV header with the configs of AVC and AAC.
+func testHeader(avcc []byte) []byte {
+	b := []byte{'F', 'L', 'V', 0x01, 0x05, 0, 0, 0, 0x09, 0, 0, 0, 0}
+	b = append(b, flvTag(9, 0, append([]byte{0x17, 0, 0, 0, 0}, avcc...))...)
+	return append(b, flvTag(8, 0, append([]byte{0xAF, 0}, testASC...))...)
+}
+
+// testTags returns the FLV tags of n frames of each kind from the frame index, with a keyframe leading every testFrames.
+func testTags(from int, n int) []byte {
+	var b []byte
+	for i := from; i < from+n; i++ {
+		timestamp := uint32(i * testInterval)
+
+		nalu := make([]byte, 4+50)
+		binary.BigEndian.PutUint32(nalu, 50)
+		nalu[4] = 0x41
+		flag := byte(0x27)
+		if i%testFrames == 0 {
+			nalu[4] = 0x65
+			flag = 0x17
+		}
+		b = append(b, flvTag(9, timestamp, append([]byte{flag, 1, 0, 0, 0}, nalu...))...)
+		b = append(b, flvTag(8, timestamp, append([]byte{0xAF, 1}, make([]byte, 20)...))...)
+	}
+	return b
+}
+
+// testDASH returns a DASH of 1s segments in a time shift buffer of 3, kept in memory.
+func testDASH(lowLatency bool) *DASH {
+	d := new(DASH).Init("/live/test.mpd", &av.MediaRecorderConstraints{Mode: av.ModeAll, FileName: "test", MaxDuration: 1, Segments: 3}, testFactory())
+	d.LowLatency = lowLatency
+	return d
+}
+
+func testSource(t *testing.T, d *DASH) av.IDemuxer {
+	demuxer, ok := format.New("FLV", av.ModeAll, testFactory()).(av.IDemuxer)
+	if !ok {
+		t.Fatalf("Demuxer FLV not registered")
+	}
+	err := d.Source(demuxer)
+	if err != nil {
+		t.Fatalf("Failed to source: %v", err)
+	}
+	return demuxer
+}
+
+func testManifest(t *testing.T, d *DASH) *mpd.MPD {
+	data := d.Manifest()
+	if data == nil {
+		t.Fatalf("MPD not available")
+	}
+	m := new(mpd.MPD)
+	err := m.Unmarshal(data)
+	if err != nil {
+		t.Fatalf("Failed to unmarshal MPD: %v\n%s", err, data)
+	}
+	if m.Type != mpd.TYPE_DYNAMIC {
+		t.Fatalf("Unexpected type %s", m.Type)
+	}
+	return m
+}
+
+// testPeriodOf checks the start of the period, and the init segment and timeline of each kind in it.
+func testPeriodOf(t *testing.T, p *mpd.Period, start mpd.Duration, inits map[string]string, offset uint64, timeline ...mpd.S) {
+	if p.Start != start {
+		t.Fatalf("Period %s: start %s, expected %s", p.Id, p.Start, start)
+	}
+	if len(p.AdaptationSet) != len(inits) {
+		t.Fatalf("Period %s: %d AdaptationSets, expected %d", p.Id, len(p.AdaptationSet), len(inits))
+	}
+	for _, set := range p.AdaptationSet {
+		template := set.Representation[0].SegmentTemplate[0]
+		if template.Initialization != inits[set.ContentType] || template.PresentationTimeOffset != offset {
+			t.Fatalf("Period %s: %s init %s, presentationTimeOffset %d", p.Id, set.ContentType, template.Initialization, template.PresentationTimeOffset)
+		}
+		s := template.SegmentTimeline[0].S
+		if len(s) != len(timeline) {
+			t.Fatalf("Period %s: %s timeline %+v, expected %+v", p.Id, set.ContentType, s, timeline)
+		}
+		for i := range s {
+			if s[i] != timeline[i] {
+				t.Fatalf("Period %s: %s timeline %+v, expected %+v", p.Id, set.ContentType, s, timeline)
+			}
+		}
+	}
+}
+
+var testInits = map[string]string{av.KindVideo: "test-video-init-0.mp4", av.KindAudio: "test-audio-init-1.mp4"}
+
+// TestTimelineGrowth repeats the S of the same duration, and slides the timeline through the time shift buffer.
+func TestTimelineGrowth(t *testing.T) {
+	d := testDASH(false)
+	defer d.Close()
+
+	demuxer := testSource(t, d)
+	demuxer.Append(testHeader(testAVCC))
+	demuxer.Append(testTags(0, 2*testFrames+1))
+
+	m := testManifest(t, d)
+	if len(m.Period) != 1 || m.TimeShiftBufferDepth != "PT3S" {
+		t.Fatalf("Unexpected MPD: periods=%d, timeShiftBufferDepth=%s", len(m.Period), m.TimeShiftBufferDepth)
+	}
+	testPeriodOf(t, &m.Period[0], "PT0S", testInits, 0, mpd.S{T: "0", D: "1000", R: 1})
+
+	// 8 segments are finished, the last 3 of which are listed, and the ones a buffer earlier are removed.
+	demuxer.Append(testTags(2*testFrames+1, 6*testFrames))
+
+	m = testManifest(t, d)
+	testPeriodOf(t, &m.Period[0], "PT0S", testInits, 0, mpd.S{T: "5000", D: "1000", R: 2})
+	for uri, ok := range map[string]bool{
+		"test-0-video-0.m4s":    false,
+		"test-0-audio-0.m4s":    false,
+		"test-0-video-1000.m4s": true,
+		"test-0-audio-7000.m4s": true,
+		"test-0-video-8000.m4s": false, // uncompleted
+	} {
+		if _, found := d.Segment(uri); found != ok {
+			t.Fatalf("Segment %s: found=%v, expected %v", uri, found, ok)
+		}
+	}
+}
+
+// TestPeriods starts a new period on a new init segment, and on a new source, the timestamps of which restart.
+func TestPeriods(t *testing.T) {
+	d := testDASH(false)
+	defer d.Close()
+
+	demuxer := testSource(t, d)
+	demuxer.Append(testHeader(testAVCC))
+	demuxer.Append(testTags(0, 2*testFrames+1))
+
+	// The next keyframe at 3s starts a period with the new AVC config.
+	avcc := append([]byte{}, testAVCC...)
+	avcc[3] = 0x1F
+	demuxer.Append(flvTag(9, 2040, append([]byte{0x17, 0, 0, 0, 0}, avcc...)))
+	demuxer.Append(testTags(2*testFrames+1, 2*testFrames))
+
+	m := testManifest(t, d)
+	if len(m.Period) != 2 {
+		t.Fatalf("Expected 2 periods, got %d", len(m.Period))
+	}
+	testPeriodOf(t, &m.Period[0], "PT0S", testInits, 0, mpd.S{T: "1000", D: "1000", R: 1}) // 0 out of the buffer
+	testPeriodOf(t, &m.Period[1], "PT3S", map[string]string{av.KindVideo: "test-video-init-2.mp4", av.KindAudio: "test-audio-init-1.mp4"}, 3000,
+		mpd.S{T: "3000", D: "1000"})
+
+	// The new source goes on from the end of the last segments, which are finished by one more frame.
+	demuxer = testSource(t, d)
+	demuxer.Append(testHeader(testAVCC))
+	demuxer.Append(testTags(0, testFrames+1))
+
+	m = testManifest(t, d)
+	if len(m.Period) != 3 || m.Period[2].Id != "2" {
+		t.Fatalf("Expected 3 periods, got %d", len(m.Period))
+	}
+	testPeriodOf(t, &m.Period[1], "PT3S", map[string]string{av.KindVideo: "test-video-init-2.mp4", av.KindAudio: "test-audio-init-1.mp4"}, 3000,
+		mpd.S{T: "3000", D: "1000"}, mpd.S{T: "4000", D: "40"})
+	testPeriodOf(t, &m.Period[2], "PT4.04S", map[string]string{av.KindVideo: "test-video-init-3.mp4", av.KindAudio: "test-audio-init-4.mp4"}, 0,
+		mpd.S{T: "0", D: "1000"})
+}
+
+// TestLowLatency announces the uncompleted segments, and serves them by chunked transfer until finished.
+func TestLowLatency(t *testing.T) {
+	d := testDASH(true)
+	defer d.Close()
+
+	srv := httptest.NewServer(d)
+	defer srv.Close()
+
+	demuxer := testSource(t, d)
+	demuxer.Append(testHeader(testAVCC))
+	demuxer.Append(testTags(0, testFrames+1))
+
+	data := d.Manifest()
+	if !bytes.Contains(data, []byte(`availabilityTimeComplete="false"`)) || !bytes.Contains(data, []byte(`availabilityTimeOffset="0.96"`)) {
+		t.Fatalf("Uncompleted segments not announced:\n%s", data)
+	}
+
+	// The response starts with the frame written, and goes on until the segment is finished.
+	res, err := http.Get(srv.URL + "/live/test-0-video-1000.m4s")
+	if err != nil {
+		t.Fatalf("Failed to get segment: %v", err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK || len(res.TransferEncoding) == 0 || res.TransferEncoding[0] != "chunked" {
+		t.Fatalf("Unexpected response: status=%d, transfer=%v", res.StatusCode, res.TransferEncoding)
+	}
+	demuxer.Append(testTags(testFrames+1, testFrames))
+
+	b, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		t.Fatalf("Failed to read segment: %v", err)
+	}
+	seg, ok := d.Segment("test-0-video-1000.m4s")
+	if !ok || !bytes.Equal(b, seg) {
+		t.Fatalf("Segment of %d bytes, expected %d", len(b), len(seg))
+	}
+
+	// Once ended, the segments are complete.
+	d.Close()
+	if data = d.Manifest(); strings.Contains(string(data), "availabilityTimeComplete") {
+		t.Fatalf("Ended MPD with uncompleted segments:\n%s", data)
+	}
+}
@@ -0,0 +1,162 @@
+package dash
+
+import (
+	"net/http"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/studease/common/av"
+	"github.com/studease/common/av/utils/output"
+	"github.com/studease/common/log"
+)
+
+var (
+	outputs = new(output.Registry).Init(".mpd")
+
+	contentTypes = map[string]string{
+		".mpd": "application/dash+xml",
+		".mp4": "video/mp4",
+		".m4s": "video/iso.segment",
+	}
+)
+
+// Open returns the DASH registered at the URL path of the MPD, or creates and registers one.
+// A publisher reconnecting to the same path continues the existing presentation in a new period.
+func Open(path string, lowLatency bool, constraints *av.MediaRecorderConstraints, factory log.ILoggerFactory) *DASH {
+	return outputs.Open(path, func() output.Output {
+		d := new(DASH).Init(path, constraints, factory)
+		d.LowLatency = lowLatency
+		return d
+	}).(*DASH)
+}
+
+// Find returns the DASH registered at the URL path of the MPD.
+func Find(path string) *DASH {
+	d, _ := outputs.Find(path).(*DASH)
+	return d
+}
+
+// Lookup returns the DASH of the MPD or segment at the URL path, which must be of an extension served by DASH.
+func Lookup(name string) *DASH {
+	if _, ok := contentTypes[path.Ext(name)]; !ok {
+		return nil
+	}
+	d, _ := outputs.Lookup(name).(*DASH)
+	return d
+}
+
+// Handler serves the MPDs and segments of the registered DASH by the URL path.
+// Segments are named after the MPD, e.g. /live/test-0-video-0.m4s belongs to /live/test.mpd.
+type Handler struct{}
+
+// ServeHTTP implements http.Handler.
+func (me *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	outputs.ServeHTTP(w, r)
+}
+
+// ServeHTTP serves the MPD and the segments by the base name of the URL path.
+// If LowLatency, a segment being written is sent by chunked transfer until finished,
+// and a request of the next one, which is made ahead of time with availabilityTimeOffset, is blocked until it starts.
+func (me *DASH) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	base := path.Base(r.URL.Path)
+	ext := path.Ext(base)
+	timeout := 2 * time.Duration(me.target) * time.Millisecond
+
+	if typ, ok := contentTypes[ext]; ok {
+		w.Header().Set("Content-Type", typ)
+	}
+
+	if ext == ".mpd" {
+		if base != path.Base(me.Path) {
+			http.NotFound(w, r)
+			return
+		}
+		data := me.Manifest()
+		if data == nil {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Write(data)
+		return
+	}
+
+	if me.LowLatency && me.upcoming(base) {
+		me.signal.Wait(r, timeout, me.Ended, func() bool { return me.uncompleted(base) != nil || me.exists(base) })
+		me.stream(w, r, base, timeout)
+		return
+	}
+
+	data, ok := me.Segment(base)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	w.Write(data)
+}
+
+// upcoming returns whether the URI is a media segment of the current period, which is not finished yet.
+func (me *DASH) upcoming(uri string) bool {
+	me.mtx.RLock()
+	defer me.mtx.RUnlock()
+
+	if len(me.periods) == 0 || me.exists(uri) {
+		return false
+	}
+	p := me.current()
+	for _, rep := range p.Representations {
+		prefix := strings.TrimSuffix(me.media(p, rep), "$Time$.m4s")
+		if strings.HasPrefix(uri, prefix) && strings.HasSuffix(uri, ".m4s") {
+			return true
+		}
+	}
+	return false
+}
+
+// stream writes the segment by chunked transfer as it's written, until finished, or idle for the timeout.
+func (me *DASH) stream(w http.ResponseWriter, r *http.Request, uri string, timeout time.Duration) {
+	var (
+		offset     int
+		flusher, _ = w.(http.Flusher)
+	)
+
+	for {
+		me.mtx.RLock()
+		seg := me.uncompleted(uri)
+		data, done := []byte(nil), seg == nil
+		if seg != nil {
+			data = seg.data
+		} else if b, ok := me.read(uri); ok {
+			data = b
+		} else if offset == 0 {
+			me.mtx.RUnlock()
+			http.NotFound(w, r)
+			return
+		}
+		notify := me.signal.C()
+		me.mtx.RUnlock()
+
+		if len(data) > offset {
+			_, err := w.Write(data[offset:])
+			if err != nil {
+				return
+			}
+			offset = len(data)
+			if flusher != nil {
+				flusher.Flush()
+			}
+		}
+		if done || me.Ended() {
+			return
+		}
+
+		select {
+		case <-notify:
+		case <-time.After(timeout):
+			return
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
@@ -8,15 +8,19 @@ import (
 
 // MediaRecorderEvent types.
 const (
-	START  = "start"
-	PAUSE  = "pause"
-	RESUME = "resume"
-	STOP   = "stop"
+	START         = "start"
+	PAUSE         = "pause"
+	RESUME        = "resume"
+	STOP          = "stop"
+	DATAAVAILABLE = "dataavailable"
 )
 
-// MediaRecorderEvent dispatched when the state of MediaRecorder has changed.
+// MediaRecorderEvent dispatched when the state of MediaRecorder has changed, or a file has been finished.
 type MediaRecorderEvent struct {
 	Event.Event
+	URI      string // of the finished file, relative to the directory
+	Duration uint32 // in milliseconds
+	Size     int64  // in bytes
 }
 
 // Init this class.
@@ -27,15 +31,24 @@ func (me *MediaRecorderEvent) Init(typ string, target interface{}) *MediaRecorde
 
 // Clone an instance of an MediaRecorderEvent subclass.
 func (me *MediaRecorderEvent) Clone() *MediaRecorderEvent {
-	return New(me.Type, me.Target)
+	return NewData(me.Type, me.Target, me.URI, me.Duration, me.Size)
 }
 
 // String returns a string containing all the properties of the MediaRecorderEvent object.
 func (me *MediaRecorderEvent) String() string {
-	return fmt.Sprintf("[MediaRecorderEvent type=%s]", me.Type)
+	return fmt.Sprintf("[MediaRecorderEvent type=%s uri=%s duration=%d size=%d]", me.Type, me.URI, me.Duration, me.Size)
 }
 
 // New creates a new MediaRecorderEvent object.
 func New(typ string, target interface{}) *MediaRecorderEvent {
 	return new(MediaRecorderEvent).Init(typ, target)
 }
+
+// NewData creates a new MediaRecorderEvent object of a finished file.
+func NewData(typ string, target interface{}, uri string, duration uint32, size int64) *MediaRecorderEvent {
+	e := New(typ, target)
+	e.URI = uri
+	e.Duration = duration
+	e.Size = size
+	return e
+}
@@ -0,0 +1,330 @@
+package hls
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/url"
+	"time"
+
+	"github.com/studease/common/av"
+	"github.com/studease/common/av/format"
+	"github.com/studease/common/av/utils/m3u8"
+	Event "github.com/studease/common/events/event"
+	"github.com/studease/common/log"
+	"github.com/studease/common/utils/fetch"
+)
+
+// Static constants.
+const (
+	liveEdge          = 3 // segments from the end of a live playlist to start at
+	maxReloadFailures = 3
+)
+
+// Client pulls a remote HLS stream, and demuxes the TS or fMP4 segments into the tracks of this IMediaStream.
+// Timestamps go on continuously over segments, discontinuities, and segments failed to load.
+// Only variants with muxed audio and video are supported, alternative renditions are ignored.
+type Client struct {
+	format.Joiner
+
+	URL       string
+	Fetcher   fetch.IFetcher
+	Bandwidth uint   // of the variant picked from a master playlist at most, 0 for the highest
+	Height    uint32 // of the variant resolution at most, 0 for any
+	logger    log.ILogger
+	factory   log.ILoggerFactory
+	demuxer   av.IDemuxer
+	container string // of the demuxer, TS or FMP4
+	init      string // URI of the init segment appended to the demuxer
+	target    time.Duration
+	broken    bool // whether the next segment doesn't follow the last one
+}
+
+// Init this class.
+func (me *Client) Init(uri string, fetcher fetch.IFetcher, factory log.ILoggerFactory) *Client {
+	me.Joiner.Init(factory.NewLogger("HLS"), factory)
+	me.URL = uri
+	me.Fetcher = fetcher
+	if me.Fetcher == nil {
+		me.Fetcher = new(fetch.HTTPFetcher)
+	}
+	me.logger = factory.NewLogger("HLS")
+	me.factory = factory
+	me.target = time.Duration(DefaultTargetDuration) * time.Second
+	me.broken = false
+	return me
+}
+
+// Run pulls the stream until the playlist ends, an error, or ctx done, and then dispatches CLOSE.
+// A master playlist is resolved to a variant by Bandwidth and Height first.
+// A live playlist is started 3 segments from the end, and reloaded every target duration, or half of it if unchanged.
+func (me *Client) Run(ctx context.Context) error {
+	defer me.DispatchEvent(Event.New(Event.CLOSE, me))
+	defer me.detach()
+
+	uri := me.URL
+	data, err := me.Fetcher.Fetch(ctx, uri, "")
+	if err != nil {
+		return err
+	}
+
+	var imports map[string]string
+	if bytes.Contains(data, []byte("#EXT-X-STREAM-INF")) {
+		master := new(m3u8.MasterPlaylist)
+		err = master.Unmarshal(data)
+		if err != nil {
+			return err
+		}
+		variant := Variant(master, me.Bandwidth, me.Height)
+		if variant == nil {
+			return fmt.Errorf("no variant in master playlist %s", uri)
+		}
+		uri = resolve(uri, master.Substitute(variant.URI))
+		imports = master.Variables()
+		data = nil
+		me.logger.Debugf(4, "Picked variant %s: bandwidth=%d, resolution=%s.", uri, variant.BANDWIDTH, variant.RESOLUTION)
+	}
+
+	var (
+		next     = -1 // media sequence of the next segment, -1 before the first load
+		failures = 0
+	)
+	for {
+		start := time.Now()
+		if data == nil {
+			data, err = me.Fetcher.Fetch(ctx, uri, "")
+		}
+		pl := new(m3u8.MediaPlaylist)
+		if err == nil {
+			err = pl.Unmarshal(data, imports)
+		}
+		data = nil
+
+		if err != nil {
+			if e := ctx.Err(); e != nil {
+				return e
+			}
+			failures++
+			if failures > maxReloadFailures {
+				return err
+			}
+			me.logger.Warnf("Failed to load playlist %s: %v", uri, err)
+			err = me.sleep(ctx, start.Add(me.target/2))
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		failures = 0
+		if pl.EXT_X_TARGETDURATION > 0 {
+			me.target = time.Duration(pl.EXT_X_TARGETDURATION) * time.Second
+		}
+
+		changed, err := me.load(ctx, uri, pl, &next)
+		if err != nil {
+			return err
+		}
+		if pl.EXT_X_ENDLIST {
+			return nil
+		}
+
+		interval := me.target
+		if !changed {
+			interval /= 2
+		}
+		err = me.sleep(ctx, start.Add(interval))
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (me *Client) sleep(ctx context.Context, t time.Time) error {
+	timer := time.NewTimer(time.Until(t))
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// load demuxes the segments of the playlist from next, and returns whether any was new.
+// Segments failed to load are skipped, which the timeline goes on over.
+func (me *Client) load(ctx context.Context, uri string, pl *m3u8.MediaPlaylist, next *int) (bool, error) {
+	var (
+		sequence = int(pl.EXT_X_MEDIA_SEQUENCE)
+		segments = pl.MediaSegments
+		key      m3u8.KeyAttributes
+		init     string
+		changed  = false
+	)
+
+	// Parts of the uncompleted segment are not pulled.
+	if n := len(segments); n > 0 && segments[n-1].URI == "" {
+		segments = segments[:n-1]
+	}
+
+	switch {
+	case *next < 0:
+		*next = sequence
+		if !pl.EXT_X_ENDLIST && len(segments) > liveEdge {
+			*next = sequence + len(segments) - liveEdge
+		}
+	case *next < sequence:
+		me.logger.Warnf("Fell behind playlist %s by %d segments.", uri, sequence-*next)
+		*next = sequence
+		me.broken = true
+	case *next > sequence+len(segments):
+		me.logger.Warnf("Playlist %s restarted from media sequence %d.", uri, sequence)
+		*next = sequence
+		if !pl.EXT_X_ENDLIST && len(segments) > liveEdge {
+			*next = sequence + len(segments) - liveEdge
+		}
+		me.broken = true
+	}
+
+	for i, item := range segments {
+		// Keys and maps apply to the following segments.
+		if item.EXT_X_KEY.METHOD != "" {
+			key = item.EXT_X_KEY
+		}
+		if item.EXT_X_MAP.URI != "" {
+			init = resolve(uri, pl.Substitute(item.EXT_X_MAP.URI))
+		}
+		if sequence+i < *next {
+			continue
+		}
+		*next = sequence + i + 1
+		changed = true
+
+		if key.METHOD != "" && key.METHOD != "NONE" {
+			return changed, fmt.Errorf("segments encrypted with %s not supported", key.METHOD)
+		}
+		if item.EXT_X_GAP {
+			me.broken = true
+			continue
+		}
+
+		err := me.segment(ctx, resolve(uri, pl.Substitute(item.URI)), &item, init)
+		if err != nil {
+			if e := ctx.Err(); e != nil {
+				return changed, e
+			}
+			me.logger.Warnf("Failed to load segment %s: %v", item.URI, err)
+			me.broken = true
+		}
+	}
+	return changed, nil
+}
+
+// segment fetches and demuxes a segment, with a new demuxer after a discontinuity, or if the format or init segment changes.
+func (me *Client) segment(ctx context.Context, uri string, item *m3u8.MediaSegmentTags, init string) error {
+	if item.EXT_X_BYTERANGE.N > 0 || item.EXT_X_MAP.BYTERANGE != "" {
+		return fmt.Errorf("byte range not supported")
+	}
+
+	container := "TS"
+	if init != "" {
+		container = "FMP4"
+	}
+
+	data, err := me.Fetcher.Fetch(ctx, uri, "")
+	if err != nil {
+		return err
+	}
+
+	if me.demuxer == nil || me.broken || item.EXT_X_DISCONTINUITY || container != me.container || init != me.init {
+		err = me.open(container)
+		if err != nil {
+			return err
+		}
+		if init != "" {
+			b, err := me.Fetcher.Fetch(ctx, init, "")
+			if err != nil {
+				return err
+			}
+			me.demuxer.Append(b)
+			me.init = init
+		}
+	}
+	err = format.ReadFrom(ctx, me.demuxer, bytes.NewReader(data), false)
+	if err != nil {
+		return err
+	}
+	return me.Flush(ctx)
+}
+
+// open creates a demuxer, the timeline of which goes on from the last packet.
+func (me *Client) open(container string) error {
+	me.detach()
+
+	demuxer, ok := format.New(container, av.ModeAll, me.factory).(av.IDemuxer)
+	if !ok {
+		return fmt.Errorf("demuxer %s not registered", container)
+	}
+	me.Attach(demuxer)
+	me.Break()
+
+	me.demuxer = demuxer
+	me.container = container
+	me.init = ""
+	me.broken = false
+	return nil
+}
+
+func (me *Client) detach() {
+	if me.demuxer == nil {
+		return
+	}
+	me.Detach(me.demuxer)
+	me.demuxer = nil
+}
+
+// Variant returns the stream of the highest BANDWIDTH within bandwidth, and of the RESOLUTION height within height,
+// either of which is ignored if 0. The stream of the lowest BANDWIDTH is returned if none matches.
+func Variant(master *m3u8.MasterPlaylist, bandwidth uint, height uint32) *m3u8.StreamInfAttributes {
+	var (
+		picked *m3u8.StreamInfAttributes
+		lowest *m3u8.StreamInfAttributes
+	)
+
+	for i := range master.EXT_X_STREAM_INF {
+		item := &master.EXT_X_STREAM_INF[i]
+		if lowest == nil || item.BANDWIDTH < lowest.BANDWIDTH {
+			lowest = item
+		}
+		if bandwidth > 0 && item.BANDWIDTH > bandwidth {
+			continue
+		}
+		if height > 0 {
+			var w, h uint32
+			fmt.Sscanf(item.RESOLUTION, "%dx%d", &w, &h)
+			if h > height {
+				continue
+			}
+		}
+		if picked == nil || item.BANDWIDTH > picked.BANDWIDTH {
+			picked = item
+		}
+	}
+	if picked == nil {
+		return lowest
+	}
+	return picked
+}
+
+// resolve returns the URI relative to the base.
+func resolve(base string, uri string) string {
+	b, err := url.Parse(base)
+	if err != nil {
+		return uri
+	}
+	u, err := url.Parse(uri)
+	if err != nil {
+		return uri
+	}
+	return b.ResolveReference(u).String()
+}
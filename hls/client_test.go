@@ -0,0 +1,353 @@
+package hls
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/studease/common/av"
+	"github.com/studease/common/av/codec/aac"
+	"github.com/studease/common/av/codec/avc"
+	"github.com/studease/common/av/format"
+	_ "github.com/studease/common/av/format/flv"
+	_ "github.com/studease/common/av/format/fmp4"
+	_ "github.com/studease/common/av/format/ts"
+	"github.com/studease/common/events"
+	MediaEvent "github.com/studease/common/events/mediaevent"
+	MediaStreamTrackEvent "github.com/studease/common/events/mediastreamtrackevent"
+	"github.com/studease/common/log"
+)
+
+const (
+	testFrames   = 25 // per segment
+	testInterval = 40 // ms between frames
+)
+
+var (
+	testAVCC = []byte{
+		0x01, 0x42, 0xC0, 0x1E, 0xFF, 0xE1, 0x00, 0x08, 0x67, 0x42, 0xC0, 0x1E, 0xDA, 0x05, 0x07, 0xE4,
+		0x01, 0x00, 0x04, 0x68, 0xCE, 0x38, 0x80,
+	}
+	testASC = []byte{0x12, 0x10}
+)
+
+func testFactory() log.ILoggerFactory {
+	return new(log.DefaultLoggerFactory).Init(0x0800, ioutil.Discard)
+}
+
+func flvTag(typ byte, timestamp uint32, body []byte) []byte {
+	tag := make([]byte, 11, 11+len(body)+4)
+	tag[0] = typ
+	tag[1] = byte(len(body) >> 16)
+	tag[2] = byte(len(body) >> 8)
+	tag[3] = byte(len(body))
+	tag[4] = byte(timestamp >> 16)
+	tag[5] = byte(timestamp >> 8)
+	tag[6] = byte(timestamp)
+	tag[7] = byte(timestamp >> 24)
+	tag = append(tag, body...)
+	return append(tag, byte((11+len(body))>>24), byte((11+len(body))>>16), byte((11+len(body))>>8), byte(11+len(body)))
+}
+
+// testFLV returns an FLV of AVC and AAC frames from 0, with a keyframe leading each segment.
+func testFLV(segments int) []byte {
+	b := []byte{'F', 'L', 'V', 0x01, 0x05, 0, 0, 0, 0x09, 0, 0, 0, 0}
+	b = append(b, flvTag(9, 0, append([]byte{0x17, 0, 0, 0, 0}, testAVCC...))...)
+	b = append(b, flvTag(8, 0, append([]byte{0xAF, 0}, testASC...))...)
+	for i := 0; i < segments*testFrames; i++ {
+		timestamp := uint32(i * testInterval)
+
+		nalu := make([]byte, 4+50)
+		binary.BigEndian.PutUint32(nalu, 50)
+		nalu[4] = 0x41
+		flag := byte(0x27)
+		if i%testFrames == 0 {
+			nalu[4] = 0x65
+			flag = 0x17
+		}
+		b = append(b, flvTag(9, timestamp, append([]byte{flag, 1, 0, 0, 0}, nalu...))...)
+		b = append(b, flvTag(8, timestamp, append([]byte{0xAF, 1}, make([]byte, 20)...))...)
+	}
+	return b
+}
+
+// testSegments remuxes n segments of frames into the container, and cuts them on keyframes, as HLS does.
+// The timeline of the segments is continuous from 0. The init segment is nil for TS.
+func testSegments(t *testing.T, container string, n int) (init []byte, segments [][]byte) {
+	factory := testFactory()
+	demuxer, ok := format.New("FLV", format.DefaultPipeMode, factory).(av.IDemuxer)
+	if !ok {
+		t.Fatalf("Demuxer FLV not registered")
+	}
+	remuxer := format.New(container, format.DefaultPipeMode, factory)
+	if remuxer == nil {
+		t.Fatalf("Remuxer %s not registered", container)
+	}
+
+	remuxer.AddEventListener(MediaEvent.PACKET, events.NewListener(func(e *MediaEvent.MediaEvent) {
+		pkt := e.Packet
+		if pkt.Kind == av.KindScript {
+			init = pkt.Payload
+			return
+		}
+		datatype, _ := pkt.Get("DataType").(byte)
+		if pkt.Kind == av.KindVideo && datatype != avc.NALU || pkt.Kind == av.KindAudio && datatype != aac.RAW_FRAME_DATA {
+			return
+		}
+
+		keyframe, _ := pkt.Get("Keyframe").(bool)
+		if container == "TS" {
+			keyframe, _ = pkt.Get("PSI").(bool)
+		}
+		if pkt.Kind == av.KindVideo && keyframe {
+			segments = append(segments, nil)
+		}
+		if len(segments) > 0 {
+			segments[len(segments)-1] = append(segments[len(segments)-1], pkt.Payload...)
+		}
+	}, 0))
+	remuxer.Source(demuxer)
+	demuxer.Append(testFLV(n))
+	remuxer.Close()
+
+	if len(segments) != n {
+		t.Fatalf("Expected %d segments, got %d", n, len(segments))
+	}
+	return init, segments
+}
+
+type testOrigin struct {
+	sync.Mutex
+	files    map[string][]byte
+	requests []string
+}
+
+func (me *testOrigin) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	me.Lock()
+	data, ok := me.files[r.URL.Path]
+	me.requests = append(me.requests, r.URL.Path)
+	me.Unlock()
+
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	w.Write(data)
+}
+
+func (me *testOrigin) set(path string, data []byte) {
+	me.Lock()
+	me.files[path] = data
+	me.Unlock()
+}
+
+func (me *testOrigin) requested(path string) bool {
+	me.Lock()
+	defer me.Unlock()
+
+	for _, item := range me.requests {
+		if item == path {
+			return true
+		}
+	}
+	return false
+}
+
+func testServer(t *testing.T) (*testOrigin, *httptest.Server) {
+	origin := &testOrigin{files: make(map[string][]byte)}
+	srv := httptest.NewServer(origin)
+	t.Cleanup(srv.Close)
+	return origin, srv
+}
+
+// testPlaylist returns a media playlist of the segments, each of which is prefixed with the tags if any.
+func testPlaylist(sequence int, tags map[int]string, segments []string, end bool) []byte {
+	s := fmt.Sprintf("#EXTM3U\n#EXT-X-VERSION:7\n#EXT-X-TARGETDURATION:1\n#EXT-X-MEDIA-SEQUENCE:%d\n", sequence)
+	for i, uri := range segments {
+		if tag, ok := tags[i]; ok {
+			s += tag + "\n"
+		}
+		s += "#EXTINF:1.000,\n" + uri + "\n"
+	}
+	if end {
+		s += "#EXT-X-ENDLIST\n"
+	}
+	return []byte(s)
+}
+
+// testRun pulls the playlist, and returns the timestamps of frames by kind.
+func testRun(t *testing.T, c *Client) map[string][]uint32 {
+	var (
+		mtx        sync.Mutex
+		timestamps = make(map[string][]uint32)
+	)
+
+	packetListener := events.NewListener(func(e *MediaEvent.MediaEvent) {
+		if datatype, _ := e.Packet.Get("DataType").(byte); datatype == 0 {
+			return
+		}
+		mtx.Lock()
+		timestamps[e.Packet.Kind] = append(timestamps[e.Packet.Kind], e.Packet.Timestamp)
+		mtx.Unlock()
+	}, 0)
+	c.AddEventListener(MediaStreamTrackEvent.ADDTRACK, events.NewListener(func(e *MediaStreamTrackEvent.MediaStreamTrackEvent) {
+		e.Track.Source().AddEventListener(MediaEvent.PACKET, packetListener)
+	}, 0))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	err := c.Run(ctx)
+	if err != nil {
+		t.Fatalf("Failed to run: %v", err)
+	}
+	return timestamps
+}
+
+// testContinuous checks that frames of each kind are n, spaced by testInterval from 0.
+func testContinuous(t *testing.T, timestamps map[string][]uint32, n int) {
+	for _, kind := range []string{"video", "audio"} {
+		items := timestamps[kind]
+		if len(items) != n {
+			t.Fatalf("Expected %d %s frames, got %d", n, kind, len(items))
+		}
+		for i, timestamp := range items {
+			if timestamp != uint32(i*testInterval) {
+				t.Fatalf("Expected %s frame %d at %d, got %d", kind, i, i*testInterval, timestamp)
+			}
+		}
+	}
+}
+
+func TestClientTS(t *testing.T) {
+	origin, srv := testServer(t)
+	_, segments := testSegments(t, "TS", 3)
+	for i, data := range segments {
+		origin.set(fmt.Sprintf("/seg%d.ts", i), data)
+	}
+	origin.set("/index.m3u8", testPlaylist(0, nil, []string{"seg0.ts", "seg1.ts", "seg2.ts"}, true))
+
+	c := new(Client).Init(srv.URL+"/index.m3u8", nil, testFactory())
+	testContinuous(t, testRun(t, c), 3*testFrames)
+}
+
+func TestClientFMP4(t *testing.T) {
+	origin, srv := testServer(t)
+	init, segments := testSegments(t, "FMP4", 3)
+	origin.set("/init.mp4", init)
+	for i, data := range segments {
+		origin.set(fmt.Sprintf("/seg%d.m4s", i), data)
+	}
+	tags := map[int]string{0: "#EXT-X-MAP:URI=\"init.mp4\""}
+	origin.set("/index.m3u8", testPlaylist(0, tags, []string{"seg0.m4s", "seg1.m4s", "seg2.m4s"}, true))
+
+	c := new(Client).Init(srv.URL+"/index.m3u8", nil, testFactory())
+	testContinuous(t, testRun(t, c), 3*testFrames)
+}
+
+func TestClientDiscontinuity(t *testing.T) {
+	origin, srv := testServer(t)
+
+	// The timestamps restart from 0 after the discontinuity.
+	_, segments := testSegments(t, "TS", 2)
+	origin.set("/seg0.ts", segments[0])
+	origin.set("/seg1.ts", segments[1])
+	_, segments = testSegments(t, "TS", 1)
+	origin.set("/seg2.ts", segments[0])
+	tags := map[int]string{2: "#EXT-X-DISCONTINUITY"}
+	origin.set("/index.m3u8", testPlaylist(0, tags, []string{"seg0.ts", "seg1.ts", "seg2.ts"}, true))
+
+	c := new(Client).Init(srv.URL+"/index.m3u8", nil, testFactory())
+	testContinuous(t, testRun(t, c), 3*testFrames)
+}
+
+func TestClientFailedSegment(t *testing.T) {
+	origin, srv := testServer(t)
+
+	// seg1.ts is missing, and the timeline goes on over it.
+	_, segments := testSegments(t, "TS", 3)
+	origin.set("/seg0.ts", segments[0])
+	origin.set("/seg2.ts", segments[2])
+	origin.set("/index.m3u8", testPlaylist(0, nil, []string{"seg0.ts", "seg1.ts", "seg2.ts"}, true))
+
+	c := new(Client).Init(srv.URL+"/index.m3u8", nil, testFactory())
+	testContinuous(t, testRun(t, c), 2*testFrames)
+	if !origin.requested("/seg1.ts") {
+		t.Fatalf("Expected seg1.ts requested")
+	}
+}
+
+func TestClientMaster(t *testing.T) {
+	origin, srv := testServer(t)
+	_, segments := testSegments(t, "TS", 1)
+	for _, name := range []string{"low", "mid", "high"} {
+		origin.set("/"+name+"/seg0.ts", segments[0])
+		origin.set("/"+name+"/index.m3u8", testPlaylist(0, nil, []string{"seg0.ts"}, true))
+	}
+	origin.set("/master.m3u8", []byte(strings.Join([]string{
+		"#EXTM3U",
+		"#EXT-X-STREAM-INF:BANDWIDTH=500000,RESOLUTION=640x360",
+		"low/index.m3u8",
+		"#EXT-X-STREAM-INF:BANDWIDTH=1000000,RESOLUTION=1280x720",
+		"mid/index.m3u8",
+		"#EXT-X-STREAM-INF:BANDWIDTH=3000000,RESOLUTION=1920x1080",
+		"high/index.m3u8",
+		"",
+	}, "\n")))
+
+	for _, item := range []struct {
+		bandwidth uint
+		height    uint32
+		variant   string
+	}{
+		{0, 0, "high"},
+		{2000000, 0, "mid"},
+		{0, 360, "low"},
+		{100000, 0, "low"},
+	} {
+		origin.Lock()
+		origin.requests = nil
+		origin.Unlock()
+
+		c := new(Client).Init(srv.URL+"/master.m3u8", nil, testFactory())
+		c.Bandwidth = item.bandwidth
+		c.Height = item.height
+		testContinuous(t, testRun(t, c), testFrames)
+		if !origin.requested("/" + item.variant + "/seg0.ts") {
+			t.Fatalf("Expected variant %s for bandwidth=%d, height=%d", item.variant, item.bandwidth, item.height)
+		}
+	}
+}
+
+func TestClientLive(t *testing.T) {
+	origin, srv := testServer(t)
+
+	var uris []string
+	_, segments := testSegments(t, "TS", 7)
+	for i, data := range segments {
+		origin.set(fmt.Sprintf("/seg%d.ts", i), data)
+		uris = append(uris, fmt.Sprintf("seg%d.ts", i))
+	}
+
+	// Starts 3 segments from the end, and then the playlist slides and ends on reload.
+	origin.set("/index.m3u8", testPlaylist(0, nil, uris[:5], false))
+	go func() {
+		for !origin.requested("/seg4.ts") {
+			time.Sleep(10 * time.Millisecond)
+		}
+		origin.set("/index.m3u8", testPlaylist(2, nil, uris[2:], true))
+	}()
+
+	c := new(Client).Init(srv.URL+"/index.m3u8", nil, testFactory())
+	testContinuous(t, testRun(t, c), 5*testFrames)
+	if origin.requested("/seg1.ts") {
+		t.Fatalf("Expected starting from seg2.ts")
+	}
+}
@@ -0,0 +1,764 @@
+package hls
+
+import (
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"path"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/studease/common/av"
+	"github.com/studease/common/av/codec/aac"
+	"github.com/studease/common/av/codec/avc"
+	"github.com/studease/common/av/format"
+	"github.com/studease/common/av/format/cmaf"
+	_ "github.com/studease/common/av/format/fmp4" // Register FMP4 remuxer.
+	_ "github.com/studease/common/av/format/ts"   // Register TS remuxer.
+	"github.com/studease/common/av/utils/m3u8"
+	"github.com/studease/common/av/utils/output"
+	"github.com/studease/common/events"
+	Event "github.com/studease/common/events/event"
+	MediaEvent "github.com/studease/common/events/mediaevent"
+	"github.com/studease/common/log"
+)
+
+// Static constants.
+const (
+	DefaultTargetDuration   uint32 = 6 // seconds
+	DefaultLowLatencyTarget uint32 = 2 // seconds, of segments with parts
+	DefaultWindow                  = 6 // segments in the playlist
+
+	partHoldBack          = 3 // parts behind the live edge, about 1 second with the default target and 6 parts per segment
+	partWindow            = 3 // target durations of the segments listed with parts
+	skipUntil             = 6 // target durations kept in delta playlists
+	programDateTimeLayout = "2006-01-02T15:04:05.000Z07:00"
+)
+
+var (
+	exts = map[string][2]string{
+		"TS":   {"", ".ts"},
+		"FMP4": {".mp4", ".m4s"},
+		"CMAF": {".mp4", ".m4s"},
+	}
+)
+
+// Segment describes a media segment of the playlist, and its parts if low-latency.
+type Segment struct {
+	*cmaf.MediaSegment
+
+	Map             string // URI of the init segment, fMP4 and CMAF only
+	ProgramDateTime time.Time
+	Discontinuity   bool
+	file            *os.File // of the uncompleted segment
+	part            *os.File // of the uncompleted part
+}
+
+// report is the last part of an output, which is announced in the playlists of its renditions.
+type report struct {
+	msn  int
+	part int
+}
+
+// HLS packages a live IMediaStream into a media playlist, with TS, fMP4 or CMAF segments cut on keyframes.
+// Segments are kept in memory if Directory is empty, otherwise written there with the playlist.
+// Once the source closes, the playlist waits for another one to continue after a discontinuity,
+// and ends if none arrives within a window.
+// If Chunks is set, each segment is split into as many parts, which are published once completed (LL-HLS).
+type HLS struct {
+	events.EventDispatcher
+
+	Name        string // of the remuxer, TS, FMP4 or CMAF
+	Path        string // URL path of the playlist
+	Group       string // of the renditions, which report their last parts to each other
+	constraints *av.MediaRecorderConstraints
+	logger      log.ILogger
+	factory     log.ILoggerFactory
+	mtx         sync.RWMutex
+	remuxer     av.IRemuxer
+	data        []byte            // marshaled playlist
+	files       map[string][]byte // in memory
+	segments    []*Segment        // finished, the last window of which are listed
+	segment     *Segment          // uncompleted
+	init        string            // URI of the current init segment
+	target      uint32            // in milliseconds
+	part        uint32            // target duration of parts in milliseconds, 0 if not low-latency
+	window      int
+	sequence    int       // of the next segment
+	skipped     int       // discontinuities of the deleted segments
+	inits       int       // init segments created
+	epoch       time.Time // wall clock of the timestamp 0 of the source
+	last        uint32
+	frame       uint32 // duration of the last sample
+	started     bool   // whether the current source has got any packet
+	broken      bool   // whether the next segment follows a discontinuity
+	ended       uint32
+	report      atomic.Value
+	dateRanges  []m3u8.DateRangeAttributes
+	signal      output.Signal // wakes up on changes of the playlist
+	timer       *time.Timer
+
+	packetListener *events.EventListener
+	closeListener  *events.EventListener
+}
+
+// Init this class.
+func (me *HLS) Init(name string, path string, constraints *av.MediaRecorderConstraints, factory log.ILoggerFactory) *HLS {
+	me.EventDispatcher.Init(factory.NewLogger("HLS"))
+	me.Name = name
+	me.Path = path
+	me.constraints = constraints
+	me.logger = factory.NewLogger("HLS")
+	me.factory = factory
+	me.files = make(map[string][]byte)
+	me.segments = make([]*Segment, 0)
+	me.dateRanges = nil
+	me.target = constraints.MaxDuration * 1000
+	if me.target == 0 {
+		me.target = DefaultTargetDuration * 1000
+		if constraints.Chunks > 0 {
+			me.target = DefaultLowLatencyTarget * 1000
+		}
+	}
+	me.part = 0
+	if constraints.Chunks > 0 {
+		me.part = me.target / uint32(constraints.Chunks)
+	}
+	me.window = constraints.Segments
+	if me.window <= 0 {
+		me.window = DefaultWindow
+	}
+	me.sequence = 0
+	me.skipped = 0
+	me.inits = 0
+	me.broken = false
+	me.ended = 0
+	me.signal.Init(&me.mtx)
+	me.packetListener = events.NewListener(me.onPacket, 0)
+	me.closeListener = events.NewListener(me.onClose, 0)
+	return me
+}
+
+// Source attaches the IMediaStream as input. If there was one, the next segment follows a discontinuity.
+func (me *HLS) Source(ms av.IMediaStream) error {
+	if ms == nil {
+		me.Close()
+		return nil
+	}
+
+	ext, ok := exts[me.Name]
+	if !ok {
+		return fmt.Errorf("unrecognized segment format %s", me.Name)
+	}
+
+	me.mtx.Lock()
+	if me.Ended() {
+		me.mtx.Unlock()
+		return fmt.Errorf("playlist ended")
+	}
+	if me.timer != nil {
+		me.timer.Stop()
+		me.timer = nil
+	}
+	prev := me.remuxer
+	me.mtx.Unlock()
+
+	// Finishes the segment of the previous source, out of the lock.
+	if prev != nil {
+		prev.Close()
+	}
+
+	if me.constraints.Directory != "" {
+		err := os.MkdirAll(me.constraints.Directory, os.ModePerm)
+		if err != nil {
+			return err
+		}
+	}
+
+	mode := me.constraints.Mode
+	if ext[0] != "" {
+		// A single init segment with all of the tracks.
+		mode |= av.ModeInterleaved
+	}
+	remuxer := format.New(me.Name, mode, me.factory)
+	if remuxer == nil {
+		return fmt.Errorf("remuxer %s not registered", me.Name)
+	}
+
+	me.mtx.Lock()
+	me.remuxer = remuxer
+	me.started = false
+	me.mtx.Unlock()
+
+	remuxer.AddEventListener(MediaEvent.PACKET, me.packetListener)
+	remuxer.AddEventListener(Event.CLOSE, me.closeListener)
+	remuxer.Source(ms)
+	return nil
+}
+
+func (me *HLS) onPacket(e *MediaEvent.MediaEvent) {
+	pkt := e.Packet
+
+	me.mtx.Lock()
+	defer me.mtx.Unlock()
+
+	if me.Ended() || e.Target != me.remuxer {
+		return
+	}
+	if pkt.Kind == av.KindScript && exts[me.Name][0] != "" {
+		me.writeInit(pkt.Payload)
+		return
+	}
+
+	// Init segments of a single track, and the end of sequence.
+	datatype, _ := pkt.Get("DataType").(byte)
+	if pkt.Kind == av.KindVideo && datatype != avc.NALU || pkt.Kind == av.KindAudio && datatype != aac.RAW_FRAME_DATA {
+		return
+	}
+
+	independent := me.independent(pkt)
+	if !me.started {
+		if !independent || exts[me.Name][0] != "" && me.init == "" {
+			return
+		}
+		me.started = true
+		me.epoch = time.Now().Add(-time.Duration(pkt.Timestamp) * time.Millisecond)
+	}
+
+	if seg := me.segment; seg != nil && independent && pkt.Timestamp-seg.Timestamp >= me.target {
+		me.finish(pkt.Timestamp - seg.Timestamp)
+	}
+	if me.segment == nil {
+		err := me.open(pkt.Timestamp)
+		if err != nil {
+			me.logger.Errorf("Failed to open segment: %v", err)
+			return
+		}
+	} else if me.part > 0 && me.partial(pkt) {
+		me.cut(pkt.Timestamp)
+	}
+
+	seg := me.segment
+	if c := seg.Chunk; c != nil && c.Size == 0 {
+		c.Independent = independent
+	}
+	err := me.write(seg, pkt.Payload)
+	if err != nil {
+		me.logger.Errorf("Failed to write segment %s: %v", seg.URI, err)
+	}
+	if pkt.Kind == av.KindVideo || len(me.remuxer.GetVideoTracks()) == 0 {
+		if pkt.Timestamp > me.last {
+			me.frame = pkt.Timestamp - me.last
+		}
+		me.last = pkt.Timestamp
+	}
+}
+
+// independent returns whether a segment could start with the packet.
+// TS packets carrying PAT and PMT start on video keyframes, or about every second if there's no video.
+func (me *HLS) independent(pkt *av.Packet) bool {
+	if me.Name == "TS" {
+		psi, _ := pkt.Get("PSI").(bool)
+		return psi
+	}
+	if len(me.remuxer.GetVideoTracks()) == 0 {
+		return pkt.Kind == av.KindAudio
+	}
+	keyframe, _ := pkt.Get("Keyframe").(bool)
+	return pkt.Kind == av.KindVideo && keyframe
+}
+
+// partial returns whether the uncompleted part should be cut before the packet, so that it won't exceed the target.
+// Parts are cut on video frames if any.
+func (me *HLS) partial(pkt *av.Packet) bool {
+	c := me.segment.Chunk
+	if c == nil || c.Size == 0 || pkt.Kind != av.KindVideo && len(me.remuxer.GetVideoTracks()) > 0 {
+		return false
+	}
+	return pkt.Timestamp+me.frame-c.Timestamp > me.part
+}
+
+func (me *HLS) onClose(e *Event.Event) {
+	me.mtx.Lock()
+	defer me.mtx.Unlock()
+
+	if e.Target != me.remuxer {
+		return
+	}
+	e.Target.(av.IRemuxer).RemoveEventListener(MediaEvent.PACKET, me.packetListener)
+	e.Target.(av.IRemuxer).RemoveEventListener(Event.CLOSE, me.closeListener)
+	me.remuxer = nil
+
+	if seg := me.segment; seg != nil {
+		me.finish(me.last + me.frame - seg.Timestamp)
+	}
+	if me.started {
+		me.broken = true
+	}
+	if !me.Ended() {
+		me.timer = time.AfterFunc(time.Duration(me.target)*time.Duration(me.window)*time.Millisecond, me.Close)
+	}
+}
+
+// writeInit stores the init segment, which is referred by the following segments with EXT-X-MAP.
+func (me *HLS) writeInit(data []byte) {
+	uri := fmt.Sprintf("%s-init-%d%s", me.constraints.FileName, me.inits, exts[me.Name][0])
+	me.inits++
+
+	if me.constraints.Directory == "" {
+		me.files[uri] = data
+	} else {
+		err := ioutil.WriteFile(me.path(uri), data, 0666)
+		if err != nil {
+			me.logger.Errorf("Failed to write init segment %s: %v", uri, err)
+			return
+		}
+	}
+	old := me.init
+	me.init = uri
+	me.release(old)
+}
+
+func (me *HLS) path(uri string) string {
+	return filepath.Join(me.constraints.Directory, uri)
+}
+
+// create returns the file of the URI if not in memory.
+func (me *HLS) create(uri string) (*os.File, error) {
+	if me.constraints.Directory == "" {
+		me.files[uri] = make([]byte, 0)
+		return nil, nil
+	}
+	return os.OpenFile(me.path(uri), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0666)
+}
+
+func (me *HLS) open(timestamp uint32) error {
+	seg := &Segment{MediaSegment: new(cmaf.MediaSegment).Init(me.sequence)}
+	seg.URI = fmt.Sprintf("%s-%d%s", me.constraints.FileName, seg.Major, exts[me.Name][1])
+	seg.Map = me.init
+	seg.Timestamp = timestamp
+	seg.Independent = true
+	seg.ProgramDateTime = me.epoch.Add(time.Duration(timestamp) * time.Millisecond)
+	seg.Discontinuity = me.broken
+
+	f, err := me.create(seg.URI)
+	if err != nil {
+		return err
+	}
+	seg.file = f
+
+	me.sequence++
+	me.broken = false
+	me.segment = seg
+
+	if me.part > 0 {
+		return me.openPart(timestamp)
+	}
+	return nil
+}
+
+// openPart starts a part of the uncompleted segment, which is hinted to preload.
+func (me *HLS) openPart(timestamp uint32) error {
+	seg := me.segment
+	c := new(cmaf.MediaChunk).Init(len(seg.Chunks))
+	c.URI = fmt.Sprintf("%s-%d.%d%s", me.constraints.FileName, seg.Major, c.Minor, exts[me.Name][1])
+	c.Timestamp = timestamp
+	c.Offset = seg.Size
+
+	f, err := me.create(c.URI)
+	if err != nil {
+		return err
+	}
+	seg.part = f
+	seg.Chunk = c
+	return nil
+}
+
+// cut completes the uncompleted part at the timestamp, and starts the next one.
+func (me *HLS) cut(timestamp uint32) {
+	me.completePart(timestamp)
+
+	err := me.openPart(timestamp)
+	if err != nil {
+		me.logger.Errorf("Failed to open part: %v", err)
+	}
+	me.update()
+}
+
+func (me *HLS) completePart(timestamp uint32) {
+	seg := me.segment
+	c := seg.Chunk
+	if c == nil {
+		return
+	}
+	c.Duration = timestamp - c.Timestamp
+	if seg.part != nil {
+		err := seg.part.Close()
+		if err != nil {
+			me.logger.Errorf("Failed to close part %s: %v", c.URI, err)
+		}
+		seg.part = nil
+	}
+	seg.Chunks = append(seg.Chunks, c)
+	seg.Chunk = nil
+	me.report.Store(report{msn: seg.Major, part: c.Minor})
+}
+
+func (me *HLS) write(seg *Segment, data []byte) error {
+	seg.Size += uint32(len(data))
+	if c := seg.Chunk; c != nil {
+		c.Size += uint32(len(data))
+		if seg.part != nil {
+			_, err := seg.part.Write(data)
+			if err != nil {
+				return err
+			}
+		} else if me.constraints.Directory == "" {
+			me.files[c.URI] = append(me.files[c.URI], data...)
+		}
+	}
+	if seg.file != nil {
+		_, err := seg.file.Write(data)
+		return err
+	}
+	me.files[seg.URI] = append(me.files[seg.URI], data...)
+	return nil
+}
+
+// finish completes the uncompleted segment, deletes the ones expired, and updates the playlist.
+// Segments are kept for another window after leaving the playlist, as clients may still be loading them.
+func (me *HLS) finish(duration uint32) {
+	seg := me.segment
+	seg.Duration = duration
+	me.completePart(seg.Timestamp + duration)
+	if seg.file != nil {
+		err := seg.file.Close()
+		if err != nil {
+			me.logger.Errorf("Failed to close segment %s: %v", seg.URI, err)
+		}
+		seg.file = nil
+	}
+	me.segment = nil
+	me.segments = append(me.segments, seg)
+
+	for len(me.segments) > 2*me.window {
+		old := me.segments[0]
+		me.segments = me.segments[1:]
+		if old.Discontinuity {
+			me.skipped++
+		}
+		me.remove(old.URI)
+		for _, c := range old.Chunks {
+			me.remove(c.URI)
+		}
+		me.release(old.Map)
+	}
+
+	ranges := me.dateRanges[:0]
+	for _, item := range me.dateRanges {
+		if _, end, _ := item.Span(); end.IsZero() || !end.Before(me.segments[0].ProgramDateTime) {
+			ranges = append(ranges, item)
+		}
+	}
+	me.dateRanges = ranges
+	me.update()
+}
+
+// release deletes the init segment if no longer referred.
+func (me *HLS) release(uri string) {
+	if uri == "" || uri == me.init {
+		return
+	}
+	for _, seg := range me.segments {
+		if seg.Map == uri {
+			return
+		}
+	}
+	me.remove(uri)
+}
+
+func (me *HLS) remove(uri string) {
+	if me.constraints.Directory == "" {
+		delete(me.files, uri)
+		return
+	}
+	err := os.Remove(me.path(uri))
+	if err != nil {
+		me.logger.Debugf(3, "Failed to remove %s: %v", uri, err)
+	}
+}
+
+// update rebuilds the playlist, writes it if not in memory, and wakes up the blocking requests.
+func (me *HLS) update() {
+	me.data = me.render(false, nil)
+
+	if me.constraints.Directory != "" {
+		// Replaced as a whole, so that clients never read a partial playlist.
+		name := me.path(me.constraints.FileName + ".m3u8")
+		err := ioutil.WriteFile(name+".tmp", me.data, 0666)
+		if err == nil {
+			err = os.Rename(name+".tmp", name)
+		}
+		if err != nil {
+			me.logger.Errorf("Failed to write playlist %s: %v", name, err)
+		}
+	}
+
+	me.signal.Wake()
+}
+
+// render marshals the playlist with the last window of segments, and the parts of the uncompleted one.
+// If skip, the segments older than CAN-SKIP-UNTIL are replaced with EXT-X-SKIP.
+func (me *HLS) render(skip bool, reports []m3u8.RenditionReportAttributes) []byte {
+	var (
+		playlist m3u8.MediaPlaylist
+		total    uint32 // duration of the listed segments
+	)
+
+	start := len(me.segments) - me.window
+	if start < 0 {
+		start = 0
+	}
+
+	discontinuities := me.skipped
+	for _, seg := range me.segments[:start] {
+		if seg.Discontinuity {
+			discontinuities++
+		}
+	}
+
+	listed := append([]*Segment{}, me.segments[start:]...)
+	if me.segment != nil && me.part > 0 {
+		listed = append(listed, me.segment)
+	}
+
+	// Starts of the listed segments, relative to the first one.
+	starts := make([]uint32, len(listed))
+	for i, seg := range listed {
+		starts[i] = total
+		if seg != me.segment {
+			total += seg.Duration
+		} else if n := len(seg.Chunks); n > 0 {
+			total += seg.Chunks[n-1].Timestamp + seg.Chunks[n-1].Duration - seg.Timestamp
+		}
+	}
+
+	skipped := 0
+	if skip && me.part > 0 {
+		for i, seg := range listed {
+			if seg == me.segment || total-starts[i]-seg.Duration < skipUntil*me.target || seg.Discontinuity && i > 0 {
+				break
+			}
+			skipped++
+		}
+	}
+
+	version := uint(3)
+	switch {
+	case me.part > 0:
+		version = m3u8.DEFAULT_VERSION
+	case exts[me.Name][0] != "":
+		version = 6
+	}
+	playlist.Init(version, 0)
+
+	target := me.target / 1000
+	items := make([]m3u8.MediaSegmentTags, 0, len(listed)-skipped)
+	for i := skipped; i < len(listed); i++ {
+		seg := listed[i]
+		if n := uint32(math.Round(float64(seg.Duration) / 1000)); n > target {
+			target = n
+		}
+
+		item := m3u8.MediaSegmentTags{}
+		if seg != me.segment {
+			item.URI = seg.URI
+			item.EXTINF.Duration = float64(seg.Duration) / 1000
+		}
+		// Kept on the first segment too, which is counted in EXT-X-DISCONTINUITY-SEQUENCE once deleted.
+		item.EXT_X_DISCONTINUITY = seg.Discontinuity
+		if i == skipped || seg.Discontinuity {
+			item.EXT_X_PROGRAM_DATE_TIME = seg.ProgramDateTime.Format(programDateTimeLayout)
+		}
+		if seg.Map != "" && (i == skipped || seg.Map != listed[i-1].Map) {
+			item.EXT_X_MAP.URI = seg.Map
+		}
+
+		// Parts are listed in the last few target durations only.
+		if me.part > 0 && total-starts[i]-seg.Duration < partWindow*me.target {
+			for _, c := range seg.Chunks {
+				part := m3u8.PartAttributes{URI: c.URI, DURATION: float64(c.Duration) / 1000}
+				if c.Independent {
+					part.INDEPENDENT = "YES"
+				}
+				item.EXT_X_PART = append(item.EXT_X_PART, part)
+			}
+		}
+		if item.URI == "" && len(item.EXT_X_PART) == 0 {
+			continue
+		}
+		items = append(items, item)
+	}
+
+	playlist.EXT_X_TARGETDURATION = uint(target)
+	if len(listed) > 0 {
+		playlist.EXT_X_MEDIA_SEQUENCE = uint(listed[0].Major)
+	}
+	playlist.EXT_X_DISCONTINUITY_SEQUENCE = uint(discontinuities)
+	playlist.EXT_X_ENDLIST = me.Ended()
+	playlist.MediaSegments = items
+
+	// Date ranges ended before the listed segments are dropped, legacy cues are added for the others.
+	for _, item := range me.dateRanges {
+		if _, end, err := item.Span(); err == nil && (len(listed) == 0 || end.IsZero() || !end.Before(listed[0].ProgramDateTime)) {
+			playlist.EXT_X_DATERANGE = append(playlist.EXT_X_DATERANGE, item)
+		}
+	}
+	playlist.AddCues()
+
+	if me.part > 0 {
+		playlist.EXT_X_PART_INF.PART_TARGET = float64(me.part) / 1000
+		playlist.EXT_X_SERVER_CONTROL.CAN_BLOCK_RELOAD = "YES"
+		playlist.EXT_X_SERVER_CONTROL.PART_HOLD_BACK = float64(partHoldBack*me.part) / 1000
+		playlist.EXT_X_SERVER_CONTROL.CAN_SKIP_UNTIL = float64(skipUntil * me.target / 1000)
+		if skipped > 0 {
+			playlist.EXT_X_SKIP.SKIPPED_SEGMENTS = fmt.Sprintf("%d", skipped)
+		}
+		if seg := me.segment; seg != nil && seg.Chunk != nil {
+			playlist.EXT_X_PRELOAD_HINT.TYPE = "PART"
+			playlist.EXT_X_PRELOAD_HINT.URI = seg.Chunk.URI
+		}
+		playlist.EXT_X_RENDITION_REPORT = reports
+	}
+
+	data, err := playlist.Marshal()
+	if err != nil {
+		me.logger.Errorf("Failed to marshal playlist: %v", err)
+		return nil
+	}
+	return append([]byte{}, data...)
+}
+
+// AddDateRange lists the date range, e.g. an ad break with SCTE35-OUT, from the next update of the playlist,
+// until it ends before the listed segments. The one of the same ID is replaced.
+func (me *HLS) AddDateRange(item m3u8.DateRangeAttributes) error {
+	_, _, err := item.Span()
+	if err != nil {
+		return err
+	}
+
+	me.mtx.Lock()
+	defer me.mtx.Unlock()
+
+	for i, dr := range me.dateRanges {
+		if dr.ID == item.ID {
+			me.dateRanges[i] = item
+			return nil
+		}
+	}
+	me.dateRanges = append(me.dateRanges, item)
+	return nil
+}
+
+// Playlist returns the current media playlist with the reports of the renditions, nil if nothing is listed yet.
+// If skip, the segments older than CAN-SKIP-UNTIL are skipped, which requires low-latency.
+func (me *HLS) Playlist(skip bool) []byte {
+	reports := make([]m3u8.RenditionReportAttributes, 0)
+	for _, h := range renditions(me) {
+		if v, ok := h.report.Load().(report); ok {
+			uri := h.Path
+			if path.Dir(h.Path) == path.Dir(me.Path) {
+				uri = path.Base(h.Path)
+			}
+			reports = append(reports, m3u8.RenditionReportAttributes{URI: uri, LAST_MSN: uint(v.msn), LAST_PART: uint(v.part)})
+		}
+	}
+
+	me.mtx.RLock()
+	defer me.mtx.RUnlock()
+
+	if me.data == nil || !skip && len(reports) == 0 {
+		return me.data
+	}
+	return me.render(skip, reports)
+}
+
+// Segment returns the data of an init segment, a finished media segment or part by the URI.
+func (me *HLS) Segment(uri string) ([]byte, bool) {
+	me.mtx.RLock()
+	defer me.mtx.RUnlock()
+
+	if seg := me.segment; seg != nil && (seg.URI == uri || seg.Chunk != nil && seg.Chunk.URI == uri) {
+		return nil, false // not completed
+	}
+	if me.constraints.Directory == "" {
+		data, ok := me.files[uri]
+		return data, ok
+	}
+	if !me.exists(uri) {
+		return nil, false
+	}
+	data, err := ioutil.ReadFile(me.path(uri))
+	return data, err == nil
+}
+
+func (me *HLS) exists(uri string) bool {
+	if uri == me.init {
+		return true
+	}
+
+	segments := me.segments
+	if me.segment != nil {
+		segments = append(segments[:len(segments):len(segments)], me.segment)
+	}
+	for _, seg := range segments {
+		if seg.URI == uri && seg != me.segment || seg.Map == uri {
+			return true
+		}
+		for _, c := range seg.Chunks {
+			if c.URI == uri {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Ended returns whether the playlist has ended.
+func (me *HLS) Ended() bool {
+	return atomic.LoadUint32(&me.ended) != 0
+}
+
+// Close detaches the source, ends the playlist with EXT-X-ENDLIST, and unregisters it.
+func (me *HLS) Close() {
+	me.mtx.Lock()
+	if me.Ended() {
+		me.mtx.Unlock()
+		return
+	}
+	if me.timer != nil {
+		me.timer.Stop()
+		me.timer = nil
+	}
+	remuxer := me.remuxer
+	me.mtx.Unlock()
+
+	if remuxer != nil {
+		remuxer.Close()
+	}
+
+	me.mtx.Lock()
+	if me.timer != nil {
+		me.timer.Stop()
+		me.timer = nil
+	}
+	atomic.StoreUint32(&me.ended, 1)
+	me.update()
+	me.mtx.Unlock()
+
+	outputs.Unregister(me.Path, me)
+	me.DispatchEvent(Event.New(Event.CLOSE, me))
+}
@@ -0,0 +1,120 @@
+package hls
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/studease/common/av"
+	"github.com/studease/common/av/format/cmaf"
+	"github.com/studease/common/av/utils/m3u8"
+)
+
+// TestDiscontinuitySequence slides a discontinuity through the window, which must be either tagged, or counted.
+func TestDiscontinuitySequence(t *testing.T) {
+	h := new(HLS).Init("TS", "/live/test.m3u8", &av.MediaRecorderConstraints{Segments: 3}, testFactory())
+
+	for i := 0; i < 8; i++ {
+		seg := &Segment{MediaSegment: new(cmaf.MediaSegment).Init(i), ProgramDateTime: time.Now()}
+		seg.URI = fmt.Sprintf("test-%d.ts", i)
+		seg.Duration = 6000
+		seg.Discontinuity = i == 2
+		h.segment = seg
+		h.finish(seg.Duration)
+
+		pl := new(m3u8.MediaPlaylist)
+		err := pl.Unmarshal(h.data, nil)
+		if err != nil {
+			t.Fatalf("Failed to unmarshal playlist: %v", err)
+		}
+
+		// The discontinuity is listed while test-2.ts is, and counted afterwards.
+		sequence := pl.EXT_X_MEDIA_SEQUENCE
+		tagged := 0
+		for j, item := range pl.MediaSegments {
+			if item.EXT_X_DISCONTINUITY {
+				tagged++
+				if uint(j)+sequence != 2 {
+					t.Fatalf("Unexpected discontinuity on segment %d", uint(j)+sequence)
+				}
+			}
+		}
+		if listed := sequence <= 2 && i >= 2; listed != (tagged == 1) {
+			t.Fatalf("Expected discontinuity tagged=%v after segment %d, playlist:\n%s", listed, i, h.data)
+		}
+		if counted := sequence > 2; counted != (pl.EXT_X_DISCONTINUITY_SEQUENCE == 1) {
+			t.Fatalf("Expected discontinuity counted=%v after segment %d, playlist:\n%s", counted, i, h.data)
+		}
+	}
+}
+
+// TestCues lists an ad break, which must be marked by legacy cues on the segments where it starts and ends,
+// until it ends before the listed segments.
+func TestCues(t *testing.T) {
+	h := new(HLS).Init("TS", "/live/test.m3u8", &av.MediaRecorderConstraints{Segments: 3}, testFactory())
+	epoch := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	err := h.AddDateRange(m3u8.DateRangeAttributes{
+		ID:         "ad-1",
+		START_DATE: epoch.Add(6 * time.Second).Format(programDateTimeLayout),
+		DURATION:   12,
+		SCTE35_OUT: []byte{0xFC, 0x30},
+	})
+	if err != nil {
+		t.Fatalf("Failed to add date range: %v", err)
+	}
+
+	for i := 0; i < 10; i++ {
+		seg := &Segment{MediaSegment: new(cmaf.MediaSegment).Init(i), ProgramDateTime: epoch.Add(time.Duration(i*6) * time.Second)}
+		seg.URI = fmt.Sprintf("test-%d.ts", i)
+		seg.Duration = 6000
+		h.segment = seg
+		h.finish(seg.Duration)
+
+		pl := new(m3u8.MediaPlaylist)
+		err := pl.Unmarshal(h.data, nil)
+		if err != nil {
+			t.Fatalf("Failed to unmarshal playlist: %v", err)
+		}
+
+		// Ends at test-3.ts, which is no longer listed after test-6.ts.
+		if listed := i < 6; listed != (len(pl.EXT_X_DATERANGE) == 1) {
+			t.Fatalf("Expected date range listed=%v after segment %d, playlist:\n%s", listed, i, h.data)
+		}
+		for j, item := range pl.MediaSegments {
+			n := pl.EXT_X_MEDIA_SEQUENCE + uint(j)
+			if out := item.EXT_X_CUE_OUT != nil; out != (n == 1) || out && item.EXT_X_CUE_OUT.DURATION != 12 {
+				t.Fatalf("Unexpected EXT-X-CUE-OUT on segment %d after segment %d, playlist:\n%s", n, i, h.data)
+			}
+			if item.EXT_X_CUE_IN != (n == 3) {
+				t.Fatalf("Unexpected EXT-X-CUE-IN on segment %d after segment %d, playlist:\n%s", n, i, h.data)
+			}
+		}
+	}
+	// Deleted with test-3.ts.
+	if len(h.dateRanges) != 0 {
+		t.Fatalf("Expected date range deleted, got %d", len(h.dateRanges))
+	}
+}
+
+// TestLookup finds the HLS by the paths of its playlist and segments only, so that other outputs of the stream, e.g. FLV, are not taken.
+func TestLookup(t *testing.T) {
+	h := Open("TS", "/lookup/test.m3u8", "", &av.MediaRecorderConstraints{Segments: 3}, testFactory())
+	defer outputs.Unregister("/lookup/test.m3u8", h)
+
+	for _, item := range []struct {
+		path  string
+		found bool
+	}{
+		{"/lookup/test.m3u8", true},
+		{"/lookup/test-1.ts", true},
+		{"/lookup/test-video-init.mp4", true},
+		{"/lookup/test-720p.flv", false},
+		{"/lookup/test.flv", false},
+		{"/lookup/other-1.ts", false},
+	} {
+		if found := Lookup(item.path) == h; found != item.found {
+			t.Fatalf("%s: found=%v, expected %v", item.path, found, item.found)
+		}
+	}
+}
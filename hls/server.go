@@ -0,0 +1,163 @@
+package hls
+
+import (
+	"net/http"
+	"path"
+	"strconv"
+	"time"
+
+	"github.com/studease/common/av"
+	"github.com/studease/common/av/utils/output"
+	"github.com/studease/common/log"
+)
+
+var (
+	outputs = new(output.Registry).Init(".m3u8")
+
+	contentTypes = map[string]string{
+		".m3u8": "application/vnd.apple.mpegurl",
+		".ts":   "video/mp2t",
+		".mp4":  "video/mp4",
+		".m4s":  "video/iso.segment",
+	}
+)
+
+// Open returns the HLS registered at the URL path of the playlist, or creates and registers one.
+// A publisher reconnecting to the same path continues the existing playlist.
+// Low-latency outputs of the same group report their last parts to each other, if the group is not empty.
+func Open(name string, path string, group string, constraints *av.MediaRecorderConstraints, factory log.ILoggerFactory) *HLS {
+	return outputs.Open(path, func() output.Output {
+		h := new(HLS).Init(name, path, constraints, factory)
+		h.Group = group
+		return h
+	}).(*HLS)
+}
+
+// Find returns the HLS registered at the URL path of the playlist.
+func Find(path string) *HLS {
+	h, _ := outputs.Find(path).(*HLS)
+	return h
+}
+
+// Lookup returns the HLS of the playlist or segment at the URL path, which must be of an extension served by HLS.
+func Lookup(name string) *HLS {
+	if _, ok := contentTypes[path.Ext(name)]; !ok {
+		return nil
+	}
+	h, _ := outputs.Lookup(name).(*HLS)
+	return h
+}
+
+// renditions returns the other low-latency outputs in the group of h.
+func renditions(h *HLS) []*HLS {
+	arr := make([]*HLS, 0)
+	if h.Group == "" {
+		return arr
+	}
+	outputs.Range(func(o output.Output) {
+		if item := o.(*HLS); item != h && item.Group == h.Group && item.part > 0 {
+			arr = append(arr, item)
+		}
+	})
+	return arr
+}
+
+// Handler serves the playlists and segments of the registered HLS by the URL path.
+// Segments are named after the playlist, e.g. /live/test-1.ts belongs to /live/test.m3u8.
+type Handler struct{}
+
+// ServeHTTP implements http.Handler.
+func (me *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	outputs.ServeHTTP(w, r)
+}
+
+// ServeHTTP serves the playlist and the segments by the base name of the URL path.
+// A playlist request with _HLS_msn, and optionally _HLS_part, is blocked until the part or the segment is listed,
+// and a request of the part hinted to preload is blocked until the part is completed.
+func (me *HLS) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	base := path.Base(r.URL.Path)
+	ext := path.Ext(base)
+	timeout := 3 * time.Duration(me.target) * time.Millisecond
+
+	if typ, ok := contentTypes[ext]; ok {
+		w.Header().Set("Content-Type", typ)
+	}
+
+	if ext == ".m3u8" {
+		if base != path.Base(me.Path) {
+			http.NotFound(w, r)
+			return
+		}
+
+		query := r.URL.Query()
+		if v := query.Get("_HLS_msn"); v != "" && me.part > 0 {
+			msn, err := strconv.Atoi(v)
+			if err != nil || msn < 0 {
+				http.Error(w, "bad _HLS_msn", http.StatusBadRequest)
+				return
+			}
+			part := -1
+			if v = query.Get("_HLS_part"); v != "" {
+				part, err = strconv.Atoi(v)
+				if err != nil || part < 0 {
+					http.Error(w, "bad _HLS_part", http.StatusBadRequest)
+					return
+				}
+			}
+
+			me.mtx.RLock()
+			far := msn > me.sequence+1
+			me.mtx.RUnlock()
+			if far {
+				http.Error(w, "_HLS_msn too far in the future", http.StatusBadRequest)
+				return
+			}
+			if !me.signal.Wait(r, timeout, me.Ended, func() bool { return me.listed(msn, part) }) && !me.Ended() {
+				http.Error(w, "playlist not updated in time", http.StatusServiceUnavailable)
+				return
+			}
+		}
+
+		data := me.Playlist(query.Get("_HLS_skip") == "YES")
+		if data == nil {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Write(data)
+		return
+	}
+
+	me.mtx.RLock()
+	hinted := me.segment != nil && me.segment.Chunk != nil && me.segment.Chunk.URI == base
+	me.mtx.RUnlock()
+	if hinted {
+		me.signal.Wait(r, timeout, me.Ended, func() bool { return me.exists(base) })
+	}
+
+	data, ok := me.Segment(base)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	w.Write(data)
+}
+
+// listed returns whether the part of the media sequence number, or the whole segment if part is -1, is listed.
+// A part beyond the last one of a finished segment is the first one of the next segment.
+func (me *HLS) listed(msn int, part int) bool {
+	if n := len(me.segments); n > 0 {
+		last := me.segments[n-1]
+		if last.Major > msn {
+			return true
+		}
+		if last.Major == msn {
+			if part < 0 || part < len(last.Chunks) {
+				return true
+			}
+			msn, part = msn+1, 0
+		}
+	}
+	seg := me.segment
+	return seg != nil && seg.Major == msn && part >= 0 && part < len(seg.Chunks)
+}
@@ -16,15 +16,39 @@ type Server struct {
 
 // Location config of rtmp server.
 type Location struct {
-	XMLName       xml.Name      `xml:"Location"`
-	Pattern       string        `xml:"pattern,attr"`
-	Handler       string        `xml:""`
-	Proxy         basecfg.URL   `xml:""`
-	OnOpen        basecfg.URL   `xml:""`
-	OnClose       basecfg.URL   `xml:""`
-	OnPublish     basecfg.URL   `xml:""`
-	OnPublishDone basecfg.URL   `xml:""`
-	OnPlay        basecfg.URL   `xml:""`
-	OnPlayDone    basecfg.URL   `xml:""`
-	DVRs          []basecfg.DVR `xml:"DVR"`
+	XMLName           xml.Name       `xml:"Location"`
+	Pattern           string         `xml:"pattern,attr"`
+	Handler           string         `xml:""`
+	Root              string         `xml:""`
+	Proxy             basecfg.URL    `xml:""`
+	Pull              basecfg.URL    `xml:""` // HTTP-FLV or HLS, relayed if played but not published
+	MaxPublishBitrate int32          `xml:""` // bps
+	MaxPlayBitrate    int32          `xml:""` // bps
+	MaxDuration       uint32         `xml:""` // seconds
+	MaxPlayers        int            `xml:""` // per stream
+	OnOpen            basecfg.URL    `xml:""`
+	OnClose           basecfg.URL    `xml:""`
+	OnPublish         basecfg.URL    `xml:""`
+	OnPublishDone     basecfg.URL    `xml:""`
+	OnPlay            basecfg.URL    `xml:""`
+	OnPlayDone        basecfg.URL    `xml:""`
+	DVRs              []basecfg.DVR  `xml:"DVR"`
+	HLSs              []basecfg.HLS  `xml:"HLS"`
+	DASHs             []basecfg.DASH `xml:"DASH"`
+	Playlists         []Playlist     `xml:"Playlist"`
+}
+
+// Playlist config of rtmp location.
+type Playlist struct {
+	Name  string         `xml:"name,attr"`
+	Loop  bool           `xml:"loop,attr"`
+	Items []PlaylistItem `xml:"Item"`
+}
+
+// PlaylistItem config. Start is in seconds, -2 for live or recorded, -1 for live only.
+// Duration is in seconds, 0 plays to the end.
+type PlaylistItem struct {
+	Start    float64 `xml:"start,attr"`
+	Duration float64 `xml:"duration,attr"`
+	Stream   string  `xml:",chardata"`
 }
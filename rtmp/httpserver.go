@@ -0,0 +1,414 @@
+package rtmp
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/studease/common/av"
+	"github.com/studease/common/av/format"
+	_ "github.com/studease/common/av/format/flv" // Register FLV remuxer.
+	"github.com/studease/common/dash"
+	"github.com/studease/common/hls"
+	"github.com/studease/common/log"
+	"github.com/studease/common/target"
+	basecfg "github.com/studease/common/utils/config"
+)
+
+// Static constants.
+const (
+	DEFAULT_HTTP_PORT = 80
+)
+
+var (
+	playPathRe, _ = regexp.Compile("^/([-\\.[:word:]]+)(?:/([-\\.[:word:]]+))?/([-\\.[:word:]]+)\\.(flv|mp4)$")
+)
+
+// HTTPServer plays the live streams of an RTMP server in HTTP-FLV, or WebSocket-FLV if upgraded, e.g. http://host/live/test.flv.
+// The path is mapped to the stream as rtmp://host/live with the name test, and served by the location of rtmp-live handler,
+// which applies OnPlay, OnPlayDone and MaxPlayers. The query mode=audio or mode=video plays audio or video only.
+//
+// WebSocket only, ws://host/live/test.mp4 plays fMP4 for Media Source Extensions, see mseDescriptor.
+// Separate audio and video buffers are used, unless mode contains interleaved, e.g. mode=all,interleaved.
+// The query start=latest starts from the latest keyframe, instead of the next one.
+//
+// The HLS playlists and DASH MPDs of the locations are served as well, with their segments, e.g. http://host/live/_definst_/test.m3u8.
+type HTTPServer struct {
+	srv      *Server
+	config   *basecfg.Listener
+	logger   log.ILogger
+	factory  log.ILoggerFactory
+	upgrader websocket.Upgrader
+	mtx      sync.Mutex
+	hubs     map[mseKey]*mseHub
+}
+
+// Init this class.
+func (me *HTTPServer) Init(srv *Server, cfg *basecfg.Listener, logger log.ILogger, factory log.ILoggerFactory) *HTTPServer {
+	me.srv = srv
+	me.config = cfg
+	me.logger = logger
+	me.factory = factory
+	me.upgrader = websocket.Upgrader{
+		ReadBufferSize:  1024,
+		WriteBufferSize: DEFAULT_SEND_BUFFER_SIZE,
+		CheckOrigin:     func(r *http.Request) bool { return true },
+	}
+	me.hubs = make(map[mseKey]*mseHub)
+	if cfg.Port == 0 {
+		cfg.Port = DEFAULT_HTTP_PORT
+	}
+	if cfg.Timeout == 0 {
+		cfg.Timeout = DEFAULT_TIMEOUT
+	}
+	if cfg.Cors == "" {
+		cfg.Cors = DEFAULT_CORS
+	}
+	return me
+}
+
+// ListenAndServe listens on the TCP network address and then serves HTTP requests.
+func (me *HTTPServer) ListenAndServe() error {
+	me.logger.Infof("Listening on port %d", me.config.Port)
+
+	s := &http.Server{
+		Addr:              fmt.Sprintf(":%d", me.config.Port),
+		Handler:           me,
+		ReadHeaderTimeout: time.Duration(me.config.Timeout) * time.Second,
+		IdleTimeout:       time.Duration(me.config.MaxIdleTime) * time.Second,
+	}
+	return s.ListenAndServe()
+}
+
+// ServeHTTP implements http.Handler.
+func (me *HTTPServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h := w.Header()
+	h.Set("Access-Control-Allow-Origin", "*")
+
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodOptions:
+		h.Set("Access-Control-Allow-Methods", "GET, OPTIONS")
+		h.Set("Access-Control-Allow-Headers", "Range")
+		h.Set("Access-Control-Max-Age", "86400")
+		w.WriteHeader(http.StatusNoContent)
+		return
+	default:
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	if r.URL.Path == "/crossdomain.xml" {
+		http.ServeFile(w, r, me.config.Cors)
+		return
+	}
+
+	// HLS and DASH only take the paths of their own extensions, the others fall through to FLV.
+	if !websocket.IsWebSocketUpgrade(r) {
+		if h := hls.Lookup(r.URL.Path); h != nil {
+			h.ServeHTTP(w, r)
+			return
+		}
+		if d := dash.Lookup(r.URL.Path); d != nil {
+			d.ServeHTTP(w, r)
+			return
+		}
+	}
+
+	arr := playPathRe.FindStringSubmatch(r.URL.Path)
+	if arr == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	p := &httpPlayer{
+		AppName:  arr[1],
+		InstName: "_definst_",
+		Name:     arr[3],
+		Format:   arr[4],
+		r:        r,
+	}
+	u := &url.URL{Path: "/" + p.AppName}
+	if arr[2] != "" {
+		p.InstName = arr[2]
+		u.Path += "/" + p.InstName
+	}
+
+	handler, ok := me.srv.Handler(u).(*LiveHandler)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	if p.Format == "mp4" && !websocket.IsWebSocketUpgrade(r) {
+		http.Error(w, "websocket required", http.StatusBadRequest)
+		return
+	}
+	me.play(w, r, p, handler)
+}
+
+func (me *HTTPServer) play(w http.ResponseWriter, r *http.Request, p *httpPlayer, handler *LiveHandler) {
+	cfg := handler.cfg
+
+	if url := &cfg.OnPlay; url.Enable {
+		err := p.sendNotification(url, "play")
+		if err != nil {
+			me.logger.Errorf("Failed to send \"play\" notification: %v", err)
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+	}
+
+	stream := me.srv.GetStream(p.AppName, p.InstName, p.Name)
+	if stream == nil {
+		me.logger.Errorf("Failed to get stream")
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+
+	if !me.srv.addPlayer(stream, cfg.MaxPlayers) {
+		me.logger.Infof("Max players reached: stream=%s, max=%d", stream.Name(), cfg.MaxPlayers)
+		http.Error(w, "max players reached", http.StatusServiceUnavailable)
+		return
+	}
+	defer me.srv.removePlayer(stream)
+
+	handler.pull(p.AppName, p.InstName, stream)
+
+	defer func() {
+		if url := &cfg.OnPlayDone; url.Enable {
+			err := p.sendNotification(url, "unplay")
+			if err != nil {
+				me.logger.Errorf("Failed to send \"unplay\" notification: %v", err)
+			}
+		}
+	}()
+
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+
+	if cfg.MaxDuration > 0 {
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(cfg.MaxDuration)*time.Second)
+		defer cancel()
+	}
+
+	mode := av.Mode(r.URL.Query().Get("mode"), ",") & (av.ModeKeyframe | av.ModeAudio | av.ModeInterleaved)
+	if (mode & av.ModeAll) == av.ModeNone {
+		mode |= av.ModeAll
+	}
+
+	if p.Format == "mp4" {
+		me.playMSE(ctx, cancel, w, r, p, stream, mode)
+		return
+	}
+	me.playFLV(ctx, cancel, w, r, p, stream, mode&^av.ModeInterleaved)
+}
+
+func (me *HTTPServer) playFLV(ctx context.Context, cancel context.CancelFunc, w http.ResponseWriter, r *http.Request, p *httpPlayer, stream *Stream, mode uint32) {
+	var out io.Writer
+	if websocket.IsWebSocketUpgrade(r) {
+		conn, err := me.upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			me.logger.Debugf(2, "Failed to upgrade: %v", err)
+			return
+		}
+		defer conn.Close()
+
+		// Control frames are handled while reading, until closed by the client.
+		go discard(conn, cancel)
+		out = &wsWriter{conn: conn, timeout: time.Duration(me.config.Timeout) * time.Second}
+	} else {
+		h := w.Header()
+		h.Set("Content-Type", "video/x-flv")
+		h.Set("Cache-Control", "no-cache")
+		w.WriteHeader(http.StatusOK)
+		out = &flushWriter{w: w}
+	}
+
+	remuxer := format.New("FLV", mode, me.factory)
+	if remuxer == nil {
+		me.logger.Errorf("Remuxer FLV not registered")
+		return
+	}
+
+	me.logger.Debugf(4, "Playing %s/%s/%s: addr=%s, mode=0x%02X", p.AppName, p.InstName, p.Name, r.RemoteAddr, mode)
+
+	writer := new(format.Writer).Init(remuxer, out, me.logger)
+	remuxer.Source(stream)
+
+	// Releases the stream if blocked in writing.
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			writer.Close()
+		case <-done:
+		}
+	}()
+
+	err := writer.Run(ctx)
+	remuxer.Close()
+
+	me.logger.Debugf(4, "Stopped playing %s/%s/%s: addr=%s, written=%d, err=%v", p.AppName, p.InstName, p.Name, r.RemoteAddr, writer.Written(), err)
+}
+
+func (me *HTTPServer) playMSE(ctx context.Context, cancel context.CancelFunc, w http.ResponseWriter, r *http.Request, p *httpPlayer, stream *Stream, mode uint32) {
+	conn, err := me.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		me.logger.Debugf(2, "Failed to upgrade: %v", err)
+		return
+	}
+	defer conn.Close()
+
+	go discard(conn, cancel)
+
+	me.logger.Debugf(4, "Playing %s/%s/%s: addr=%s, mode=0x%02X, fmp4", p.AppName, p.InstName, p.Name, r.RemoteAddr, mode)
+
+	c := new(mseClient).Init()
+	hub := me.join(stream, mode, c, r.URL.Query().Get("start") == "latest")
+	if hub == nil {
+		return
+	}
+	defer me.leave(hub, c)
+
+	timeout := time.Duration(me.config.Timeout) * time.Second
+	for {
+		select {
+		case m := <-c.queue:
+			conn.SetWriteDeadline(time.Now().Add(timeout))
+
+			err = conn.WriteMessage(m.typ, m.data)
+			if err != nil {
+				me.logger.Debugf(4, "Stopped playing %s/%s/%s: addr=%s, dropped=%d, err=%v", p.AppName, p.InstName, p.Name, r.RemoteAddr, atomic.LoadUint32(&c.dropped), err)
+				return
+			}
+
+		case <-c.closed:
+			me.logger.Debugf(4, "Stopped playing %s/%s/%s: addr=%s, dropped=%d, closed", p.AppName, p.InstName, p.Name, r.RemoteAddr, atomic.LoadUint32(&c.dropped))
+			return
+
+		case <-ctx.Done():
+			me.logger.Debugf(4, "Stopped playing %s/%s/%s: addr=%s, dropped=%d, err=%v", p.AppName, p.InstName, p.Name, r.RemoteAddr, atomic.LoadUint32(&c.dropped), ctx.Err())
+			return
+		}
+	}
+}
+
+// join adds the client to the hub of the stream in the mode, which is created if not yet, or closed with the stream.
+func (me *HTTPServer) join(stream *Stream, mode uint32, c *mseClient, latest bool) *mseHub {
+	me.mtx.Lock()
+	defer me.mtx.Unlock()
+
+	key := mseKey{stream, mode}
+	if hub := me.hubs[key]; hub != nil && hub.add(c, latest) {
+		return hub
+	}
+
+	remuxer := format.New("FMP4", mode, me.factory)
+	if remuxer == nil {
+		me.logger.Errorf("Remuxer FMP4 not registered")
+		return nil
+	}
+
+	hub := new(mseHub).Init(key, remuxer, me.logger)
+	me.hubs[key] = hub
+	remuxer.Source(stream)
+	hub.add(c, latest)
+	return hub
+}
+
+// leave removes the client from the hub, which is closed if no clients left.
+func (me *HTTPServer) leave(hub *mseHub, c *mseClient) {
+	me.mtx.Lock()
+	defer me.mtx.Unlock()
+
+	if hub.remove(c) == 0 {
+		if me.hubs[hub.key] == hub {
+			delete(me.hubs, hub.key)
+		}
+		hub.Close()
+	}
+}
+
+// discard handles control frames while reading, until closed by the client.
+func discard(conn *websocket.Conn, cancel context.CancelFunc) {
+	for {
+		if _, _, err := conn.NextReader(); err != nil {
+			cancel()
+			return
+		}
+	}
+}
+
+// httpPlayer is a player of HTTP-FLV, WebSocket-FLV, or WebSocket-fMP4.
+type httpPlayer struct {
+	AppName  string
+	InstName string
+	Name     string
+	Format   string
+	r        *http.Request
+}
+
+func (me *httpPlayer) sendNotification(url *basecfg.URL, event string) error {
+	addr, _, err := net.SplitHostPort(me.r.RemoteAddr)
+	if err != nil {
+		addr = me.r.RemoteAddr
+	}
+
+	rawquery := "call=" + event
+	rawquery += "&addr=" + addr
+	rawquery += "&app=" + me.AppName
+	rawquery += "&inst=" + me.InstName
+	rawquery += "&name=" + me.Name
+	if tmp := me.r.URL.Query().Encode(); event == "play" && tmp != "" {
+		rawquery += "&" + tmp
+	}
+
+	res, err := target.Request(url, rawquery)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf(res.Status)
+	}
+	return nil
+}
+
+// flushWriter sends each write by chunked transfer at once.
+type flushWriter struct {
+	w http.ResponseWriter
+}
+
+func (me *flushWriter) Write(p []byte) (int, error) {
+	n, err := me.w.Write(p)
+	if f, ok := me.w.(http.Flusher); ok && err == nil {
+		f.Flush()
+	}
+	return n, err
+}
+
+// wsWriter sends each write in a binary message.
+type wsWriter struct {
+	conn    *websocket.Conn
+	timeout time.Duration
+}
+
+func (me *wsWriter) Write(p []byte) (int, error) {
+	me.conn.SetWriteDeadline(time.Now().Add(me.timeout))
+
+	err := me.conn.WriteMessage(websocket.BinaryMessage, p)
+	if err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
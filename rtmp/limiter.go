@@ -0,0 +1,139 @@
+package rtmp
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	Code "github.com/studease/common/events/netstatusevent/code"
+	Level "github.com/studease/common/events/netstatusevent/level"
+	"github.com/studease/common/log"
+	rtmpcfg "github.com/studease/common/rtmp/config"
+	"github.com/studease/common/utils/bw"
+)
+
+// Static constants.
+const (
+	LIMIT_INTERVAL = 1 // seconds between two checks
+	LIMIT_WINDOW   = 5 // seconds of the inbound bitrate average
+)
+
+// Limiter enforces the limits of a Location on a publishing or playing NetStream.
+type Limiter struct {
+	cfg     *rtmpcfg.Location
+	logger  log.ILogger
+	mtx     sync.Mutex
+	ns      *NetStream
+	player  interface{} // counted by Server.addPlayer while playing
+	state   uint32
+	done    chan struct{} // closed on Stop, nil if not checking
+	start   time.Time
+	bytesIn uint32
+	samples []uint32
+	writer  *bw.Writer
+}
+
+// Init this class.
+func (me *Limiter) Init(ns *NetStream, player interface{}, state uint32, cfg *rtmpcfg.Location, logger log.ILogger) *Limiter {
+	me.cfg = cfg
+	me.logger = logger
+	me.ns = ns
+	me.player = player
+	me.state = state
+	me.samples = make([]uint32, 0, LIMIT_WINDOW)
+	return me
+}
+
+// Start checking the limits, and shaping outbound traffic while playing.
+func (me *Limiter) Start() {
+	me.mtx.Lock()
+	defer me.mtx.Unlock()
+
+	me.start = time.Now()
+	me.bytesIn = atomic.LoadUint32(&me.ns.nc.BytesIn)
+
+	if me.state == STREAM_PLAYING && me.cfg.MaxPlayBitrate > 0 && me.writer == nil {
+		mgr := new(bw.Manager).Init(0, me.cfg.MaxPlayBitrate)
+		me.writer = mgr.NewWriter(me.logger)
+		me.ns.nc.Shape(me.ns.id, me.writer)
+	}
+
+	if (me.state == STREAM_PUBLISHING && me.cfg.MaxPublishBitrate > 0 || me.cfg.MaxDuration > 0) && me.done == nil {
+		me.done = make(chan struct{})
+		go me.watch(me.done)
+	}
+}
+
+// Stop checking the limits.
+func (me *Limiter) Stop() {
+	me.mtx.Lock()
+	defer me.mtx.Unlock()
+
+	if me.done != nil {
+		close(me.done)
+		me.done = nil
+	}
+	if me.writer != nil {
+		// The manager belongs to this limiter only, so the writer is simply detached.
+		me.ns.nc.Shape(me.ns.id, nil)
+		me.writer = nil
+	}
+}
+
+// watch checks the limits every LIMIT_INTERVAL, until done is closed.
+func (me *Limiter) watch(done chan struct{}) {
+	ticker := time.NewTicker(LIMIT_INTERVAL * time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			me.check()
+		case <-done:
+			return
+		}
+	}
+}
+
+func (me *Limiter) check() {
+	if max := me.cfg.MaxDuration; max > 0 && time.Since(me.start) >= time.Duration(max)*time.Second {
+		me.logger.Infof("Max duration reached: stream=%d, duration=%ds", me.ns.id, max)
+
+		if me.state == STREAM_PUBLISHING {
+			me.ns.SendStatus(Level.STATUS, Code.NETSTREAM_UNPUBLISH_SUCCESS, "max duration reached")
+		} else {
+			me.ns.SendStatus(Level.STATUS, Code.NETSTREAM_PLAY_STOP, "max duration reached")
+		}
+		me.Stop()
+		me.ns.nc.Close()
+		return
+	}
+
+	if max := me.cfg.MaxPublishBitrate; me.state == STREAM_PUBLISHING && max > 0 {
+		in := atomic.LoadUint32(&me.ns.nc.BytesIn)
+		if len(me.samples) == LIMIT_WINDOW {
+			me.samples = me.samples[1:]
+		}
+		me.samples = append(me.samples, in-me.bytesIn)
+		me.bytesIn = in
+
+		// Average over the window, so that a single large keyframe won't be taken as exceeding.
+		if len(me.samples) < LIMIT_WINDOW {
+			return
+		}
+
+		var total uint64
+		for _, n := range me.samples {
+			total += uint64(n)
+		}
+
+		bitrate := total * 8 / uint64(LIMIT_WINDOW*LIMIT_INTERVAL)
+		if bitrate > uint64(max) {
+			me.logger.Infof("Max publish bitrate exceeded: stream=%d, bitrate=%d/%d", me.ns.id, bitrate, max)
+
+			me.ns.SendStatus(Level.ERROR, Code.NETSTREAM_PUBLISH_DENIED, "max publish bitrate exceeded")
+			me.Stop()
+			me.ns.nc.Close()
+		}
+	}
+}
@@ -2,17 +2,24 @@ package rtmp
 
 import (
 	"bytes"
+	"fmt"
+	"path"
+	"path/filepath"
 	"strings"
+	"sync"
 	"sync/atomic"
 
 	"github.com/studease/common/av"
+	"github.com/studease/common/av/mediarecorder"
 	"github.com/studease/common/av/utils/amf"
+	"github.com/studease/common/dash"
 	"github.com/studease/common/events"
 	CommandEvent "github.com/studease/common/events/commandevent"
 	Event "github.com/studease/common/events/event"
 	MediaRecorderEvent "github.com/studease/common/events/mediarecorderevent"
 	Code "github.com/studease/common/events/netstatusevent/code"
 	Level "github.com/studease/common/events/netstatusevent/level"
+	"github.com/studease/common/hls"
 	"github.com/studease/common/log"
 	rtmpcfg "github.com/studease/common/rtmp/config"
 	"github.com/studease/common/rtmp/message"
@@ -20,6 +27,7 @@ import (
 	CSID "github.com/studease/common/rtmp/message/csid"
 	EventType "github.com/studease/common/rtmp/message/eventtype"
 	LimitType "github.com/studease/common/rtmp/message/limittype"
+	PublishingType "github.com/studease/common/rtmp/message/publishingtype"
 	"github.com/studease/common/target"
 	basecfg "github.com/studease/common/utils/config"
 )
@@ -54,6 +62,10 @@ type LiveHandler struct {
 	logger  log.ILogger
 	factory log.ILoggerFactory
 
+	mtx      sync.Mutex
+	limiters map[*NetStream]*Limiter
+	records  map[string]*record
+
 	connectListener      *events.EventListener
 	createStreamListener *events.EventListener
 	publishListener      *events.EventListener
@@ -71,6 +83,8 @@ func (me *LiveHandler) Init(srv *Server, cfg *rtmpcfg.Location, logger log.ILogg
 	me.cfg = cfg
 	me.logger = logger
 	me.factory = factory
+	me.limiters = make(map[*NetStream]*Limiter)
+	me.records = make(map[string]*record)
 	me.connectListener = events.NewListener(me.onConnect, 0)
 	me.createStreamListener = events.NewListener(me.onCreateStream, 0)
 	me.publishListener = events.NewListener(me.onPublish, 0)
@@ -106,7 +120,11 @@ func (me *LiveHandler) onConnect(e *CommandEvent.CommandEvent) {
 	me.srv.Accept(nc)
 
 	nc.SetAckWindowSize(DEFAULT_ACK_WINDOW_SIZE)
-	nc.SetPeerBandwidth(DEFAULT_PEER_BANDWIDTH, LimitType.DYNAMIC)
+	if max := me.cfg.MaxPublishBitrate; max > 0 {
+		nc.SetPeerBandwidth(uint32(max/8), LimitType.HARD)
+	} else {
+		nc.SetPeerBandwidth(DEFAULT_PEER_BANDWIDTH, LimitType.DYNAMIC)
+	}
 	nc.SendUserControl(EventType.STREAM_BEGIN, 0, 0, 0)
 	nc.SetChunkSize(DEFAULT_CHUNK_SIZE)
 
@@ -188,6 +206,13 @@ func (me *LiveHandler) onPublish(e *CommandEvent.CommandEvent) {
 
 	atomic.StoreUint32(&ns.readyState, STREAM_PUBLISHING)
 	ns.Sink(stream)
+	me.limit(ns, stream, STREAM_PUBLISHING)
+
+	// Record on demand of the client
+	switch m.PublishingType {
+	case PublishingType.RECORD, PublishingType.APPEND:
+		me.record(ns, stream, m.PublishingName, m.PublishingType == PublishingType.APPEND)
+	}
 
 	// Start IMediaRecorder
 	for _, cfg := range me.cfg.DVRs {
@@ -204,6 +229,7 @@ func (me *LiveHandler) onPublish(e *CommandEvent.CommandEvent) {
 		constraints.MaxDuration = cfg.MaxDuration
 		constraints.MaxSize = cfg.MaxSize
 		constraints.MaxFrames = cfg.MaxFrames
+		constraints.Seekable = cfg.Seekable
 
 		recorder := stream.NewRecorder(cfg.Name, constraints, me.factory)
 		recorder.AddEventListener(MediaRecorderEvent.START, me.recorderListener)
@@ -216,6 +242,53 @@ func (me *LiveHandler) onPublish(e *CommandEvent.CommandEvent) {
 		}
 	}
 
+	// Start HLS, which continues the playlist if the publisher reconnects
+	for _, cfg := range me.cfg.HLSs {
+		constraints := new(av.MediaRecorderConstraints)
+		constraints.Mode = av.Mode(cfg.Mode, ",")
+		if constraints.Mode == av.ModeNone {
+			constraints.Mode = av.ModeAll
+		}
+		constraints.Directory = stream.Info.StartTime.Format(cfg.Directory)
+		constraints.Directory = strings.Replace(constraints.Directory, "${APPLICATION}", nc.AppName, -1)
+		constraints.Directory = strings.Replace(constraints.Directory, "${INSTANCE}", nc.InstName, -1)
+		constraints.FileName = strings.Replace(cfg.FileName, "${STREAM}", stream.Name(), -1)
+		constraints.Segments = cfg.Segments
+		constraints.MaxDuration = cfg.MaxDuration
+		constraints.Chunks = cfg.Chunks
+
+		group := strings.Replace(cfg.Group, "${APPLICATION}", nc.AppName, -1)
+		group = strings.Replace(group, "${INSTANCE}", nc.InstName, -1)
+		group = strings.Replace(group, "${STREAM}", stream.Name(), -1)
+
+		uri := "/" + path.Join(nc.AppName, nc.InstName, constraints.FileName+".m3u8")
+		err := hls.Open(cfg.Name, uri, group, constraints, me.factory).Source(stream)
+		if err != nil {
+			me.logger.Warnf("Failed to start HLS %s: %v", uri, err)
+		}
+	}
+
+	// Start DASH, which continues the presentation in a new period if the publisher reconnects
+	for _, cfg := range me.cfg.DASHs {
+		constraints := new(av.MediaRecorderConstraints)
+		constraints.Mode = av.Mode(cfg.Mode, ",")
+		if constraints.Mode == av.ModeNone {
+			constraints.Mode = av.ModeAll
+		}
+		constraints.Directory = stream.Info.StartTime.Format(cfg.Directory)
+		constraints.Directory = strings.Replace(constraints.Directory, "${APPLICATION}", nc.AppName, -1)
+		constraints.Directory = strings.Replace(constraints.Directory, "${INSTANCE}", nc.InstName, -1)
+		constraints.FileName = strings.Replace(cfg.FileName, "${STREAM}", stream.Name(), -1)
+		constraints.Segments = cfg.Segments
+		constraints.MaxDuration = cfg.MaxDuration
+
+		uri := "/" + path.Join(nc.AppName, nc.InstName, constraints.FileName+".mpd")
+		err := dash.Open(uri, cfg.LowLatency, constraints, me.factory).Source(stream)
+		if err != nil {
+			me.logger.Warnf("Failed to start DASH %s: %v", uri, err)
+		}
+	}
+
 	// Publish to proxy
 	if url := &me.cfg.Proxy; url.Enable && !m.Flag {
 		u, err := target.Parse(url.Path)
@@ -277,6 +350,14 @@ func (me *LiveHandler) onPlay(e *CommandEvent.CommandEvent) {
 		return
 	}
 
+	if !me.srv.addPlayer(stream, me.cfg.MaxPlayers) {
+		me.logger.Infof("Max players reached: stream=%s, max=%d", stream.Name(), me.cfg.MaxPlayers)
+		ns.SendStatus(Level.ERROR, Code.NETSTREAM_PLAY_FAILED, "max players reached")
+		ns.Close()
+		return
+	}
+	me.limit(ns, stream, STREAM_PLAYING)
+
 	err := nc.SendUserControl(EventType.STREAM_BEGIN, ns.id, 0, 0)
 	if err != nil {
 		me.logger.Errorf("Failed to send user control: event=0x%02X, stream=%d", EventType.STREAM_BEGIN, ns.id)
@@ -304,6 +385,9 @@ func (me *LiveHandler) onPlay(e *CommandEvent.CommandEvent) {
 	ns.AddEventListener(CommandEvent.PAUSE, me.pauseListener)
 	ns.Source(stream)
 
+	// Play from relay
+	me.pull(nc.AppName, nc.InstName, stream)
+
 	// Play from proxy
 	if url := &me.cfg.Proxy; (atomic.LoadUint32(&stream.readyState)&STREAM_PUBLISHING) == 0 && url.Enable {
 		u, err := target.Parse(url.Path)
@@ -332,6 +416,30 @@ func (me *LiveHandler) onPlay(e *CommandEvent.CommandEvent) {
 	}
 }
 
+// pull starts relaying the stream from the Pull URL, if it's not published.
+func (me *LiveHandler) pull(appName string, instName string, stream *Stream) {
+	url := &me.cfg.Pull
+	if !url.Enable || (atomic.LoadUint32(&stream.readyState)&STREAM_PUBLISHING) != 0 {
+		return
+	}
+
+	u, err := target.Parse(url.Path)
+	if err != nil {
+		me.logger.Warnf("Failed to parse url: %v", err)
+		return
+	}
+
+	u = strings.Replace(u, "${APPLICATION}", appName, -1)
+	u = strings.Replace(u, "${INSTANCE}", instName, -1)
+	u = strings.Replace(u, "${STREAM}", stream.Name(), -1)
+
+	relay := new(Relay).Init(u, me.srv, stream, me.factory.NewLogger("RELAY"), me.factory)
+	err = relay.Start()
+	if err != nil {
+		me.logger.Debugf(4, "Relay not started: %v", err)
+	}
+}
+
 func (me *LiveHandler) onSeek(e *CommandEvent.CommandEvent) {
 	ns := e.Target.(*NetStream)
 	nc := ns.nc
@@ -384,6 +492,9 @@ func (me *LiveHandler) onCloseStream(e *CommandEvent.CommandEvent) {
 
 	ns := e.Target.(*NetStream)
 
+	me.unlimit(ns)
+	me.stopRecording(ns)
+
 	switch atomic.LoadUint32(&ns.readyState) {
 	case STREAM_UNPUBLISHING:
 		url = &me.cfg.OnPublishDone
@@ -417,6 +528,153 @@ func (me *LiveHandler) onClose(e *Event.Event) {
 	}
 }
 
+// limit replaces the limiter of the NetStream, player is the key counted by Server.addPlayer, if playing.
+func (me *LiveHandler) limit(ns *NetStream, player interface{}, state uint32) {
+	me.unlimit(ns)
+
+	l := new(Limiter).Init(ns, player, state, me.cfg, me.logger)
+	l.Start()
+
+	me.mtx.Lock()
+	me.limiters[ns] = l
+	me.mtx.Unlock()
+}
+
+// unlimit stops the limiter of the NetStream if any, and uncounts the player.
+func (me *LiveHandler) unlimit(ns *NetStream) {
+	me.mtx.Lock()
+	l, ok := me.limiters[ns]
+	delete(me.limiters, ns)
+	me.mtx.Unlock()
+
+	if ok {
+		l.Stop()
+		if l.state == STREAM_PLAYING && l.player != nil {
+			me.srv.removePlayer(l.player)
+		}
+	}
+}
+
+type record struct {
+	ns       *NetStream
+	recorder av.IMediaRecorder
+}
+
+func (me *LiveHandler) record(ns *NetStream, stream *Stream, name string, append bool) {
+	nc := ns.nc
+
+	if i := strings.IndexByte(name, '?'); i != -1 {
+		name = name[:i]
+	}
+
+	// Cleaning a rooted path drops any "..", so the file never escapes the root.
+	name = path.Clean("/" + name)
+	if !hasWriteAccess(nc.WriteAccess, name) {
+		me.logger.Warnf("Record no access: name=%s, access=%s", name, nc.WriteAccess)
+		ns.SendStatus(Level.ERROR, Code.NETSTREAM_RECORD_NOACCESS, "no write access")
+		return
+	}
+
+	root := filepath.Join(me.cfg.Root, nc.AppName, nc.InstName)
+	dir := filepath.Join(root, filepath.FromSlash(path.Dir(name)))
+	file := filepath.Join(dir, path.Base(name))
+
+	me.mtx.Lock()
+	if _, ok := me.records[file]; ok {
+		me.mtx.Unlock()
+		ns.SendStatus(Level.ERROR, Code.NETSTREAM_RECORD_ALREADYEXISTS, "record already exists")
+		return
+	}
+	r := &record{ns: ns}
+	me.records[file] = r
+	me.mtx.Unlock()
+
+	constraints := new(av.MediaRecorderConstraints)
+	constraints.Mode = av.ModeAll
+	constraints.Directory = dir
+	constraints.FileName = path.Base(name)
+	constraints.Append = append
+
+	r.recorder = stream.NewRecorder("FLV", constraints, me.factory)
+	r.recorder.AddEventListener(MediaRecorderEvent.START, me.recorderListener)
+	r.recorder.AddEventListener(MediaRecorderEvent.PAUSE, me.recorderListener)
+	r.recorder.AddEventListener(MediaRecorderEvent.RESUME, me.recorderListener)
+	r.recorder.AddEventListener(MediaRecorderEvent.STOP, me.recorderListener)
+
+	err := startRecorder(r.recorder, stream)
+	if err != nil {
+		me.logger.Errorf("Failed to record %s: %v", file, err)
+
+		me.mtx.Lock()
+		delete(me.records, file)
+		me.mtx.Unlock()
+
+		ns.SendStatus(Level.ERROR, Code.NETSTREAM_RECORD_FAILED, err.Error())
+		return
+	}
+
+	ns.SendStatus(Level.STATUS, Code.NETSTREAM_RECORD_START, "record start")
+}
+
+func (me *LiveHandler) stopRecording(ns *NetStream) {
+	var (
+		r *record
+	)
+
+	me.mtx.Lock()
+	for file, v := range me.records {
+		if v.ns == ns {
+			r = v
+			delete(me.records, file)
+			break
+		}
+	}
+	me.mtx.Unlock()
+
+	if r == nil || r.recorder == nil {
+		return
+	}
+
+	if r.recorder.ReadyState() != mediarecorder.StateInactive {
+		r.recorder.Stop()
+	}
+	ns.SendStatus(Level.STATUS, Code.NETSTREAM_RECORD_STOP, "record stop")
+}
+
+// startRecorder catches the panic of IMediaRecorder, such as failing to create the file.
+func startRecorder(recorder av.IMediaRecorder, stream *Stream) (err error) {
+	defer func() {
+		if v := recover(); v != nil {
+			err = fmt.Errorf("%v", v)
+		}
+	}()
+
+	recorder.Source(stream)
+	recorder.Start()
+
+	if recorder.ReadyState() != mediarecorder.StateRecording {
+		recorder.Stop()
+		return fmt.Errorf("recorder not started")
+	}
+	return nil
+}
+
+// hasWriteAccess checks the name against WriteAccess, a semicolon-delimited list of directories.
+func hasWriteAccess(access string, name string) bool {
+	for _, dir := range strings.Split(access, ";") {
+		dir = strings.TrimSpace(dir)
+		if dir == "" {
+			continue
+		}
+
+		dir = path.Clean("/" + dir)
+		if dir == "/" || name == dir || strings.HasPrefix(name, dir+"/") {
+			return true
+		}
+	}
+	return false
+}
+
 // NewInfoObject creates a rtmp info object.
 func NewInfoObject(level string, code string, description string) *amf.Value {
 	info := amf.NewValue(amf.OBJECT)
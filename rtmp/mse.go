@@ -0,0 +1,337 @@
+package rtmp
+
+import (
+	"encoding/json"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/gorilla/websocket"
+	"github.com/studease/common/av"
+	"github.com/studease/common/av/codec/aac"
+	"github.com/studease/common/av/codec/avc"
+	_ "github.com/studease/common/av/format/fmp4" // Register FMP4 remuxer.
+	"github.com/studease/common/events"
+	Event "github.com/studease/common/events/event"
+	MediaEvent "github.com/studease/common/events/mediaevent"
+	"github.com/studease/common/log"
+)
+
+// Static constants.
+const (
+	MSE_QUEUE_SIZE = 256  // messages queued for a client, before dropping
+	MSE_MAX_CACHED = 1024 // fragments cached since the latest keyframe
+)
+
+// mseDescriptor describes the SourceBuffers to create, sent in a text message before the init segments.
+// Each binary message starts with a byte of the buffer index, followed by an init segment or a fragment.
+type mseDescriptor struct {
+	Type        string      `json:"type"`
+	Interleaved bool        `json:"interleaved"`
+	Buffers     []mseBuffer `json:"buffers"`
+}
+
+type mseBuffer struct {
+	Kind     string     `json:"kind"`
+	MimeType string     `json:"mimeType"`
+	Tracks   []mseTrack `json:"tracks"`
+}
+
+type mseTrack struct {
+	Kind       string `json:"kind"`
+	Codec      string `json:"codec"`
+	Width      uint32 `json:"width,omitempty"`
+	Height     uint32 `json:"height,omitempty"`
+	SampleRate uint32 `json:"sampleRate,omitempty"`
+	Channels   uint32 `json:"channels,omitempty"`
+}
+
+type mseMessage struct {
+	typ  int
+	data []byte
+}
+
+// mseKey identifies an mseHub by the stream and the remuxer mode.
+type mseKey struct {
+	stream *Stream
+	mode   uint32
+}
+
+// mseHub shares an FMP4 remuxer among the clients playing a stream in the same mode.
+// It keeps the init segments, and the fragments since the latest keyframe for the clients starting from there.
+type mseHub struct {
+	key        mseKey
+	remuxer    av.IRemuxer
+	logger     log.ILogger
+	mtx        sync.Mutex
+	clients    map[*mseClient]bool
+	descriptor []byte
+	buffers    []string // kinds of the buffers, or script if interleaved
+	inits      map[string][]byte
+	cached     [][]byte
+	closed     bool
+
+	packetListener *events.EventListener
+	closeListener  *events.EventListener
+}
+
+// Init this class.
+func (me *mseHub) Init(key mseKey, remuxer av.IRemuxer, logger log.ILogger) *mseHub {
+	me.key = key
+	me.remuxer = remuxer
+	me.logger = logger
+	me.clients = make(map[*mseClient]bool)
+	me.descriptor = nil
+	me.buffers = nil
+	me.inits = make(map[string][]byte)
+	me.cached = nil
+	me.closed = false
+	me.packetListener = events.NewListener(me.onPacket, 0)
+	me.closeListener = events.NewListener(me.onClose, 0)
+
+	me.remuxer.AddEventListener(MediaEvent.PACKET, me.packetListener)
+	me.remuxer.AddEventListener(Event.CLOSE, me.closeListener)
+	return me
+}
+
+func (me *mseHub) onPacket(e *MediaEvent.MediaEvent) {
+	pkt := e.Packet
+
+	me.mtx.Lock()
+	defer me.mtx.Unlock()
+
+	if me.closed {
+		return
+	}
+
+	datatype, _ := pkt.Get("DataType").(byte)
+	switch {
+	case pkt.Kind == av.KindScript,
+		pkt.Kind == av.KindVideo && datatype == avc.SEQUENCE_HEADER, pkt.Kind == av.KindAudio && datatype == aac.SPECIFIC_CONFIG:
+		me.onInitSegment(pkt)
+		return
+	case pkt.Kind == av.KindVideo && (datatype == avc.NALU || datatype == avc.END_OF_SEQUENCE), pkt.Kind == av.KindAudio && datatype == aac.RAW_FRAME_DATA:
+	default:
+		return
+	}
+
+	index := me.index(pkt.Kind)
+	if index < 0 {
+		return
+	}
+
+	data := make([]byte, 1+len(pkt.Payload))
+	data[0] = byte(index)
+	copy(data[1:], pkt.Payload)
+
+	keyframe := me.keyframe(pkt)
+	if keyframe && pkt.Kind == av.KindVideo {
+		me.cached = me.cached[:0]
+	}
+	if len(me.cached) > 0 || keyframe && pkt.Kind == av.KindVideo {
+		if len(me.cached) < MSE_MAX_CACHED {
+			me.cached = append(me.cached, data)
+		} else {
+			me.cached = me.cached[:0]
+		}
+	}
+
+	for c := range me.clients {
+		c.fragment(data, keyframe)
+	}
+}
+
+// onInitSegment updates the descriptor, and sends it with the init segments to all of the clients.
+func (me *mseHub) onInitSegment(pkt *av.Packet) {
+	me.inits[pkt.Kind] = pkt.Payload
+	me.update()
+
+	for c := range me.clients {
+		me.start(c)
+	}
+}
+
+func (me *mseHub) update() {
+	tracks := me.remuxer.GetTracks()
+	info := me.remuxer.Information()
+	desc := &mseDescriptor{
+		Type:        "descriptor",
+		Interleaved: me.key.mode&av.ModeInterleaved != 0,
+	}
+
+	me.buffers = me.buffers[:0]
+	for _, kind := range []string{av.KindScript, av.KindVideo, av.KindAudio} {
+		if me.inits[kind] == nil || desc.Interleaved != (kind == av.KindScript) {
+			continue
+		}
+
+		buf := mseBuffer{Kind: kind, MimeType: "audio/mp4"}
+		codecs := make([]string, 0)
+		for _, track := range tracks {
+			if kind != av.KindScript && track.Kind() != kind {
+				continue
+			}
+
+			ctx := track.Source().Context()
+			t := mseTrack{Kind: track.Kind(), Codec: ctx.Codec}
+			switch track.Kind() {
+			case av.KindVideo:
+				buf.MimeType = "video/mp4"
+				t.Width = info.Width
+				t.Height = info.Height
+			case av.KindAudio:
+				t.SampleRate = info.SampleRate
+				t.Channels = info.Channels
+			}
+			buf.Tracks = append(buf.Tracks, t)
+			codecs = append(codecs, ctx.Codec)
+		}
+		buf.MimeType += "; codecs=\"" + strings.Join(codecs, ",") + "\""
+
+		desc.Buffers = append(desc.Buffers, buf)
+		me.buffers = append(me.buffers, kind)
+	}
+
+	data, err := json.Marshal(desc)
+	if err != nil {
+		me.logger.Errorf("Failed to marshal descriptor: %v", err)
+		return
+	}
+	me.descriptor = data
+}
+
+// index returns the buffer index of the kind, or -1 if the buffer is not initialized.
+func (me *mseHub) index(kind string) int {
+	for i, item := range me.buffers {
+		if item == av.KindScript || item == kind {
+			return i
+		}
+	}
+	return -1
+}
+
+// keyframe returns whether the fragment is a random access point of the hub.
+func (me *mseHub) keyframe(pkt *av.Packet) bool {
+	if pkt.Kind == av.KindVideo {
+		keyframe, _ := pkt.Get("Keyframe").(bool)
+		return keyframe
+	}
+	return len(me.remuxer.GetVideoTracks()) == 0
+}
+
+// start sends the descriptor and the init segments to the client.
+func (me *mseHub) start(c *mseClient) {
+	if me.descriptor == nil {
+		return
+	}
+	c.send(websocket.TextMessage, me.descriptor)
+	for i, kind := range me.buffers {
+		init := me.inits[kind]
+		data := make([]byte, 1+len(init))
+		data[0] = byte(i)
+		copy(data[1:], init)
+		c.send(websocket.BinaryMessage, data)
+	}
+}
+
+// add starts a client, from the latest keyframe if cached, or else the next one. It returns false if the hub is closed.
+func (me *mseHub) add(c *mseClient, latest bool) bool {
+	me.mtx.Lock()
+	defer me.mtx.Unlock()
+
+	if me.closed {
+		return false
+	}
+
+	me.clients[c] = true
+	me.start(c)
+	if latest && len(me.cached) > 0 {
+		for _, data := range me.cached {
+			c.send(websocket.BinaryMessage, data)
+		}
+		c.waiting = false
+	}
+	return true
+}
+
+// remove returns the number of the clients left.
+func (me *mseHub) remove(c *mseClient) int {
+	me.mtx.Lock()
+	defer me.mtx.Unlock()
+
+	delete(me.clients, c)
+	return len(me.clients)
+}
+
+func (me *mseHub) onClose(e *Event.Event) {
+	me.mtx.Lock()
+	defer me.mtx.Unlock()
+
+	me.closed = true
+	for c := range me.clients {
+		c.Close()
+	}
+}
+
+// Close detaches the remuxer.
+func (me *mseHub) Close() {
+	me.remuxer.Close()
+	me.remuxer.RemoveEventListener(MediaEvent.PACKET, me.packetListener)
+	me.remuxer.RemoveEventListener(Event.CLOSE, me.closeListener)
+}
+
+// mseClient queues the messages to a WebSocket. Fragments are dropped while the queue is full, until it's half empty at a keyframe.
+type mseClient struct {
+	queue    chan mseMessage
+	closed   chan struct{}
+	once     sync.Once
+	waiting  bool // for a keyframe to start, or to resume after dropping
+	dropping bool
+	dropped  uint32 // atomic, logged without the lock of the hub
+}
+
+// Init this class.
+func (me *mseClient) Init() *mseClient {
+	me.queue = make(chan mseMessage, MSE_QUEUE_SIZE)
+	me.closed = make(chan struct{})
+	me.waiting = true
+	me.dropping = false
+	atomic.StoreUint32(&me.dropped, 0)
+	return me
+}
+
+// send queues a message which is not to be dropped. The client is closed if it's too slow to queue.
+func (me *mseClient) send(typ int, data []byte) {
+	select {
+	case me.queue <- mseMessage{typ, data}:
+	default:
+		me.Close()
+	}
+}
+
+func (me *mseClient) fragment(data []byte, keyframe bool) {
+	if me.waiting || me.dropping {
+		if !keyframe || me.dropping && len(me.queue) > MSE_QUEUE_SIZE/2 {
+			if me.dropping {
+				atomic.AddUint32(&me.dropped, 1)
+			}
+			return
+		}
+		me.waiting = false
+		me.dropping = false
+	}
+
+	select {
+	case me.queue <- mseMessage{websocket.BinaryMessage, data}:
+	default:
+		me.dropping = true
+		atomic.AddUint32(&me.dropped, 1)
+	}
+}
+
+// Close stops the client.
+func (me *mseClient) Close() {
+	me.once.Do(func() {
+		close(me.closed)
+	})
+}
@@ -0,0 +1,266 @@
+package rtmp
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"io/ioutil"
+	"sync/atomic"
+	"testing"
+
+	"github.com/gorilla/websocket"
+	"github.com/studease/common/av"
+	"github.com/studease/common/av/format"
+	"github.com/studease/common/log"
+)
+
+var (
+	testAVCC = []byte{
+		0x01, 0x42, 0xC0, 0x1E, 0xFF, 0xE1, 0x00, 0x08, 0x67, 0x42, 0xC0, 0x1E, 0xDA, 0x05, 0x07, 0xE4,
+		0x01, 0x00, 0x04, 0x68, 0xCE, 0x38, 0x80,
+	}
+	testASC = []byte{0x12, 0x10}
+)
+
+func testFactory() log.ILoggerFactory {
+	return new(log.DefaultLoggerFactory).Init(0x0800, ioutil.Discard)
+}
+
+func flvTag(typ byte, timestamp uint32, body []byte) []byte {
+	tag := make([]byte, 11, 11+len(body)+4)
+	tag[0] = typ
+	tag[1] = byte(len(body) >> 16)
+	tag[2] = byte(len(body) >> 8)
+	tag[3] = byte(len(body))
+	tag[4] = byte(timestamp >> 16)
+	tag[5] = byte(timestamp >> 8)
+	tag[6] = byte(timestamp)
+	tag[7] = byte(timestamp >> 24)
+	tag = append(tag, body...)
+	size := make([]byte, 4)
+	binary.BigEndian.PutUint32(size, uint32(11+len(body)))
+	return append(tag, size...)
+}
+
+// testHeader returns the FLV header with the configs of AVC and AAC.
+func testHeader() []byte {
+	b := []byte{'F', 'L', 'V', 0x01, 0x05, 0, 0, 0, 0x09, 0, 0, 0, 0}
+	b = append(b, flvTag(9, 0, append([]byte{0x17, 0, 0, 0, 0}, testAVCC...))...)
+	return append(b, flvTag(8, 0, append([]byte{0xAF, 0}, testASC...))...)
+}
+
+// testTags returns the FLV tags of video and audio frames of 40ms from the frame index, with a keyframe every 25.
+func testTags(from int, n int) []byte {
+	var b []byte
+	for i := from; i < from+n; i++ {
+		nalu := make([]byte, 4+50)
+		binary.BigEndian.PutUint32(nalu, 50)
+		nalu[4] = 0x41
+		flag := byte(0x27)
+		if i%25 == 0 {
+			nalu[4] = 0x65
+			flag = 0x17
+		}
+		b = append(b, flvTag(9, uint32(i*40), append([]byte{flag, 1, 0, 0, 0}, nalu...))...)
+		b = append(b, flvTag(8, uint32(i*40), append([]byte{0xAF, 1}, make([]byte, 20)...))...)
+	}
+	return b
+}
+
+// testHub returns an mseHub of separate buffers, remuxing an FLV demuxer as the stream.
+func testHub(t *testing.T) (*mseHub, av.IDemuxer) {
+	demuxer, ok := format.New("FLV", av.ModeAll, testFactory()).(av.IDemuxer)
+	if !ok {
+		t.Fatalf("Demuxer FLV not registered")
+	}
+	remuxer := format.New("FMP4", av.ModeAll, testFactory())
+	if remuxer == nil {
+		t.Fatalf("Remuxer FMP4 not registered")
+	}
+
+	hub := new(mseHub).Init(mseKey{nil, av.ModeAll}, remuxer, testFactory().NewLogger("MSE"))
+	remuxer.Source(demuxer)
+	return hub, demuxer
+}
+
+// testDrain returns the messages queued for the client.
+func testDrain(c *mseClient) []mseMessage {
+	var (
+		messages []mseMessage
+	)
+
+	for {
+		select {
+		case m := <-c.queue:
+			messages = append(messages, m)
+		default:
+			return messages
+		}
+	}
+}
+
+// testStart checks that the messages start with the descriptor of video and audio buffers, followed by their init segments,
+// and returns the rest.
+func testStart(t *testing.T, messages []mseMessage) []mseMessage {
+	if len(messages) < 3 || messages[0].typ != websocket.TextMessage {
+		t.Fatalf("Expected a descriptor and 2 init segments, got %d messages", len(messages))
+	}
+
+	var desc mseDescriptor
+	err := json.Unmarshal(messages[0].data, &desc)
+	if err != nil {
+		t.Fatalf("Failed to unmarshal descriptor: %v", err)
+	}
+	if desc.Type != "descriptor" || desc.Interleaved || len(desc.Buffers) != 2 || desc.Buffers[0].Kind != av.KindVideo || desc.Buffers[1].Kind != av.KindAudio {
+		t.Fatalf("Unexpected descriptor %s", messages[0].data)
+	}
+	for i, m := range messages[1:3] {
+		if m.typ != websocket.BinaryMessage || m.data[0] != byte(i) || string(m.data[5:9]) != "ftyp" {
+			t.Fatalf("Unexpected init segment %d", i)
+		}
+	}
+	return messages[3:]
+}
+
+// TestMSEDescriptor sends the descriptor and the init segments to the clients on start, and again on a new init segment.
+func TestMSEDescriptor(t *testing.T) {
+	hub, demuxer := testHub(t)
+	defer hub.Close()
+
+	c := new(mseClient).Init()
+	if !hub.add(c, false) {
+		t.Fatalf("Hub closed")
+	}
+	demuxer.Append(testHeader())
+	demuxer.Append(testTags(0, 10))
+
+	// The video init segment comes first, with the descriptor of the video buffer only.
+	messages := testDrain(c)
+	if len(messages) < 2 || messages[0].typ != websocket.TextMessage || string(messages[0].data) == string(hub.descriptor) {
+		t.Fatalf("Expected the descriptor of the video buffer first")
+	}
+	if fragments := testStart(t, messages[2:]); len(fragments) != 20 {
+		t.Fatalf("Expected 20 fragments, got %d", len(fragments))
+	}
+
+	// A new AVC config is sent with the descriptor and the init segments again, while a late client gets them at once.
+	late := new(mseClient).Init()
+	hub.add(late, false)
+	if fragments := testStart(t, testDrain(late)); len(fragments) != 0 {
+		t.Fatalf("Expected no fragments, got %d", len(fragments))
+	}
+
+	avcc := append([]byte{}, testAVCC...)
+	avcc[3] = 0x1F
+	demuxer.Append(flvTag(9, 400, append([]byte{0x17, 0, 0, 0, 0}, avcc...)))
+
+	for _, client := range []*mseClient{c, late} {
+		if fragments := testStart(t, testDrain(client)); len(fragments) != 0 {
+			t.Fatalf("Expected no fragments, got %d", len(fragments))
+		}
+	}
+}
+
+// TestMSELatest starts a client with start=latest from the cached keyframe, and the others from the next keyframe.
+func TestMSELatest(t *testing.T) {
+	hub, demuxer := testHub(t)
+	defer hub.Close()
+
+	demuxer.Append(testHeader())
+	demuxer.Append(testTags(0, 30))
+	if len(hub.cached) != 10 || hub.cached[0][0] != 0 {
+		t.Fatalf("Expected 10 fragments cached since the video keyframe, got %d", len(hub.cached))
+	}
+
+	latest, next := new(mseClient).Init(), new(mseClient).Init()
+	hub.add(latest, true)
+	hub.add(next, false)
+
+	fragments := testStart(t, testDrain(latest))
+	if len(fragments) != 10 || latest.waiting {
+		t.Fatalf("Expected the 10 cached fragments, got %d", len(fragments))
+	}
+	for i, m := range fragments {
+		if string(m.data) != string(hub.cached[i]) {
+			t.Fatalf("Fragment %d differs from the cached", i)
+		}
+	}
+	if fragments = testStart(t, testDrain(next)); len(fragments) != 0 || !next.waiting {
+		t.Fatalf("Expected no fragments before the next keyframe, got %d", len(fragments))
+	}
+
+	// Until the next keyframe, the fragments go to the started client only. Then the cache restarts.
+	demuxer.Append(testTags(30, 21))
+	if n := len(testDrain(latest)); n != 42 {
+		t.Fatalf("Expected 42 fragments, got %d", n)
+	}
+	fragments = testDrain(next)
+	if len(fragments) != 2 || next.waiting || fragments[0].data[0] != 0 {
+		t.Fatalf("Expected 2 fragments from the keyframe, got %d", len(fragments))
+	}
+	if len(hub.cached) != 2 || string(hub.cached[0]) != string(fragments[0].data) {
+		t.Fatalf("Expected 2 fragments cached since the new keyframe, got %d", len(hub.cached))
+	}
+}
+
+// TestMSEClientDrop drops the fragments once the queue is full, and resumes at a keyframe once it's half empty.
+func TestMSEClientDrop(t *testing.T) {
+	c := new(mseClient).Init()
+
+	// Waiting for a keyframe to start.
+	c.fragment([]byte{0, 'P'}, false)
+	if len(c.queue) != 0 || atomic.LoadUint32(&c.dropped) != 0 {
+		t.Fatalf("Queued %d before a keyframe, dropped %d", len(c.queue), atomic.LoadUint32(&c.dropped))
+	}
+	c.fragment([]byte{0, 'I'}, true)
+	for len(c.queue) < MSE_QUEUE_SIZE {
+		c.fragment([]byte{0, 'P'}, false)
+	}
+
+	for i, item := range []struct {
+		drain    int
+		keyframe bool
+		queued   bool
+		dropped  uint32
+	}{
+		{0, false, false, 1}, // full
+		{0, true, false, 2},  // a keyframe while full
+		{MSE_QUEUE_SIZE / 2, false, false, 3},
+		{-1, true, false, 4}, // a keyframe while more than half
+		{1, true, true, 4},   // half empty
+		{0, false, true, 4},
+	} {
+		switch {
+		case item.drain > 0:
+			for j := 0; j < item.drain; j++ {
+				<-c.queue
+			}
+		case item.drain < 0:
+			<-c.queue
+			c.queue <- mseMessage{websocket.BinaryMessage, []byte{0, 'P'}}
+			c.queue <- mseMessage{websocket.BinaryMessage, []byte{0, 'P'}}
+		}
+
+		n := len(c.queue)
+		c.fragment([]byte{0, byte(i)}, item.keyframe)
+		if queued := len(c.queue) > n; queued != item.queued || atomic.LoadUint32(&c.dropped) != item.dropped {
+			t.Fatalf("%d: queued=%v, dropped=%d, expected %v, %d", i, queued, atomic.LoadUint32(&c.dropped), item.queued, item.dropped)
+		}
+	}
+
+	select {
+	case <-c.closed:
+		t.Fatalf("Closed by dropping fragments")
+	default:
+	}
+
+	// A message not to be dropped closes the client if the queue is full.
+	for len(c.queue) < MSE_QUEUE_SIZE {
+		c.send(websocket.BinaryMessage, []byte{0})
+	}
+	c.send(websocket.TextMessage, []byte("{}"))
+	select {
+	case <-c.closed:
+	default:
+		t.Fatalf("Not closed on a full queue")
+	}
+}
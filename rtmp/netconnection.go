@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"encoding/binary"
 	"fmt"
+	"io"
 	"net"
 	"net/http"
 	"net/url"
@@ -23,6 +24,7 @@ import (
 	EventType "github.com/studease/common/rtmp/message/eventtype"
 	"github.com/studease/common/rtmp/message/support"
 	"github.com/studease/common/target"
+	"github.com/studease/common/utils/bw"
 	basecfg "github.com/studease/common/utils/config"
 )
 
@@ -67,6 +69,7 @@ type NetConnection struct {
 	lastAckWindowSize uint32
 	message           *message.Message
 	messages          map[uint32]*message.Message
+	shapers           map[uint32]*bw.Writer // by stream ID
 	nearAckWindowSize uint32
 	neerBandwidth     uint32
 	nearChunkSize     int32
@@ -119,6 +122,7 @@ func (me *NetConnection) Init(conn net.Conn, srv *Server, logger log.ILogger, fa
 	me.farAckWindowSize = 2500000
 	me.farChunkSize = 128
 	me.headersOut = make(map[uint32]*message.Header)
+	me.shapers = make(map[uint32]*bw.Writer)
 	me.lastAckWindowSize = 0
 	me.messages = make(map[uint32]*message.Message)
 	me.nearChunkSize = 128
@@ -610,9 +614,10 @@ func (me *NetConnection) processCommandConnect(m *message.CommandMessage) error
 		return err
 	}
 
-	h, _ := me.srv.mux.Handler(me.URL)
+	// The handler is resolved once, so the connection keeps running on it even if the server reloads.
+	h := me.srv.Handler(me.URL)
 	if h != nil {
-		h.(IHandler).ServeRTMP(me)
+		h.ServeRTMP(me)
 	}
 
 	me.DispatchEvent(CommandEvent.New(CommandEvent.CONNECT, me, m))
@@ -972,6 +977,13 @@ func (me *NetConnection) sendBytes(csid uint32, typ byte, timestamp uint32, stre
 		n = len(data)
 	)
 
+	var w io.Writer = me.conn
+	me.mtx.RLock()
+	if s, ok := me.shapers[streamID]; ok {
+		w = s
+	}
+	me.mtx.RUnlock()
+
 	if me.ObjectEncoding == AMF3 {
 		switch typ {
 		case message.DATA:
@@ -1058,7 +1070,7 @@ func (me *NetConnection) sendBytes(csid uint32, typ byte, timestamp uint32, stre
 		}
 
 		// Write Chunk
-		x, err = me.conn.Write(b.Bytes())
+		x, err = w.Write(b.Bytes())
 		if err != nil {
 			return i, err
 		}
@@ -1073,6 +1085,21 @@ func (me *NetConnection) sendBytes(csid uint32, typ byte, timestamp uint32, stre
 	return i, nil
 }
 
+// Shape sends outbound messages of the stream through the bandwidth limited writer, or directly to the connection if w is nil.
+// Messages of other streams are not affected.
+func (me *NetConnection) Shape(streamID uint32, w *bw.Writer) {
+	me.mtx.Lock()
+	defer me.mtx.Unlock()
+
+	if w == nil {
+		delete(me.shapers, streamID)
+		return
+	}
+
+	w.Attach(me.conn)
+	me.shapers[streamID] = w
+}
+
 // Close the connection that was opened locally or to the server and dispatches a netStatus event with a code property of NetConnection.Connect.Closed
 func (me *NetConnection) Close() {
 	switch atomic.LoadUint32(&me.readyState) {
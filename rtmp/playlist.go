@@ -0,0 +1,178 @@
+package rtmp
+
+import (
+	"sync"
+	"sync/atomic"
+
+	"github.com/studease/common/av"
+	"github.com/studease/common/av/format/flv"
+	"github.com/studease/common/events"
+	Event "github.com/studease/common/events/event"
+	MediaEvent "github.com/studease/common/events/mediaevent"
+	"github.com/studease/common/log"
+	rtmpcfg "github.com/studease/common/rtmp/config"
+	"github.com/studease/common/rtmp/message"
+)
+
+// PlaylistItem is a live stream or recorded file, played in a window.
+type PlaylistItem struct {
+	Name     string
+	Start    float64 // seconds, -2 for live or recorded, -1 for live only
+	Duration float64 // seconds, -1 to the end
+}
+
+// Playlist is a server-side sequence of items, played as one continuous stream.
+type Playlist struct {
+	mtx   sync.RWMutex
+	name  string
+	loop  bool
+	items []PlaylistItem
+}
+
+// Init this class.
+func (me *Playlist) Init(name string, loop bool) *Playlist {
+	me.name = name
+	me.loop = loop
+	me.items = nil
+	return me
+}
+
+// NewPlaylist creates a Playlist from the config.
+func NewPlaylist(cfg *rtmpcfg.Playlist) *Playlist {
+	pl := new(Playlist).Init(cfg.Name, cfg.Loop)
+	for _, item := range cfg.Items {
+		duration := item.Duration
+		if duration <= 0 {
+			duration = -1
+		}
+		pl.Add(PlaylistItem{Name: item.Stream, Start: item.Start, Duration: duration})
+	}
+	return pl
+}
+
+// Name returns name of this Playlist.
+func (me *Playlist) Name() string {
+	return me.name
+}
+
+// Loop returns whether this Playlist restarts after the last item.
+func (me *Playlist) Loop() bool {
+	return me.loop
+}
+
+// Add appends an item.
+func (me *Playlist) Add(item PlaylistItem) {
+	me.mtx.Lock()
+	defer me.mtx.Unlock()
+
+	me.items = append(me.items, item)
+}
+
+// Remove deletes the item at the index.
+func (me *Playlist) Remove(i int) {
+	me.mtx.Lock()
+	defer me.mtx.Unlock()
+
+	if i >= 0 && i < len(me.items) {
+		me.items = append(me.items[:i], me.items[i+1:]...)
+	}
+}
+
+// Clear deletes all of the items.
+func (me *Playlist) Clear() {
+	me.mtx.Lock()
+	defer me.mtx.Unlock()
+
+	me.items = nil
+}
+
+// Items returns a copy of the items.
+func (me *Playlist) Items() []PlaylistItem {
+	me.mtx.RLock()
+	defer me.mtx.RUnlock()
+
+	items := make([]PlaylistItem, len(me.items))
+	copy(items, me.items)
+	return items
+}
+
+// liveSource receives tags of a live Stream through the FLV remuxer.
+type liveSource struct {
+	remuxer  *flv.FLV
+	logger   log.ILogger
+	samples  chan *VODSample
+	closed   chan struct{}
+	once     sync.Once
+	dropping uint32
+
+	packetListener *events.EventListener
+	closeListener  *events.EventListener
+}
+
+func (me *liveSource) init(stream *Stream, logger log.ILogger) *liveSource {
+	me.logger = logger
+	me.samples = make(chan *VODSample, 256)
+	me.closed = make(chan struct{})
+	me.packetListener = events.NewListener(me.onPacket, 0)
+	me.closeListener = events.NewListener(me.onClose, 0)
+
+	me.remuxer = new(flv.FLV)
+	me.remuxer.Init(av.ModeAll, logger)
+	me.remuxer.AddEventListener(MediaEvent.PACKET, me.packetListener)
+	me.remuxer.AddEventListener(Event.CLOSE, me.closeListener)
+	me.remuxer.Source(stream)
+	return me
+}
+
+func (me *liveSource) onPacket(e *MediaEvent.MediaEvent) {
+	tag := e.Packet
+	if len(tag.Payload) < 11+int(tag.Length) {
+		return
+	}
+
+	s := new(VODSample)
+	s.Type = tag.Payload[0]
+	s.Timestamp = tag.Timestamp
+	s.Data = tag.Payload[11 : 11+tag.Length]
+	switch s.Type {
+	case message.VIDEO:
+		s.Keyframe = len(s.Data) > 0 && s.Data[0]>>4 == flv.KEYFRAME
+	case message.AUDIO:
+		s.Keyframe = true
+	}
+
+	// Never block the publisher, the player is too slow if the buffer is full.
+	select {
+	case me.samples <- s:
+		atomic.StoreUint32(&me.dropping, 0)
+	default:
+		if atomic.CompareAndSwapUint32(&me.dropping, 0, 1) {
+			me.logger.Warnf("Playlist buffer full, dropping live samples")
+		}
+	}
+}
+
+func (me *liveSource) onClose(e *Event.Event) {
+	me.once.Do(func() {
+		close(me.closed)
+	})
+}
+
+func (me *liveSource) close() {
+	me.remuxer.RemoveEventListener(MediaEvent.PACKET, me.packetListener)
+	me.remuxer.RemoveEventListener(Event.CLOSE, me.closeListener)
+	me.remuxer.Close()
+	me.onClose(nil)
+}
+
+// isHeader returns true if the sample is metadata or sequence header.
+func isHeader(s *VODSample) bool {
+	switch s.Type {
+	case message.AUDIO:
+		return len(s.Data) > 1 && s.Data[0]&0xF0 == flv.AAC && s.Data[1] == 0
+	case message.VIDEO:
+		return len(s.Data) > 1 && s.Data[0]&0x0F == flv.AVC && s.Data[1] == 0
+	default:
+		return true
+	}
+}
@@ -0,0 +1,268 @@
+package rtmp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"sync/atomic"
+	"time"
+
+	"github.com/studease/common/av"
+	"github.com/studease/common/av/format"
+	_ "github.com/studease/common/av/format/flv" // Register FLV demuxer.
+	"github.com/studease/common/events"
+	ErrorEvent "github.com/studease/common/events/errorevent"
+	MediaStreamTrackEvent "github.com/studease/common/events/mediastreamtrackevent"
+	"github.com/studease/common/hls"
+	"github.com/studease/common/log"
+)
+
+// Static constants.
+const (
+	RELAY_MIN_BACKOFF = 1 * time.Second
+	RELAY_MAX_BACKOFF = 30 * time.Second
+	RELAY_IDLE_CHECK  = 5 * time.Second // interval of checking whether any player remains
+)
+
+// IPuller pulls a remote stream into the tracks of this IMediaStream, on a continuous timeline if run again.
+type IPuller interface {
+	av.IMediaStream
+	Run(ctx context.Context) error
+}
+
+// Relay pulls a remote HTTP-FLV or HLS stream, and publishes it into a local Stream, as if a publisher had connected.
+// It reconnects with backoff on EOF or an error, and stops when no players remain, or the server is closed.
+type Relay struct {
+	URL     string
+	srv     *Server
+	stream  *Stream
+	puller  IPuller
+	logger  log.ILogger
+	factory log.ILoggerFactory
+	cancel  context.CancelFunc
+	done    chan struct{}
+
+	addtrackListener    *events.EventListener
+	removetrackListener *events.EventListener
+}
+
+// Init this class. URLs ending with .m3u8 are pulled as HLS, and others as HTTP-FLV.
+func (me *Relay) Init(uri string, srv *Server, stream *Stream, logger log.ILogger, factory log.ILoggerFactory) *Relay {
+	me.URL = uri
+	me.srv = srv
+	me.stream = stream
+	me.logger = logger
+	me.factory = factory
+	me.done = make(chan struct{})
+	me.addtrackListener = events.NewListener(me.onAddTrack, 0)
+	me.removetrackListener = events.NewListener(me.onRemoveTrack, 0)
+
+	if u, err := url.Parse(uri); err == nil && path.Ext(u.Path) == ".m3u8" {
+		c := new(hls.Client).Init(uri, nil, factory)
+		c.Realtime = true
+		me.puller = c
+	} else {
+		me.puller = new(FLVPuller).Init(uri, factory)
+	}
+	return me
+}
+
+// Start publishes into the stream, and pulls in background. It fails if the stream is being published, or the server is closed.
+func (me *Relay) Start() error {
+	for {
+		state := atomic.LoadUint32(&me.stream.readyState)
+		if (state & STREAM_PUBLISHING) != 0 {
+			return fmt.Errorf("stream %s already published", me.stream.Name())
+		}
+		if atomic.CompareAndSwapUint32(&me.stream.readyState, state, state|STREAM_PUBLISHING) {
+			break
+		}
+	}
+	if !me.srv.addRelay(me) {
+		me.unpublish()
+		return fmt.Errorf("server closed")
+	}
+
+	for _, track := range me.puller.GetTracks() {
+		me.stream.AddTrack(track)
+	}
+	me.puller.AddEventListener(MediaStreamTrackEvent.ADDTRACK, me.addtrackListener)
+	me.puller.AddEventListener(MediaStreamTrackEvent.REMOVETRACK, me.removetrackListener)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	me.cancel = cancel
+
+	go me.watch(ctx)
+	go me.run(ctx)
+	return nil
+}
+
+func (me *Relay) run(ctx context.Context) {
+	defer close(me.done)
+	defer me.srv.removeRelay(me)
+	defer me.unpublish()
+
+	backoff := RELAY_MIN_BACKOFF
+	for {
+		start := time.Now()
+		err := me.puller.Run(ctx)
+		if ctx.Err() != nil {
+			me.logger.Debugf(4, "Relay %s stopped.", me.URL)
+			return
+		}
+
+		// Reset after pulling for a while, as the remote was available.
+		if time.Since(start) > RELAY_MAX_BACKOFF {
+			backoff = RELAY_MIN_BACKOFF
+		}
+		if err == nil {
+			err = io.EOF
+		}
+		me.logger.Warnf("Relay %s interrupted, reconnecting in %v: %v", me.URL, backoff, err)
+
+		timer := time.NewTimer(backoff)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			me.logger.Debugf(4, "Relay %s stopped.", me.URL)
+			return
+		}
+
+		if backoff *= 2; backoff > RELAY_MAX_BACKOFF {
+			backoff = RELAY_MAX_BACKOFF
+		}
+	}
+}
+
+// watch stops the relay when no players remain.
+func (me *Relay) watch(ctx context.Context) {
+	ticker := time.NewTicker(RELAY_IDLE_CHECK)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if me.srv.Players(me.stream) == 0 {
+				me.logger.Debugf(4, "Relay %s idle.", me.URL)
+				me.cancel()
+				return
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (me *Relay) unpublish() {
+	me.puller.RemoveEventListener(MediaStreamTrackEvent.ADDTRACK, me.addtrackListener)
+	me.puller.RemoveEventListener(MediaStreamTrackEvent.REMOVETRACK, me.removetrackListener)
+	for _, track := range me.puller.GetTracks() {
+		me.stream.RemoveTrack(track)
+	}
+
+	for {
+		state := atomic.LoadUint32(&me.stream.readyState)
+		if atomic.CompareAndSwapUint32(&me.stream.readyState, state, state&^STREAM_PUBLISHING) {
+			break
+		}
+	}
+}
+
+func (me *Relay) onAddTrack(e *MediaStreamTrackEvent.MediaStreamTrackEvent) {
+	me.stream.AddTrack(e.Track)
+}
+
+func (me *Relay) onRemoveTrack(e *MediaStreamTrackEvent.MediaStreamTrackEvent) {
+	me.stream.RemoveTrack(e.Track)
+}
+
+// Close stops the relay, and waits until the stream is unpublished.
+func (me *Relay) Close() {
+	if me.cancel != nil {
+		me.cancel()
+		<-me.done
+	}
+}
+
+// FLVPuller pulls a remote HTTP-FLV stream into the tracks of this IMediaStream.
+type FLVPuller struct {
+	format.Joiner
+
+	URL     string
+	Client  *http.Client
+	logger  log.ILogger
+	factory log.ILoggerFactory
+}
+
+// Init this class.
+func (me *FLVPuller) Init(uri string, factory log.ILoggerFactory) *FLVPuller {
+	me.Joiner.Init(factory.NewLogger("FLV"), factory)
+	me.URL = uri
+	me.Client = http.DefaultClient
+	me.logger = factory.NewLogger("FLV")
+	me.factory = factory
+	return me
+}
+
+// Run pulls the stream until EOF, an error, or ctx done. The timeline goes on from the last packet if run again.
+func (me *FLVPuller) Run(ctx context.Context) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, me.URL, nil)
+	if err != nil {
+		return err
+	}
+
+	res, err := me.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return errors.New(res.Status)
+	}
+
+	demuxer, ok := format.New("FLV", av.ModeAll, me.factory).(av.IDemuxer)
+	if !ok {
+		return fmt.Errorf("demuxer FLV not registered")
+	}
+	me.Attach(demuxer)
+	defer me.Detach(demuxer)
+	me.Break()
+
+	var failed error
+	errorListener := events.NewListener(func(e *ErrorEvent.ErrorEvent) {
+		failed = fmt.Errorf("%s: %v", e.Name, e.Message)
+	}, 0)
+	demuxer.AddEventListener(ErrorEvent.ERROR, errorListener)
+	defer demuxer.RemoveEventListener(ErrorEvent.ERROR, errorListener)
+
+	buf := make([]byte, format.ReadBufferSize)
+	for {
+		n, err := res.Body.Read(buf)
+		if n > 0 {
+			demuxer.Append(buf[:n])
+			if failed != nil {
+				return failed
+			}
+
+			e := me.Flush(ctx)
+			if e != nil {
+				return e
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			if e := ctx.Err(); e != nil {
+				return e
+			}
+			return err
+		}
+	}
+}
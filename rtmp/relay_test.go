@@ -0,0 +1,132 @@
+package rtmp
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/studease/common/events"
+	MediaEvent "github.com/studease/common/events/mediaevent"
+	MediaStreamTrackEvent "github.com/studease/common/events/mediastreamtrackevent"
+	rtmpcfg "github.com/studease/common/rtmp/config"
+)
+
+// testOrigin serves an FLV of 10 frames of each kind at /live/test.flv, and counts the requests.
+func testOrigin(requests *int32) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(requests, 1)
+		if r.URL.Path != "/live/test.flv" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "video/x-flv")
+		w.Write(append(testHeader(), testTags(0, 10)...))
+	}))
+}
+
+// TestFLVPullerRun pulls until EOF, and goes on from the last packet when run again, without repeating the configs.
+func TestFLVPullerRun(t *testing.T) {
+	var (
+		requests int32
+		configs  int
+		frames   = make(map[string][]uint32)
+	)
+
+	origin := testOrigin(&requests)
+	defer origin.Close()
+
+	puller := new(FLVPuller).Init(origin.URL+"/live/test.flv", testFactory())
+
+	packetListener := events.NewListener(func(e *MediaEvent.MediaEvent) {
+		if datatype, _ := e.Packet.Get("DataType").(byte); datatype == 0 {
+			configs++
+			return
+		}
+		frames[e.Packet.Kind] = append(frames[e.Packet.Kind], e.Packet.Timestamp)
+	}, 0)
+	puller.AddEventListener(MediaStreamTrackEvent.ADDTRACK, events.NewListener(func(e *MediaStreamTrackEvent.MediaStreamTrackEvent) {
+		e.Track.Source().AddEventListener(MediaEvent.PACKET, packetListener)
+	}, 0))
+
+	for i := 0; i < 2; i++ {
+		err := puller.Run(context.Background())
+		if err != nil {
+			t.Fatalf("Run %d: %v", i, err)
+		}
+	}
+	if requests != 2 || configs != 2 {
+		t.Fatalf("Expected 2 requests and 2 configs, got %d, %d", requests, configs)
+	}
+	for _, kind := range []string{"video", "audio"} {
+		if len(frames[kind]) != 20 {
+			t.Fatalf("Expected 20 %s frames, got %d", kind, len(frames[kind]))
+		}
+		for i, timestamp := range frames[kind] {
+			if timestamp != uint32(i*40) {
+				t.Fatalf("Expected %s frame %d at %d, got %d", kind, i, i*40, timestamp)
+			}
+		}
+	}
+
+	puller.URL = origin.URL + "/live/missing.flv"
+	if err := puller.Run(context.Background()); err == nil || err.Error() != "404 Not Found" {
+		t.Fatalf("Expected 404 Not Found, got %v", err)
+	}
+}
+
+// TestRelay reconnects on EOF, and is closed with the server, which unpublishes the stream.
+func TestRelay(t *testing.T) {
+	var (
+		requests int32
+	)
+
+	origin := testOrigin(&requests)
+	defer origin.Close()
+
+	cfg := new(rtmpcfg.Server)
+	cfg.Port = 19350 // registered, not listened on
+	srv := new(Server).Init(cfg, testFactory().NewLogger("RTMP"), testFactory())
+	stream := srv.GetStream("live", "_definst_", "test")
+
+	relay := new(Relay).Init(origin.URL+"/live/test.flv", srv, stream, testFactory().NewLogger("RELAY"), testFactory())
+	err := relay.Start()
+	if err != nil {
+		t.Fatalf("Failed to start: %v", err)
+	}
+
+	// Reconnected after the backoff.
+	for deadline := time.Now().Add(2 * RELAY_MIN_BACKOFF); atomic.LoadInt32(&requests) < 2; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("Not reconnected, %d request", atomic.LoadInt32(&requests))
+		}
+	}
+	if len(stream.GetTracks()) != 2 || srv.relays[stream] != relay {
+		t.Fatalf("Relay not publishing: tracks=%d", len(stream.GetTracks()))
+	}
+	if err = new(Relay).Init(origin.URL+"/live/test.flv", srv, stream, testFactory().NewLogger("RELAY"), testFactory()).Start(); err == nil {
+		t.Fatalf("Started on a published stream")
+	}
+
+	err = srv.Close()
+	if err != nil {
+		t.Fatalf("Failed to close: %v", err)
+	}
+	select {
+	case <-relay.done:
+	default:
+		t.Fatalf("Relay not closed with the server")
+	}
+	if atomic.LoadUint32(&stream.readyState)&STREAM_PUBLISHING != 0 || len(stream.GetTracks()) != 0 || len(srv.relays) != 0 {
+		t.Fatalf("Stream not unpublished: tracks=%d, relays=%d", len(stream.GetTracks()), len(srv.relays))
+	}
+
+	if err = new(Relay).Init(origin.URL+"/live/test.flv", srv, stream, testFactory().NewLogger("RELAY"), testFactory()).Start(); err == nil {
+		t.Fatalf("Started on a closed server")
+	}
+	if atomic.LoadUint32(&stream.readyState)&STREAM_PUBLISHING != 0 {
+		t.Fatalf("Stream left published by a relay not started")
+	}
+}
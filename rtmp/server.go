@@ -3,8 +3,12 @@ package rtmp
 import (
 	"fmt"
 	"net"
+	"net/url"
+	"os"
+	"os/signal"
 	"sync"
 	"sync/atomic"
+	"syscall"
 	"time"
 
 	Code "github.com/studease/common/events/netstatusevent/code"
@@ -39,19 +43,192 @@ type Server struct {
 	config       *rtmpcfg.Server
 	logger       log.ILogger
 	factory      log.ILoggerFactory
-	mux          utils.Mux
+	mux          *utils.Mux
 	mtx          sync.RWMutex
+	reloading    sync.Mutex
 	applications map[string]*Application
+	players      map[interface{}]int // by *Stream, or the file name of VOD
+	relays       map[*Stream]*Relay
+	listener     net.Listener
+	closed       bool
 }
 
 // Init this class.
 func (me *Server) Init(cfg *rtmpcfg.Server, logger log.ILogger, factory log.ILoggerFactory) *Server {
-	me.mux.Init()
 	me.config = cfg
 	me.logger = logger
 	me.factory = factory
 	me.applications = make(map[string]*Application)
+	me.players = make(map[interface{}]int)
+	me.relays = make(map[*Stream]*Relay)
+	setDefaults(cfg)
 
+	servers[me.config.Port] = me
+	return me
+}
+
+// ListenAndServe listens on the TCP network address and then calls Serve to handle incoming connections.
+// Accepted connections are configured to enable TCP keep-alives.
+func (me *Server) ListenAndServe() error {
+	cfg := me.Config()
+
+	mux, err := me.newMux(cfg)
+	if err != nil {
+		me.logger.Errorf("Failed to build locations: %v", err)
+		return err
+	}
+
+	me.mtx.Lock()
+	me.mux = mux
+	me.mtx.Unlock()
+
+	me.logger.Infof("Listening on port %d", cfg.Port)
+
+	l, err := net.Listen("tcp", fmt.Sprintf(":%d", cfg.Port))
+	if err != nil {
+		me.logger.Errorf("Failed to listen on port %d", cfg.Port)
+		return err
+	}
+
+	return me.Serve(new(utils.TCPKeepAliveListener).Init(l, time.Duration(cfg.MaxIdleTime)*time.Second))
+}
+
+// Reload swaps in the locations of the given config.
+// Connections already accepted keep running on their old handler, while new connections use the new one.
+// Listener settings, such as the port, can't be changed without restarting.
+// Server-side playlists set at runtime are kept, unless configured again.
+func (me *Server) Reload(cfg *rtmpcfg.Server) error {
+	me.reloading.Lock()
+	defer me.reloading.Unlock()
+
+	setDefaults(cfg)
+
+	if port := me.Config().Port; cfg.Port != port {
+		me.logger.Warnf("Port can't be changed while running, keeping %d", port)
+		cfg.Port = port
+	}
+
+	mux, err := me.newMux(cfg)
+	if err != nil {
+		me.logger.Errorf("Failed to reload locations: %v", err)
+		return err
+	}
+
+	me.mtx.Lock()
+	me.config = cfg
+	me.mux = mux
+	me.mtx.Unlock()
+
+	me.logger.Infof("Reloaded %d location[s] on port %d", len(cfg.Locations), cfg.Port)
+	return nil
+}
+
+// ReloadOnSignal calls Reload with the config returned by load, each time one of the signals arrives.
+// If no signal is given, SIGHUP is used. It returns a function which stops watching.
+func (me *Server) ReloadOnSignal(load func() (*rtmpcfg.Server, error), signals ...os.Signal) func() {
+	if len(signals) == 0 {
+		signals = []os.Signal{syscall.SIGHUP}
+	}
+
+	c := make(chan os.Signal, 1)
+	done := make(chan struct{})
+	signal.Notify(c, signals...)
+
+	go func() {
+		for {
+			select {
+			case sig := <-c:
+				me.logger.Infof("Reloading on signal %v", sig)
+
+				cfg, err := load()
+				if err != nil {
+					me.logger.Errorf("Failed to load config: %v", err)
+					continue
+				}
+
+				me.Reload(cfg)
+
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	return func() {
+		signal.Stop(c)
+		close(done)
+	}
+}
+
+// Config returns the config currently in use.
+func (me *Server) Config() *rtmpcfg.Server {
+	me.mtx.RLock()
+	defer me.mtx.RUnlock()
+
+	return me.config
+}
+
+// Handler returns the handler matching the given url, from the locations currently in use.
+func (me *Server) Handler(u *url.URL) IHandler {
+	me.mtx.RLock()
+	mux := me.mux
+	me.mtx.RUnlock()
+
+	if mux == nil {
+		return nil
+	}
+
+	h, _ := mux.Handler(u)
+	if h == nil {
+		return nil
+	}
+	return h.(IHandler)
+}
+
+// newMux creates handlers of all the locations, without touching the one in use.
+func (me *Server) newMux(cfg *rtmpcfg.Server) (*utils.Mux, error) {
+	me.mtx.RLock()
+	cur := me.mux
+	me.mtx.RUnlock()
+
+	mux := new(utils.Mux).Init()
+	patterns := make(map[string]bool)
+
+	for i := range cfg.Locations {
+		loc := &cfg.Locations[i]
+		if loc.Pattern == "" {
+			loc.Pattern = "/"
+		}
+		if loc.Handler == "" {
+			loc.Handler = "rtmp-live"
+		}
+		if patterns[loc.Pattern] {
+			return nil, fmt.Errorf("multiple locations for %s", loc.Pattern)
+		}
+
+		h := NewHandler(me, loc, me.factory)
+		if h == nil {
+			me.logger.Warnf("Handler \"%s\" not registered", loc.Handler)
+			continue
+		}
+
+		// Of the same location before reloading.
+		if vod, ok := h.(*VODHandler); ok && cur != nil {
+			if old, pattern := cur.Handler(&url.URL{Path: loc.Pattern}); pattern == loc.Pattern {
+				if old, ok := old.(*VODHandler); ok {
+					vod.inherit(old)
+				}
+			}
+		}
+
+		patterns[loc.Pattern] = true
+		mux.Handle(loc.Pattern, h)
+	}
+
+	return mux, nil
+}
+
+func setDefaults(cfg *rtmpcfg.Server) {
 	if cfg.Port == 0 {
 		cfg.Port = DEFAULT_PORT
 	}
@@ -79,46 +256,21 @@ func (me *Server) Init(cfg *rtmpcfg.Server, logger log.ILogger, factory log.ILog
 	if cfg.ChunkSize < 128 || cfg.ChunkSize > 65536 {
 		cfg.ChunkSize = DEFAULT_CHUNK_SIZE
 	}
-
-	servers[me.config.Port] = me
-	return me
-}
-
-// ListenAndServe listens on the TCP network address and then calls Serve to handle incoming connections.
-// Accepted connections are configured to enable TCP keep-alives.
-func (me *Server) ListenAndServe() error {
-	for i, loc := range me.config.Locations {
-		if loc.Pattern == "" {
-			loc.Pattern = "/"
-		}
-		if loc.Handler == "" {
-			loc.Handler = "rtmp-live"
-		}
-
-		h := NewHandler(me, &me.config.Locations[i], me.factory)
-		if h == nil {
-			me.logger.Warnf("Handler \"%s\" not registered", loc.Handler)
-			continue
+	for i := range cfg.Locations {
+		if loc := &cfg.Locations[i]; loc.Root == "" {
+			loc.Root = cfg.Root
 		}
-
-		me.mux.Handle(loc.Pattern, h)
 	}
-
-	me.logger.Infof("Listening on port %d", me.config.Port)
-
-	l, err := net.Listen("tcp", fmt.Sprintf(":%d", me.config.Port))
-	if err != nil {
-		me.logger.Errorf("Failed to listen on port %d", me.config.Port)
-		return err
-	}
-
-	return me.Serve(new(utils.TCPKeepAliveListener).Init(l, time.Duration(me.config.MaxIdleTime)*time.Second))
 }
 
 // Serve accepts incoming connections on the Listener l, creating a new service goroutine for each.
 func (me *Server) Serve(l net.Listener) error {
 	defer l.Close()
 
+	me.mtx.Lock()
+	me.listener = l
+	me.mtx.Unlock()
+
 	d := 5 * time.Millisecond // How long to sleep on accept failure
 	m := 1 * time.Second
 
@@ -194,6 +346,82 @@ func (me *Server) FindStream(appName string, instName string, name string) *Stre
 	return nil
 }
 
+// addPlayer counts a player of the stream or file, returns false if max players (> 0) reached.
+func (me *Server) addPlayer(key interface{}, max int) bool {
+	me.mtx.Lock()
+	defer me.mtx.Unlock()
+
+	n := me.players[key]
+	if max > 0 && n >= max {
+		return false
+	}
+
+	me.players[key] = n + 1
+	return true
+}
+
+// removePlayer uncounts a player of the stream or file.
+func (me *Server) removePlayer(key interface{}) {
+	me.mtx.Lock()
+	defer me.mtx.Unlock()
+
+	if n := me.players[key] - 1; n > 0 {
+		me.players[key] = n
+	} else {
+		delete(me.players, key)
+	}
+}
+
+// Players returns the number of players of the stream.
+func (me *Server) Players(stream *Stream) int {
+	me.mtx.RLock()
+	defer me.mtx.RUnlock()
+
+	return me.players[stream]
+}
+
+// addRelay registers the relay of the stream, returns false if the server is closed.
+func (me *Server) addRelay(relay *Relay) bool {
+	me.mtx.Lock()
+	defer me.mtx.Unlock()
+
+	if me.closed {
+		return false
+	}
+
+	me.relays[relay.stream] = relay
+	return true
+}
+
+// removeRelay unregisters the relay, unless replaced.
+func (me *Server) removeRelay(relay *Relay) {
+	me.mtx.Lock()
+	defer me.mtx.Unlock()
+
+	if me.relays[relay.stream] == relay {
+		delete(me.relays, relay.stream)
+	}
+}
+
+// Close stops accepting connections, and closes the relays.
+func (me *Server) Close() error {
+	me.mtx.Lock()
+	me.closed = true
+	l := me.listener
+	relays := me.relays
+	me.listener = nil
+	me.relays = make(map[*Stream]*Relay)
+	me.mtx.Unlock()
+
+	for _, relay := range relays {
+		relay.Close()
+	}
+	if l != nil {
+		return l.Close()
+	}
+	return nil
+}
+
 // GetServer returns the server listening on the port.
 func GetServer(port int) *Server {
 	return servers[port]
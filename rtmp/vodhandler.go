@@ -0,0 +1,349 @@
+package rtmp
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+
+	"github.com/studease/common/av/utils/amf"
+	"github.com/studease/common/events"
+	CommandEvent "github.com/studease/common/events/commandevent"
+	Code "github.com/studease/common/events/netstatusevent/code"
+	Level "github.com/studease/common/events/netstatusevent/level"
+	"github.com/studease/common/log"
+	rtmpcfg "github.com/studease/common/rtmp/config"
+	EventType "github.com/studease/common/rtmp/message/eventtype"
+)
+
+func init() {
+	Register("rtmp-vod", VODHandler{})
+}
+
+// VODHandler provides video on demand service of the recorded FLV and MP4 files under root of the location,
+// and server-side playlists mixing live streams and recorded files.
+type VODHandler struct {
+	LiveHandler
+
+	players   map[*NetStream]*VODPlayer
+	playlists map[string]*Playlist
+	added     map[string]bool // names of the playlists set at runtime
+
+	play2Listener *events.EventListener
+}
+
+// Init this class.
+func (me *VODHandler) Init(srv *Server, cfg *rtmpcfg.Location, logger log.ILogger, factory log.ILoggerFactory) IHandler {
+	me.LiveHandler.Init(srv, cfg, logger, factory)
+	me.players = make(map[*NetStream]*VODPlayer)
+	me.playlists = make(map[string]*Playlist)
+	me.added = make(map[string]bool)
+	for i := range cfg.Playlists {
+		pl := NewPlaylist(&cfg.Playlists[i])
+		me.playlists[pl.Name()] = pl
+	}
+
+	// Replace the NetStream listeners, connection level ones are shared with LiveHandler.
+	me.publishListener = events.NewListener(me.onPublish, 0)
+	me.playListener = events.NewListener(me.onPlay, 0)
+	me.play2Listener = events.NewListener(me.onPlay2, 0)
+	me.seekListener = events.NewListener(me.onSeek, 0)
+	me.pauseListener = events.NewListener(me.onPause, 0)
+	me.closeStreamListener = events.NewListener(me.onCloseStream, 0)
+	return me
+}
+
+// Playlist returns the server-side playlist by name, or nil if not exists.
+func (me *VODHandler) Playlist(name string) *Playlist {
+	me.mtx.Lock()
+	defer me.mtx.Unlock()
+
+	return me.playlists[name]
+}
+
+// SetPlaylist adds or replaces a server-side playlist, which takes effect on the next play.
+func (me *VODHandler) SetPlaylist(pl *Playlist) {
+	me.mtx.Lock()
+	defer me.mtx.Unlock()
+
+	me.playlists[pl.Name()] = pl
+	me.added[pl.Name()] = true
+}
+
+// DeletePlaylist removes a server-side playlist.
+func (me *VODHandler) DeletePlaylist(name string) {
+	me.mtx.Lock()
+	defer me.mtx.Unlock()
+
+	delete(me.playlists, name)
+	delete(me.added, name)
+}
+
+// inherit keeps the playlists set at runtime on the handler replaced by reloading, unless configured again.
+func (me *VODHandler) inherit(old *VODHandler) {
+	old.mtx.Lock()
+	arr := make([]*Playlist, 0, len(old.added))
+	for name := range old.added {
+		arr = append(arr, old.playlists[name])
+	}
+	old.mtx.Unlock()
+
+	me.mtx.Lock()
+	defer me.mtx.Unlock()
+
+	for _, pl := range arr {
+		if _, ok := me.playlists[pl.Name()]; !ok {
+			me.playlists[pl.Name()] = pl
+			me.added[pl.Name()] = true
+		}
+	}
+}
+
+func (me *VODHandler) onPublish(e *CommandEvent.CommandEvent) {
+	ns := e.Target.(*NetStream)
+
+	ns.SendStatus(Level.ERROR, Code.NETSTREAM_PUBLISH_DENIED, "publish not allowed")
+	ns.Close()
+}
+
+func (me *VODHandler) onPlay(e *CommandEvent.CommandEvent) {
+	ns := e.Target.(*NetStream)
+	nc := ns.nc
+	m := e.Message
+
+	item := &PlaylistItem{Name: m.StreamName, Start: m.Start, Duration: m.Duration}
+
+	// Queue the item if not reset.
+	if p := me.getPlayer(ns); p != nil && !m.Reset {
+		p.Queue(item)
+		return
+	}
+
+	if url := &me.cfg.OnPlay; url.Enable {
+		err := ns.sendNotification(url, "play")
+		if err != nil {
+			me.logger.Errorf("Failed to send \"play\" notification: %v", err)
+			ns.SendStatus(Level.ERROR, Code.NETSTREAM_PLAY_FAILED, err.Error())
+			ns.Close()
+			return
+		}
+	}
+
+	me.stopPlayer(ns)
+
+	p := new(VODPlayer).Init(ns, me, me.logger)
+
+	var err error
+	if pl := me.Playlist(strings.SplitN(m.StreamName, "?", 2)[0]); pl != nil {
+		err = p.Load(pl)
+	} else {
+		err = p.Load(nil, item)
+	}
+	if err != nil {
+		me.logger.Warnf("Failed to play %s: %v", m.StreamName, err)
+		if os.IsNotExist(err) {
+			ns.SendStatus(Level.ERROR, Code.NETSTREAM_PLAY_STREAMNOTFOUND, "stream not found")
+		} else {
+			ns.SendStatus(Level.ERROR, Code.NETSTREAM_PLAY_FILESTRUCTUREINVALID, "file structure invalid")
+		}
+		return
+	}
+
+	// Counted by the file, which a server-side playlist of the same name takes the place of.
+	player := me.resolve(nc, m.StreamName)
+	if !me.srv.addPlayer(player, me.cfg.MaxPlayers) {
+		me.logger.Infof("Max players reached: stream=%s, max=%d", m.StreamName, me.cfg.MaxPlayers)
+		p.Stop()
+		ns.SendStatus(Level.ERROR, Code.NETSTREAM_PLAY_FAILED, "max players reached")
+		ns.Close()
+		return
+	}
+	me.limit(ns, player, STREAM_PLAYING)
+
+	err = nc.SendUserControl(EventType.STREAM_IS_RECORDED, ns.id, 0, 0)
+	if err == nil {
+		err = nc.SendUserControl(EventType.STREAM_BEGIN, ns.id, 0, 0)
+	}
+	if err != nil {
+		me.logger.Errorf("Failed to send user control: stream=%d", ns.id)
+		p.Stop()
+		nc.Close()
+		return
+	}
+
+	if m.Reset {
+		err = ns.SendStatus(Level.STATUS, Code.NETSTREAM_PLAY_RESET, "play reset")
+		if err != nil {
+			me.logger.Errorf("Failed to send status: %s", Code.NETSTREAM_PLAY_RESET)
+			p.Stop()
+			nc.Close()
+			return
+		}
+	}
+
+	err = ns.SendStatus(Level.STATUS, Code.NETSTREAM_PLAY_START, "play start")
+	if err != nil {
+		me.logger.Errorf("Failed to send status: %s", Code.NETSTREAM_PLAY_START)
+		p.Stop()
+		nc.Close()
+		return
+	}
+
+	me.mtx.Lock()
+	me.players[ns] = p
+	me.mtx.Unlock()
+
+	atomic.StoreUint32(&ns.readyState, STREAM_PLAYING)
+
+	ns.AddEventListener(CommandEvent.PLAY2, me.play2Listener)
+	ns.AddEventListener(CommandEvent.SEEK, me.seekListener)
+	ns.AddEventListener(CommandEvent.PAUSE, me.pauseListener)
+
+	go p.Run()
+}
+
+func (me *VODHandler) onPlay2(e *CommandEvent.CommandEvent) {
+	ns := e.Target.(*NetStream)
+	args := &e.Message.Arguments
+
+	p := me.getPlayer(ns)
+	if p == nil {
+		ns.SendStatus(Level.ERROR, Code.NETSTREAM_PLAY_FAILED, "not playing")
+		return
+	}
+
+	if args.Type != amf.OBJECT && args.Type != amf.ECMA_ARRAY {
+		ns.SendStatus(Level.ERROR, Code.NETSTREAM_PLAY_FAILED, "bad arguments")
+		return
+	}
+
+	item := &PlaylistItem{Start: -2, Duration: -1}
+	transition := "switch"
+
+	if v := args.Get("streamName"); v != nil {
+		item.Name, _ = v.Raw().(string)
+	}
+	if v := args.Get("start"); v != nil && v.Type == amf.DOUBLE {
+		item.Start = v.Double()
+	}
+	if v := args.Get("len"); v != nil && v.Type == amf.DOUBLE {
+		item.Duration = v.Double()
+	}
+	if v := args.Get("transition"); v != nil && v.Type == amf.STRING {
+		transition = v.String()
+	}
+
+	me.logger.Debugf(4, "play2: stream=%d, name=%s, transition=%s", ns.id, item.Name, transition)
+
+	switch transition {
+	case "append", "appendAndWait":
+		p.Queue(item)
+	case "reset":
+		p.Switch(item, true)
+	case "stop":
+		p.Switch(nil, false)
+	default: // "switch", "swap"
+		p.Switch(item, false)
+	}
+}
+
+// open returns a VODIndex for recorded file, or a liveSource for live stream.
+func (me *VODHandler) open(nc *NetConnection, item *PlaylistItem) (*VODIndex, *liveSource, error) {
+	if item.Start >= 0 {
+		index, err := OpenVODIndex(me.resolve(nc, item.Name))
+		return index, nil, err
+	}
+
+	// Live or recorded, the live stream is preferred if being published.
+	if item.Start != -1 {
+		stream := me.srv.FindStream(nc.AppName, nc.InstName, item.Name)
+		if stream != nil {
+			return nil, new(liveSource).init(stream, me.logger), nil
+		}
+
+		index, err := OpenVODIndex(me.resolve(nc, item.Name))
+		return index, nil, err
+	}
+
+	stream := me.srv.GetStream(nc.AppName, nc.InstName, item.Name)
+	if stream == nil {
+		return nil, nil, fmt.Errorf("failed to get stream")
+	}
+	return nil, new(liveSource).init(stream, me.logger), nil
+}
+
+// resolve maps the stream name to a file under root, e.g. "mp4:dir/sample.mp4", "sample".
+func (me *VODHandler) resolve(nc *NetConnection, name string) string {
+	if i := strings.IndexByte(name, '?'); i != -1 {
+		name = name[:i]
+	}
+
+	ext := ".flv"
+	if i := strings.IndexByte(name, ':'); i != -1 {
+		ext = "." + strings.ToLower(name[:i])
+		name = name[i+1:]
+	}
+
+	// Cleaning a rooted path drops any "..", so the file never escapes the root.
+	name = path.Clean("/" + name)
+	if path.Ext(name) == "" {
+		name += ext
+	}
+
+	return filepath.Join(me.cfg.Root, nc.AppName, nc.InstName, filepath.FromSlash(name))
+}
+
+func (me *VODHandler) onSeek(e *CommandEvent.CommandEvent) {
+	ns := e.Target.(*NetStream)
+	m := e.Message
+
+	p := me.getPlayer(ns)
+	if p == nil {
+		me.LiveHandler.onSeek(e)
+		return
+	}
+
+	p.Seek(uint32(m.MilliSeconds))
+}
+
+func (me *VODHandler) onPause(e *CommandEvent.CommandEvent) {
+	ns := e.Target.(*NetStream)
+	m := e.Message
+
+	p := me.getPlayer(ns)
+	if p == nil {
+		me.LiveHandler.onPause(e)
+		return
+	}
+
+	ns.pause = m.Flag
+	ns.time = m.MilliSeconds
+	p.Pause(m.Flag, uint32(m.MilliSeconds))
+}
+
+func (me *VODHandler) onCloseStream(e *CommandEvent.CommandEvent) {
+	ns := e.Target.(*NetStream)
+
+	me.stopPlayer(ns)
+	me.LiveHandler.onCloseStream(e)
+}
+
+func (me *VODHandler) getPlayer(ns *NetStream) *VODPlayer {
+	me.mtx.Lock()
+	defer me.mtx.Unlock()
+
+	return me.players[ns]
+}
+
+func (me *VODHandler) stopPlayer(ns *NetStream) {
+	me.mtx.Lock()
+	p, ok := me.players[ns]
+	delete(me.players, ns)
+	me.mtx.Unlock()
+
+	if ok {
+		p.Stop()
+	}
+}
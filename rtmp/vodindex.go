@@ -0,0 +1,502 @@
+package rtmp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/studease/common/av/format/flv"
+	"github.com/studease/common/av/utils/amf"
+	"github.com/studease/common/av/utils/box"
+	"github.com/studease/common/rtmp/message"
+)
+
+// VODSample is a media message of a recorded file, which could be read on demand.
+type VODSample struct {
+	Type      byte // message.AUDIO, message.VIDEO or message.DATA
+	Timestamp uint32
+	Keyframe  bool
+	Offset    int64
+	Size      int
+	Prefix    []byte // FLV tag header of audio/video data, for MP4 samples
+	Data      []byte // Preloaded payload, e.g. metadata or sequence headers
+}
+
+// VODIndex holds the samples of a recorded FLV or MP4 file, sorted by timestamp.
+type VODIndex struct {
+	file     *os.File
+	Duration uint32 // ms
+	Headers  []*VODSample
+	Samples  []*VODSample
+	hasVideo bool
+}
+
+// OpenVODIndex opens the file and indexes its samples.
+func OpenVODIndex(name string) (*VODIndex, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+
+	me := &VODIndex{file: f}
+
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".mp4", ".m4v", ".m4a", ".mov", ".f4v":
+		err = me.parseMP4()
+	default:
+		err = me.parseFLV()
+	}
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	sort.SliceStable(me.Samples, func(i, j int) bool {
+		return me.Samples[i].Timestamp < me.Samples[j].Timestamp
+	})
+	if n := len(me.Samples); n > 0 && me.Samples[n-1].Timestamp > me.Duration {
+		me.Duration = me.Samples[n-1].Timestamp
+	}
+	return me, nil
+}
+
+// Seek returns index of the nearest keyframe at or before the time, in ms.
+func (me *VODIndex) Seek(ms uint32) int {
+	i := sort.Search(len(me.Samples), func(i int) bool {
+		return me.Samples[i].Timestamp > ms
+	})
+	if !me.hasVideo {
+		if i > 0 {
+			i--
+		}
+		return i
+	}
+
+	for i--; i > 0; i-- {
+		if s := me.Samples[i]; s.Type == message.VIDEO && s.Keyframe {
+			return i
+		}
+	}
+	return 0
+}
+
+// Read returns payload of the sample.
+func (me *VODIndex) Read(s *VODSample) ([]byte, error) {
+	if s.Data != nil {
+		return s.Data, nil
+	}
+
+	data := make([]byte, len(s.Prefix)+s.Size)
+	copy(data, s.Prefix)
+
+	_, err := me.file.ReadAt(data[len(s.Prefix):], s.Offset)
+	if err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// Close the file.
+func (me *VODIndex) Close() error {
+	return me.file.Close()
+}
+
+func (me *VODIndex) parseFLV() error {
+	var (
+		hdr = make([]byte, 11)
+		pos int64
+	)
+
+	_, err := me.file.ReadAt(hdr[:9], 0)
+	if err != nil {
+		return err
+	}
+	if hdr[0] != 'F' || hdr[1] != 'L' || hdr[2] != 'V' {
+		return fmt.Errorf("bad FLV signature")
+	}
+
+	pos = int64(binary.BigEndian.Uint32(hdr[5:9])) + 4
+
+	for {
+		_, err = me.file.ReadAt(hdr, pos)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		s := new(VODSample)
+		s.Type = hdr[0]
+		s.Size = int(hdr[1])<<16 | int(hdr[2])<<8 | int(hdr[3])
+		s.Timestamp = uint32(hdr[7])<<24 | uint32(hdr[4])<<16 | uint32(hdr[5])<<8 | uint32(hdr[6])
+		s.Offset = pos + 11
+		pos = s.Offset + int64(s.Size) + 4
+
+		if s.Size == 0 {
+			continue
+		}
+
+		switch s.Type {
+		case flv.KindScript:
+			s.Type = message.DATA
+			s.Data, err = me.Read(s)
+			if err != nil {
+				return err
+			}
+			me.setHeader(s)
+
+		case flv.KindAudio:
+			b := make([]byte, 2)
+			me.file.ReadAt(b, s.Offset)
+			if b[0]&0xF0 == flv.AAC && b[1] == 0 {
+				s.Data, err = me.Read(s)
+				if err != nil {
+					return err
+				}
+				me.setHeader(s)
+				continue
+			}
+			s.Keyframe = true
+			me.Samples = append(me.Samples, s)
+
+		case flv.KindVideo:
+			b := make([]byte, 2)
+			me.file.ReadAt(b, s.Offset)
+			if b[0]&0x0F == flv.AVC && b[1] == 0 {
+				s.Data, err = me.Read(s)
+				if err != nil {
+					return err
+				}
+				me.setHeader(s)
+				continue
+			}
+			s.Keyframe = b[0]>>4 == flv.KEYFRAME
+			me.hasVideo = true
+			me.Samples = append(me.Samples, s)
+		}
+	}
+
+	return nil
+}
+
+// setHeader keeps the first header of each type.
+func (me *VODIndex) setHeader(s *VODSample) {
+	for _, h := range me.Headers {
+		if h.Type == s.Type {
+			return
+		}
+	}
+	me.Headers = append(me.Headers, s)
+}
+
+type mp4Track struct {
+	*box.Track
+	codec     string
+	sttsCount []uint32
+	sttsDelta []uint32
+	cttsCount []uint32
+	cttsValue []int32
+	stss      []uint32
+	stscFirst []uint32
+	stscCount []uint32
+	size      uint32 // of every sample, or 0 if in sizes
+	count     int    // of samples
+	sizes     []uint32
+	chunks    []int64
+}
+
+func (me *VODIndex) parseMP4() error {
+	var (
+		hdr  = make([]byte, 16)
+		pos  int64
+		moov []byte
+	)
+
+	info, err := me.file.Stat()
+	if err != nil {
+		return err
+	}
+
+	for moov == nil {
+		n, err := me.file.ReadAt(hdr, pos)
+		if n < 8 {
+			if err == io.EOF {
+				return fmt.Errorf("moov not found")
+			}
+			return err
+		}
+
+		size := int64(binary.BigEndian.Uint32(hdr))
+		typ := string(hdr[4:8])
+		hlen := int64(8)
+		if size == 1 {
+			size = int64(binary.BigEndian.Uint64(hdr[8:]))
+			hlen = 16
+		} else if size == 0 {
+			return fmt.Errorf("moov not found")
+		}
+		if size < hlen || size > info.Size()-pos {
+			return fmt.Errorf("bad box size: %s, %d", typ, size)
+		}
+
+		if typ == "moov" {
+			moov = make([]byte, size-hlen)
+			_, err = me.file.ReadAt(moov, pos+hlen)
+			if err != nil {
+				return err
+			}
+		}
+		pos += size
+	}
+
+	var tracks []*mp4Track
+
+	err = box.Children(moov, func(typ string, b []byte) error {
+		if typ != "trak" {
+			return nil
+		}
+
+		info, err := box.ParseTrack(b)
+		if err != nil {
+			return err
+		}
+
+		t := &mp4Track{Track: info}
+		switch {
+		case info.Handler == box.HANDLER_VIDEO && (info.Format == "avc1" || info.Format == "avc3") && info.Config != nil:
+			t.codec = "avc1"
+		case info.Handler == box.HANDLER_SOUND && info.Format == "mp4a" && info.Config != nil:
+			t.codec = "mp4a"
+		default:
+			return nil
+		}
+
+		err = t.parse(b)
+		if err != nil {
+			return err
+		}
+		tracks = append(tracks, t)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if len(tracks) == 0 {
+		return fmt.Errorf("no supported track")
+	}
+
+	meta := amf.NewValue(amf.ECMA_ARRAY)
+
+	for _, t := range tracks {
+		switch t.codec {
+		case "avc1":
+			me.hasVideo = true
+			meta.Add(amf.NewValue(amf.DOUBLE).Set("width", float64(t.Width)))
+			meta.Add(amf.NewValue(amf.DOUBLE).Set("height", float64(t.Height)))
+			meta.Add(amf.NewValue(amf.DOUBLE).Set("videocodecid", float64(flv.AVC)))
+			me.Headers = append(me.Headers, &VODSample{
+				Type:     message.VIDEO,
+				Keyframe: true,
+				Data:     append([]byte{0x17, 0x00, 0x00, 0x00, 0x00}, t.Config...),
+			})
+		case "mp4a":
+			meta.Add(amf.NewValue(amf.DOUBLE).Set("audiocodecid", float64(flv.AAC>>4)))
+			me.Headers = append(me.Headers, &VODSample{
+				Type:     message.AUDIO,
+				Keyframe: true,
+				Data:     append([]byte{0xAF, 0x00}, t.Config...),
+			})
+		}
+
+		err = me.addMP4Samples(t)
+		if err != nil {
+			return err
+		}
+	}
+
+	var b bytes.Buffer
+	amf.EncodeString(&b, "onMetaData")
+	meta.Add(amf.NewValue(amf.DOUBLE).Set("duration", float64(me.Duration)/1000))
+	amf.Encode(&b, meta)
+
+	me.Headers = append([]*VODSample{{Type: message.DATA, Data: b.Bytes()}}, me.Headers...)
+	return nil
+}
+
+func (me *VODIndex) addMP4Samples(t *mp4Track) error {
+	var (
+		sample int
+		dts    uint64
+		stts   int
+		sttsN  uint32
+		ctts   int
+		cttsN  uint32
+		stss   int
+	)
+
+	if t.Timescale == 0 {
+		return fmt.Errorf("bad timescale")
+	}
+
+	info, err := me.file.Stat()
+	if err != nil {
+		return err
+	}
+
+	for c, offset := range t.chunks {
+		// Samples per chunk of the last entry whose first chunk is no more than this one.
+		var n uint32
+		for i, first := range t.stscFirst {
+			if first > uint32(c+1) {
+				break
+			}
+			n = t.stscCount[i]
+		}
+
+		for ; n > 0 && sample < t.count; n-- {
+			s := new(VODSample)
+			s.Offset = offset
+			s.Size = int(t.size)
+			if t.size == 0 {
+				s.Size = int(t.sizes[sample])
+			}
+			s.Timestamp = uint32(dts * 1000 / uint64(t.Timescale))
+			offset += int64(s.Size)
+
+			// The counts are not trusted, but every sample must be in the file.
+			if offset > info.Size() {
+				return fmt.Errorf("bad sample offset: %d", s.Offset)
+			}
+
+			var cts int32
+			if ctts < len(t.cttsCount) {
+				cts = t.cttsValue[ctts]
+				if cttsN++; cttsN == t.cttsCount[ctts] {
+					ctts++
+					cttsN = 0
+				}
+			}
+
+			switch t.codec {
+			case "avc1":
+				s.Type = message.VIDEO
+				if t.stss == nil {
+					s.Keyframe = true
+				} else if stss < len(t.stss) && t.stss[stss] == uint32(sample+1) {
+					s.Keyframe = true
+					stss++
+				}
+
+				ms := int32(int64(cts) * 1000 / int64(t.Timescale))
+				s.Prefix = []byte{0x27, 0x01, byte(ms >> 16), byte(ms >> 8), byte(ms)}
+				if s.Keyframe {
+					s.Prefix[0] = 0x17
+				}
+			case "mp4a":
+				s.Type = message.AUDIO
+				s.Keyframe = true
+				s.Prefix = []byte{0xAF, 0x01}
+			}
+
+			me.Samples = append(me.Samples, s)
+
+			if stts < len(t.sttsCount) {
+				dts += uint64(t.sttsDelta[stts])
+				if sttsN++; sttsN == t.sttsCount[stts] {
+					stts++
+					sttsN = 0
+				}
+			}
+			sample++
+		}
+	}
+
+	if d := uint32(dts * 1000 / uint64(t.Timescale)); d > me.Duration {
+		me.Duration = d
+	}
+	return nil
+}
+
+// parse reads the sample tables, the rest of trak is left to box.ParseTrack.
+func (me *mp4Track) parse(b []byte) error {
+	return box.Children(b, func(typ string, b []byte) error {
+		switch typ {
+		case "mdia", "minf", "stbl":
+			return me.parse(b)
+
+		case "stts":
+			return fullBoxEntries(b, 8, func(e []byte) {
+				me.sttsCount = append(me.sttsCount, binary.BigEndian.Uint32(e))
+				me.sttsDelta = append(me.sttsDelta, binary.BigEndian.Uint32(e[4:]))
+			})
+
+		case "ctts":
+			return fullBoxEntries(b, 8, func(e []byte) {
+				me.cttsCount = append(me.cttsCount, binary.BigEndian.Uint32(e))
+				me.cttsValue = append(me.cttsValue, int32(binary.BigEndian.Uint32(e[4:])))
+			})
+
+		case "stss":
+			me.stss = []uint32{}
+			return fullBoxEntries(b, 4, func(e []byte) {
+				me.stss = append(me.stss, binary.BigEndian.Uint32(e))
+			})
+
+		case "stsc":
+			return fullBoxEntries(b, 12, func(e []byte) {
+				me.stscFirst = append(me.stscFirst, binary.BigEndian.Uint32(e))
+				me.stscCount = append(me.stscCount, binary.BigEndian.Uint32(e[4:]))
+			})
+
+		case "stsz":
+			if len(b) < 12 {
+				return fmt.Errorf("bad stsz")
+			}
+			me.size = binary.BigEndian.Uint32(b[4:])
+			if me.size != 0 {
+				// Not expanded, as the count could be anything.
+				me.count = int(binary.BigEndian.Uint32(b[8:]))
+				return nil
+			}
+			// sample_size takes the place of version and flags.
+			return fullBoxEntries(b[4:], 4, func(e []byte) {
+				me.sizes = append(me.sizes, binary.BigEndian.Uint32(e))
+				me.count++
+			})
+
+		case "stco":
+			return fullBoxEntries(b, 4, func(e []byte) {
+				me.chunks = append(me.chunks, int64(binary.BigEndian.Uint32(e)))
+			})
+
+		case "co64":
+			return fullBoxEntries(b, 8, func(e []byte) {
+				me.chunks = append(me.chunks, int64(binary.BigEndian.Uint64(e)))
+			})
+		}
+		return nil
+	})
+}
+
+// fullBoxEntries iterates the entries after version, flags and entry count.
+func fullBoxEntries(b []byte, size int, fn func(e []byte)) error {
+	if len(b) < 8 {
+		return fmt.Errorf("bad full box")
+	}
+
+	n := int(binary.BigEndian.Uint32(b[4:]))
+	if n < 0 || n > (len(b)-8)/size {
+		return fmt.Errorf("bad entry count: %d", n)
+	}
+
+	for i := 0; i < n; i++ {
+		fn(b[8+i*size:])
+	}
+	return nil
+}
@@ -0,0 +1,501 @@
+package rtmp
+
+import (
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	Code "github.com/studease/common/events/netstatusevent/code"
+	Level "github.com/studease/common/events/netstatusevent/level"
+	"github.com/studease/common/log"
+	"github.com/studease/common/rtmp/message"
+	CSID "github.com/studease/common/rtmp/message/csid"
+	EventType "github.com/studease/common/rtmp/message/eventtype"
+)
+
+// VODPlayer commands.
+const (
+	vodSeek = iota
+	vodPause
+	vodQueue
+	vodSwitch
+)
+
+type vodCommand struct {
+	kind  int
+	flag  bool
+	ms    uint32
+	item  *PlaylistItem
+	reset bool
+}
+
+// VODPlayer plays a queue of recorded files and live streams to the NetStream as one continuous stream.
+// Recorded files are paced in real time, ahead of bufferLength.
+type VODPlayer struct {
+	ns       *NetStream
+	handler  *VODHandler
+	logger   log.ILogger
+	playlist *Playlist
+	queue    []*PlaylistItem
+	item     *PlaylistItem
+	index    *VODIndex
+	live     *liveSource
+	pos      int
+	end      uint32
+	hasEnd   bool
+	shift    int64 // Output timestamp = sample timestamp + shift
+	shifted  bool
+	base     uint32 // Sample timestamp where the clock began
+	clock    time.Time
+	last     uint32 // Last output timestamp
+	sent     bool
+	paused   bool
+	ended    bool
+	started  uint32
+	commands chan *vodCommand
+	done     chan struct{}
+	once     sync.Once
+}
+
+// Init this class.
+func (me *VODPlayer) Init(ns *NetStream, handler *VODHandler, logger log.ILogger) *VODPlayer {
+	me.ns = ns
+	me.handler = handler
+	me.logger = logger
+	me.commands = make(chan *vodCommand, 8)
+	me.done = make(chan struct{})
+	return me
+}
+
+// Load opens the first item, of the playlist if not nil, or else of the items.
+func (me *VODPlayer) Load(pl *Playlist, items ...*PlaylistItem) error {
+	me.playlist = pl
+	me.queue = items
+	if pl != nil {
+		me.queue = me.refill()
+	}
+	return me.load()
+}
+
+// Run plays the items, blocks until stopped.
+func (me *VODPlayer) Run() {
+	var (
+		err  error
+		wait time.Duration
+	)
+
+	atomic.StoreUint32(&me.started, 1)
+	defer me.closeItem()
+
+	if me.item != nil {
+		err = me.begin()
+	}
+
+	for err == nil {
+		wait = time.Hour
+
+		if me.item != nil && !me.paused {
+			if me.index != nil && !me.ended {
+				wait, err = me.pump()
+				if err != nil {
+					break
+				}
+			}
+			if me.ended {
+				err = me.advance(false)
+				continue
+			}
+		}
+
+		var (
+			samples <-chan *VODSample
+			closed  <-chan struct{}
+		)
+		if me.live != nil && !me.ended {
+			samples = me.live.samples
+			closed = me.live.closed
+		}
+
+		t := time.NewTimer(wait)
+
+		select {
+		case <-me.done:
+			t.Stop()
+			return
+		case c := <-me.commands:
+			err = me.handle(c)
+		case s := <-samples:
+			if !me.paused {
+				err = me.onLiveSample(s)
+			}
+		case <-closed:
+			me.ended = true
+		case <-t.C:
+		}
+
+		t.Stop()
+	}
+
+	me.logger.Errorf("Failed to play: stream=%d, %v", me.ns.id, err)
+	me.ns.nc.Close()
+}
+
+// Queue an item, which will be played after the current one.
+func (me *VODPlayer) Queue(item *PlaylistItem) {
+	me.post(&vodCommand{kind: vodQueue, item: item})
+}
+
+// Switch to the item immediately, or stop playing if item is nil.
+func (me *VODPlayer) Switch(item *PlaylistItem, reset bool) {
+	me.post(&vodCommand{kind: vodSwitch, item: item, reset: reset})
+}
+
+// Seek to the nearest keyframe of the time, in ms.
+func (me *VODPlayer) Seek(ms uint32) {
+	me.post(&vodCommand{kind: vodSeek, ms: ms})
+}
+
+// Pause or unpause at the time, in ms.
+func (me *VODPlayer) Pause(flag bool, ms uint32) {
+	me.post(&vodCommand{kind: vodPause, flag: flag, ms: ms})
+}
+
+// Stop playing.
+func (me *VODPlayer) Stop() {
+	me.once.Do(func() {
+		close(me.done)
+	})
+
+	if atomic.LoadUint32(&me.started) == 0 {
+		me.closeItem()
+	}
+}
+
+func (me *VODPlayer) post(c *vodCommand) {
+	select {
+	case me.commands <- c:
+	case <-me.done:
+	default:
+		me.logger.Warnf("VODPlayer busy, command dropped: stream=%d", me.ns.id)
+	}
+}
+
+func (me *VODPlayer) handle(c *vodCommand) error {
+	var (
+		err error
+	)
+
+	nc := me.ns.nc
+
+	switch c.kind {
+	case vodQueue:
+		me.queue = append(me.queue, c.item)
+		if me.item == nil {
+			return me.advance(false)
+		}
+
+	case vodSwitch:
+		if c.item == nil {
+			me.queue = nil
+			me.closeItem()
+			return me.complete()
+		}
+
+		if c.reset {
+			me.queue = nil
+		}
+		me.queue = append([]*PlaylistItem{c.item}, me.queue...)
+		return me.advance(c.reset)
+
+	case vodSeek:
+		t := int64(c.ms) - me.shift
+		if me.index == nil || me.item == nil {
+			return me.ns.SendStatus(Level.ERROR, Code.NETSTREAM_SEEK_FAILED, "not allowed")
+		}
+		if t < 0 || t > int64(me.index.Duration) {
+			return me.ns.SendStatus(Level.ERROR, Code.NETSTREAM_SEEK_INVALIDTIME, "seek invalid time")
+		}
+
+		err = me.ns.SendStatus(Level.STATUS, Code.NETSTREAM_SEEK_NOTIFY, "seek notify")
+		if err == nil {
+			err = me.seek(uint32(t))
+		}
+
+	case vodPause:
+		if c.flag == me.paused {
+			return nil
+		}
+
+		me.paused = c.flag
+		if c.flag {
+			err = nc.SendUserControl(EventType.STREAM_EOF, me.ns.id, 0, 0)
+			if err == nil {
+				err = me.ns.SendStatus(Level.STATUS, Code.NETSTREAM_PAUSE_NOTIFY, "pause notify")
+			}
+			break
+		}
+
+		err = nc.SendUserControl(EventType.STREAM_BEGIN, me.ns.id, 0, 0)
+		if err == nil {
+			err = me.ns.SendStatus(Level.STATUS, Code.NETSTREAM_UNPAUSE_NOTIFY, "unpause notify")
+		}
+		if err == nil && me.index != nil {
+			t := int64(c.ms) - me.shift
+			if t < 0 {
+				t = 0
+			}
+			err = me.seek(uint32(t))
+		}
+	}
+
+	return err
+}
+
+// refill returns the items of the playlist.
+func (me *VODPlayer) refill() []*PlaylistItem {
+	items := me.playlist.Items()
+	queue := make([]*PlaylistItem, len(items))
+	for i := range items {
+		queue[i] = &items[i]
+	}
+	return queue
+}
+
+// load opens the next item of the queue, which is refilled from the playlist if looping.
+func (me *VODPlayer) load() error {
+	var (
+		err      error
+		refilled bool
+	)
+
+	me.closeItem()
+
+	for {
+		if len(me.queue) == 0 {
+			if me.playlist == nil || !me.playlist.Loop() || refilled {
+				if err == nil {
+					err = io.EOF
+				}
+				return err
+			}
+
+			me.queue = me.refill()
+			refilled = true
+			continue
+		}
+
+		item := me.queue[0]
+		me.queue = me.queue[1:]
+
+		index, live, e := me.handler.open(me.ns.nc, item)
+		if e != nil {
+			me.logger.Warnf("Failed to open %s: %v", item.Name, e)
+			err = e
+			continue
+		}
+
+		me.item = item
+		me.index = index
+		me.live = live
+		return nil
+	}
+}
+
+func (me *VODPlayer) closeItem() {
+	if me.index != nil {
+		me.index.Close()
+		me.index = nil
+	}
+	if me.live != nil {
+		me.live.close()
+		me.live = nil
+	}
+	me.item = nil
+}
+
+// begin playing the loaded item in its window.
+func (me *VODPlayer) begin() error {
+	var (
+		start uint32
+	)
+
+	if me.item.Start > 0 {
+		start = uint32(me.item.Start * 1000)
+	}
+
+	me.hasEnd = me.item.Duration >= 0
+	me.end = 0
+	if me.hasEnd {
+		me.end = uint32(me.item.Duration * 1000)
+	}
+	me.shifted = false
+	me.paused = false
+	me.ended = false
+
+	if me.index != nil {
+		me.end += start
+		return me.seek(start)
+	}
+	return nil
+}
+
+// advance to the next item, with the transition statuses.
+func (me *VODPlayer) advance(reset bool) error {
+	var (
+		name string
+	)
+
+	if me.item != nil {
+		name = me.item.Name
+	}
+
+	err := me.load()
+	if err != nil {
+		if err != io.EOF {
+			me.logger.Warnf("No more item to play: stream=%d, %v", me.ns.id, err)
+		}
+		return me.complete()
+	}
+
+	if name != "" {
+		err = me.ns.SendStatus(Level.STATUS, Code.NETSTREAM_PLAY_STOP, "play stop: "+name)
+		if err != nil {
+			return err
+		}
+	}
+
+	if reset {
+		err = me.ns.SendStatus(Level.STATUS, Code.NETSTREAM_PLAY_RESET, "play reset")
+		if err != nil {
+			return err
+		}
+	}
+
+	err = me.ns.SendStatus(Level.STATUS, Code.NETSTREAM_PLAY_START, "play start: "+me.item.Name)
+	if err != nil {
+		return err
+	}
+
+	return me.begin()
+}
+
+// rebase keeps the output timestamps continuous from the last item.
+func (me *VODPlayer) rebase(base uint32) {
+	me.shift = 0
+	if me.sent {
+		me.shift = int64(me.last) + 1 - int64(base)
+	}
+	me.shifted = true
+}
+
+// seek resets the clock, and sends metadata and sequence headers before the keyframe.
+func (me *VODPlayer) seek(ms uint32) error {
+	me.pos = me.index.Seek(ms)
+	me.base = ms
+	if me.pos < len(me.index.Samples) {
+		me.base = me.index.Samples[me.pos].Timestamp
+	}
+	if !me.shifted {
+		me.rebase(me.base)
+	}
+	me.clock = time.Now()
+	me.ended = false
+
+	for _, s := range me.index.Headers {
+		err := me.send(s, uint32(int64(me.base)+me.shift))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// pump sends the samples which are due within bufferLength, returns the time to wait for the next one.
+func (me *VODPlayer) pump() (time.Duration, error) {
+	buffer := time.Duration(atomic.LoadUint32(&me.ns.bufferLength)) * time.Millisecond
+
+	for ; me.pos < len(me.index.Samples); me.pos++ {
+		s := me.index.Samples[me.pos]
+		if me.hasEnd && s.Timestamp > me.end {
+			break
+		}
+
+		due := me.clock.Add(time.Duration(s.Timestamp-me.base)*time.Millisecond - buffer)
+		if d := time.Until(due); d > 0 {
+			return d, nil
+		}
+
+		err := me.send(s, uint32(int64(s.Timestamp)+me.shift))
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	me.ended = true
+	return time.Hour, nil
+}
+
+func (me *VODPlayer) onLiveSample(s *VODSample) error {
+	if isHeader(s) {
+		return me.send(s, me.last)
+	}
+
+	if !me.shifted {
+		me.base = s.Timestamp
+		me.end += s.Timestamp
+		me.rebase(s.Timestamp)
+	}
+	if me.hasEnd && s.Timestamp > me.end {
+		me.ended = true
+		return nil
+	}
+
+	return me.send(s, uint32(int64(s.Timestamp)+me.shift))
+}
+
+func (me *VODPlayer) send(s *VODSample, timestamp uint32) error {
+	var (
+		csid uint32
+		err  error
+	)
+
+	// Samples of live streams are always preloaded.
+	data := s.Data
+	if data == nil {
+		data, err = me.index.Read(s)
+		if err != nil {
+			return err
+		}
+	}
+
+	switch s.Type {
+	case message.AUDIO:
+		csid = CSID.AUDIO
+	case message.VIDEO:
+		csid = CSID.VIDEO
+	default:
+		csid = CSID.STREAM
+	}
+
+	_, err = me.ns.nc.sendBytes(csid, s.Type, timestamp, me.ns.id, data)
+	if err != nil {
+		return err
+	}
+
+	if s.Type != message.DATA && (!me.sent || timestamp > me.last) {
+		me.last = timestamp
+	}
+	me.sent = true
+	return nil
+}
+
+func (me *VODPlayer) complete() error {
+	me.closeItem()
+
+	err := me.ns.nc.SendUserControl(EventType.STREAM_EOF, me.ns.id, 0, 0)
+	if err == nil {
+		err = me.ns.SendStatus(Level.STATUS, Code.NETSTREAM_PLAY_STOP, "play stop")
+	}
+	return err
+}
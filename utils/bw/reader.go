@@ -25,7 +25,7 @@ func (me *Reader) Init(mgr *Manager, logger log.ILogger) *Reader {
 	me.avg = &mgr.avgIn
 
 	if avg := atomic.LoadInt32(me.avg); avg > 0 {
-		atomic.StoreInt64(&me.next, time.Now().Unix()+int64(time.Second))
+		atomic.StoreInt64(&me.next, time.Now().UnixNano()+int64(time.Second))
 	}
 
 	return me
@@ -44,13 +44,13 @@ func (me *Reader) Read(p []byte) (n int, err error) {
 			atomic.AddInt32(&me.cnt, int32(n))
 		}()
 
-		for cnt := atomic.LoadInt32(&me.cnt); cnt >= avg; cnt -= avg {
-			dur := atomic.LoadInt64(&me.next) - time.Now().Unix()
+		for cnt := atomic.LoadInt32(&me.cnt); cnt >= avg; cnt = atomic.LoadInt32(&me.cnt) {
+			dur := atomic.LoadInt64(&me.next) - time.Now().UnixNano()
 			if dur > 0 {
 				time.Sleep(time.Duration(dur))
-				atomic.StoreInt32(&me.cnt, cnt-avg)
-				atomic.StoreInt64(&me.next, time.Now().Unix()+int64(time.Second))
 			}
+			atomic.AddInt32(&me.cnt, -avg)
+			atomic.StoreInt64(&me.next, time.Now().UnixNano()+int64(time.Second))
 		}
 	}
 
@@ -67,3 +67,27 @@ type DVR struct {
 	OnRecord     URL    `xml:""`
 	OnRecordDone URL    `xml:""`
 }
+
+// HLS config. Segments are kept in memory if Directory is empty.
+type HLS struct {
+	ID          string `xml:"id,attr"`
+	Name        string `xml:""` // TS or FMP4
+	Mode        string `xml:""`
+	Directory   string `xml:""`
+	FileName    string `xml:""`
+	Segments    int    `xml:""` // in the playlist
+	MaxDuration uint32 `xml:""` // target duration, in seconds
+	Chunks      int    `xml:""` // parts per segment for LL-HLS, 0 to disable
+	Group       string `xml:""` // of the renditions reporting to each other
+}
+
+// DASH config. Segments are kept in memory if Directory is empty.
+type DASH struct {
+	ID          string `xml:"id,attr"`
+	Mode        string `xml:""`
+	Directory   string `xml:""`
+	FileName    string `xml:""`
+	Segments    int    `xml:""` // in the time shift buffer
+	MaxDuration uint32 `xml:""` // target duration, in seconds
+	LowLatency  bool   `xml:""` // chunked transfer of the uncompleted segments
+}
@@ -0,0 +1,48 @@
+package fetch
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+)
+
+// IFetcher gets resources by URI, which could be replaced to add headers, cookies or a cache.
+type IFetcher interface {
+	// Fetch returns the resource, or the byte range of it if rng is not empty, e.g. "0-1023".
+	Fetch(ctx context.Context, uri string, rng string) ([]byte, error)
+}
+
+// HTTPFetcher gets the resources with the Client, or http.DefaultClient if nil.
+type HTTPFetcher struct {
+	Client *http.Client
+}
+
+// Fetch implements IFetcher.
+func (me *HTTPFetcher) Fetch(ctx context.Context, uri string, rng string) ([]byte, error) {
+	client := me.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, uri, nil)
+	if err != nil {
+		return nil, err
+	}
+	if rng != "" {
+		req.Header.Set("Range", "bytes="+rng)
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode/100 != 2 {
+		return nil, fmt.Errorf("GET %s: %s", uri, res.Status)
+	}
+	if rng != "" && res.StatusCode != http.StatusPartialContent {
+		return nil, fmt.Errorf("GET %s: range %s not satisfied", uri, rng)
+	}
+	return ioutil.ReadAll(res.Body)
+}